@@ -45,7 +45,7 @@ func (s *Server) DumpStates(req *zsys.Empty, stream zsys.Zsys_DumpStatesServer)
 
 	log.Info(stream.Context(), i18n.G("Requesting service states dump"))
 
-	b, err := json.MarshalIndent(s.Machines, "", "   ")
+	b, err := json.MarshalIndent(&s.Machines, "", "   ")
 	if err != nil {
 		return fmt.Errorf(i18n.G("couldn't convert internal state to json: %v"), err)
 	}
@@ -114,7 +114,7 @@ func (s *Server) RemoveSystemState(req *zsys.RemoveSystemStateRequest, stream zs
 
 	log.Infof(stream.Context(), i18n.G("Requesting to remove system state %q"), stateName)
 
-	err = s.Machines.RemoveState(stream.Context(), stateName, "", req.GetForce(), req.GetDryrun())
+	_, err = s.Machines.RemoveState(stream.Context(), stateName, "", req.GetForce(), req.GetDryrun())
 	if err != nil {
 		var e *machines.ErrStateRemovalNeedsConfirmation
 		if errors.As(err, &e) {
@@ -161,7 +161,7 @@ func (s *Server) RemoveUserState(req *zsys.RemoveUserStateRequest, stream zsys.Z
 
 	log.Infof(stream.Context(), i18n.G("Requesting to remove user state %q for user %s"), stateName, userName)
 
-	err := s.Machines.RemoveState(stream.Context(), stateName, userName, req.GetForce(), req.GetDryrun())
+	_, err := s.Machines.RemoveState(stream.Context(), stateName, userName, req.GetForce(), req.GetDryrun())
 	if err != nil {
 		var e *machines.ErrStateRemovalNeedsConfirmation
 		if errors.As(err, &e) {
@@ -0,0 +1,86 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// CreateBookmark bookmarks all system and user datasets of the snapshot state id as name.
+// Bookmarks are attached to the filesystem states owning the bookmarked datasets and survive the snapshot removal, so
+// that they can be used as a base for incremental sends.
+func (ms *Machines) CreateBookmark(ctx context.Context, id, name string) error {
+	if err := ms.checkWritable(i18n.G("create bookmark")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if !s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s isn't a snapshot: only snapshots can be bookmarked"), s.ID)
+	}
+	if err := validateStateName(name); err != nil {
+		return err
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Bookmarking %s as %s"), s.ID, name)
+	for _, d := range append(s.getDatasets(), s.getUsersDatasets()...) {
+		if err := t.Bookmark(d.Name, name); err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	return ms.refresh(ctx)
+}
+
+// attachBookmarks attaches bookmarks to all filesystem system and user states owning their dataset.
+// Bookmarks use their own separator and are never considered as snapshots.
+func (ms *Machines) attachBookmarks(bookmarks []*zfs.Dataset) {
+	if len(bookmarks) == 0 {
+		return
+	}
+
+	var states []*State
+	for _, m := range ms.all {
+		states = append(states, &m.State)
+		for _, h := range m.History {
+			states = append(states, h)
+		}
+		for _, userStates := range m.AllUsersStates {
+			for _, us := range userStates {
+				states = append(states, us)
+			}
+		}
+	}
+
+	attached := make(map[*State]bool)
+	for _, s := range states {
+		if s.isSnapshot() || attached[s] {
+			continue
+		}
+		attached[s] = true
+
+		names := make(map[string]bool)
+		for _, d := range s.getDatasets() {
+			names[d.Name] = true
+		}
+		// bookmarks are already sorted by name
+		for _, b := range bookmarks {
+			base := strings.Split(b.Name, libzfs.BookmarkSeparator)[0]
+			if names[base] {
+				s.Bookmarks = append(s.Bookmarks, b)
+			}
+		}
+	}
+}
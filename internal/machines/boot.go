@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/ubuntu/zsys/internal/config"
 	"github.com/ubuntu/zsys/internal/i18n"
@@ -26,6 +25,10 @@ import (
 // Return if any dataset / machine changed has been done during boot and an error if any encountered.
 // TODO: propagate error to user graphically
 func (ms *Machines) EnsureBoot(ctx context.Context) (bool, error) {
+	if err := ms.checkWritable(i18n.G("prepare boot")); err != nil {
+		return false, err
+	}
+
 	if !ms.current.isZsys() {
 		log.Info(ctx, i18n.G("Current machine isn't Zsys, nothing to do on boot"))
 		return false, nil
@@ -104,6 +107,10 @@ func (ms *Machines) EnsureBoot(ctx context.Context) (bool, error) {
 // After this operation, every New() call will get the current and correct system state.
 // Return if any dataset / machine changed has been done during boot commit and an error if any encountered.
 func (ms *Machines) Commit(ctx context.Context) (bool, error) {
+	if err := ms.checkWritable(i18n.G("commit boot")); err != nil {
+		return false, err
+	}
+
 	if !ms.current.isZsys() {
 		log.Info(ctx, i18n.G("Current machine isn't Zsys, nothing to commit on boot"))
 		return false, nil
@@ -139,7 +146,7 @@ func (ms *Machines) Commit(ctx context.Context) (bool, error) {
 		systemDatasets = append(systemDatasets, ds...)
 	}
 	// System and users datasets: set lastUsed
-	currentTime := strconv.Itoa(int(time.Now().Unix()))
+	currentTime := strconv.Itoa(int(ms.time.Now().Unix()))
 	// Last used is not a relevant change for signalling a change and justify bootloader rebuild: last-used is not
 	// displayed for current system dataset.
 	log.Infof(ctx, i18n.G("set current time to %q"), currentTime)
@@ -183,12 +190,18 @@ func (ms *Machines) Commit(ctx context.Context) (bool, error) {
 	if err := ms.Refresh(ctx); err != nil {
 		return false, err
 	}
+	// We successfully booted: any state prepared for this boot is now the current one.
+	ms.setNextState(nil)
 
 	return changed, nil
 }
 
 // UpdateLastUsed updates all active (system and user) datasets with current time
 func (ms *Machines) UpdateLastUsed(ctx context.Context) error {
+	if err := ms.checkWritable(i18n.G("update last used time")); err != nil {
+		return err
+	}
+
 	if !ms.current.isZsys() {
 		log.Info(ctx, i18n.G("Current machine isn't Zsys, nothing to update"))
 		return nil
@@ -198,7 +211,7 @@ func (ms *Machines) UpdateLastUsed(ctx context.Context) error {
 	defer t.Done()
 
 	// System and users datasets: set lastUsed
-	currentTime := strconv.Itoa(int(time.Now().Unix()))
+	currentTime := strconv.Itoa(int(ms.time.Now().Unix()))
 	log.Infof(ctx, i18n.G("Updating last used to %v"), currentTime)
 
 	var activeDatasets []*zfs.Dataset
@@ -214,12 +227,11 @@ func (ms *Machines) UpdateLastUsed(ctx context.Context) error {
 		}
 	}
 
-	// Reset last used on state: note we could use currentTime but for tests, we need magic time. We should rather
-	// mock time.Now()
-	cur := int64(activeDatasets[0].LastUsed)
-	ms.current.LastUsed = time.Unix(cur, 0)
+	// Reset last used on state from what was stored on the datasets.
+	cur := lastUsedTime(activeDatasets[0].LastUsed)
+	ms.current.LastUsed = cur
 	for _, us := range ms.current.Users {
-		us.LastUsed = time.Unix(cur, 0)
+		us.LastUsed = cur
 	}
 
 	return nil
@@ -269,23 +281,32 @@ func (snapshot State) createClones(t *zfs.Transaction, bootedStateID string, nee
 	// Only root datasets are cloned
 	userDataSuffix := t.Zfs.GenerateID(6)
 	for _, us := range snapshot.Users {
-		// Recursively clones childrens, which shouldn't have bootfs elements.
-		if err := t.Clone(us.ID, userDataSuffix, false, true); err != nil {
+		if err := us.cloneUserState(t, userDataSuffix, bootedStateID); err != nil {
 			return fmt.Errorf(i18n.G("couldn't create new user datasets from %q: %v"), snapshot.ID, err)
 		}
-		// Associate this parent new user dataset to its parent system dataset
-		base, _ := splitSnapshotName(us.ID)
-		// Reformat the name with the new uuid and clone now the dataset.
-		suffixIndex := strings.LastIndex(base, "_")
-		userdatasetName := base[:suffixIndex] + "_" + userDataSuffix
-		if err := t.SetProperty(libzfs.BootfsDatasetsProp, bootedStateID, userdatasetName, false); err != nil {
-			return fmt.Errorf(i18n.G("couldn't add %q to BootfsDatasets property of %q: ")+config.ErrorFormat, bootedStateID, us.ID, err)
-		}
 	}
 
 	return nil
 }
 
+// cloneUserState clones a user snapshot state with the given suffix and associates the new user datasets to
+// bootedStateID.
+func (us State) cloneUserState(t *zfs.Transaction, userDataSuffix, bootedStateID string) error {
+	// Recursively clones childrens, which shouldn't have bootfs elements.
+	if err := t.Clone(us.ID, userDataSuffix, false, true); err != nil {
+		return err
+	}
+	// Associate this parent new user dataset to its parent system dataset
+	base, _ := splitSnapshotName(us.ID)
+	// Reformat the name with the new uuid and clone now the dataset.
+	suffixIndex := strings.LastIndex(base, "_")
+	userdatasetName := base[:suffixIndex] + "_" + userDataSuffix
+	if err := t.SetProperty(libzfs.BootfsDatasetsProp, bootedStateID, userdatasetName, false); err != nil {
+		return fmt.Errorf(i18n.G("couldn't add %q to BootfsDatasets property of %q: ")+config.ErrorFormat, bootedStateID, us.ID, err)
+	}
+	return nil
+}
+
 func switchDatasetsCanMount(t *zfs.Transaction, ds []*zfs.Dataset, canMount string) (hasChanges bool, err error) {
 	// Only handle on and noauto datasets, not off
 	initialCanMount := "on"
@@ -0,0 +1,86 @@
+package machines
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+)
+
+// BootEntry is a state of the current machine which can be listed in the bootloader menu.
+type BootEntry struct {
+	// Label is the human friendly name of the entry, from State.BootLabel.
+	Label string
+	// Root is the root system dataset of the state.
+	Root string
+	// Cmdline is the kernel command line fragment booting on Root.
+	Cmdline string
+	// Default is set on the entry booted by default: the next state if any was prepared, the current one otherwise.
+	Default bool
+	// Bootable is false if the state can't be booted, Reason then explains why.
+	Bootable bool
+	Reason   string `json:",omitempty"`
+}
+
+// GenerateBootList returns the bootloader menu entries of the current machine: its main state first, then each
+// history state, most recently used first.
+// States which can't be booted, like ones without a mountable root dataset or with an encryption key not loaded,
+// are still listed but not marked as bootable.
+// The list is empty if there is no current zsys machine.
+func (ms *Machines) GenerateBootList() []BootEntry {
+	defer ms.rlock()()
+
+	m := ms.current
+	if !m.isZsys() {
+		return nil
+	}
+
+	defaultState := &m.State
+	if ms.nextState != nil {
+		defaultState = ms.nextState
+	}
+
+	var history []*State
+	for _, h := range m.History {
+		history = append(history, h)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].LastUsed.Equal(history[j].LastUsed) {
+			return history[i].LastUsed.After(history[j].LastUsed)
+		}
+		return history[i].ID < history[j].ID
+	})
+
+	var entries []BootEntry
+	for _, s := range append([]*State{&m.State}, history...) {
+		reason := s.notBootableReason()
+		entries = append(entries, BootEntry{
+			Label:    s.BootLabel(),
+			Root:     s.ID,
+			Cmdline:  zfsRootPrefixes[0] + s.ID,
+			Default:  s == defaultState,
+			Bootable: reason == "",
+			Reason:   reason,
+		})
+	}
+	return entries
+}
+
+// notBootableReason returns why the state can't be booted, or an empty string if it can.
+func (s State) notBootableReason() string {
+	if len(s.Datasets[s.ID]) == 0 {
+		return i18n.G("no root dataset")
+	}
+	root := s.Datasets[s.ID][0]
+	if triageMountpoint(*root) != "/" || root.CanMount == "off" {
+		return fmt.Sprintf(i18n.G("root dataset %s isn't mountable on /"), root.Name)
+	}
+	for _, route := range sortedRoutes(s.Datasets) {
+		for _, d := range s.Datasets[route] {
+			if !d.IsKeyLoaded() {
+				return fmt.Sprintf(i18n.G("encryption key of %s isn't loaded"), d.Name)
+			}
+		}
+	}
+	return ""
+}
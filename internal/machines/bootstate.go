@@ -0,0 +1,80 @@
+package machines
+
+// BootStateKind is the kind of system we are booted on, as resolved from the kernel command line.
+type BootStateKind int
+
+const (
+	// BootStateUnknown is returned when there is no usable command line to resolve the current machine from, like when
+	// not run from a booted system. UnknownBootStateReason explains why.
+	BootStateUnknown BootStateKind = iota
+	// BootedZsys is a boot on a state of a zsys machine.
+	BootedZsys
+	// BootedNonZsys is a boot on a non zfs system, or on a zfs machine not managed by zsys.
+	BootedNonZsys
+	// BootedRescue is a boot on a live or rescue system, or on a zfs root dataset matching no machine.
+	BootedRescue
+)
+
+// rescueCmdlineTags are command line parameters of live and rescue systems.
+var rescueCmdlineTags = []string{"boot=casper", "rescue", "emergency", "single",
+	"systemd.unit=rescue.target", "systemd.unit=emergency.target"}
+
+// String returns a human readable form of the boot state kind.
+func (k BootStateKind) String() string {
+	switch k {
+	case BootedZsys:
+		return "zsys"
+	case BootedNonZsys:
+		return "non-zsys"
+	case BootedRescue:
+		return "rescue"
+	}
+	return "unknown"
+}
+
+// BootState returns the kind of system we are booted on, alongside the current machine when there is one.
+// Mutating operations should only be performed when booted on a zsys machine.
+func (ms *Machines) BootState() (BootStateKind, *Machine) {
+	defer ms.rlock()()
+
+	return ms.bootState()
+}
+
+// bootState is BootState, for callers already holding the machines structure lock.
+func (ms *Machines) bootState() (BootStateKind, *Machine) {
+	if ms.current != nil {
+		if ms.current.isZsys() {
+			return BootedZsys, ms.current
+		}
+		return BootedNonZsys, ms.current
+	}
+
+	if cmdlineUnusableReason(ms.cmdline) != "" {
+		return BootStateUnknown, nil
+	}
+
+	// A zfs root dataset matching no machine isn't from an installed system
+	if root, _ := bootParametersFromCmdline(ms.cmdline); root != "" {
+		return BootedRescue, nil
+	}
+	for _, entry := range cmdlineFields(ms.cmdline) {
+		for _, tag := range rescueCmdlineTags {
+			if entry == tag {
+				return BootedRescue, nil
+			}
+		}
+	}
+
+	return BootedNonZsys, nil
+}
+
+// UnknownBootStateReason returns why the command line can't be used to detect the current machine, when BootState is
+// BootStateUnknown. It's empty otherwise.
+func (ms *Machines) UnknownBootStateReason() string {
+	defer ms.rlock()()
+
+	if k, _ := ms.bootState(); k != BootStateUnknown {
+		return ""
+	}
+	return cmdlineUnusableReason(ms.cmdline)
+}
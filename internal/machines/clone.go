@@ -0,0 +1,157 @@
+package machines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/config"
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// CloneState branches the current state into a new bootable state, named after the current one with newName as its
+// suffix (for instance rpool/ROOT/ubuntu_<newName>). The current machine is left untouched.
+// System and user datasets of the current state are snapshotted as newName, then cloned. Cloned datasets are not
+// mounted automatically and new user datasets are associated to the new state.
+// The new state is a history entry of the current machine. It returns the new state ID.
+func (ms *Machines) CloneState(ctx context.Context, newName string) (string, error) {
+	if err := ms.checkWritable(i18n.G("clone state")); err != nil {
+		return "", err
+	}
+
+	if !ms.current.isZsys() {
+		return "", errors.New(i18n.G("Current machine isn't Zsys, nothing to clone"))
+	}
+	cs, ok := ms.CurrentState()
+	if !ok {
+		return "", errors.New(i18n.G("Couldn't find current state to clone"))
+	}
+	if err := validateStateName(newName); err != nil {
+		return "", err
+	}
+
+	newID := zfs.CloneName(cs.ID, newName)
+	if _, _, err := ms.GetStateByID(newID); err == nil {
+		return "", fmt.Errorf(i18n.G("A state %s already exists"), newID)
+	}
+	if err := runPreHook(ctx, "PreClone", ms.hooks.PreClone, cs.ID); err != nil {
+		return "", err
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Cloning current state %s to %s"), cs.ID, newID)
+	if err := cs.markOperation(t, operationClone); err != nil {
+		cancel()
+		return "", err
+	}
+	for _, d := range append(cs.getDatasets(), cs.getUsersDatasets()...) {
+		if err := t.Snapshot(newName, d.Name, false); err != nil {
+			cancel()
+			return "", err
+		}
+	}
+
+	for _, route := range sortedRoutes(cs.Datasets) {
+		if err := t.Clone(route+"@"+newName, newName, false, true); err != nil {
+			cancel()
+			return "", fmt.Errorf(i18n.G("couldn't create new datasets from %q: %v"), route, err)
+		}
+	}
+
+	userDataSuffix := ms.z.GenerateID(6)
+	for _, user := range sortedStateKeys(cs.Users) {
+		us := cs.Users[user]
+		if err := t.Clone(us.ID+"@"+newName, userDataSuffix, false, true); err != nil {
+			cancel()
+			return "", fmt.Errorf(i18n.G("couldn't create new user datasets from %q: %v"), us.ID, err)
+		}
+		newUserDataset := zfs.CloneName(us.ID, userDataSuffix)
+		if err := t.SetProperty(libzfs.BootfsDatasetsProp, newID, newUserDataset, false); err != nil {
+			cancel()
+			return "", fmt.Errorf(i18n.G("couldn't add %q to BootfsDatasets property of %q: ")+config.ErrorFormat, newID, newUserDataset, err)
+		}
+	}
+	if err := cs.clearOperation(t); err != nil {
+		cancel()
+		return "", err
+	}
+
+	if err := ms.Refresh(ctx); err != nil {
+		return "", err
+	}
+	runPostHook(ctx, "PostClone", ms.hooks.PostClone, newID)
+	return newID, nil
+}
+
+// EstimateSpaceForClone returns, in bytes, a conservative estimate of the space needed to clone the state id with its
+// user states, and the space available for it. This allows checking beforehand that a revert or a clone won't run out
+// of space halfway.
+// Clones initially share all their data with the snapshots they are made from, but can grow up to the referenced
+// space of the cloned datasets as they diverge: this is the estimate. When the state spreads over multiple pools, like
+// with a separate boot pool, the values are the ones of the pool with the least space left after cloning.
+func (ms *Machines) EstimateSpaceForClone(id string) (required, available uint64, err error) {
+	defer ms.rlock()()
+
+	s, _, err := ms.getStateByID(id)
+	if err != nil {
+		return 0, 0, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+
+	requiredByPool := make(map[string]uint64)
+	for _, d := range append(s.getDatasets(), s.getUsersDatasets()...) {
+		requiredByPool[poolName(d.Name)] += d.Referenced
+	}
+	availableByPool := make(map[string]uint64)
+	for _, d := range ms.datasets {
+		if _, ok := requiredByPool[d.Name]; ok {
+			availableByPool[d.Name] = d.Available
+		}
+	}
+
+	pools := make([]string, 0, len(requiredByPool))
+	for pool := range requiredByPool {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	var leastLeft int64
+	for i, pool := range pools {
+		a, ok := availableByPool[pool]
+		if !ok {
+			return 0, 0, fmt.Errorf(i18n.G("couldn't find available space of pool %s"), pool)
+		}
+		r := requiredByPool[pool]
+		if left := int64(a) - int64(r); i == 0 || left < leastLeft {
+			leastLeft = left
+			required, available = r, a
+		}
+	}
+	return required, available, nil
+}
+
+// CloneGraph returns, for each system and user snapshot which is the origin of at least one clone, the names of its
+// direct clones, sorted. As state IDs are their root dataset names, this is also the graph of states depending on a
+// snapshot state. Clones of clones are listed under the snapshots they were made from.
+func (ms *Machines) CloneGraph() map[string][]string {
+	defer ms.rlock()()
+
+	graph := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, d := range append(append([]*zfs.Dataset(nil), ms.allSystemDatasets...), ms.allUsersDatasets...) {
+		if d.IsSnapshot || d.Origin == "" || seen[d.Name] {
+			continue
+		}
+		seen[d.Name] = true
+		graph[d.Origin] = append(graph[d.Origin], d.Name)
+	}
+	for origin := range graph {
+		sort.Strings(graph[origin])
+	}
+	return graph
+}
@@ -3,45 +3,172 @@ package machines
 import (
 	"path/filepath"
 	"strings"
+	"unicode"
+
+	"github.com/ubuntu/zsys/internal/i18n"
 )
 
 const (
 	kernelPrefix         = "BOOT_IMAGE="
-	zfsRootPrefix        = "root=ZFS="
+	initrdPrefix         = "initrd="
 	zfsRevertUserDataTag = "zsys-revert=userdata"
+
+	// autoRootDataset is the root dataset value when the initramfs selects it from the pool bootfs property.
+	autoRootDataset = "AUTO"
 )
 
-// bootParametersFromCmdline returns the rootDataset name and revertuserData state if we are in a revert case
-func bootParametersFromCmdline(cmdline string) (rootDataset string, revertuserData bool) {
-	for _, entry := range strings.Fields(cmdline) {
-		e := strings.TrimPrefix(entry, zfsRootPrefix)
-		if entry != e {
-			rootDataset = e
-			continue
+// zfsRootPrefixes are all forms of root= parameters pointing to a zfs dataset.
+var zfsRootPrefixes = []string{"root=ZFS=", "root=zfs=", "root=zfs:"}
+
+// cmdlineParser extracts boot parameters from a kernel command line, which differs between bootloaders.
+type cmdlineParser interface {
+	// rootDataset returns the root dataset name from cmdline.
+	rootDataset(cmdline string) string
+	// kernel returns the used kernel name from cmdline.
+	kernel(cmdline string) string
+}
+
+// parserForCmdline returns the cmdline parser corresponding to the bootloader which generated cmdline.
+// systemd-boot doesn't set BOOT_IMAGE, but passes the initrd path from the EFI partition instead.
+func parserForCmdline(cmdline string) cmdlineParser {
+	var hasKernel, hasInitrd bool
+	for _, entry := range cmdlineFields(cmdline) {
+		if strings.HasPrefix(entry, kernelPrefix) {
+			hasKernel = true
 		}
-		if entry == zfsRevertUserDataTag {
-			revertuserData = true
+		if strings.HasPrefix(entry, initrdPrefix) {
+			hasInitrd = true
 		}
 	}
+	if !hasKernel && hasInitrd {
+		return systemdBootCmdline{}
+	}
+	return grubCmdline{}
+}
 
-	return rootDataset, revertuserData
+// cmdlineFields splits cmdline into parameters, the same way the kernel does: any whitespace separates parameters,
+// unless it is between double quotes. Double quotes are removed.
+func cmdlineFields(cmdline string) (fields []string) {
+	var current strings.Builder
+	var inQuotes, inField bool
+	for _, c := range cmdline {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case unicode.IsSpace(c) && !inQuotes:
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	return fields
 }
 
-// kernelFromCmdline returns the used kernel name in cmdline
-func kernelFromCmdline(cmdline string) (kernel string) {
-	for _, entry := range strings.Fields(cmdline) {
+// cmdlineUnusableReason returns why the current machine can't be detected from cmdline, like when zsys isn't run from
+// a booted system, or an empty string if cmdline can be parsed.
+func cmdlineUnusableReason(cmdline string) string {
+	if strings.TrimSpace(cmdline) == "" {
+		return i18n.G("no kernel command line")
+	}
+	if strings.Count(cmdline, `"`)%2 != 0 {
+		return i18n.G("unterminated quote in kernel command line")
+	}
+	return ""
+}
+
+// rootDatasetFromCmdline returns the zfs root dataset from cmdline. The last root= parameter wins, as for the kernel.
+// It returns autoRootDataset if the initramfs is requested to select it.
+func rootDatasetFromCmdline(cmdline string) (rootDataset string) {
+	for _, entry := range cmdlineFields(cmdline) {
+		if strings.HasPrefix(entry, "root=") {
+			rootDataset = ""
+		}
+		for _, prefix := range zfsRootPrefixes {
+			e := strings.TrimPrefix(entry, prefix)
+			if entry == e {
+				continue
+			}
+			rootDataset = strings.TrimSpace(e)
+			if strings.EqualFold(rootDataset, autoRootDataset) {
+				rootDataset = autoRootDataset
+			}
+			break
+		}
+	}
+	return rootDataset
+}
+
+// grubCmdline parses cmdline generated by GRUB, which is the default.
+type grubCmdline struct{}
+
+func (grubCmdline) rootDataset(cmdline string) string {
+	return rootDatasetFromCmdline(cmdline)
+}
+
+func (grubCmdline) kernel(cmdline string) (kernel string) {
+	for _, entry := range cmdlineFields(cmdline) {
 		e := strings.TrimPrefix(entry, kernelPrefix)
 		if e == entry {
 			continue
 		}
-		return filepath.Base(e)
+		kernel = filepath.Base(e)
 	}
+	return kernel
+}
 
+// systemdBootCmdline parses cmdline generated by systemd-boot entries.
+// The kernel is deduced from the initrd name.
+type systemdBootCmdline struct{}
+
+func (systemdBootCmdline) rootDataset(cmdline string) string {
+	return rootDatasetFromCmdline(cmdline)
+}
+
+func (systemdBootCmdline) kernel(cmdline string) string {
+	for _, entry := range cmdlineFields(cmdline) {
+		e := strings.TrimPrefix(entry, initrdPrefix)
+		if e == entry {
+			continue
+		}
+		// initrd is on the EFI partition, and so, can be \ separated.
+		initrd := filepath.Base(strings.ReplaceAll(e, "\\", "/"))
+		for _, prefix := range []string{"initrd.img-", "initramfs-"} {
+			if version := strings.TrimPrefix(initrd, prefix); version != initrd {
+				return "vmlinuz-" + strings.TrimSuffix(version, ".img")
+			}
+		}
+	}
 	return ""
 }
 
+// bootParametersFromCmdline returns the rootDataset name and revertuserData state if we are in a revert case
+func bootParametersFromCmdline(cmdline string) (rootDataset string, revertuserData bool) {
+	rootDataset = parserForCmdline(cmdline).rootDataset(cmdline)
+	for _, entry := range cmdlineFields(cmdline) {
+		if entry == zfsRevertUserDataTag {
+			revertuserData = true
+		}
+	}
+
+	return rootDataset, revertuserData
+}
+
+// kernelFromCmdline returns the used kernel name in cmdline
+func kernelFromCmdline(cmdline string) (kernel string) {
+	return parserForCmdline(cmdline).kernel(cmdline)
+}
+
 // findFromRoot returns the active machine and state if any.
-// If rootName is a snapshot, it fallbacks to current mounted root dataset. If no root dataset is mounted, s can be nil
+// If rootName is a snapshot or selected by the initramfs, it fallbacks to current mounted root dataset. If no root dataset is mounted, s can be nil
 func (machines *Machines) findFromRoot(rootName string) (*Machine, *State) {
 	// Not a zfs system
 	if rootName == "" {
@@ -53,8 +180,9 @@ func (machines *Machines) findFromRoot(rootName string) (*Machine, *State) {
 		return m, &m.State
 	}
 
+	// Booting on a snapshot or letting the initramfs select the root dataset: look for the mounted one
 	var fromSnapshot bool
-	if strings.Contains(rootName, "@") {
+	if strings.Contains(rootName, "@") || rootName == autoRootDataset {
 		fromSnapshot = true
 	}
 
@@ -71,12 +199,12 @@ func (machines *Machines) findFromRoot(rootName string) (*Machine, *State) {
 
 		// We have a snapshot, we need to find the corresponding mounted main dataset on /.
 		// Look first on current machine
-		if m.Datasets[m.ID][0].Mounted && m.Datasets[m.ID][0].Mountpoint == "/" {
+		if m.Datasets[m.ID][0].Mounted && triageMountpoint(*m.Datasets[m.ID][0]) == "/" {
 			return m, &m.State
 		}
 		// Look now on History
 		for _, h := range m.History {
-			if h.Datasets[h.ID][0].Mounted && h.Datasets[h.ID][0].Mountpoint == "/" {
+			if h.Datasets[h.ID][0].Mounted && triageMountpoint(*h.Datasets[h.ID][0]) == "/" {
 				return m, h
 			}
 		}
@@ -0,0 +1,79 @@
+package machines
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+)
+
+// ContainerRole is how datasets of a container, like <pool>/USERDATA, are managed.
+type ContainerRole string
+
+const (
+	// ContainerSystem holds system datasets, like ROOT and BOOT. They are attached to machine states from their
+	// mountpoint, as / and /boot, and are otherwise handled as any other dataset.
+	ContainerSystem ContainerRole = "system"
+	// ContainerUser holds user datasets, like USERDATA, attached to the system states they are associated to.
+	ContainerUser ContainerRole = "user"
+	// ContainerPersistent holds persistent datasets, shared between all machines, even if they aren't mounted
+	// automatically. Snapshots and datasets with canmount=off are still ignored.
+	ContainerPersistent ContainerRole = "persistent"
+)
+
+// defaultContainers are the containers of a standard zsys installation.
+var defaultContainers = map[string]ContainerRole{
+	"root":     ContainerSystem,
+	"boot":     ContainerSystem,
+	"userdata": ContainerUser,
+}
+
+// WithContainers manages datasets in the containers of custom layouts, like <pool>/SRV, from the role given to
+// each container name. Names are case insensitive and override the default ROOT and BOOT system containers and
+// USERDATA user container, which are kept otherwise.
+// A dataset belongs to the first container in its path, after the pool.
+func WithContainers(containers map[string]ContainerRole) func(o *options) error {
+	return func(o *options) error {
+		c := make(map[string]ContainerRole, len(defaultContainers)+len(containers))
+		for name, role := range defaultContainers {
+			c[name] = role
+		}
+		for name, role := range containers {
+			if name == "" || strings.ContainsAny(name, "/@") {
+				return fmt.Errorf(i18n.G("invalid container name %q"), name)
+			}
+			switch role {
+			case ContainerSystem, ContainerUser, ContainerPersistent:
+			default:
+				return fmt.Errorf(i18n.G("unknown role %q for container %s"), role, name)
+			}
+			c[strings.ToLower(name)] = role
+		}
+		o.containers = c
+		return nil
+	}
+}
+
+// containerRole returns the role of the first container in the path of the dataset name, or an empty role if it isn't
+// in any.
+// The container dataset itself isn't part of it.
+func (ms *Machines) containerRole(name string) ContainerRole {
+	containers := ms.containers
+	if containers == nil {
+		containers = defaultContainers
+	}
+
+	base, _ := splitSnapshotName(name)
+	elems := strings.Split(strings.ToLower(base), "/")
+	for i := 1; i < len(elems)-1; i++ {
+		if role, ok := containers[elems[i]]; ok {
+			return role
+		}
+	}
+	return ""
+}
+
+// isUserDataset returns if the dataset name is in a user container.
+func (ms *Machines) isUserDataset(name string) bool {
+	return ms.containerRole(name) == ContainerUser
+}
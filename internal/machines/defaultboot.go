@@ -0,0 +1,81 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+)
+
+// SetDefaultBootState makes the state id the one booted by default, by setting the bootfs property of its pool to its
+// root dataset. It's then the next state of the machine, until a boot is committed. Unlike reverting, nothing is
+// cloned: the state is booted as is, and keeps being booted by default on following boots.
+func (ms *Machines) SetDefaultBootState(ctx context.Context, id string) error {
+	if err := ms.checkWritable(i18n.G("set default boot state")); err != nil {
+		return err
+	}
+
+	s, m, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if err := checkBootTarget(s, m); err != nil {
+		return err
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Setting %s as default boot state"), s.ID)
+	if err := t.SetPoolBootFS(s.ID); err != nil {
+		cancel()
+		return err
+	}
+
+	if err := ms.Refresh(ctx); err != nil {
+		return err
+	}
+
+	if s, _, err := ms.GetStateByID(id); err == nil {
+		ms.setNextState(s)
+	}
+	return nil
+}
+
+// SetNextBootState makes the state id of the current machine the one booted by default on next boot only, without
+// changing the bootfs property of its pool. The bootloader marks it as its default entry, while the persistent default
+// is kept for following boots.
+// This is only known in memory: Commit clears it once the next boot completed, and the bootloader menu should then be
+// regenerated to get back to the persistent default. Setting it again, or to the main state, replaces it.
+func (ms *Machines) SetNextBootState(ctx context.Context, id string) error {
+	s, m, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if m != ms.current {
+		return fmt.Errorf(i18n.G("%s isn't a state of current machine"), s.ID)
+	}
+	if err := checkBootTarget(s, m); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, i18n.G("Booting %s once on next boot"), s.ID)
+	ms.setNextState(s)
+	return nil
+}
+
+// checkBootTarget returns an error if the state s of machine m can't be booted as is.
+// Only filesystem states managed by zsys, with a mountable root dataset and all keys loaded, can.
+func checkBootTarget(s *State, m *Machine) error {
+	if s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s is a snapshot and can't be booted: revert to it instead"), s.ID)
+	}
+	if !m.isZsys() || !s.managedByZsys() {
+		return withKind(ErrNotZsys, fmt.Errorf(i18n.G("%s isn't managed by zsys and can't be booted"), s.ID))
+	}
+	if reason := s.notBootableReason(); reason != "" {
+		return fmt.Errorf(i18n.G("%s isn't bootable: %s"), s.ID, reason)
+	}
+	return nil
+}
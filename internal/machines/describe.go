@@ -0,0 +1,84 @@
+package machines
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+)
+
+// Describe writes a human readable tree of all machines to w: each machine with its main state, its history states,
+// most recently used first, and the user states attached to each of them, with their dataset count and size.
+// Only already computed data is printed and the output is stable: times are in UTC and everything is sorted.
+func (ms *Machines) Describe(w io.Writer) error {
+	defer ms.rlock()()
+
+	var out strings.Builder
+
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+
+		flags := []string{i18n.G("not zsys")}
+		if m.isZsys() {
+			flags[0] = i18n.G("zsys")
+		}
+		if m == ms.current {
+			flags = append(flags, i18n.G("current"))
+		}
+		fmt.Fprintf(&out, i18n.G("Machine %s (%s)\n"), m.ID, strings.Join(flags, ", "))
+
+		fmt.Fprintf(&out, i18n.G("  Main state:\n"))
+		m.State.describe(&out, "    ")
+
+		if len(m.History) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, i18n.G("  History:\n"))
+		var history []*State
+		for _, k := range sortedStateKeys(m.History) {
+			history = append(history, m.History[k])
+		}
+		sort.SliceStable(history, func(i, j int) bool { return history[i].LastUsed.After(history[j].LastUsed) })
+		for _, s := range history {
+			s.describe(&out, "    ")
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// describe writes the state summary and all its user states, sorted by user name, with indent.
+func (s State) describe(out io.Writer, indent string) {
+	fmt.Fprintf(out, i18n.G("%s- %s\n"), indent, s.summary())
+	for _, user := range sortedStateKeys(s.Users) {
+		fmt.Fprintf(out, i18n.G("%s  - %s: %s\n"), indent, user, s.Users[user].summary())
+	}
+}
+
+// summary returns the state ID with its last used time, number of datasets and size.
+func (s State) summary() string {
+	lastUsed := i18n.G("unknown")
+	if s.LastUsed.Unix() > 0 {
+		lastUsed = s.LastUsed.UTC().Format("2006-01-02 15:04:05")
+	}
+	// A state without any dataset has no size.
+	used, _, _ := s.Size()
+	return fmt.Sprintf(i18n.G("%s (last used: %s, datasets: %d, size: %s)"), s.ID, lastUsed, len(s.getDatasets()), formatSize(used))
+}
+
+// formatSize returns a human readable size, in binary units.
+func formatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
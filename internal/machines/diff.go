@@ -0,0 +1,119 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// StateDiff lists dataset differences between 2 states, A and B.
+// System and user datasets of both states are matched by their path relative to their state root datasets, without
+// the generated _<suffix> nor the snapshot name.
+type StateDiff struct {
+	// OnlyInA are dataset names of A without any matching dataset in B.
+	OnlyInA []string
+	// OnlyInB are dataset names of B without any matching dataset in A.
+	OnlyInB []string
+	// Different are datasets present in both states, but with different properties.
+	Different []DatasetDiff
+}
+
+// DatasetDiff is a dataset matching in both states with differing properties.
+type DatasetDiff struct {
+	A, B string
+	// Properties are the names of the differing properties.
+	Properties []string
+}
+
+// DiffStates compares system and user datasets of states idA and idB.
+// Note that this is a structural comparison of datasets and their properties, not a file content comparison.
+// All lists are sorted.
+func (ms *Machines) DiffStates(ctx context.Context, idA, idB string) (StateDiff, error) {
+	var diff StateDiff
+
+	sA, _, err := ms.GetStateByID(idA)
+	if err != nil {
+		return diff, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	sB, _, err := ms.GetStateByID(idB)
+	if err != nil {
+		return diff, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	log.Debugf(ctx, i18n.G("Comparing datasets of %s and %s"), sA.ID, sB.ID)
+
+	dsA, dsB := sA.datasetsByRelativeName(), sB.datasetsByRelativeName()
+	for k, dA := range dsA {
+		dB, ok := dsB[k]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, dA.Name)
+			continue
+		}
+		if props := differingProperties(*dA, *dB); props != nil {
+			diff.Different = append(diff.Different, DatasetDiff{A: dA.Name, B: dB.Name, Properties: props})
+		}
+	}
+	for k, dB := range dsB {
+		if _, ok := dsA[k]; !ok {
+			diff.OnlyInB = append(diff.OnlyInB, dB.Name)
+		}
+	}
+
+	sort.Strings(diff.OnlyInA)
+	sort.Strings(diff.OnlyInB)
+	sort.Slice(diff.Different, func(i, j int) bool { return diff.Different[i].A < diff.Different[j].A })
+
+	return diff, nil
+}
+
+// datasetsByRelativeName returns all system and user datasets of the state, indexed by their name without any
+// _<suffix> on their state root dataset nor snapshot name.
+func (s State) datasetsByRelativeName() map[string]*zfs.Dataset {
+	r := make(map[string]*zfs.Dataset)
+
+	addDatasets := func(datasets map[string][]*zfs.Dataset) {
+		for route, ds := range datasets {
+			routeBase, _ := splitSnapshotName(route)
+			prefix := routeBase
+			if i := strings.LastIndex(prefix, "_"); i > strings.LastIndex(prefix, "/") {
+				prefix = prefix[:i]
+			}
+			for _, d := range ds {
+				base, _ := splitSnapshotName(d.Name)
+				r[prefix+strings.TrimPrefix(base, routeBase)] = d
+			}
+		}
+	}
+
+	addDatasets(s.Datasets)
+	for _, us := range s.Users {
+		addDatasets(us.Datasets)
+	}
+	return r
+}
+
+// differingProperties returns the sorted names of properties differing between 2 datasets.
+func differingProperties(a, b zfs.Dataset) (props []string) {
+	values := []struct {
+		name   string
+		va, vb string
+	}{
+		{"mountpoint", a.Mountpoint, b.Mountpoint},
+		{"canmount", a.CanMount, b.CanMount},
+		{"bootfs", strconv.FormatBool(a.BootFS), strconv.FormatBool(b.BootFS)},
+		{"lastbootedkernel", a.LastBootedKernel, b.LastBootedKernel},
+		{"referenced", strconv.FormatUint(a.Referenced, 10), strconv.FormatUint(b.Referenced, 10)},
+	}
+	for _, v := range values {
+		if v.va != v.vb {
+			props = append(props, v.name)
+		}
+	}
+	sort.Strings(props)
+	return props
+}
@@ -0,0 +1,41 @@
+package machines
+
+import (
+	"context"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+)
+
+// WithDryRun makes every mutating operation, like snapshotting, cloning, reverting, removing states, garbage
+// collecting or promoting, only plan the zfs operations it would run. They are logged and returned by DryRunPlan, but
+// nothing is changed on the system and event hooks aren't run.
+// Machines reflect planned changes, so that a whole pipeline of operations can be planned, one on top of the other.
+func WithDryRun() func(o *options) error {
+	return func(o *options) error {
+		o.dryRun = true
+		return nil
+	}
+}
+
+// DryRunPlan returns the zfs operations planned so far, in order, formatted as zfs commands.
+// It's always empty if machines aren't in dry run mode.
+func (ms *Machines) DryRunPlan() []string {
+	if ms.plan == nil {
+		return nil
+	}
+	return ms.plan.Operations()
+}
+
+// ResetDryRun forgets all planned operations and rescans zfs, so that machines are back to the system state.
+func (ms *Machines) ResetDryRun(ctx context.Context) error {
+	if ms.plan == nil {
+		return nil
+	}
+	log.Debug(ctx, i18n.G("Resetting dry run plan"))
+	ms.plan.Reset()
+	if err := ms.z.Refresh(ctx); err != nil {
+		return classifyZFSError(err)
+	}
+	return ms.refresh(ctx)
+}
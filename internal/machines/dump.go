@@ -29,7 +29,9 @@ func (s sortedDatasets) Less(i, j int) bool {
 func (s sortedDatasets) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
 // MarshalJSON exports for json Marshmalling all private fields
-func (ms Machines) MarshalJSON() ([]byte, error) {
+func (ms *Machines) MarshalJSON() ([]byte, error) {
+	defer ms.rlock()()
+
 	mt := Machinesdump{}
 
 	mt.All = ms.all
@@ -55,3 +57,112 @@ func (ms Machines) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(mt)
 }
+
+// UnmarshalJSON imports a Machines dump, as exported by MarshalJSON.
+// Current machine, next state, user states and datasets are restored as references to the same elements than the
+// machines map, by their IDs and names.
+// The imported Machines isn't connected to any zfs pools: it can be queried but any operation changing the system
+// state will fail.
+func (ms *Machines) UnmarshalJSON(b []byte) error {
+	mt := Machinesdump{}
+
+	if err := json.Unmarshal(b, &mt); err != nil {
+		return err
+	}
+
+	ms.all = mt.All
+	ms.cmdline = mt.Cmdline
+	ms.current = mt.Current
+	ms.nextState = mt.NextState
+	ms.allSystemDatasets = mt.AllSystemDatasets
+	ms.allUsersDatasets = mt.AllUsersDatasets
+	ms.allPersistentDatasets = mt.AllPersistentDatasets
+	ms.unmanagedDatasets = mt.UnmanagedDatasets
+
+	ms.restoreReferences()
+
+	return nil
+}
+
+// restoreReferences makes all elements referring to the same machine, state or dataset point to the same object.
+func (ms *Machines) restoreReferences() {
+	datasets := make(map[string]*zfs.Dataset)
+	for _, ds := range [][]*zfs.Dataset{ms.allSystemDatasets, ms.allUsersDatasets, ms.allPersistentDatasets, ms.unmanagedDatasets} {
+		for _, d := range ds {
+			datasets[d.Name] = d
+		}
+	}
+	restoreDatasets := func(ds []*zfs.Dataset) {
+		for i, d := range ds {
+			if known, ok := datasets[d.Name]; ok {
+				ds[i] = known
+			}
+		}
+	}
+	restoreStateDatasets := func(s *State) {
+		for _, ds := range s.Datasets {
+			restoreDatasets(ds)
+		}
+	}
+
+	for _, m := range ms.all {
+		restoreStateDatasets(&m.State)
+		restoreDatasets(m.PersistentDatasets)
+		for _, h := range m.History {
+			restoreStateDatasets(h)
+		}
+
+		// The same user state can be listed multiple times, with different children for each system state.
+		userStates := make(map[string][]*State)
+		for _, uss := range m.AllUsersStates {
+			for _, us := range uss {
+				restoreStateDatasets(us)
+				userStates[us.ID] = append(userStates[us.ID], us)
+			}
+		}
+		restoreUsers := func(s *State) {
+			for user, us := range s.Users {
+				for _, known := range userStates[us.ID] {
+					if sameStateDatasets(known, us) {
+						s.Users[user] = known
+						break
+					}
+				}
+			}
+		}
+		restoreUsers(&m.State)
+		for _, h := range m.History {
+			restoreUsers(h)
+		}
+
+		if ms.current != nil && m.ID == ms.current.ID {
+			ms.current = m
+		}
+		if ms.nextState != nil {
+			if m.ID == ms.nextState.ID {
+				ms.nextState = &m.State
+			} else if h, ok := m.History[ms.nextState.ID]; ok {
+				ms.nextState = h
+			}
+		}
+	}
+}
+
+// sameStateDatasets returns if both states have the same datasets, by name.
+func sameStateDatasets(s1, s2 *State) bool {
+	if len(s1.Datasets) != len(s2.Datasets) {
+		return false
+	}
+	for route, ds1 := range s1.Datasets {
+		ds2, ok := s2.Datasets[route]
+		if !ok || len(ds1) != len(ds2) {
+			return false
+		}
+		for i := range ds1 {
+			if ds1[i].Name != ds2[i].Name {
+				return false
+			}
+		}
+	}
+	return true
+}
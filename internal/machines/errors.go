@@ -0,0 +1,70 @@
+package machines
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+var (
+	// ErrNoZFS is returned when zfs isn't available on the system, like when its kernel module isn't loaded.
+	ErrNoZFS = errors.New(i18n.G("zfs isn't available"))
+	// ErrPermission is returned when zfs denies an operation, like when not running as root.
+	ErrPermission = errors.New(i18n.G("permission denied"))
+	// ErrPoolBusy is returned when a pool or dataset is busy, like with an operation in progress or a held snapshot.
+	ErrPoolBusy = errors.New(i18n.G("pool is busy"))
+	// ErrStateNotFound is returned when no state matches the requested ID.
+	ErrStateNotFound = errors.New(i18n.G("state not found"))
+	// ErrReadOnly is returned by operations changing the system on machines created WithReadOnly.
+	ErrReadOnly = zfs.ErrReadOnly
+	// ErrNotZsys is returned when an operation targets a state which isn't managed by zsys.
+	ErrNotZsys = errors.New(i18n.G("state isn't managed by zsys"))
+)
+
+// kindError tags err with one of the errors above, without changing its message.
+// Both can be matched with errors.Is and errors.As.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// withKind returns err tagged with kind.
+func withKind(kind, err error) error {
+	return kindError{kind: kind, err: err}
+}
+
+// classifyZFSError tags err with ErrNoZFS, ErrPermission or ErrPoolBusy if it's one of those zfs failures.
+// libzfs errors are plain strings, so they are matched on their messages. Other errors are returned as is.
+func classifyZFSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, kind := range []error{ErrNoZFS, ErrPermission, ErrPoolBusy} {
+		if errors.Is(err, kind) {
+			return err
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, os.ErrPermission) || strings.Contains(msg, "permission denied") || strings.Contains(msg, "operation not permitted"):
+		return withKind(ErrPermission, err)
+	case errors.Is(err, syscall.EBUSY) || strings.Contains(msg, "busy"):
+		return withKind(ErrPoolBusy, err)
+	case strings.Contains(msg, "/dev/zfs") || strings.Contains(msg, "initialize the libzfs") || strings.Contains(msg, "zfs module"):
+		return withKind(ErrNoZFS, err)
+	}
+	return err
+}
@@ -1,7 +1,6 @@
 package machines
 
 import (
-	"encoding/json"
 	"sort"
 	"testing"
 
@@ -14,6 +13,9 @@ const (
 	AutomatedSnapshotPrefix = automatedSnapshotPrefix
 )
 
+// MachinesLayout exports machinesLayout to compare machines
+type MachinesLayout = machinesLayout
+
 // WithTime allows overriding default time implementations with a mock
 func WithTime(time Nower) func(o *options) error {
 	return func(o *options) error {
@@ -22,36 +24,6 @@ func WithTime(time Nower) func(o *options) error {
 	}
 }
 
-// Import from json to export the private fields
-func (ms *Machines) UnmarshalJSON(b []byte) error {
-	mt := Machinesdump{}
-
-	if err := json.Unmarshal(b, &mt); err != nil {
-		return err
-	}
-
-	ms.all = mt.All
-	ms.cmdline = mt.Cmdline
-	ms.current = mt.Current
-	ms.nextState = mt.NextState
-	ms.allSystemDatasets = mt.AllSystemDatasets
-	ms.allUsersDatasets = mt.AllUsersDatasets
-	ms.allPersistentDatasets = mt.AllPersistentDatasets
-	ms.unmanagedDatasets = mt.UnmanagedDatasets
-
-	if ms.current != nil {
-		for k, machine := range mt.All {
-			if machine.ID != ms.current.ID {
-				continue
-			}
-			// restore current machine pointing to the same element than the hashmap
-			ms.current = mt.All[k]
-		}
-	}
-
-	return nil
-}
-
 // MakeComparable prepares Machines by resetting private fields that change at each invocation
 func (ms *Machines) MakeComparable() {
 	ds := sortedDatasets(ms.allSystemDatasets)
@@ -70,9 +42,14 @@ func (ms *Machines) MakeComparable() {
 	sort.Sort(ds)
 	ms.unmanagedDatasets = ds
 
+	// Orphans and unattached system datasets are part of other datasets lists
+	ms.orphanDatasets = nil
+	ms.unattachedSystemDatasets = nil
+	ms.machinesSettings = machinesSettings{}
 	ms.z = nil
 	ms.time = nil
 	ms.conf = config.ZConfig{}
+	ms.mu = nil
 }
 
 // SplitSnapshotName calls internal splitSnapshotName to split a snapshot name in base and id of a snapshot
@@ -81,9 +58,12 @@ func SplitSnapshotName(s string) (string, string) { return splitSnapshotName(s)
 // AllMachines exports machines lists for tests
 func (ms *Machines) AllMachines() map[string]*Machine { return ms.all }
 
-func (ms Machines) CopyForTests(t *testing.T) (copy Machines) {
+func (ms *Machines) CopyForTests(t *testing.T) (copy Machines) {
 	t.Helper()
 
 	testutils.Deepcopy(t, &copy, ms)
 	return copy
 }
+
+// SetNextState exports setNextState for tests
+func (ms *Machines) SetNextState(s *State) { ms.setNextState(s) }
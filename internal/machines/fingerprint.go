@@ -0,0 +1,75 @@
+package machines
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// Fingerprint returns a stable hash of the state datasets names and of their properties which matter to boot on them,
+// including the ones of its user states. Space usage and whether datasets are currently mounted aren't part of it.
+// Two states with the same fingerprint boot the same way.
+func (s State) Fingerprint() string {
+	h := sha256.New()
+	s.writeFingerprint(h)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Fingerprint returns a stable hash of the whole machines layout: all machines with their states, as State.Fingerprint,
+// persistent datasets, swap volumes, and the current machine.
+// Two refreshes of the same datasets produce the same fingerprint, which allows cheaply checking if anything changed.
+func (ms *Machines) Fingerprint() string {
+	defer ms.rlock()()
+
+	h := sha256.New()
+	if ms.current != nil {
+		fmt.Fprintf(h, "current %q\n", ms.current.ID)
+	}
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		fmt.Fprintf(h, "machine %q zsys=%t\n", m.ID, m.IsZsys)
+		m.State.writeFingerprint(h)
+		for _, id := range sortedStateKeys(m.History) {
+			fmt.Fprintf(h, "history\n")
+			m.History[id].writeFingerprint(h)
+		}
+		persistents := append([]*zfs.Dataset(nil), m.PersistentDatasets...)
+		sort.Slice(persistents, func(i, j int) bool { return persistents[i].Name < persistents[j].Name })
+		for _, d := range persistents {
+			fmt.Fprintf(h, "persistent ")
+			writeDatasetFingerprint(h, d)
+		}
+		for _, d := range m.SwapDatasets {
+			fmt.Fprintf(h, "swap %q volsize=%d\n", d.Name, d.VolSize)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeFingerprint writes to h the state datasets, sorted by route and name, then its user states, sorted by user.
+func (s State) writeFingerprint(h hash.Hash) {
+	fmt.Fprintf(h, "state %q\n", s.ID)
+	for _, route := range sortedRoutes(s.Datasets) {
+		ds := append([]*zfs.Dataset(nil), s.Datasets[route]...)
+		sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+		fmt.Fprintf(h, "route %q\n", route)
+		for _, d := range ds {
+			writeDatasetFingerprint(h, d)
+		}
+	}
+	for _, user := range sortedStateKeys(s.Users) {
+		fmt.Fprintf(h, "user %q\n", user)
+		s.Users[user].writeFingerprint(h)
+	}
+}
+
+// writeDatasetFingerprint writes to h the dataset name and the properties which matter to boot on it.
+func writeDatasetFingerprint(h hash.Hash, d *zfs.Dataset) {
+	fmt.Fprintf(h, "dataset %q snapshot=%t mountpoint=%q canmount=%q bootfs=%t lastused=%d kernel=%q bootfsdatasets=%q "+
+		"reason=%q source=%q protected=%t origin=%q encryption=%q keystatus=%q\n",
+		d.Name, d.IsSnapshot, d.Mountpoint, d.CanMount, d.BootFS, d.LastUsed, d.LastBootedKernel, d.BootfsDatasets,
+		d.SnapshotReason, d.SnapshotSource, d.Protected, d.Origin, d.Encryption, d.KeyStatus)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"math"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/ubuntu/zsys/internal/config"
@@ -44,9 +43,42 @@ type stateWithKeep struct {
 	keep keepStatus
 }
 
+// GCPolicy refines which states are collected on top of the history rules of the configuration.
+type GCPolicy struct {
+	// KeepUserStatesLinkedToSystem keeps any user state associated to a system state which is kept, so that reverting
+	// to it restores user data too. Otherwise, user states are only kept by the history rules.
+	KeepUserStatesLinkedToSystem bool
+}
+
+var defaultGCPolicy = GCPolicy{KeepUserStatesLinkedToSystem: true}
+
+// WithGCPolicy overrides the default garbage collection policy, which keeps user states linked to kept system states.
+func WithGCPolicy(p GCPolicy) func(o *options) error {
+	return func(o *options) error {
+		o.gcPolicy = p
+		return nil
+	}
+}
+
 // GC starts garbage collection for system and users
 // If all is set manual snapshots are considered too
+// States are sorted by LastUsed and dispatched in the time buckets computed from the history rules.
+// States without any LastUsed (zero time) always fall in the oldest bucket, which holds no sample: they are collected
+// unless another rule (keep last, dependencies, manual snapshot) keeps them.
+// Only system states managed by zsys, as returned by ZsysHistory, are collected.
 func (ms *Machines) GC(ctx context.Context, all bool) error {
+	if err := ms.checkWritable(i18n.G("garbage collect")); err != nil {
+		return err
+	}
+
+	var machineID string
+	if ms.current != nil {
+		machineID = ms.current.ID
+	}
+	if err := runPreHook(ctx, "PreGC", ms.hooks.PreGC, machineID); err != nil {
+		return err
+	}
+
 	now := ms.time.Now()
 
 	buckets := computeBuckets(ctx, now, ms.conf.History)
@@ -88,8 +120,9 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 			}
 
 			var newestStateIndex int
+			// States which aren't managed by zsys have no attached user datasets: never collect them.
 			var sortedStates sortedReverseByTimeStates
-			for _, s := range m.History {
+			for _, s := range m.ZsysHistory() {
 				sortedStates = append(sortedStates, s)
 			}
 			sort.Sort(sortedStates)
@@ -155,8 +188,13 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 							}
 						}
 					}
+					// Protected states. What they depend on is then kept by the snapshot and clone rules
+					if keep == keepUnknown && s.Protected() {
+						log.Debugf(ctx, i18n.G("Keeping %v as it's protected"), s.ID)
+						keep = keepYes
+					}
 					// Non automated snapshots
-					if keep == keepUnknown && s.isSnapshot() && !all && !strings.Contains(s.ID, "@"+automatedSnapshotPrefix) {
+					if keep == keepUnknown && s.isSnapshot() && !all && !ms.snapshotNaming.isAutomated(s) {
 						log.Debugf(ctx, i18n.G("Keeping snapshot %v as it's not a zsys one"), s.ID)
 						keep = keepYes
 					}
@@ -222,13 +260,29 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 		}
 
 		// Remove the given states.
+		removed := make(map[string]bool)
 		for _, s := range statesToRemove {
+			removed[s.ID] = true
+		}
+		for i, s := range statesToRemove {
 			log.Infof(ctx, i18n.G("Selecting state to remove: %s"), s.ID)
+			ms.progress.report(i, len(statesToRemove), s.ID)
+			if k, shared := ms.neededByKeptStates(s, removed); k != nil {
+				log.Warningf(ctx, i18n.G("Keeping %s as %s relies on %s"), s.ID, k.ID, joinDatasetNames(shared))
+				keepDueToErrorOnDelete[s.ID] = true
+				continue
+			}
+			if held := ms.heldDatasets(s); len(held) > 0 {
+				log.Warningf(ctx, i18n.G("Keeping %s as %s"), s.ID, describeHolds(held))
+				keepDueToErrorOnDelete[s.ID] = true
+				continue
+			}
 			if err := s.remove(ctx, ms, ""); err != nil {
 				log.Errorf(ctx, i18n.G("Couldn't fully destroy state %s: %v\nPutting it in keep list."), s.ID, err)
 				keepDueToErrorOnDelete[s.ID] = true
 			}
 		}
+		ms.progress.report(len(statesToRemove), len(statesToRemove), "")
 		statesToRemove = nil
 		if err := ms.Refresh(ctx); err != nil {
 			return fmt.Errorf("Couldn't refresh machine list: %v", err)
@@ -250,6 +304,22 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 		log.Debugf(ctx, "GC User Pass #%d", gcPassNum)
 		statesChanges := false
 
+		// User states associated to kept system states, on any machine
+		linkedToKeptSystemStates := make(map[string]bool)
+		if ms.gcPolicy.KeepUserStatesLinkedToSystem {
+			for _, m := range ms.all {
+				systemStates := []*State{&m.State}
+				for _, s := range m.History {
+					systemStates = append(systemStates, s)
+				}
+				for _, s := range systemStates {
+					for _, us := range s.Users {
+						linkedToKeptSystemStates[us.ID] = true
+					}
+				}
+			}
+		}
+
 		for _, m := range ms.all {
 			// FIXME: we count same user state multiple times if linked to multiple bootfs systems
 			for _, us := range m.AllUsersStates {
@@ -327,8 +397,13 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 								}
 							}
 						}
+						// Protected states
+						if keep == keepUnknown && s.Protected() {
+							log.Debugf(ctx, i18n.G("Keeping %v as it's protected"), s.ID)
+							keep = keepYes
+						}
 						// Non automated snapshots
-						if keep == keepUnknown && s.isSnapshot() && !all && !strings.Contains(s.ID, "@"+automatedSnapshotPrefix) {
+						if keep == keepUnknown && s.isSnapshot() && !all && !ms.snapshotNaming.isAutomated(s) {
 							log.Debugf(ctx, i18n.G("Keeping snapshot %v as it's not a zsys one"), s.ID)
 							keep = keepYes
 						}
@@ -337,8 +412,13 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 							log.Debugf(ctx, i18n.G("Keeping %v as it's not a snapshot and associated to a system state"), s.ID)
 							keep = keepYes
 						}
+						// Associated to a kept system state
+						if keep == keepUnknown && linkedToKeptSystemStates[s.ID] {
+							log.Debugf(ctx, i18n.G("Keeping %v as it's associated to a kept system state"), s.ID)
+							keep = keepYes
+						}
 						// Snapshot linked to system state
-						if keep == keepUnknown && s.isSnapshot() {
+						if keep == keepUnknown && ms.gcPolicy.KeepUserStatesLinkedToSystem && s.isSnapshot() {
 							_, snapshotName := splitSnapshotName(s.ID)
 							// Do we have a state associated with us?
 							for k := range m.History {
@@ -415,8 +495,23 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 		}
 
 		// Remove the given states.
+		removed := make(map[string]bool)
 		for _, s := range statesToRemove {
+			removed[s.ID] = true
+		}
+		for i, s := range statesToRemove {
 			log.Infof(ctx, i18n.G("Selecting state to remove: %s"), s.ID)
+			ms.progress.report(i, len(statesToRemove), s.ID)
+			if k, shared := ms.neededByKeptStates(s, removed); k != nil {
+				log.Warningf(ctx, i18n.G("Keeping user state %s as %s relies on %s"), s.ID, k.ID, joinDatasetNames(shared))
+				keepDueToErrorOnDelete[s.ID] = true
+				continue
+			}
+			if held := ms.heldDatasets(s); len(held) > 0 {
+				log.Warningf(ctx, i18n.G("Keeping user state %s as %s"), s.ID, describeHolds(held))
+				keepDueToErrorOnDelete[s.ID] = true
+				continue
+			}
 			if err := s.remove(ctx, ms, ""); err != nil {
 				log.Errorf(ctx, i18n.G("Couldn't fully destroy user state %s: %v.\nPutting it in keep list."), s.ID, err)
 				keepDueToErrorOnDelete[s.ID] = true
@@ -426,6 +521,7 @@ func (ms *Machines) GC(ctx context.Context, all bool) error {
 				delete(userDatasetsToKeep, route)
 			}
 		}
+		ms.progress.report(len(statesToRemove), len(statesToRemove), "")
 
 		statesToRemove = nil
 		if err := ms.Refresh(ctx); err != nil {
@@ -512,6 +608,7 @@ nextUnmanagedUserPass:
 		gcPassNum++
 	}
 
+	runPostHook(ctx, "PostGC", ms.hooks.PostGC, machineID)
 	return nil
 }
 
@@ -539,7 +636,9 @@ func removeFromSlice(s []string, name string) (r []string) {
 }
 
 // computeBuckets initializes the list of buckets in which the dataset will be sorted.
-// Buckets are defined from the main configuration file.
+// Buckets are defined from the main configuration file. They are returned from the newest to the oldest one, the first
+// one keeping everything after GCStartAfter and the last one, starting at zero time, keeping nothing.
+// The list only depends on now and rules, so that the same timestamps always result in the same selection.
 func computeBuckets(ctx context.Context, now time.Time, rules config.HistoryRules) (buckets []bucket) {
 	log.Debugf(ctx, "calculating buckets")
 	nowDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/ubuntu/zsys/internal/i18n"
 	"github.com/ubuntu/zsys/internal/log"
@@ -50,6 +52,29 @@ func isChild(name string, d zfs.Dataset) (bool, error) {
 	return false, err
 }
 
+// legacyMountpoint is the mountpoint of datasets mounted through fstab, or by the initramfs, rather than by zfs.
+const legacyMountpoint = "legacy"
+
+// triageMountpoint returns where the dataset is mounted, to sort it as a system or boot dataset.
+// Datasets with mountpoint=legacy have no mountpoint recorded in zfs: they are matched by their container name
+// instead. Datasets directly in a ROOT container are then root datasets mounted on /, and any dataset in a BOOT
+// container is a boot dataset mounted under /boot.
+func triageMountpoint(d zfs.Dataset) string {
+	if d.Mountpoint != legacyMountpoint {
+		return d.Mountpoint
+	}
+
+	base, _ := splitSnapshotName(d.Name)
+	lowerName := strings.ToLower(base)
+	if strings.HasSuffix(filepath.Dir(lowerName)+"/", systemdatasetsContainerName) {
+		return "/"
+	}
+	if strings.Contains(lowerName, bootdatasetsContainerName) {
+		return "/boot"
+	}
+	return d.Mountpoint
+}
+
 func getRootDatasets(ctx context.Context, ds []*zfs.Dataset) (rds map[*zfs.Dataset][]*zfs.Dataset) {
 	rds = make(map[*zfs.Dataset][]*zfs.Dataset)
 nextUserData:
@@ -76,58 +101,165 @@ nextUserData:
 // resolveOrigin iterates over each datasets up to their true origin and replaces them.
 // This is only done for onlyOnMountpoint if not empty to limit the interest of deduplication we are interested in.
 func resolveOrigin(ctx context.Context, datasets []*zfs.Dataset, onlyOnMountpoint string) map[string]*string {
+	return newOriginResolver(datasets).resolve(ctx, datasets, onlyOnMountpoint)
+}
+
+// originResolver resolves datasets up to their true origin. Each clone chain is only walked once and shared between
+// all callers.
+// It only knows about the datasets it was created with: a new one is needed each time zfs datasets are refreshed,
+// as promotions change origins.
+// Datasets of all pools are indexed together. zfs clones and their origins are always on the same pool, so a clone
+// chain never spans pools: boot datasets on a separate pool are resolved on their own and attached to the system
+// state matching their name, not their origin.
+type originResolver struct {
+	datasets map[string]*zfs.Dataset
+
+	// mu only protects roots: datasets are never modified once indexed.
+	mu    sync.RWMutex
+	roots map[string]string
+}
+
+// newOriginResolver indexes datasets to resolve their origin.
+func newOriginResolver(datasets []*zfs.Dataset) *originResolver {
+	or := originResolver{
+		datasets: make(map[string]*zfs.Dataset, len(datasets)),
+		roots:    make(map[string]string),
+	}
+	for _, d := range datasets {
+		or.datasets[d.Name] = d
+	}
+	return &or
+}
+
+// resolve returns the true origin of each datasets.
+// Each dataset is resolved independently, spread over a pool of workers, so that large pools don't pay for a
+// sequential walk. Results are then collected in datasets order.
+func (or *originResolver) resolve(ctx context.Context, datasets []*zfs.Dataset, onlyOnMountpoint string) map[string]*string {
+	origins := make([]*string, len(datasets))
+	forEachParallel(len(datasets), func(i int) {
+		d := datasets[i]
+		if (onlyOnMountpoint != "" && triageMountpoint(*d) != onlyOnMountpoint) || d.CanMount == "off" {
+			return
+		}
+		origins[i] = or.resolveDataset(ctx, d)
+	})
+
 	r := make(map[string]*string)
-	for _, curDataset := range datasets {
-		if (onlyOnMountpoint != "" && curDataset.Mountpoint != onlyOnMountpoint) || curDataset.CanMount == "off" {
+	for i, d := range datasets {
+		if origins[i] == nil {
 			continue
 		}
+		r[d.Name] = origins[i]
+	}
+	return r
+}
 
-		// copy to a local variable so that they don't all use the same address
-		origin := curDataset.Origin
-		if curDataset.IsSnapshot {
-			origin = curDataset.Name
+// resolveDataset returns the true origin of d: empty for a main filesystem dataset, the root filesystem dataset
+// of its clone chain otherwise.
+// It returns nil if any origin in the chain doesn't match a known dataset.
+func (or *originResolver) resolveDataset(ctx context.Context, d *zfs.Dataset) *string {
+	// copy to a local variable so that they don't all use the same address
+	origin := d.Origin
+	if d.IsSnapshot {
+		origin = d.Name
+	}
+	if origin == "" {
+		return &origin
+	}
 
-		}
-		r[curDataset.Name] = &origin
+	// origin for a clone points to a snapshot, points directly to the originating file system datasets to prevent a hop
+	base, _ := splitSnapshotName(origin)
+	root, missing := or.chainRoot(base)
+	if missing != "" {
+		log.Warningf(ctx, i18n.G("Didn't find origin %q for %q matching any dataset"), missing, d.Name)
+		return nil
+	}
+	return &root
+}
 
-		if *r[curDataset.Name] == "" && !curDataset.IsSnapshot {
-			continue
+// chainRoot returns the filesystem dataset at the top of the clone chain of name.
+// missing is the first dataset of the chain that isn't known, if any.
+// Concurrent callers can walk the same chain: they find the same root.
+func (or *originResolver) chainRoot(name string) (root, missing string) {
+	var walked []string
+	visited := make(map[string]bool)
+	cur := name
+	for {
+		or.mu.RLock()
+		r, ok := or.roots[cur]
+		or.mu.RUnlock()
+		if ok {
+			root = r
+			break
+		}
+		d, ok := or.datasets[cur]
+		if !ok || visited[cur] {
+			return "", cur
 		}
+		visited[cur] = true
+		walked = append(walked, cur)
+		if d.Origin == "" {
+			root = cur
+			break
+		}
+		cur, _ = splitSnapshotName(d.Origin)
+	}
 
-		curOrig := r[curDataset.Name]
-	nextOrigin:
-		for {
-			// origin for a clone points to a snapshot, points directly to the originating file system datasets to prevent a hop
-			if j := strings.LastIndex(*curOrig, "@"); j > 0 {
-				*curOrig = (*curOrig)[:j]
-			}
+	or.mu.Lock()
+	for _, n := range walked {
+		or.roots[n] = root
+	}
+	or.mu.Unlock()
+	return root, ""
+}
 
-			originStart := *curOrig
-			for _, d := range datasets {
-				if *curOrig != d.Name {
-					continue
-				}
-				if d.Origin != "" {
-					*curOrig = d.Origin
-					break
-				}
-				break nextOrigin
-			}
-			if originStart == *curOrig {
-				log.Warningf(ctx, i18n.G("Didn't find origin %q for %q matching any dataset"), *curOrig, curDataset.Name)
-				delete(r, curDataset.Name)
-				break
-			}
+// chain returns name followed by each dataset of its clone chain: a clone is followed by its origin snapshot, and a
+// snapshot by the filesystem dataset it belongs to. The chain ends with the filesystem dataset at its top.
+func (or *originResolver) chain(name string) ([]string, error) {
+	if _, ok := or.datasets[name]; !ok {
+		return nil, fmt.Errorf(i18n.G("no dataset matches %q"), name)
+	}
+
+	chain := []string{name}
+	visited := map[string]bool{name: true}
+	cur := name
+	for {
+		next := or.datasets[cur].Origin
+		if base, snapshot := splitSnapshotName(cur); snapshot != "" {
+			next = base
+		}
+		if next == "" {
+			return chain, nil
 		}
+		if _, ok := or.datasets[next]; !ok {
+			return nil, fmt.Errorf(i18n.G("origin %q of %q doesn't match any dataset"), next, cur)
+		}
+		if visited[next] {
+			return nil, fmt.Errorf(i18n.G("origin chain of %q loops on %q"), name, next)
+		}
+		visited[next] = true
+		chain = append(chain, next)
+		cur = next
 	}
-	return r
 }
 
-// appendDatasetIfNotPresent will check that the dataset wasn't already added and will append it
-// excludeCanMountOff restricts (for unlinked datasets) the check on datasets that are canMount noauto or on
-func appendDatasetIfNotPresent(mainDatasets, newDatasets []*zfs.Dataset, excludeCanMountOff bool) []*zfs.Dataset {
+// canMountOffPolicy selects if appendDatasetIfNotPresent appends canmount=off datasets.
+type canMountOffPolicy int
+
+const (
+	// includeCanMountOff appends datasets whatever their canmount value.
+	includeCanMountOff canMountOffPolicy = iota
+	// excludeCanMountOff never appends canmount=off datasets, only noauto and on ones.
+	excludeCanMountOff
+)
+
+// appendDatasetIfNotPresent appends to mainDatasets each dataset of newDatasets which wasn't already added.
+// With excludeCanMountOff, canmount=off datasets of newDatasets are skipped. This is how unlinked boot datasets are
+// added to system datasets, so that they are switched to noauto with them, while their containers are left alone.
+// Nothing else is changed on appended datasets.
+func appendDatasetIfNotPresent(mainDatasets, newDatasets []*zfs.Dataset, policy canMountOffPolicy) []*zfs.Dataset {
 	for _, d := range newDatasets {
-		if excludeCanMountOff && d.CanMount == "off" {
+		if policy == excludeCanMountOff && d.CanMount == "off" {
 			continue
 		}
 
@@ -178,6 +310,15 @@ func sortedStateKeys(m map[string]*State) []string {
 	return keys
 }
 
+func sortedRoutes(datasets map[string][]*zfs.Dataset) []string {
+	keys := make([]string, 0, len(datasets))
+	for k := range datasets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // splitSnapshotName return base and trailing names
 func splitSnapshotName(name string) (string, string) {
 	i := strings.LastIndex(name, "@")
@@ -187,6 +328,11 @@ func splitSnapshotName(name string) (string, string) {
 	return name[:i], name[i+1:]
 }
 
+// isDatasetOrDescendant returns if n is the dataset name or any of its children or snapshots.
+func isDatasetOrDescendant(name, n string) bool {
+	return n == name || strings.HasPrefix(n, name+"/") || strings.HasPrefix(n, name+"@")
+}
+
 // nameInBootfsDatasets returns if name is part of the bootfsdatsets list for d
 func nameInBootfsDatasets(name string, d zfs.Dataset) bool {
 	for _, bootfsDataset := range strings.Split(d.BootfsDatasets, bootfsdatasetsSeparator) {
@@ -197,17 +343,65 @@ func nameInBootfsDatasets(name string, d zfs.Dataset) bool {
 	return false
 }
 
+// isBootDatasetOf returns if d is the main boot dataset of the system state id.
+// It has to be directly under a boot container, named after the state root dataset and, if it's explicitly associated
+// to some system states, id has to be one of them.
+// Pools are not compared, as boot datasets are generally on a separate boot pool.
+func isBootDatasetOf(d zfs.Dataset, id string) bool {
+	name, _ := splitSnapshotName(d.Name)
+	stateName, _ := splitSnapshotName(id)
+	if !strings.EqualFold("/"+filepath.Base(filepath.Dir(name))+"/", bootdatasetsContainerName) {
+		return false
+	}
+	if filepath.Base(name) != filepath.Base(stateName) {
+		return false
+	}
+	return d.BootfsDatasets == "" || nameInBootfsDatasets(id, d)
+}
+
+// userFromDatasetName returns the user a user dataset (or snapshot) belongs to.
+// zsys names user datasets <user>_<id>: only the last underscore separates the id, so that users can themselves
+// contain underscores, like john_doe. An underscore with nothing before it, like in system users as _apt, is part of
+// the user name and is never taken as the id separator.
 func userFromDatasetName(n string) string {
 	base, _ := splitSnapshotName(n)
-	t := strings.Split(filepath.Base(base), "_")
-	user := t[0]
-	if len(t) > 1 {
-		user = strings.Join(t[:len(t)-1], "_")
+	name := filepath.Base(base)
+	i := strings.LastIndex(name, "_")
+	if i <= 0 {
+		return name
 	}
-	return user
+	return name[:i]
+}
 
+// poolName returns the name of the pool the dataset name belongs to.
+func poolName(name string) string {
+	if i := strings.IndexAny(name, "/@"); i >= 0 {
+		return name[:i]
+	}
+	return name
 }
 
-func isUserDataset(path string) bool {
-	return strings.Contains(strings.ToLower(path), userdatasetsContainerName)
+// forEachParallel calls f with each index from 0 to n-1, spread over a pool of workers.
+// It returns once all calls are done. f must only write to its own index results.
+func forEachParallel(n int, f func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	nWorkers := runtime.GOMAXPROCS(0)
+	if nWorkers > n {
+		nWorkers = n
+	}
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 }
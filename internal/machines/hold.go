@@ -0,0 +1,124 @@
+package machines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// HoldSnapshot places the hold tag on all system and user datasets of the snapshot state id.
+// Held states are never destroyed, by garbage collection or RemoveState, until the tag is released. This allows
+// keeping a base for incremental sends alive while a transfer is in flight.
+func (ms *Machines) HoldSnapshot(ctx context.Context, id, tag string) error {
+	if err := ms.checkWritable(i18n.G("hold snapshot")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if !s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s isn't a snapshot: only snapshots can be held"), s.ID)
+	}
+	if tag == "" {
+		return errors.New(i18n.G("hold tag can't be empty"))
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Holding %s with %s"), s.ID, tag)
+	for _, d := range append(s.getDatasets(), s.getUsersDatasets()...) {
+		if err := t.Hold(d.Name, tag); err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	return ms.refresh(ctx)
+}
+
+// ReleaseSnapshot releases the hold tag on all system and user datasets of the snapshot state id holding it.
+func (ms *Machines) ReleaseSnapshot(ctx context.Context, id, tag string) error {
+	if err := ms.checkWritable(i18n.G("release snapshot")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+
+	var held []*zfs.Dataset
+	for _, d := range append(s.getDatasets(), s.getUsersDatasets()...) {
+		for _, h := range d.Holds {
+			if h == tag {
+				held = append(held, d)
+				break
+			}
+		}
+	}
+	if len(held) == 0 {
+		return fmt.Errorf(i18n.G("%s isn't held with %s"), s.ID, tag)
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Releasing %s on %s"), tag, s.ID)
+	for _, d := range held {
+		if err := t.Release(d.Name, tag); err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	return ms.refresh(ctx)
+}
+
+// attachHolds sets on all system and user states the hold tags of their datasets.
+func (ms *Machines) attachHolds() {
+	for _, s := range ms.allStates() {
+		seen := make(map[string]bool)
+		var holds []string
+		for _, d := range s.getDatasets() {
+			for _, h := range d.Holds {
+				if seen[h] {
+					continue
+				}
+				seen[h] = true
+				holds = append(holds, h)
+			}
+		}
+		sort.Strings(holds)
+		s.Holds = holds
+	}
+}
+
+// heldDatasets returns the held datasets destroyed with s, sorted by name.
+func (ms *Machines) heldDatasets(s *State) []*zfs.Dataset {
+	var r []*zfs.Dataset
+	for _, d := range newSharingIndex(ms.z.Datasets()).footprint(s) {
+		if len(d.Holds) > 0 {
+			r = append(r, d)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// describeHolds returns which tags hold each dataset of ds.
+func describeHolds(ds []*zfs.Dataset) string {
+	var r []string
+	for _, d := range ds {
+		r = append(r, fmt.Sprintf(i18n.G("%s is held by %s"), d.Name, strings.Join(d.Holds, ", ")))
+	}
+	return strings.Join(r, "; ")
+}
@@ -0,0 +1,58 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+)
+
+// HookFunc is called with the ID of the state an operation is about.
+type HookFunc func(ctx context.Context, id string) error
+
+// EventHooks are optional callbacks run around state-mutating operations. This allows integrating with system events
+// (like package upgrades) without this package depending on them.
+// An error returned by a Pre hook aborts the operation before anything is changed. Post hooks are only called once
+// the operation succeeded and their errors are logged.
+type EventHooks struct {
+	// PreSnapshot is called with the state to snapshot, PostSnapshot with the new snapshot state.
+	PreSnapshot, PostSnapshot HookFunc
+	// PreRevert is called with the state to revert to, PostRevert with the new main state of the machine.
+	PreRevert, PostRevert HookFunc
+	// PreClone is called with the state to clone, PostClone with the new state.
+	PreClone, PostClone HookFunc
+	// PreGC and PostGC are called with the current machine ID, which is empty if there is none.
+	PreGC, PostGC HookFunc
+}
+
+// WithEventHooks runs hooks around state-mutating operations.
+func WithEventHooks(hooks EventHooks) func(o *options) error {
+	return func(o *options) error {
+		o.hooks = hooks
+		return nil
+	}
+}
+
+// runPreHook runs hook, if any, on id. Its error should abort the operation.
+func runPreHook(ctx context.Context, name string, hook HookFunc, id string) error {
+	if hook == nil {
+		return nil
+	}
+	log.Debugf(ctx, i18n.G("Running %s hook on %q"), name, id)
+	if err := hook(ctx, id); err != nil {
+		return fmt.Errorf(i18n.G("%s hook on %q failed: %v"), name, id, err)
+	}
+	return nil
+}
+
+// runPostHook runs hook, if any, on id. As the operation is already done, errors are only logged.
+func runPostHook(ctx context.Context, name string, hook HookFunc, id string) {
+	if hook == nil {
+		return
+	}
+	log.Debugf(ctx, i18n.G("Running %s hook on %q"), name, id)
+	if err := hook(ctx, id); err != nil {
+		log.Warningf(ctx, i18n.G("%s hook on %q failed: %v"), name, id, err)
+	}
+}
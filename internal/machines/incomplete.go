@@ -0,0 +1,52 @@
+package machines
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// Operations marked on the state root dataset they run from, until they complete.
+const (
+	operationClone  = "clone"
+	operationRevert = "revert"
+)
+
+// markOperation marks the root dataset of s with op in progress. The marker is reverted with the transaction if the
+// operation fails, and left set if the operation is interrupted.
+func (s State) markOperation(t *zfs.Transaction, op string) error {
+	return t.SetProperty(libzfs.OperationInProgressProp, op, s.ID, true)
+}
+
+// clearOperation removes the operation marker from the root dataset of s, once the operation is done.
+func (s State) clearOperation(t *zfs.Transaction) error {
+	return t.SetProperty(libzfs.OperationInProgressProp, "", s.ID, true)
+}
+
+// IncompleteOperations returns the sorted names of datasets still marked with an operation in progress. They were
+// being changed by a clone or a revert which was interrupted, like on a power loss, and can be left with half built
+// states to clean up.
+func (ms *Machines) IncompleteOperations() []string {
+	defer ms.rlock()()
+
+	var datasets []string
+	for _, d := range ms.datasets {
+		if d.OperationInProgress == "" {
+			continue
+		}
+		datasets = append(datasets, d.Name)
+	}
+	sort.Strings(datasets)
+	return datasets
+}
+
+// warnIncompleteOperations logs each dataset left with an operation in progress.
+func (ms *Machines) warnIncompleteOperations(ctx context.Context) {
+	for _, name := range ms.IncompleteOperations() {
+		log.Warningf(ctx, i18n.G("%s was left with an interrupted operation: it may need to be cleaned up"), name)
+	}
+}
@@ -2,11 +2,15 @@ package machines
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -96,6 +100,91 @@ func TestResolveOrigin(t *testing.T) {
 	}
 }
 
+// BenchmarkResolveOrigin resolves origins on a synthetic 5000 datasets pool of long clone chains.
+// Compare sequential and parallel resolution with: go test -run XXX -bench ResolveOrigin -cpu 1,4
+func BenchmarkResolveOrigin(b *testing.B) {
+	config.SetVerboseMode(0)
+	defer func() { config.SetVerboseMode(1) }()
+
+	ds := generateCloneChains(100, 25)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resolveOrigin(context.Background(), ds, "/")
+	}
+}
+
+// BenchmarkResolveOriginDeepChains resolves origins on a synthetic pool of few machines with very deep clone chains,
+// where each chain is shared by many datasets.
+func BenchmarkResolveOriginDeepChains(b *testing.B) {
+	config.SetVerboseMode(0)
+	defer func() { config.SetVerboseMode(1) }()
+
+	ds := generateCloneChains(5, 1000)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resolveOrigin(context.Background(), ds, "/")
+	}
+}
+
+// BenchmarkTriage sorts a synthetic 5000 datasets pool of machines with many snapshots and children datasets.
+// Compare sequential and parallel classification with: go test -run XXX -bench Triage -cpu 1,4
+func BenchmarkTriage(b *testing.B) {
+	config.SetVerboseMode(0)
+	defer func() { config.SetVerboseMode(1) }()
+
+	ds := generateMachinesWithStates(10, 100, 4)
+	origins := resolveOrigin(context.Background(), ds, "/")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ms := Machines{machinesLayout: machinesLayout{all: make(map[string]*Machine)}}
+		if _, _, _, _, err := ms.populate(context.Background(), ds, origins); err != nil {
+			b.Fatalf("populate failed: %v", err)
+		}
+	}
+}
+
+// generateMachinesWithStates returns nMachines machines of nStates states, the current one and its snapshots,
+// each state having nChildren children datasets.
+// Datasets are sorted, as refresh does before triaging them.
+func generateMachinesWithStates(nMachines, nStates, nChildren int) (ds []*zfs.Dataset) {
+	for i := 0; i < nMachines; i++ {
+		root := "rpool/ROOT/ubuntu_" + strconv.Itoa(i)
+		for j := 0; j < nStates; j++ {
+			var suffix string
+			if j > 0 {
+				suffix = "@autozsys_" + strconv.Itoa(j)
+			}
+			ds = append(ds, &zfs.Dataset{Name: root + suffix, IsSnapshot: j > 0,
+				DatasetProp: zfs.DatasetProp{Mountpoint: "/", CanMount: "on"}})
+			for k := 0; k < nChildren; k++ {
+				ds = append(ds, &zfs.Dataset{Name: root + "/child" + strconv.Itoa(k) + suffix, IsSnapshot: j > 0,
+					DatasetProp: zfs.DatasetProp{Mountpoint: "/child" + strconv.Itoa(k), CanMount: "on"}})
+			}
+		}
+	}
+	sort.Sort(sortedDataset(ds))
+	return ds
+}
+
+// generateCloneChains returns nMachines machines, each being a chain of nStates root datasets with one snapshot,
+// any state being a clone of the previous state snapshot.
+func generateCloneChains(nMachines, nStates int) (ds []*zfs.Dataset) {
+	for i := 0; i < nMachines; i++ {
+		var origin string
+		for j := 0; j < nStates; j++ {
+			name := "rpool/ROOT/machine" + strconv.Itoa(i) + "_" + strconv.Itoa(j)
+			ds = append(ds,
+				&zfs.Dataset{Name: name, DatasetProp: zfs.DatasetProp{Mountpoint: "/", CanMount: "noauto", Origin: origin}},
+				&zfs.Dataset{Name: name + "@snap", IsSnapshot: true, DatasetProp: zfs.DatasetProp{Mountpoint: "/", CanMount: "noauto"}})
+			origin = name + "@snap"
+		}
+	}
+	return ds
+}
+
 func TestGetDependencies(t *testing.T) {
 	t.Parallel()
 	type stateWithLinkedState struct {
@@ -564,6 +653,126 @@ func TestSelectStatesToRemove(t *testing.T) {
 	}
 }
 
+func TestParentStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		name string
+
+		want    []string
+		wantErr bool
+	}{
+		"Pool":                     {name: "rpool"},
+		"Root dataset":             {name: "rpool/ROOT/ubuntu_1234", want: []string{"rpool/ROOT", "rpool"}},
+		"Child dataset":            {name: "rpool/ROOT/ubuntu_1234/var/lib", want: []string{"rpool/ROOT/ubuntu_1234/var", "rpool/ROOT/ubuntu_1234", "rpool/ROOT", "rpool"}},
+		"Snapshot":                 {name: "rpool/ROOT/ubuntu_1234/var@snap1", want: []string{"rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT@snap1", "rpool@snap1"}},
+		"Error on multiple @ name": {name: "rpool/ROOT/ubuntu_1234/var@snap1@snap2", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parentStates(zfs.Dataset{Name: tc.name})
+			if tc.wantErr {
+				assert.Error(t, err, "parentStates should have failed")
+				return
+			}
+			assert.NoError(t, err, "parentStates shouldn't have failed")
+			assert.Equal(t, tc.want, got, "Unexpected parent states")
+		})
+	}
+}
+
+func TestBootParametersFromCmdline(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		cmdline string
+
+		wantRoot        string
+		wantRevert      bool
+		wantKernel      string
+		wantSystemdBoot bool
+	}{
+		"GRUB": {cmdline: "BOOT_IMAGE=/vmlinuz-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_1234 ro quiet splash",
+			wantRoot: "rpool/ROOT/ubuntu_1234", wantKernel: "vmlinuz-5.4.0-21-generic"},
+		"GRUB on snapshot with user revert": {cmdline: "BOOT_IMAGE=/BOOT/ubuntu_1234@/vmlinuz-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_1234@snap1 ro quiet splash zsys-revert=userdata",
+			wantRoot: "rpool/ROOT/ubuntu_1234@snap1", wantRevert: true, wantKernel: "vmlinuz-5.4.0-21-generic"},
+		"GRUB with initrd": {cmdline: "BOOT_IMAGE=/vmlinuz-5.4.0-21-generic initrd=/initrd.img-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_1234 ro",
+			wantRoot: "rpool/ROOT/ubuntu_1234", wantKernel: "vmlinuz-5.4.0-21-generic"},
+		"GRUB with dracut root form": {cmdline: "BOOT_IMAGE=/vmlinuz-5.4.0-21-generic root=zfs:rpool/ROOT/ubuntu_1234 ro",
+			wantRoot: "rpool/ROOT/ubuntu_1234", wantKernel: "vmlinuz-5.4.0-21-generic"},
+		"No bootloader information": {cmdline: "aaaaa root=ZFS=rpool/ROOT/ubuntu_1234 bbbbb",
+			wantRoot: "rpool/ROOT/ubuntu_1234"},
+
+		"systemd-boot": {cmdline: "initrd=\\EFI\\ubuntu\\initrd.img-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_1234 rw quiet",
+			wantRoot: "rpool/ROOT/ubuntu_1234", wantKernel: "vmlinuz-5.4.0-21-generic", wantSystemdBoot: true},
+		"systemd-boot with dracut root form": {cmdline: "initrd=\\EFI\\fedora\\initramfs-5.6.8-300.fc32.x86_64.img root=zfs:rpool/ROOT/fedora_1234 rw",
+			wantRoot: "rpool/ROOT/fedora_1234", wantKernel: "vmlinuz-5.6.8-300.fc32.x86_64", wantSystemdBoot: true},
+		"systemd-boot on snapshot with user revert": {cmdline: "initrd=/ubuntu/initrd.img-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_1234@snap1 zsys-revert=userdata",
+			wantRoot: "rpool/ROOT/ubuntu_1234@snap1", wantRevert: true, wantKernel: "vmlinuz-5.4.0-21-generic", wantSystemdBoot: true},
+		"systemd-boot with unknown initrd name": {cmdline: "initrd=\\EFI\\ubuntu\\initrd root=ZFS=rpool/ROOT/ubuntu_1234",
+			wantRoot: "rpool/ROOT/ubuntu_1234", wantSystemdBoot: true},
+
+		"Not a zfs system": {cmdline: "BOOT_IMAGE=/vmlinuz-5.4.0-21-generic root=UUID=e8ae3b4a ro", wantKernel: "vmlinuz-5.4.0-21-generic"},
+		"Empty cmdline":    {},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, isSystemdBoot := parserForCmdline(tc.cmdline).(systemdBootCmdline)
+			assert.Equal(t, tc.wantSystemdBoot, isSystemdBoot, "Unexpected detected bootloader")
+
+			root, revert := bootParametersFromCmdline(tc.cmdline)
+			assert.Equal(t, tc.wantRoot, root, "Unexpected root dataset")
+			assert.Equal(t, tc.wantRevert, revert, "Unexpected user data revert state")
+			assert.Equal(t, tc.wantKernel, kernelFromCmdline(tc.cmdline), "Unexpected kernel")
+		})
+	}
+}
+
+func TestRootDatasetFromCmdline(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		cmdline string
+
+		wantRoot string
+	}{
+		"Simple":                             {cmdline: "ro root=ZFS=rpool/ROOT/ubuntu_1234 quiet", wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Quoted value":                       {cmdline: `ro root=ZFS="rpool/ROOT/ubuntu_1234" quiet`, wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Quoted parameter":                   {cmdline: `ro "root=ZFS=rpool/ROOT/ubuntu_1234" quiet`, wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Quoted value with spaces":           {cmdline: `ro root=ZFS="rpool/ROOT/my ubuntu_1234" quiet`, wantRoot: "rpool/ROOT/my ubuntu_1234"},
+		"Surrounding whitespaces":            {cmdline: "\t ro   root=ZFS=rpool/ROOT/ubuntu_1234 \n", wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Surrounding whitespaces in value":   {cmdline: `root=ZFS=" rpool/ROOT/ubuntu_1234 "`, wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Root after other parameters":        {cmdline: "BOOT_IMAGE=/vmlinuz zsys-revert=userdata ro quiet splash root=ZFS=rpool/ROOT/ubuntu_1234", wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Duplicated root, last wins":         {cmdline: "root=ZFS=rpool/ROOT/ubuntu_1234 ro root=ZFS=rpool/ROOT/ubuntu_5678", wantRoot: "rpool/ROOT/ubuntu_5678"},
+		"Duplicated root, last non zfs wins": {cmdline: "root=ZFS=rpool/ROOT/ubuntu_1234 ro root=UUID=e8ae3b4a"},
+		"Lowercase form":                     {cmdline: "root=zfs=rpool/ROOT/ubuntu_1234", wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Dracut form":                        {cmdline: "root=zfs:rpool/ROOT/ubuntu_1234", wantRoot: "rpool/ROOT/ubuntu_1234"},
+		"Dracut auto form":                   {cmdline: "root=zfs:AUTO", wantRoot: "AUTO"},
+		"Auto form":                          {cmdline: "root=ZFS=auto", wantRoot: "AUTO"},
+		"Snapshot":                           {cmdline: `root=ZFS="rpool/ROOT/ubuntu_1234@snap1"`, wantRoot: "rpool/ROOT/ubuntu_1234@snap1"},
+
+		"Not a zfs root":      {cmdline: "root=/dev/sda1 ro"},
+		"Unbalanced quotes":   {cmdline: `root=ZFS="rpool/ROOT/ubuntu_1234 ro`, wantRoot: "rpool/ROOT/ubuntu_1234 ro"},
+		"Empty zfs root":      {cmdline: "root=ZFS= ro"},
+		"Empty cmdline":       {},
+		"Similar prefix only": {cmdline: "myroot=ZFS=rpool/ROOT/ubuntu_1234"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.wantRoot, rootDatasetFromCmdline(tc.cmdline), "Unexpected root dataset")
+		})
+	}
+}
+
 func assertStatesToKeepMatch(t *testing.T, want []string, got []*State) {
 	var gotIDs []string
 
@@ -580,7 +789,7 @@ func assertStatesToKeepMatch(t *testing.T, want []string, got []*State) {
 // assertDatasetsOrigin compares got maps of origin to reference files, based on test name.
 func assertDatasetsOrigin(t *testing.T, got map[string]*string) {
 	want := make(map[string]*string)
-	testutils.LoadFromGoldenFile(t, got, &want)
+	testutils.LoadFromGoldenFile(t, &got, &want)
 
 	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
 		t.Errorf("Dataset origin mismatch (-want +got):\n%s", diff)
@@ -593,7 +802,7 @@ func assertMachinesToGolden(t *testing.T, got Machines) {
 
 	want := Machines{}
 	got.MakeComparable()
-	testutils.LoadFromGoldenFile(t, got, &want)
+	testutils.LoadFromGoldenFile(t, &got, &want)
 
 	assertMachinesEquals(t, want, got)
 }
@@ -606,7 +815,8 @@ func assertMachinesEquals(t *testing.T, m1, m2 Machines) {
 	m2.MakeComparable()
 
 	if diff := cmp.Diff(m1, m2, cmpopts.EquateEmpty(),
-		cmp.AllowUnexported(Machines{}),
+		cmp.AllowUnexported(Machines{}, machinesLayout{}), cmpopts.IgnoreFields(Machines{}, "machinesSettings"),
+		cmpopts.IgnoreFields(machinesLayout{}, "datasets"),
 		cmpopts.IgnoreUnexported(zfs.Dataset{}, zfs.DatasetProp{})); diff != "" {
 		t.Errorf("Machines mismatch (-want +got):\n%s", diff)
 	}
@@ -741,3 +951,275 @@ foundState:
 	}
 	return s
 }
+
+func TestFormatSize(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		size uint64
+
+		want string
+	}{
+		"Zero":           {size: 0, want: "0 B"},
+		"Bytes":          {size: 1023, want: "1023 B"},
+		"Exactly 1 KiB":  {size: 1024, want: "1.0 KiB"},
+		"Rounded MiB":    {size: 1572864, want: "1.5 MiB"},
+		"GiB":            {size: 5 * 1024 * 1024 * 1024, want: "5.0 GiB"},
+		"Biggest values": {size: ^uint64(0), want: "16.0 EiB"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.want, formatSize(tc.size), "Unexpected formatted size")
+		})
+	}
+}
+
+func TestAppendDatasetIfNotPresent(t *testing.T) {
+	t.Parallel()
+	newDataset := func(name, canMount string) *zfs.Dataset {
+		return &zfs.Dataset{Name: name, DatasetProp: zfs.DatasetProp{CanMount: canMount}}
+	}
+	main := []*zfs.Dataset{newDataset("rpool/ROOT/ubuntu_1234", "on"), newDataset("bpool/BOOT/ubuntu_1234", "noauto")}
+	news := []*zfs.Dataset{
+		newDataset("bpool/BOOT", "off"),
+		newDataset("bpool/BOOT/ubuntu_1234", "noauto"),
+		newDataset("bpool/BOOT/ubuntu_5678", "noauto"),
+		newDataset("bpool/BOOT/ubuntu_5678/grub", "on"),
+	}
+
+	tests := map[string]struct {
+		main   []*zfs.Dataset
+		policy canMountOffPolicy
+
+		want []string
+	}{
+		"Include canmount off datasets": {main: main, policy: includeCanMountOff,
+			want: []string{"rpool/ROOT/ubuntu_1234", "bpool/BOOT/ubuntu_1234", "bpool/BOOT", "bpool/BOOT/ubuntu_5678", "bpool/BOOT/ubuntu_5678/grub"}},
+		"Exclude canmount off datasets": {main: main, policy: excludeCanMountOff,
+			want: []string{"rpool/ROOT/ubuntu_1234", "bpool/BOOT/ubuntu_1234", "bpool/BOOT/ubuntu_5678", "bpool/BOOT/ubuntu_5678/grub"}},
+		"Append to empty list": {policy: excludeCanMountOff,
+			want: []string{"bpool/BOOT/ubuntu_1234", "bpool/BOOT/ubuntu_5678", "bpool/BOOT/ubuntu_5678/grub"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			mainDatasets := append([]*zfs.Dataset(nil), tc.main...)
+			got := appendDatasetIfNotPresent(mainDatasets, news, tc.policy)
+
+			var gotNames []string
+			for _, d := range got {
+				gotNames = append(gotNames, d.Name)
+			}
+			assert.Equal(t, tc.want, gotNames, "Unexpected appended datasets")
+			for _, d := range news {
+				if d.Name == "bpool/BOOT" {
+					assert.Equal(t, "off", d.CanMount, "canmount of appended datasets shouldn't change")
+				}
+			}
+		})
+	}
+}
+
+func TestPersistentDatasetsSize(t *testing.T) {
+	t.Parallel()
+	srv := &zfs.Dataset{Name: "rpool/srv", DatasetProp: zfs.DatasetProp{UsedByDataset: 50, UsedBySnapshots: 5}}
+	tests := map[string]struct {
+		persistents []*zfs.Dataset
+
+		want uint64
+	}{
+		"No persistent dataset":             {},
+		"Filesystem includes its snapshots": {persistents: []*zfs.Dataset{srv}, want: 55},
+		"Datasets are summed once": {persistents: []*zfs.Dataset{srv, srv,
+			{Name: "rpool/srv/data", DatasetProp: zfs.DatasetProp{UsedByDataset: 7}}}, want: 62},
+		"Snapshots are accounted in their filesystem": {persistents: []*zfs.Dataset{srv,
+			{Name: "rpool/srv@snap1", IsSnapshot: true, DatasetProp: zfs.DatasetProp{UsedByDataset: 5}}}, want: 55},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ms := Machines{machinesLayout: machinesLayout{allPersistentDatasets: tc.persistents}}
+			assert.Equal(t, tc.want, ms.PersistentDatasetsSize(), "Unexpected persistent datasets size")
+		})
+	}
+}
+
+func TestUserFromDatasetName(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		name string
+
+		want string
+	}{
+		"Simple user":                              {name: "rpool/USERDATA/user1_abc123", want: "user1"},
+		"User with digits":                         {name: "rpool/USERDATA/user123_abc123", want: "user123"},
+		"User with underscores":                    {name: "rpool/USERDATA/john_doe_abc123", want: "john_doe"},
+		"User starting with underscore":            {name: "rpool/USERDATA/_apt_abc123", want: "_apt"},
+		"Snapshot of user with underscores":        {name: "rpool/USERDATA/john_doe_abc123@snap_1", want: "john_doe"},
+		"User without id":                          {name: "rpool/USERDATA/user123", want: "user123"},
+		"User starting with underscore without id": {name: "rpool/USERDATA/_apt", want: "_apt"},
+		"Snapshot of user without id":              {name: "rpool/USERDATA/_apt@snap", want: "_apt"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.want, userFromDatasetName(tc.name), "Unexpected user name")
+		})
+	}
+}
+
+func TestClassifyZFSError(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		err error
+
+		want error
+	}{
+		"Permission denied":          {err: errors.New("can't list datasets: permission denied"), want: ErrPermission},
+		"Operation not permitted":    {err: errors.New("Operation not permitted"), want: ErrPermission},
+		"Wrapped os permission":      {err: fmt.Errorf("couldn't open: %w", os.ErrPermission), want: ErrPermission},
+		"Busy dataset":               {err: errors.New("can't remove rpool/ROOT/ubuntu_1234@snap1: dataset is busy"), want: ErrPoolBusy},
+		"Wrapped EBUSY":              {err: fmt.Errorf("couldn't export: %w", syscall.EBUSY), want: ErrPoolBusy},
+		"No zfs device":              {err: errors.New("/dev/zfs and /proc/self/mounts are required"), want: ErrNoZFS},
+		"Failed libzfs init":         {err: errors.New("Failed to initialize the libzfs library"), want: ErrNoZFS},
+		"Already classified is kept": {err: withKind(ErrNoZFS, errors.New("permission denied")), want: ErrNoZFS},
+
+		"Other error is unchanged": {err: errors.New("something else")},
+		"No error":                 {},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := classifyZFSError(tc.err)
+			if tc.err == nil {
+				assert.NoError(t, got, "No error should stay nil")
+				return
+			}
+			assert.Equal(t, tc.err.Error(), got.Error(), "Classifying shouldn't change the error message")
+			assert.True(t, errors.Is(got, tc.err), "Original error should still be matched")
+			for _, kind := range []error{ErrNoZFS, ErrPermission, ErrPoolBusy} {
+				assert.Equal(t, kind == tc.want, errors.Is(got, kind), "Unexpected match of %v", kind)
+			}
+		})
+	}
+}
+
+func TestKernelsForState(t *testing.T) {
+	tests := map[string]struct {
+		def   string
+		state string
+		// files are created in the dataset when mounted
+		files      []string
+		errOnMount bool
+
+		wantMounted string
+		wantKernels []string
+		wantErr     bool
+	}{
+		"Kernels with initrd on separate boot dataset": {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_5678",
+			files:       []string{"vmlinuz-5.4.0-1-generic", "initrd.img-5.4.0-1-generic", "vmlinuz-5.3.0-1-generic", "initrd.img-5.2.0-1-generic", "config-5.4.0-1-generic"},
+			wantMounted: "bpool/BOOT/ubuntu_5678", wantKernels: []string{"vmlinuz-5.4.0-1-generic"}},
+		"Multiple kernels are sorted": {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_1234",
+			files:       []string{"vmlinuz-5.4.0-2-generic", "initrd.img-5.4.0-2-generic", "vmlinuz-5.4.0-1-generic", "initrd-5.4.0-1-generic"},
+			wantMounted: "bpool/BOOT/ubuntu_1234", wantKernels: []string{"vmlinuz-5.4.0-1-generic", "vmlinuz-5.4.0-2-generic"}},
+		"Kernels of a snapshot state": {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_1234@snap1",
+			files:       []string{"vmlinuz-5.4.0-1-generic", "initrd.img-5.4.0-1-generic"},
+			wantMounted: "bpool/BOOT/ubuntu_1234@snap1", wantKernels: []string{"vmlinuz-5.4.0-1-generic"}},
+		"Kernels in boot directory of root dataset": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678",
+			files:       []string{"boot/vmlinuz-5.4.0-1-generic", "boot/initrd.img-5.4.0-1-generic", "vmlinuz-5.3.0-1-generic", "initrd.img-5.3.0-1-generic"},
+			wantMounted: "rpool/ROOT/ubuntu_5678", wantKernels: []string{"vmlinuz-5.4.0-1-generic"}},
+		"No kernel": {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_5678",
+			files: []string{"initrd.img-5.4.0-1-generic"}, wantMounted: "bpool/BOOT/ubuntu_5678"},
+
+		"Error on unknown state":    {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/doesntexist", wantErr: true},
+		"Error on mount failure":    {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_5678", errOnMount: true, wantErr: true},
+		"Error on missing boot dir": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678", wantMounted: "rpool/ROOT/ubuntu_5678", wantErr: true},
+	}
+
+	// Mount calls are replaced for all tests, which thus can't run in parallel.
+	origMount, origUnmount := mountReadOnly, unmount
+	defer func() { mountReadOnly, unmount = origMount, origUnmount }()
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			var mounted string
+			mountReadOnly = func(dataset, dir string) error {
+				if tc.errOnMount {
+					return errors.New("mount failure requested")
+				}
+				mounted = dataset
+				for _, f := range tc.files {
+					p := filepath.Join(dir, f)
+					if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+						t.Fatalf("couldn't create %s: %v", filepath.Dir(p), err)
+					}
+					if err := os.WriteFile(p, nil, 0644); err != nil {
+						t.Fatalf("couldn't create %s: %v", p, err)
+					}
+				}
+				return nil
+			}
+			var unmounted string
+			unmount = func(dir string) error {
+				unmounted = dir
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			ms, err := New(context.Background(), "", WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			kernels, err := ms.KernelsForState(context.Background(), tc.state)
+			assert.Equal(t, tc.wantMounted, mounted, "Unexpected mounted dataset")
+			if tc.wantMounted != "" {
+				assert.NotEmpty(t, unmounted, "Mounted dataset should be unmounted")
+				_, errStat := os.Stat(unmounted)
+				assert.True(t, os.IsNotExist(errStat), "Temporary mountpoint should be removed")
+			}
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantKernels, kernels, "Unexpected kernels")
+		})
+	}
+}
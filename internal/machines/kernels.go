@@ -0,0 +1,145 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+const (
+	kernelFilePrefix = "vmlinuz-"
+	bootMountDir     = "/boot"
+)
+
+// initrdPrefixes are the names an initrd of a kernel version can have.
+var initrdPrefixes = []string{"initrd.img-", "initrd-"}
+
+// mountReadOnly and unmount are the system calls used to access boot datasets which aren't mounted.
+var (
+	mountReadOnly = func(dataset, dir string) error {
+		return syscall.Mount(dataset, dir, "zfs", syscall.MS_RDONLY, "zfsutil")
+	}
+	unmount = func(dir string) error {
+		return syscall.Unmount(dir, 0)
+	}
+)
+
+// KernelsForState returns the kernels, as vmlinuz-<version>, having an initrd in the boot directory of state id,
+// sorted by name. They are the kernels which can be booted from this state.
+// The boot directory is read from the boot dataset of the state, or from its root dataset if /boot isn't a separate
+// dataset. Datasets which aren't mounted, like ones of history states or snapshots, are temporarily mounted read only.
+func (ms *Machines) KernelsForState(ctx context.Context, id string) ([]string, error) {
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return nil, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+
+	d, subdir := s.bootDirDataset()
+	if d == nil {
+		return nil, fmt.Errorf(i18n.G("no boot directory found for %s"), s.ID)
+	}
+
+	dir, cleanup, err := accessDataset(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	return kernelsInDir(ctx, filepath.Join(dir, subdir))
+}
+
+// bootDirDataset returns the dataset of s holding the boot directory, with the path of the directory in it.
+func (s State) bootDirDataset() (*zfs.Dataset, string) {
+	var root *zfs.Dataset
+	for _, route := range sortedRoutes(s.Datasets) {
+		for _, d := range s.Datasets[route] {
+			switch triageMountpoint(*d) {
+			case bootMountDir:
+				return d, "."
+			case "/":
+				if root == nil {
+					root = d
+				}
+			}
+		}
+	}
+	if root == nil {
+		return nil, ""
+	}
+	return root, strings.TrimPrefix(bootMountDir, "/")
+}
+
+// accessDataset returns the directory where d content can be read. If d isn't mounted, it's mounted read only on a
+// temporary directory, until cleanup is called.
+func accessDataset(ctx context.Context, d *zfs.Dataset) (dir string, cleanup func(), err error) {
+	if d.Mounted && !d.IsSnapshot {
+		return d.Mountpoint, func() {}, nil
+	}
+
+	dir, err = ioutil.TempDir("", "zsys-boot-")
+	if err != nil {
+		return "", nil, fmt.Errorf(i18n.G("couldn't create temporary mountpoint for %s: %v"), d.Name, err)
+	}
+	log.Debugf(ctx, i18n.G("Mounting %s read only on %s"), d.Name, dir)
+	if err := mountReadOnly(d.Name, dir); err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf(i18n.G("couldn't mount %s: %v"), d.Name, err)
+	}
+
+	return dir, func() {
+		if err := unmount(dir); err != nil {
+			log.Warningf(ctx, i18n.G("Couldn't unmount %s: %v"), dir, err)
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			log.Warningf(ctx, i18n.G("couldn't cleanup %s directory: %v"), dir, err)
+		}
+	}, nil
+}
+
+// kernelsInDir returns the kernels of dir with a matching initrd, sorted by name.
+func kernelsInDir(ctx context.Context, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf(i18n.G("couldn't list %s directory content: %v"), dir, err)
+	}
+
+	files := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		files[e.Name()] = true
+	}
+
+	var kernels []string
+	for f := range files {
+		if !strings.HasPrefix(f, kernelFilePrefix) {
+			continue
+		}
+		version := strings.TrimPrefix(f, kernelFilePrefix)
+		var hasInitrd bool
+		for _, p := range initrdPrefixes {
+			if files[p+version] {
+				hasInitrd = true
+				break
+			}
+		}
+		if !hasInitrd {
+			log.Debugf(ctx, i18n.G("Ignoring %s without any initrd"), f)
+			continue
+		}
+		kernels = append(kernels, f)
+	}
+	sort.Strings(kernels)
+	return kernels, nil
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -22,9 +23,58 @@ import (
 
 // Machines hold a zfs system states, with a map of main root system dataset name to a given Machine,
 // current machine and nextState if an upgrade has been proceeded.
+//
+// Accessors (CurrentMachine, CurrentState, NextState, GetMachine, GetStateByID, Machines…) can be called
+// concurrently with Refresh, RefreshDataset or ReloadProperties: they either see the machines structure before or
+// after the change, never a partially updated one. Operations changing the system state must still be serialized by
+// the caller, and with readers. Returned machines and states are replaced, not updated in place,
+// on refresh, apart from their last used time.
 type Machines struct {
+	// machines structure, replaced as a whole on each refresh
+	machinesLayout
+	// settings from options, kept as is on each refresh
+	machinesSettings
+
+	cmdline string
+
+	z    *zfs.Zfs
+	conf config.ZConfig
+	time Nower
+
+	// mu protects the machines structure, replaced on each refresh, against concurrent readers.
+	// It's a pointer so that it's shared by every copy of Machines, and is never replaced.
+	mu *sync.RWMutex
+}
+
+// machinesSettings are the Machines settings given as options on creation.
+type machinesSettings struct {
+	hooks    EventHooks
+	gcPolicy GCPolicy
+	// record how each dataset was sorted on refresh
+	triageReport bool
+
+	// datasets matching any of those patterns, or with an ancestor matching them, are excluded from machines
+	ignoreDatasets []string
+	// naming scheme of automatic snapshots
+	snapshotNaming SnapshotNaming
+	// old user names mapped to their new name, to group user states of renamed users
+	renamedUsers map[string]string
+	// reports progress of long running operations
+	progress progressReporter
+
+	// zfs operations planned instead of being run, in dry run mode only
+	plan *zfs.Plan
+	// refuses any operation changing the system
+	readOnly bool
+	// role of each container name, in lower case
+	containers map[string]ContainerRole
+}
+
+// machinesLayout is the machines structure built from the datasets on each refresh.
+type machinesLayout struct {
+	// every dataset scanned, including ignored ones, so that readers don't access the zfs cache being rescanned
+	datasets              []*zfs.Dataset
 	all                   map[string]*Machine
-	cmdline               string
 	current               *Machine
 	nextState             *State
 	allSystemDatasets     []*zfs.Dataset
@@ -32,10 +82,12 @@ type Machines struct {
 	allPersistentDatasets []*zfs.Dataset
 	// cantmount noauto or off datasets, which are not system, users or persistent
 	unmanagedDatasets []*zfs.Dataset
-
-	z    *zfs.Zfs
-	conf config.ZConfig
-	time Nower
+	// unmanaged clones which couldn't be attached to any machine, with the reason why
+	orphanDatasets []orphanDataset
+	// system and boot datasets which couldn't be attached to any machine state, with the reason why
+	unattachedSystemDatasets []unattachedDataset
+	// how each dataset was sorted on last refresh, only recorded if triageReport is set
+	triage []TriageDecision
 }
 
 // Machine is a group of Main and its History children states
@@ -52,6 +104,9 @@ type Machine struct {
 	// PersistentDatasets are all datasets that are canmount=on and and not in ROOT, USERDATA or BOOT dataset containers.
 	// Those are common between all machines, as persistent (and detected without snapshot information)
 	PersistentDatasets []*zfs.Dataset `json:",omitempty"`
+	// SwapDatasets are the swap volumes of this machine, sorted by name. Volumes which aren't under any of its system
+	// datasets are shared by all machines of the same pool.
+	SwapDatasets []*zfs.Dataset `json:",omitempty"`
 }
 
 // State is a finite regroupement of multiple ID and elements corresponding to a bootable machine instance.
@@ -65,12 +120,17 @@ type State struct {
 	Datasets map[string][]*zfs.Dataset `json:",omitempty"`
 	// Users are all users states that are depending of that system state
 	Users map[string]*State `json:",omitempty"`
+	// Bookmarks are all bookmarks of the filesystem datasets of this State, sorted by name.
+	Bookmarks []*zfs.Dataset `json:",omitempty"`
+	// Holds are the hold tags on any dataset of this State, sorted. Held states can't be destroyed.
+	Holds []string `json:",omitempty"`
 }
 
 const (
-	userdatasetsContainerName = "/userdata/"
-	bootdatasetsContainerName = "/boot/"
-	bootfsdatasetsSeparator   = ","
+	systemdatasetsContainerName = "/root/"
+	userdatasetsContainerName   = "/userdata/"
+	bootdatasetsContainerName   = "/boot/"
+	bootfsdatasetsSeparator     = ","
 )
 
 // WithLibZFS allows overriding default libzfs implementations with a mock
@@ -92,10 +152,66 @@ func WithConfig(path string) func(o *options) error {
 	}
 }
 
+// WithCmdline overrides the kernel command line New is called with, to detect current machine and state.
+func WithCmdline(cmdline string) func(o *options) error {
+	return func(o *options) error {
+		o.cmdline = &cmdline
+		return nil
+	}
+}
+
+// WithStrictLayout makes New fail on layouts which are almost always a misconfiguration, like multiple main root
+// datasets on the same pool, instead of creating independent machines.
+func WithStrictLayout() func(o *options) error {
+	return func(o *options) error {
+		o.strictLayout = true
+		return nil
+	}
+}
+
+// WithIgnoreDatasets excludes datasets matching any of the glob patterns, and their descendants, from machines. They
+// are neither attached to any machine nor reported as orphans.
+func WithIgnoreDatasets(patterns []string) func(o *options) error {
+	return func(o *options) error {
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf(i18n.G("invalid pattern %q to ignore datasets: %v"), p, err)
+			}
+		}
+		o.ignoreDatasets = patterns
+		return nil
+	}
+}
+
+// WithPools limits machines to datasets of the named pools, other imported pools being ignored. This avoids scanning
+// and surfacing machines of external or backup pools.
+// Origins are only resolved, and datasets triaged, within those pools. zfs clones always share the pool of their origin,
+// but datasets only related by name to another pool, like boot datasets on a separate boot pool, are only attached
+// to their state if that pool is selected too.
+func WithPools(pools []string) func(o *options) error {
+	return func(o *options) error {
+		o.pools = pools
+		return nil
+	}
+}
+
 type options struct {
-	configPath string
-	libzfs     libzfs.Interface
-	time       Nower
+	configPath     string
+	libzfs         libzfs.Interface
+	time           Nower
+	cmdline        *string
+	strictLayout   bool
+	hooks          EventHooks
+	triageReport   bool
+	gcPolicy       GCPolicy
+	ignoreDatasets []string
+	snapshotNaming SnapshotNaming
+	pools          []string
+	progress       Progress
+	dryRun         bool
+	renamedUsers   map[string]string
+	readOnly       bool
+	containers     map[string]ContainerRole
 }
 
 type option func(*options) error
@@ -114,20 +230,71 @@ func (timeAdapter) Now() time.Time {
 // New detects and generate machines elems
 func New(ctx context.Context, cmdline string, opts ...option) (Machines, error) {
 	log.Info(ctx, i18n.G("Building new machines list"))
+	args, err := applyOptions(opts)
+	if err != nil {
+		return Machines{}, err
+	}
+
+	zfsOpts := []func(*zfs.Zfs){zfs.WithLibZFS(args.libzfs)}
+	if len(args.pools) > 0 {
+		zfsOpts = append(zfsOpts, zfs.WithPools(args.pools))
+	}
+	var plan *zfs.Plan
+	if args.dryRun {
+		plan = &zfs.Plan{}
+		zfsOpts = append(zfsOpts, zfs.WithDryRun(plan))
+	}
+	if args.readOnly {
+		zfsOpts = append(zfsOpts, zfs.WithReadOnly())
+	}
+	z, err := zfs.New(ctx, zfsOpts...)
+	if err != nil {
+		return Machines{}, classifyZFSError(fmt.Errorf(i18n.G("couldn't scan zfs filesystem: %w"), err))
+	}
+
+	return newFromZfs(ctx, cmdline, z, plan, args)
+}
+
+// NewFromDatasets detects all machines from datasets, as a given layout, without scanning zfs.
+// Datasets are taken as is: the machines can be queried, but any operation needing zfs fails.
+// Options are the same than New ones, a libzfs implementation being ignored.
+func NewFromDatasets(ctx context.Context, cmdline string, datasets []zfs.Dataset, opts ...option) (Machines, error) {
+	log.Info(ctx, i18n.G("Building machines list from datasets"))
+	args, err := applyOptions(opts)
+	if err != nil {
+		return Machines{}, err
+	}
+
+	z, err := zfs.NewFromDatasets(ctx, datasets)
+	if err != nil {
+		return Machines{}, fmt.Errorf(i18n.G("couldn't load datasets: %v"), err)
+	}
+
+	return newFromZfs(ctx, cmdline, z, nil, args)
+}
+
+// applyOptions returns default options, overridden by opts.
+func applyOptions(opts []option) (options, error) {
 	args := options{
-		configPath: config.DefaultPath,
-		libzfs:     &libzfs.Adapter{},
-		time:       timeAdapter{},
+		configPath:     config.DefaultPath,
+		libzfs:         &libzfs.Adapter{},
+		time:           timeAdapter{},
+		gcPolicy:       defaultGCPolicy,
+		snapshotNaming: defaultSnapshotNaming,
+		containers:     defaultContainers,
 	}
 	for _, o := range opts {
 		if err := o(&args); err != nil {
-			return Machines{}, fmt.Errorf(i18n.G("Couldn't apply option to server: %v"), err)
+			return options{}, fmt.Errorf(i18n.G("Couldn't apply option to server: %v"), err)
 		}
 	}
+	return args, nil
+}
 
-	z, err := zfs.New(ctx, zfs.WithLibZFS(args.libzfs))
-	if err != nil {
-		return Machines{}, fmt.Errorf(i18n.G("couldn't scan zfs filesystem"), err)
+// newFromZfs detects all machines from z datasets. plan is the list of operations planned by z, if it's a dry run.
+func newFromZfs(ctx context.Context, cmdline string, z *zfs.Zfs, plan *zfs.Plan, args options) (Machines, error) {
+	if args.cmdline != nil {
+		cmdline = *args.cmdline
 	}
 
 	conf, err := config.Load(ctx, args.configPath)
@@ -136,44 +303,282 @@ func New(ctx context.Context, cmdline string, opts ...option) (Machines, error)
 	}
 
 	machines := Machines{
-		all:     make(map[string]*Machine),
+		machinesLayout: machinesLayout{all: make(map[string]*Machine)},
+		machinesSettings: machinesSettings{
+			hooks:          args.hooks,
+			gcPolicy:       args.gcPolicy,
+			triageReport:   args.triageReport,
+			ignoreDatasets: args.ignoreDatasets,
+			snapshotNaming: args.snapshotNaming,
+			renamedUsers:   args.renamedUsers,
+			progress:       newProgressReporter(args.progress),
+			plan:           plan,
+			readOnly:       args.readOnly,
+			containers:     args.containers,
+		},
 		cmdline: cmdline,
 		z:       z,
 		conf:    conf,
 		time:    args.time,
+		mu:      &sync.RWMutex{},
+	}
+	// Hooks integrate with the system, which a dry run shouldn't change.
+	if plan != nil {
+		machines.hooks = EventHooks{}
+	}
+	if err := machines.refresh(ctx); err != nil {
+		return Machines{}, fmt.Errorf(i18n.G("couldn't build machines list: %w"), err)
+	}
+	machines.warnIncompleteOperations(ctx)
+
+	if args.strictLayout {
+		if errs := machines.duplicateMainRoots(); errs != nil {
+			var msgs []string
+			for _, e := range errs {
+				msgs = append(msgs, e.Error())
+			}
+			return Machines{}, fmt.Errorf(i18n.G("invalid machines layout:\n%s"), strings.Join(msgs, "\n"))
+		}
 	}
-	machines.refresh(ctx)
+
 	return machines, nil
 }
 
-// Refresh reloads the list of machines after rescanning zfs datasets state from system
+// SetCmdline changes the kernel command line and detects again the current machine, without rescanning datasets.
+// An error is returned if cmdline boots on a zfs dataset not matching any machine, and nothing is changed.
+func (ms *Machines) SetCmdline(ctx context.Context, cmdline string) error {
+	root, _ := bootParametersFromCmdline(cmdline)
+	m, _ := ms.findFromRoot(root)
+	if root != "" && m == nil {
+		return fmt.Errorf(i18n.G("no machine matches root dataset %q"), root)
+	}
+
+	log.Debugf(ctx, i18n.G("Changing command line to %q"), cmdline)
+	unlock := ms.lock()
+	defer unlock()
+	ms.cmdline = cmdline
+	ms.current = m
+	return nil
+}
+
+// Refresh reloads the list of machines after rescanning zfs datasets state from system.
+// Cancelling ctx stops the rescan early with ctx.Err(), and machines are left unchanged.
+// In a dry run, zfs isn't rescanned, so that planned changes are kept: see ResetDryRun.
 func (ms *Machines) Refresh(ctx context.Context) error {
+	if ms.plan != nil {
+		return ms.refresh(ctx)
+	}
 	if err := ms.z.Refresh(ctx); err != nil {
+		return classifyZFSError(err)
+	}
+
+	return ms.refresh(ctx)
+}
+
+// RefreshDataset reloads only the dataset name and its descendants from zfs.
+// If only properties which don't change the machines layout were modified, affected states are updated in place.
+// Otherwise (datasets created or removed, like a new snapshot, or modified origin, mountpoint, canmount, bootfs or
+// bootfs datasets properties), the machines layout is rebuilt from the zfs cache, without rescanning any other
+// dataset.
+// If name can't be reloaded, we fall back to a full Refresh.
+func (ms *Machines) RefreshDataset(ctx context.Context, name string) error {
+	layoutBefore := make(map[*zfs.Dataset]datasetLayout)
+	for _, d := range ms.filterIgnoredDatasets(ctx, ms.z.Datasets()) {
+		if !isDatasetOrDescendant(name, d.Name) {
+			continue
+		}
+		layoutBefore[d] = layoutFromDataset(*d)
+	}
+
+	// Cached datasets are updated in place: keep readers out meanwhile.
+	unlock := ms.lock()
+	sameDatasets, err := ms.z.RefreshDataset(ctx, name)
+	if err != nil {
+		unlock()
+		log.Infof(ctx, i18n.G("couldn't refresh %q only, refreshing every datasets: %v"), name, err)
+		return ms.Refresh(ctx)
+	}
+
+	layoutChanged := !sameDatasets
+	for d, l := range layoutBefore {
+		if l != layoutFromDataset(*d) {
+			layoutChanged = true
+			break
+		}
+	}
+	if layoutChanged {
+		unlock()
+		log.Debugf(ctx, i18n.G("machines layout changed after refreshing %q"), name)
+		return ms.refresh(ctx)
+	}
+
+	defer unlock()
+	for s := range ms.getAllStatesOnMachines() {
+		if !isDatasetOrDescendant(name, s.ID) {
+			continue
+		}
+		s.refreshLastUsed()
+	}
+	for _, m := range ms.all {
+		for _, uss := range m.AllUsersStates {
+			for _, us := range uss {
+				if !isDatasetOrDescendant(name, us.ID) {
+					continue
+				}
+				us.refreshLastUsed()
+			}
+		}
+	}
+
+	return nil
+}
+
+// rlock takes a read lock on the machines structure and returns the function releasing it.
+// Machines not created by New, like imported ones, aren't protected.
+func (ms *Machines) rlock() func() {
+	if ms.mu == nil {
+		return func() {}
+	}
+	ms.mu.RLock()
+	return ms.mu.RUnlock
+}
+
+// lock takes a write lock on the machines structure and returns the function releasing it.
+func (ms *Machines) lock() func() {
+	if ms.mu == nil {
+		return func() {}
+	}
+	ms.mu.Lock()
+	return ms.mu.Unlock
+}
+
+// filterIgnoredDatasets returns datasets without the ones matching, or with an ancestor matching, an ignore pattern.
+func (ms *Machines) filterIgnoredDatasets(ctx context.Context, datasets []*zfs.Dataset) []*zfs.Dataset {
+	if len(ms.ignoreDatasets) == 0 {
+		return datasets
+	}
+
+	r := make([]*zfs.Dataset, 0, len(datasets))
+nextDataset:
+	for _, d := range datasets {
+		base, _ := splitSnapshotName(d.Name)
+		for n := base; n != "." && n != "/"; n = filepath.Dir(n) {
+			for _, p := range ms.ignoreDatasets {
+				// Patterns are validated when creating machines.
+				if ok, _ := filepath.Match(p, n); ok {
+					log.Debugf(ctx, i18n.G("Ignoring dataset %q: %q matches %q"), d.Name, n, p)
+					continue nextDataset
+				}
+			}
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+// ReloadProperties rereads only the properties of datasetName from zfs, like after setting a single property on it.
+// The dataset is updated in place: every state referencing it, in any machine, sees the new values. It's cheaper than
+// RefreshDataset as neither its children nor its snapshots are reloaded.
+// If a property the machines layout depends on changed (origin, mountpoint, canmount, bootfs or bootfs datasets),
+// the machines layout is rebuilt from the zfs cache, without rescanning any other dataset.
+func (ms *Machines) ReloadProperties(ctx context.Context, datasetName string) error {
+	var d *zfs.Dataset
+	for _, candidate := range ms.z.Datasets() {
+		if candidate.Name == datasetName {
+			d = candidate
+			break
+		}
+	}
+	if d == nil {
+		return fmt.Errorf(i18n.G("no dataset %q to reload properties of"), datasetName)
+	}
+	layoutBefore := layoutFromDataset(*d)
+
+	// d is updated in place: keep readers out meanwhile.
+	unlock := ms.lock()
+	if err := ms.z.ReloadProperties(ctx, datasetName); err != nil {
+		unlock()
 		return err
 	}
 
-	ms.refresh(ctx)
+	if layoutFromDataset(*d) != layoutBefore {
+		unlock()
+		log.Debugf(ctx, i18n.G("machines layout changed after reloading properties of %q"), datasetName)
+		return ms.refresh(ctx)
+	}
+
+	defer unlock()
+	for _, s := range ms.allStates() {
+		if s.rootDataset() == d {
+			s.refreshLastUsed()
+		}
+	}
 	return nil
 }
 
-// refresh reloads the list of machines, based on already loaded zfs datasets state
-func (ms *Machines) refresh(ctx context.Context) {
+// datasetLayout are the dataset properties used to build the machines layout.
+type datasetLayout struct {
+	origin         string
+	mountpoint     string
+	canMount       string
+	bootFS         bool
+	bootfsDatasets string
+}
+
+func layoutFromDataset(d zfs.Dataset) datasetLayout {
+	return datasetLayout{
+		origin:         d.Origin,
+		mountpoint:     d.Mountpoint,
+		canMount:       d.CanMount,
+		bootFS:         d.BootFS,
+		bootfsDatasets: d.BootfsDatasets,
+	}
+}
+
+// refreshLastUsed sets state LastUsed from its root dataset.
+func (s *State) refreshLastUsed() {
+	d := s.rootDataset()
+	if d == nil {
+		return
+	}
+	s.LastUsed = lastUsedTime(d.LastUsed)
+}
+
+// lastUsedTime converts a dataset last used property, in seconds since epoch, to a time. Datasets never used, without
+// any property, have a zero time rather than the epoch.
+func lastUsedTime(lastUsed int) time.Time {
+	if lastUsed == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(lastUsed), 0)
+}
+
+// refresh reloads the list of machines, based on already loaded zfs datasets state.
+// If ctx is cancelled meanwhile, it returns ctx.Err() and machines are left unchanged.
+func (ms *Machines) refresh(ctx context.Context) error {
 	machines := Machines{
-		all:     make(map[string]*Machine),
-		cmdline: ms.cmdline,
-		z:       ms.z,
-		conf:    ms.conf,
-		time:    ms.time,
+		machinesLayout:   machinesLayout{all: make(map[string]*Machine)},
+		machinesSettings: ms.machinesSettings,
+		cmdline:          ms.cmdline,
+		z:                ms.z,
+		conf:             ms.conf,
+		time:             ms.time,
+		mu:               ms.mu,
 	}
 
-	datasets := machines.z.Datasets()
+	machines.datasets = machines.z.Datasets()
+	datasets := machines.filterIgnoredDatasets(ctx, machines.datasets)
 
 	// Sort datasets so that children datasets are after their parents.
 	sortedDataset := sortedDataset(datasets)
 	sort.Sort(sortedDataset)
 
-	// Resolve out to its root origin for /, /boot* and user datasets
-	origins := resolveOrigin(ctx, []*zfs.Dataset(sortedDataset), "/")
+	// Resolve out to its root origin for /, /boot* and user datasets.
+	// Resolvers are only valid for their set of datasets and are thus recreated on each refresh.
+	origins := resolveOrigin(ctx, sortedDataset, "/")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// First, set main datasets, then set clones
 	mainDatasets := make([]*zfs.Dataset, 0, len(sortedDataset))
@@ -192,7 +597,10 @@ func (ms *Machines) refresh(ctx context.Context) {
 	}
 
 	// First, handle system datasets (active for each machine and history) and return remaining ones.
-	boots, flattenedUserDatas, persistents, unmanagedDatasets := machines.populate(ctx, append(append(mainDatasets, cloneDatasets...), otherDatasets...), origins)
+	boots, flattenedUserDatas, persistents, unmanagedDatasets, err := machines.populate(ctx, append(append(mainDatasets, cloneDatasets...), otherDatasets...), origins)
+	if err != nil {
+		return err
+	}
 
 	// Get a userdata map from parent to its children
 	rootUserDatasets := getRootDatasets(ctx, flattenedUserDatas)
@@ -201,7 +609,13 @@ func (ms *Machines) refresh(ctx context.Context) {
 	for k := range rootUserDatasets {
 		rootsOnlyUserDatasets = append(rootsOnlyUserDatasets, k)
 	}
+	// We want reproducibility, so attach user datasets in a given order.
+	sort.Slice(rootsOnlyUserDatasets, func(i, j int) bool { return rootsOnlyUserDatasets[i].Name < rootsOnlyUserDatasets[j].Name })
+	// User datasets origins are only looked up among user root datasets.
 	originsUserDatasets := resolveOrigin(ctx, rootsOnlyUserDatasets, "")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	statesAndMachines := machines.getAllStatesOnMachines()
 	unattachedSnapshotsUserDatasets, unattachedClonesUserDatasets := make(map[*zfs.Dataset][]*zfs.Dataset), make(map[*zfs.Dataset][]*zfs.Dataset) // user only snapshots or clone (not linked to a system state)
@@ -213,7 +627,12 @@ func (ms *Machines) refresh(ctx context.Context) {
 		originToAttach[m] = make(map[string]bool)
 	}
 
-	for r, children := range rootUserDatasets {
+	for _, r := range rootsOnlyUserDatasets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		children := rootUserDatasets[r]
+
 		// Handle snapshots userdatasets
 		var associateWithAtLeastOne bool
 		if r.IsSnapshot {
@@ -223,7 +642,11 @@ func (ms *Machines) refresh(ctx context.Context) {
 				// its name.
 				if strings.HasSuffix(s.ID, "@"+snapshot) {
 					user, us := m.addUserState(ctx, s.ID, r, children)
-					s.Users[user] = us
+					// The same snapshot name can be on multiple pools, like for received states: prefer the user
+					// snapshot on the pool of the system state.
+					if cur, ok := s.Users[user]; !ok || poolName(cur.ID) != poolName(s.ID) || poolName(r.Name) == poolName(s.ID) {
+						s.Users[user] = us
+					}
 					origin := *originsUserDatasets[r.Name]
 					if _, ok := attachedOrigins[m][origin]; !ok {
 						originToAttach[m][origin] = true
@@ -296,6 +719,10 @@ func (ms *Machines) refresh(ctx context.Context) {
 
 	// This is a userdataset "snapshot" clone dataset.
 	for r, children := range unattachedClonesUserDatasets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// WARNING: We only consider the dataset "group" (clones and promoted) attached to main state of a given machine
 		// to regroup on a known machine.
 
@@ -313,6 +740,9 @@ func (ms *Machines) refresh(ctx context.Context) {
 			log.Infof(ctx, i18n.G("Couldn't find any association for user dataset %s"), r.Name)
 			unmanagedDatasets = append(unmanagedDatasets, r)
 			unmanagedDatasets = append(unmanagedDatasets, children...)
+			if r.Origin != "" {
+				machines.addOrphan(r, fmt.Sprintf(i18n.G("origin %s of user clone doesn't exist"), r.Origin))
+			}
 			continue
 		}
 
@@ -343,10 +773,15 @@ func (ms *Machines) refresh(ctx context.Context) {
 		log.Infof(ctx, i18n.G("Couldn't find any association for user dataset %s"), r.Name)
 		unmanagedDatasets = append(unmanagedDatasets, r)
 		unmanagedDatasets = append(unmanagedDatasets, children...)
+		machines.addOrphan(r, fmt.Sprintf(i18n.G("user clone of %s isn't associated to any machine"), r.Origin))
 	}
 
 	// This is a userdataset "snapshot" snapshot dataset.
 	for r, children := range unattachedSnapshotsUserDatasets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		base, _ := splitSnapshotName(r.Name)
 		user := userFromDatasetName(r.Name)
 		var associated bool
@@ -375,6 +810,10 @@ func (ms *Machines) refresh(ctx context.Context) {
 	// Same with children and history datasets.
 	// We want reproducibility, so iterate to attach datasets in a given order.
 	for _, k := range sortedMachineKeys(machines.all) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		m := machines.all[k]
 		m.attachRemainingDatasets(ctx, boots, persistents)
 
@@ -390,43 +829,80 @@ func (ms *Machines) refresh(ctx context.Context) {
 		}
 	}
 
-	// Append unlinked boot datasets to ensure we will switch to noauto everything
-	machines.allSystemDatasets = appendDatasetIfNotPresent(machines.allSystemDatasets, boots, true)
+	machines.mergeRenamedUsers(ctx)
+	machines.attachBookmarks(machines.z.Bookmarks())
+	machines.attachHolds()
+	machines.attachSwapDatasets(machines.z.Volumes())
+
+	// Append unlinked boot datasets to ensure we will switch to noauto everything, but their containers
+	machines.allSystemDatasets = appendDatasetIfNotPresent(machines.allSystemDatasets, boots, excludeCanMountOff)
 	machines.allPersistentDatasets = persistents
 	machines.unmanagedDatasets = unmanagedDatasets
+	machines.detectUnattachedSystemDatasets(sortedDataset, origins, boots)
 
+	if reason := cmdlineUnusableReason(machines.cmdline); reason != "" {
+		log.Debugf(ctx, i18n.G("Current machine isn't detected: %s"), reason)
+	}
 	root, _ := bootParametersFromCmdline(machines.cmdline)
 	m, _ := machines.findFromRoot(root)
 	machines.current = m
 
-	*ms = machines
+	// Keep the state prepared for next boot, if it still exists
+	if ms.nextState != nil {
+		for s := range machines.getAllStatesOnMachines() {
+			if s.ID == ms.nextState.ID {
+				machines.nextState = s
+				break
+			}
+		}
+	}
+
+	unlock := ms.lock()
+	ms.machinesLayout = machines.machinesLayout
+	unlock()
 	l, err := log.LevelFromContext(ctx)
 	if (err == nil && l == log.DebugLevel) || // remote connected and send logs
 		log.GetLevel() == log.DebugLevel { // local log output
-		b, err := json.MarshalIndent(ms, "", "   ")
+		b, err := json.MarshalIndent(&machines, "", "   ")
 		if err != nil {
 			log.Warningf(ctx, i18n.G("couldn't convert internal state to json: %v"), err)
-			return
+			return nil
 		}
 		log.Debugf(ctx, i18n.G("current machines scanning layout:\n%s\n"), string(b))
 	}
+	return nil
 }
 
 // populate attach main system datasets to machines and returns other types of datasets for later triage/attachment, alongside
 // a map to direct access to a given state and machine
-func (ms *Machines) populate(ctx context.Context, allDatasets []*zfs.Dataset, origins map[string]*string) (boots, userdatas, persistents, unmanagedDatasets []*zfs.Dataset) {
-	for _, d := range allDatasets {
-		// we are taking the d address. Ensure we have a local variable that isn’t going to be reused
-		d := d
+// Datasets are first classified independently of each other over a pool of workers. They are then attached in
+// allDatasets order, so that the result doesn't depend on the workers scheduling.
+// It returns an error if ctx is cancelled.
+func (ms *Machines) populate(ctx context.Context, allDatasets []*zfs.Dataset, origins map[string]*string) (boots, userdatas, persistents, unmanagedDatasets []*zfs.Dataset, err error) {
+	triages := make([]datasetTriage, len(allDatasets))
+	forEachParallel(len(allDatasets), func(i int) {
+		triages[i] = ms.triageDataset(*allDatasets[i])
+	})
+
+	// states are all machines and history states created so far, by ID.
+	states := make(map[string]machineState)
+	for i, d := range allDatasets {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		t := triages[i]
 		// Main active system dataset building up a machine
-		m := newMachineFromDataset(d, origins[d.Name])
+		m := newMachineFromDataset(d, t.systemRoot, origins[d.Name])
 		if m != nil {
 			ms.all[d.Name] = m
+			states[m.ID] = machineState{machine: m, state: &m.State}
+			ms.recordTriage(d, TriageSystem, TriageRuleMainRoot, m.ID)
 			continue
 		}
 
 		// Check for children, clones and snapshots
-		if ms.populateSystemAndHistory(ctx, d, origins[d.Name]) {
+		if ms.populateSystemAndHistory(ctx, d, t, origins[d.Name], states) {
 			continue
 		}
 
@@ -434,15 +910,24 @@ func (ms *Machines) populate(ctx context.Context, allDatasets []*zfs.Dataset, or
 
 		// Extract boot datasets if any. We can't attach them directly with machines as if they are on another pool:
 		// the machine will not necessiraly loaded yet.
-		if strings.Contains(strings.ToLower(d.Name), bootdatasetsContainerName) && strings.HasPrefix(d.Mountpoint, "/boot") {
+		if t.boot {
 			boots = append(boots, d)
+			ms.recordTriage(d, TriageBoot, TriageRuleBootPrefix, "")
 			continue
 		}
 
 		// Extract zsys user datasets if any. We can't attach them directly with machines as if they are on another pool,
 		// the machine is not necessiraly loaded yet.
-		if isUserDataset(d.Name) {
+		if t.role == ContainerUser {
 			userdatas = append(userdatas, d)
+			ms.recordTriage(d, TriageUserData, TriageRuleUserDataContainer, "")
+			continue
+		}
+
+		// Datasets of persistent containers are persistent, even if nothing mounts them automatically.
+		if t.role == ContainerPersistent && d.CanMount != "off" && !d.IsSnapshot {
+			persistents = append(persistents, d)
+			ms.recordTriage(d, TriagePersistent, TriageRulePersistentContainer, "")
 			continue
 		}
 
@@ -451,20 +936,75 @@ func (ms *Machines) populate(ctx context.Context, allDatasets []*zfs.Dataset, or
 		if d.CanMount != "on" || d.IsSnapshot {
 			log.Debugf(ctx, i18n.G("ignoring %q: either an orphan clone or not a boot, user or system datasets and canmount isn't on"), d.Name)
 			unmanagedDatasets = append(unmanagedDatasets, d)
+			ms.recordTriage(d, TriageUnmanaged, TriageRuleIgnoredOrphan, "")
+			if d.Origin != "" {
+				ms.addOrphan(d, fmt.Sprintf(i18n.G("clone of %s isn't a boot, user or system dataset of any machine"), d.Origin))
+			}
 			continue
 		}
 
 		// should be persistent datasets
 		persistents = append(persistents, d)
+		ms.recordTriage(d, TriagePersistent, TriageRulePersistent, "")
+	}
+
+	return boots, userdatas, persistents, unmanagedDatasets, nil
+}
+
+// datasetTriage is the classification of a dataset which doesn't depend on any other dataset.
+type datasetTriage struct {
+	// systemRoot is set for mountable datasets mounted on /: main or history system states.
+	systemRoot bool
+	// parents are the names of the states the dataset can be a child of, closest first.
+	parents    []string
+	parentsErr error
+
+	boot bool
+	role ContainerRole
+}
+
+// triageDataset classifies d. It only reads ms configuration and can thus be called concurrently.
+func (ms *Machines) triageDataset(d zfs.Dataset) datasetTriage {
+	mountpoint := triageMountpoint(d)
+	t := datasetTriage{
+		systemRoot: mountpoint == "/" && d.CanMount != "off",
+		boot:       strings.Contains(strings.ToLower(d.Name), bootdatasetsContainerName) && strings.HasPrefix(mountpoint, "/boot"),
+		role:       ms.containerRole(d.Name),
+	}
+	t.parents, t.parentsErr = parentStates(d)
+	return t
+}
+
+// parentStates returns the names of the states d can be a child of, closest first, as matched by isChild.
+// Filesystem datasets are children of their ancestors and snapshots of their ancestors snapshots of the same name.
+// An error will mean that the dataset name isn't what we expected it to be.
+func parentStates(d zfs.Dataset) (parents []string, err error) {
+	var snapshot string
+	switch names := strings.Split(d.Name, "@"); len(names) {
+	case 1:
+	case 2:
+		snapshot = "@" + names[1]
+	default:
+		return nil, fmt.Errorf(i18n.G("unexpected number of @ in dataset name %q"), d.Name)
+	}
+
+	base := strings.TrimSuffix(d.Name, snapshot)
+	for i := strings.LastIndex(base, "/"); i > 0; i = strings.LastIndex(base[:i], "/") {
+		parents = append(parents, base[:i]+snapshot)
 	}
+	return parents, nil
+}
 
-	return boots, userdatas, persistents, unmanagedDatasets
+// machineState is a system state and the machine it belongs to.
+type machineState struct {
+	machine *Machine
+	state   *State
 }
 
 // newMachineFromDataset returns a new machine if the given dataset is a main system one.
-func newMachineFromDataset(d *zfs.Dataset, origin *string) *Machine {
+func newMachineFromDataset(d *zfs.Dataset, systemRoot bool, origin *string) *Machine {
 	// Register all zsys non cloned mountable / to a new machine
-	if d.Mountpoint == "/" && d.CanMount != "off" && origin != nil && *origin == "" {
+	if systemRoot && origin != nil && *origin == "" {
 		m := Machine{
 			IsZsys: d.BootFS,
 			State: State{
@@ -476,56 +1016,49 @@ func newMachineFromDataset(d *zfs.Dataset, origin *string) *Machine {
 			History:        make(map[string]*State),
 		}
 		m.Datasets[d.Name] = []*zfs.Dataset{d}
-		// We don't want lastused to be 1970 in our golden files
-		if d.LastUsed != 0 {
-			m.State.LastUsed = time.Unix(int64(d.LastUsed), 0)
-		}
+		m.State.LastUsed = lastUsedTime(d.LastUsed)
 		return &m
 	}
 	return nil
 }
 
 // populateSystemAndHistory identified if the given dataset is a system dataset (children of root one) or a history
-// one. It creates and attach the states as needed.
+// one. It creates and attach the states as needed, registering new ones in states.
 // It returns ok if the dataset matches any machine and is attached.
-func (ms *Machines) populateSystemAndHistory(ctx context.Context, d *zfs.Dataset, origin *string) (ok bool) {
-	for _, m := range ms.all {
-		// Direct main machine state children
-		if ok, err := isChild(m.ID, *d); err != nil {
-			log.Warningf(ctx, i18n.G("ignoring %q as couldn't assert if it's a child: ")+config.ErrorFormat, d.Name, err)
-		} else if ok {
-			m.Datasets[m.ID] = append(m.Datasets[m.ID], d)
-			return true
-		}
-
-		// Clones or snapshot root dataset (origins points to origin dataset)
-		if d.Mountpoint == "/" && d.CanMount != "off" && origin != nil && *origin == m.ID {
-			s := &State{
-				ID:       d.Name,
-				Datasets: make(map[string][]*zfs.Dataset),
-				Users:    make(map[string]*State),
-			}
-			s.Datasets[d.Name] = []*zfs.Dataset{d}
-			m.History[d.Name] = s
-			// We don't want lastused to be 1970 in our golden files
-			if d.LastUsed != 0 {
-				m.History[d.Name].LastUsed = time.Unix(int64(d.LastUsed), 0)
-			}
-			return true
-		}
-
-		// Clones or snapshot children
-		for _, h := range m.History {
-			if ok, err := isChild(h.ID, *d); err != nil {
-				log.Warningf(ctx, i18n.G("ignoring %q as couldn't assert if it's a child: ")+config.ErrorFormat, d.Name, err)
-			} else if ok {
-				h.Datasets[h.ID] = append(h.Datasets[h.ID], d)
-				return true
-			}
+func (ms *Machines) populateSystemAndHistory(ctx context.Context, d *zfs.Dataset, t datasetTriage, origin *string, states map[string]machineState) (ok bool) {
+	// Direct main machine state, clones or snapshot children
+	if t.parentsErr != nil {
+		log.Warningf(ctx, i18n.G("ignoring %q as couldn't assert if it's a child: ")+config.ErrorFormat, d.Name, t.parentsErr)
+	}
+	for _, p := range t.parents {
+		ps, ok := states[p]
+		if !ok {
+			continue
 		}
+		ps.state.Datasets[ps.state.ID] = append(ps.state.Datasets[ps.state.ID], d)
+		ms.recordTriage(d, TriageSystem, TriageRuleChild, ps.machine.ID)
+		return true
 	}
 
-	return false
+	// Clones or snapshot root dataset (origins points to origin dataset)
+	if !t.systemRoot || origin == nil {
+		return false
+	}
+	m, ok := ms.all[*origin]
+	if !ok {
+		return false
+	}
+	s := &State{
+		ID:       d.Name,
+		Datasets: make(map[string][]*zfs.Dataset),
+		Users:    make(map[string]*State),
+	}
+	s.Datasets[d.Name] = []*zfs.Dataset{d}
+	s.LastUsed = lastUsedTime(d.LastUsed)
+	m.History[d.Name] = s
+	states[s.ID] = machineState{machine: m, state: s}
+	ms.recordTriage(d, TriageSystem, TriageRuleCloneOrigin, m.ID)
+	return true
 }
 
 // addUserState creates and attach a new user state to the machine users map.
@@ -534,10 +1067,7 @@ func (m *Machine) addUserState(ctx context.Context, systemStateID string, r *zfs
 	s := &State{
 		ID:       r.Name,
 		Datasets: map[string][]*zfs.Dataset{r.Name: append([]*zfs.Dataset{r}, children...)},
-	}
-	// We don't want lastused to be 1970 in our golden files
-	if r.LastUsed != 0 {
-		s.LastUsed = time.Unix(int64(r.LastUsed), 0)
+		LastUsed: lastUsedTime(r.LastUsed),
 	}
 
 	// Attach to global user map new userData
@@ -556,9 +1086,6 @@ func (m *Machine) addUserState(ctx context.Context, systemStateID string, r *zfs
 
 // attachRemainingDatasets attaches to machine boot and persistent datasets if they fit current machine.
 func (m *Machine) attachRemainingDatasets(ctx context.Context, boots, persistents []*zfs.Dataset) {
-	// machineID is the basename of the State.
-	machineID := filepath.Base(m.ID)
-
 	// Boot datasets
 	var bootDatasetsID string
 	for _, d := range boots {
@@ -567,7 +1094,7 @@ func (m *Machine) attachRemainingDatasets(ctx context.Context, boots, persistent
 			continue
 		}
 		// Main boot base dataset (matching machine ID)
-		if strings.HasSuffix(d.Name, "/"+machineID) {
+		if isBootDatasetOf(*d, m.ID) {
 			bootDatasetsID = d.Name
 			m.Datasets[bootDatasetsID] = []*zfs.Dataset{d}
 		} else if bootDatasetsID != "" && strings.HasPrefix(d.Name, bootDatasetsID+"/") { // child
@@ -575,65 +1102,172 @@ func (m *Machine) attachRemainingDatasets(ctx context.Context, boots, persistent
 		}
 	}
 
-	// Persistent datasets
-	m.PersistentDatasets = persistents
+	// Persistent datasets, with a slice per machine so that changing it on one doesn't leak to the others
+	m.PersistentDatasets = append([]*zfs.Dataset(nil), persistents...)
 
 	// Handle history now
+	// Filesystem states of this machine, which boot datasets snapshots of history states can be attached to.
+	machineStateIDs := []string{m.ID}
+	for _, k := range sortedStateKeys(m.History) {
+		if !m.History[k].isSnapshot() {
+			machineStateIDs = append(machineStateIDs, k)
+		}
+	}
 	// We want reproducibility, so iterate to attach datasets in a given order.
 	for _, k := range sortedStateKeys(m.History) {
 		h := m.History[k]
-		h.attachRemainingDatasetsForHistory(boots)
+		h.attachRemainingDatasetsForHistory(boots, machineStateIDs)
 	}
 }
 
 // attachRemainingDatasetsForHistory attaches to a given history state boot datasets if they fit.
 // It's similar to attachRemainingDatasets with some particular rules on snapshots.
-func (s *State) attachRemainingDatasetsForHistory(boots []*zfs.Dataset) {
-	// stateID is the basename of the State.
-	stateID := filepath.Base(s.ID)
+// Boot datasets are matched on exact dataset and snapshot names, never on substrings.
+func (s *State) attachRemainingDatasetsForHistory(boots []*zfs.Dataset, machineStateIDs []string) {
+	_, snapshot := splitSnapshotName(s.ID)
+
+	// For clones just match the base datasetname or its children.
+	if snapshot == "" {
+		var bootDatasetsID string
+		for _, d := range boots {
+			if d.IsSnapshot {
+				continue
+			}
 
-	var snapshot string
-	if j := strings.LastIndex(stateID, "@"); j > 0 {
-		snapshot = stateID[j+1:]
+			// Main boot base dataset (matching machine ID)
+			if isBootDatasetOf(*d, s.ID) {
+				bootDatasetsID = d.Name
+				s.Datasets[bootDatasetsID] = []*zfs.Dataset{d}
+			} else if bootDatasetsID != "" && strings.HasPrefix(d.Name, bootDatasetsID+"/") { // child
+				s.Datasets[bootDatasetsID] = append(s.Datasets[bootDatasetsID], d)
+			}
+		}
+		return
 	}
 
-	// Boot datasets
+	// Snapshots are not necessarily with a dataset ID matching their state one because of dataset promotions.
+	// Prefer the boot snapshot named after the state and fallback to the first snapshot of a boot dataset of any
+	// filesystem state of this machine.
 	var bootDatasetsID string
 	for _, d := range boots {
-		if snapshot != "" {
-			// Snapshots are not necessarily with a dataset ID matching its parent of dataset promotions, just match
-			// its name and take the first route we find.
-			if bootDatasetsID == "" && strings.HasSuffix(d.Name, "@"+snapshot) {
+		if _, snap := splitSnapshotName(d.Name); snap != snapshot {
+			continue
+		}
+		if isBootDatasetOf(*d, s.ID) {
+			bootDatasetsID = d.Name
+			break
+		}
+		if bootDatasetsID != "" {
+			continue
+		}
+		for _, id := range machineStateIDs {
+			if isBootDatasetOf(*d, id) {
 				bootDatasetsID = d.Name
-				s.Datasets[bootDatasetsID] = []*zfs.Dataset{d}
-				continue
-			} else if bootDatasetsID != "" {
-				baseBootDatasetsID, _ := splitSnapshotName(bootDatasetsID)
-				if strings.HasPrefix(d.Name, baseBootDatasetsID+"/") && strings.HasSuffix(d.Name, "@"+snapshot) { // child
-					s.Datasets[bootDatasetsID] = append(s.Datasets[bootDatasetsID], d)
-				}
+				break
 			}
 		}
-		// For clones just match the base datasetname or its children.
-		if d.IsSnapshot {
+	}
+	if bootDatasetsID == "" {
+		return
+	}
+
+	baseBootDatasetsID, _ := splitSnapshotName(bootDatasetsID)
+	for _, d := range boots {
+		base, snap := splitSnapshotName(d.Name)
+		if snap != snapshot {
 			continue
 		}
-
-		// Main boot base dataset (matching machine ID)
-		if strings.HasSuffix(d.Name, "/"+stateID) {
-			bootDatasetsID = d.Name
-			s.Datasets[bootDatasetsID] = []*zfs.Dataset{d}
-		} else if bootDatasetsID != "" && strings.HasPrefix(d.Name, bootDatasetsID+"/") { // child
+		if base == baseBootDatasetsID {
+			s.Datasets[bootDatasetsID] = prependDataset(s.Datasets[bootDatasetsID], d)
+		} else if strings.HasPrefix(base, baseBootDatasetsID+"/") { // child
 			s.Datasets[bootDatasetsID] = append(s.Datasets[bootDatasetsID], d)
 		}
 	}
 }
 
+// orphanDataset is a clone which couldn't be attached to any machine.
+type orphanDataset struct {
+	d      *zfs.Dataset
+	reason string
+}
+
+// addOrphan records d as an orphan clone, for reason.
+func (ms *Machines) addOrphan(d *zfs.Dataset, reason string) {
+	ms.orphanDatasets = append(ms.orphanDatasets, orphanDataset{d: d, reason: reason})
+}
+
+// OrphanDatasets returns clones which couldn't be attached to any machine on last refresh, sorted by name.
+// They often are leftovers of a failed revert or an interrupted garbage collection, and are only listed as
+// unmanaged datasets.
+func (ms *Machines) OrphanDatasets() []*zfs.Dataset {
+	defer ms.rlock()()
+
+	orphans := make([]orphanDataset, len(ms.orphanDatasets))
+	copy(orphans, ms.orphanDatasets)
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].d.Name < orphans[j].d.Name })
+
+	var r []*zfs.Dataset
+	for _, o := range orphans {
+		r = append(r, o.d)
+	}
+	return r
+}
+
+// OrphanReason returns why the dataset name was classified as an orphan clone, if it is one.
+func (ms *Machines) OrphanReason(name string) (reason string, ok bool) {
+	defer ms.rlock()()
+
+	for _, o := range ms.orphanDatasets {
+		if o.d.Name == name {
+			return o.reason, true
+		}
+	}
+	return "", false
+}
+
 // CurrentIsZsys returns if there is a current machine, and if it's the case, if it's zsys.
 func (ms *Machines) CurrentIsZsys() bool {
+	defer ms.rlock()()
+
 	return ms.current.isZsys()
 }
 
+// CurrentMachine returns the machine we are currently booted on.
+// ok is false if the root dataset from the command line doesn't match any machine (non zfs or rescue boot).
+func (ms *Machines) CurrentMachine() (m *Machine, ok bool) {
+	defer ms.rlock()()
+
+	return ms.current, ms.current != nil
+}
+
+// CurrentState returns the state we are currently booted on, which can be the main machine state or a history one.
+// ok is false if the root dataset from the command line doesn't match any state.
+func (ms *Machines) CurrentState() (s *State, ok bool) {
+	defer ms.rlock()()
+
+	root, _ := bootParametersFromCmdline(ms.cmdline)
+	_, s = ms.findFromRoot(root)
+	return s, s != nil
+}
+
+// NextState returns the state prepared to be booted by default on next boot, if any.
+// A state is prepared for next boot when reverting to it, when setting it as the default boot state, or when
+// booting it once. This is kept across refreshes, as long as the state exists, and cleared by Commit once the boot
+// completed, as the booted state is then the current one.
+// The bootloader menu should mark it as its default entry.
+func (ms *Machines) NextState() (s *State, ok bool) {
+	defer ms.rlock()()
+
+	return ms.nextState, ms.nextState != nil
+}
+
+// setNextState marks s as the state to boot on next boot. nil clears it.
+func (ms *Machines) setNextState(s *State) {
+	defer ms.lock()()
+
+	ms.nextState = s
+}
+
 // isZsys returns if the machine is a zsys one.
 func (m *Machine) isZsys() bool {
 	if m == nil {
@@ -642,9 +1276,67 @@ func (m *Machine) isZsys() bool {
 	return m.IsZsys
 }
 
+// ZsysHistory returns the history states of m managed by zsys, sorted by ID.
+// Machines which aren't zsys ones and their states coexist with zsys ones, but zsys doesn't attach any user, boot or
+// persistent datasets to them: they have no zsys history state. A history state of a zsys machine which root dataset
+// isn't tagged as a zsys one, generally after manual changes, isn't returned either.
+func (m *Machine) ZsysHistory() []*State {
+	if !m.isZsys() {
+		return nil
+	}
+	var r []*State
+	for _, k := range sortedStateKeys(m.History) {
+		if s := m.History[k]; s.managedByZsys() {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// HistoryStates returns the history states of m, sorted by ID. Snapshot states, which are cloned to be booted, are only
+// returned if includeSnapshots is set: clone states are returned otherwise.
+func (m *Machine) HistoryStates(includeSnapshots bool) []*State {
+	var r []*State
+	for _, k := range sortedStateKeys(m.History) {
+		s := m.History[k]
+		if !includeSnapshots && s.isSnapshot() {
+			continue
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// managedByZsys returns if the root dataset of s is tagged as a zsys one.
+func (s State) managedByZsys() bool {
+	root := s.rootDataset()
+	return root != nil && root.BootFS
+}
+
+// IsCurrent returns if m is the machine we are currently booted on in ms.
+// Machines are compared by identity: m must come from ms, and not from a previous refresh or a copy.
+func (m *Machine) IsCurrent(ms *Machines) bool {
+	defer ms.rlock()()
+
+	return m != nil && ms.current == m
+}
+
+// IsHistory returns if s is one of the history states of m.
+// States are compared by identity: the main state of m, or a state of another machine with the same ID, isn't part
+// of its history.
+func (s *State) IsHistory(m *Machine) bool {
+	if s == nil || m == nil {
+		return false
+	}
+	h, ok := m.History[s.ID]
+	return ok && h == s
+}
+
 // GetMachine returns matching machine.
 // If ID is empty, it will fetch current machine
-func (ms Machines) GetMachine(ID string) (*Machine, error) {
+func (ms *Machines) GetMachine(ID string) (*Machine, error) {
+	defer ms.rlock()()
+
 	if ID == "" {
 		if ms.current == nil {
 			return nil, errors.New(i18n.G("no ID given and cannot retrieve current machine. Please specify one ID."))
@@ -689,6 +1381,291 @@ func (ms Machines) GetMachine(ID string) (*Machine, error) {
 	return machines[0], nil
 }
 
+// OriginChain returns datasetName followed by each dataset it depends on through clones, up to the filesystem dataset
+// at the top of its clone chain: a clone is followed by its origin snapshot, and a snapshot by the filesystem dataset it
+// belongs to. This is the order in which datasets need to exist, reversed, for promotions and incremental sends.
+// An error is returned if any dataset of the chain is unknown or if origins loop.
+func (ms *Machines) OriginChain(datasetName string) ([]string, error) {
+	defer ms.rlock()()
+
+	if datasetName == "" {
+		return nil, errors.New(i18n.G("dataset name is mandatory"))
+	}
+	return newOriginResolver(ms.datasets).chain(datasetName)
+}
+
+// MachineForUserDataset returns the machine and system state owning the user dataset datasetName.
+// Current machine is searched first, then other machines in order. On a given machine, the main state wins over
+// history states, which are checked in order.
+// State is nil if the dataset is only a user state of the machine, without being attached to any system state.
+// An error is returned for persistent or unassociated datasets.
+func (ms *Machines) MachineForUserDataset(datasetName string) (*Machine, *State, error) {
+	defer ms.rlock()()
+
+	for _, d := range ms.allPersistentDatasets {
+		if d.Name == datasetName {
+			return nil, nil, fmt.Errorf(i18n.G("%s is a persistent dataset, not owned by any machine"), datasetName)
+		}
+	}
+
+	var machines []*Machine
+	if ms.current != nil {
+		machines = append(machines, ms.current)
+	}
+	for _, m := range ms.sortedMachines() {
+		if m != ms.current {
+			machines = append(machines, m)
+		}
+	}
+
+	hasDataset := func(s *State) bool {
+		for _, d := range s.getDatasets() {
+			if d.Name == datasetName {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range machines {
+		states := []*State{&m.State}
+		for _, k := range sortedStateKeys(m.History) {
+			states = append(states, m.History[k])
+		}
+		for _, s := range states {
+			for _, user := range sortedStateKeys(s.Users) {
+				if hasDataset(s.Users[user]) {
+					return m, s, nil
+				}
+			}
+		}
+
+		for _, uss := range m.AllUsersStates {
+			for _, us := range uss {
+				if hasDataset(us) {
+					return m, nil, nil
+				}
+			}
+		}
+	}
+
+	return nil, nil, fmt.Errorf(i18n.G("no machine owns user dataset %s"), datasetName)
+}
+
+// Machines returns all detected machines, ordered by their main system dataset name.
+// The returned machines are shared with the internal state and must be treated as read only: they are
+// replaced, not updated in place, on the next Refresh.
+func (ms *Machines) Machines() []*Machine {
+	defer ms.rlock()()
+
+	return ms.sortedMachines()
+}
+
+// sortedMachines returns all machines, ordered by their main system dataset name.
+func (ms *Machines) sortedMachines() []*Machine {
+	r := make([]*Machine, 0, len(ms.all))
+	for _, k := range sortedMachineKeys(ms.all) {
+		r = append(r, ms.all[k])
+	}
+	return r
+}
+
+// SortedMachineIDs returns the IDs of all machines, sorted in the same order this package iterates over them.
+func (ms *Machines) SortedMachineIDs() []string {
+	defer ms.rlock()()
+
+	return sortedMachineKeys(ms.all)
+}
+
+// Pools returns the names of all pools hosting system, boot, user or persistent datasets of any machine, sorted.
+// Pools only hosting datasets zsys doesn't manage aren't returned.
+func (ms *Machines) Pools() []string {
+	defer ms.rlock()()
+
+	seen := make(map[string]bool)
+	var pools []string
+	for _, datasets := range [][]*zfs.Dataset{ms.allSystemDatasets, ms.allUsersDatasets, ms.allPersistentDatasets} {
+		for _, d := range datasets {
+			pool := poolName(d.Name)
+			if seen[pool] {
+				continue
+			}
+			seen[pool] = true
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+// SortedHistoryIDs returns the IDs of all history states of this machine, sorted in the same order this package
+// iterates over them.
+func (m Machine) SortedHistoryIDs() []string {
+	return sortedStateKeys(m.History)
+}
+
+// UserNames returns the sorted list of users having at least one state on this machine.
+func (m Machine) UserNames() []string {
+	users := make([]string, 0, len(m.AllUsersStates))
+	for user := range m.AllUsersStates {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// UserStates returns all states of user on this machine.
+// The user state attached to the main machine state, if any, is first. Others are sorted by last used time,
+// most recent first, and then by ID.
+func (m Machine) UserStates(user string) ([]*State, error) {
+	uss, ok := m.AllUsersStates[user]
+	if !ok {
+		return nil, fmt.Errorf(i18n.G("no user %q found on machine %s"), user, m.ID)
+	}
+
+	current := m.State.Users[user]
+	r := make([]*State, 0, len(uss))
+	for _, k := range sortedStateKeys(uss) {
+		us := uss[k]
+		if current != nil && us.ID == current.ID {
+			continue
+		}
+		// A user state is listed once per system state it is associated with.
+		r = appendStateIfNotPresent(r, us)
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].LastUsed.After(r[j].LastUsed) })
+
+	if current != nil {
+		r = append([]*State{current}, r...)
+	}
+	return r, nil
+}
+
+// MachineSpace is the space used by a machine.
+// Persistent datasets are shared between all machines: their space is reported separately and shouldn't be summed
+// across machines.
+type MachineSpace struct {
+	// States is the space, in bytes, exclusively held by all system and user states of the machine.
+	States uint64
+	// Persistent is the space, in bytes, held by persistent datasets, shared by all machines.
+	Persistent uint64
+	// Swap is the space, in bytes, held by the swap volumes of the machine. Some can be shared with other machines.
+	Swap uint64
+}
+
+// Space returns the space used by the machine states, separately from the one of the persistent datasets.
+// Snapshot space is already accounted in their filesystem datasets and datasets shared between states are only
+// counted once.
+func (m Machine) Space() MachineSpace {
+	var r MachineSpace
+
+	seen := make(map[string]bool)
+	addState := func(s *State) {
+		for _, d := range s.getDatasets() {
+			if d.IsSnapshot || seen[d.Name] {
+				continue
+			}
+			seen[d.Name] = true
+			r.States += exclusiveSize(*d)
+		}
+	}
+	addState(&m.State)
+	for _, k := range sortedStateKeys(m.History) {
+		addState(m.History[k])
+	}
+	for _, uss := range m.AllUsersStates {
+		for _, us := range uss {
+			addState(us)
+		}
+	}
+
+	r.Persistent = persistentSize(m.PersistentDatasets)
+	r.Swap = persistentSize(m.SwapDatasets)
+	return r
+}
+
+// AllDatasets returns the system, user and persistent datasets of the machine and of all its history states, snapshots
+// included, sorted by name. Datasets shared between states, like user datasets attached to multiple system states, are
+// only listed once.
+func (m *Machine) AllDatasets() []*zfs.Dataset {
+	seen := make(map[string]bool)
+	var r []*zfs.Dataset
+	add := func(ds []*zfs.Dataset) {
+		for _, d := range ds {
+			if seen[d.Name] {
+				continue
+			}
+			seen[d.Name] = true
+			r = append(r, d)
+		}
+	}
+
+	states := []*State{&m.State}
+	for _, k := range sortedStateKeys(m.History) {
+		states = append(states, m.History[k])
+	}
+	for _, s := range states {
+		add(s.getDatasets())
+		add(s.getUsersDatasets())
+	}
+	for _, uss := range m.AllUsersStates {
+		for _, us := range uss {
+			add(us.getDatasets())
+		}
+	}
+	add(m.PersistentDatasets)
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// PersistentDatasets returns all persistent datasets, sorted by name. They are shared by all machines and states, and
+// never changed by reverting.
+func (ms *Machines) PersistentDatasets() []*zfs.Dataset {
+	defer ms.rlock()()
+
+	r := append([]*zfs.Dataset(nil), ms.allPersistentDatasets...)
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// PersistentDatasetsSize returns the space, in bytes, held by all persistent datasets, which are shared by all machines.
+func (ms *Machines) PersistentDatasetsSize() uint64 {
+	defer ms.rlock()()
+
+	return persistentSize(ms.allPersistentDatasets)
+}
+
+// persistentSize returns the space held by persistent datasets, counting each one once.
+func persistentSize(ds []*zfs.Dataset) (size uint64) {
+	seen := make(map[string]bool)
+	for _, d := range ds {
+		if d.IsSnapshot || seen[d.Name] {
+			continue
+		}
+		seen[d.Name] = true
+		size += exclusiveSize(*d)
+	}
+	return size
+}
+
+// StatesOlderThan returns history states of this machine last used more than d ago, oldest first.
+// States without any known last used time are never returned.
+func (m Machine) StatesOlderThan(d time.Duration) []*State {
+	limit := time.Now().Add(-d)
+
+	var r []*State
+	for _, k := range sortedStateKeys(m.History) {
+		s := m.History[k]
+		if s.LastUsed.IsZero() || s.LastUsed.Unix() == 0 || !s.LastUsed.Before(limit) {
+			continue
+		}
+		r = append(r, s)
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].LastUsed.Before(r[j].LastUsed) })
+	return r
+}
+
 // Info returns detailed machine informations.
 func (m Machine) Info(full bool) (string, error) {
 	var out bytes.Buffer
@@ -846,7 +1823,9 @@ func (s State) toWriter(w io.Writer, isHistory, full bool) {
 }
 
 // List all the machines and a summary
-func (ms Machines) List() (string, error) {
+func (ms *Machines) List() (string, error) {
+	defer ms.rlock()()
+
 	var out bytes.Buffer
 	w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
 
@@ -2,10 +2,14 @@ package machines_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -176,6 +180,69 @@ func TestIdempotentNew(t *testing.T) {
 	assertMachinesEquals(t, got1, got2)
 }
 
+func TestNewFromDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
+
+		duplicateDataset bool
+		wantErr          bool
+	}{
+		"One machine with user datasets":         {def: "m_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234")},
+		"Machines with snapshots and clones":     {def: "m_layout2_machines_with_snapshots_clones.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678")},
+		"Separate boot pool with snapshots":      {def: "m_snapshot_with_separate_boot_with_children.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234")},
+		"Non zsys machine":                       {def: "d_two_machines_one_zsys_one_non_zsys.yaml", cmdline: generateCmdLine("rpool2")},
+		"No current machine":                     {def: "m_with_userdata.yaml"},
+		"Error on dataset listed multiple times": {def: "m_with_userdata.yaml", duplicateDataset: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			want, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatalf("couldn't scan datasets: %v", err)
+			}
+			var datasets []zfs.Dataset
+			for _, d := range z.Datasets() {
+				datasets = append(datasets, *d)
+			}
+			if tc.duplicateDataset {
+				datasets = append(datasets, datasets[0])
+			}
+
+			got, err := machines.NewFromDatasets(context.Background(), tc.cmdline, datasets)
+			if tc.wantErr {
+				assert.Error(t, err, "NewFromDatasets should fail")
+				return
+			}
+			assert.NoError(t, err, "NewFromDatasets should succeed")
+			assertMachinesEquals(t, want, got)
+
+			// Nothing can be changed on zfs
+			assert.Error(t, got.Refresh(context.Background()), "Refresh should fail without zfs")
+			if got.CurrentIsZsys() {
+				_, err = got.CreateSystemSnapshot(context.Background(), "new_snapshot")
+				assert.Error(t, err, "CreateSystemSnapshot should fail without zfs")
+			}
+		})
+	}
+}
+
 func TestBoot(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
@@ -614,6 +681,316 @@ func TestUpdateLastUsed(t *testing.T) {
 	}
 }
 
+func TestLastUsedFromClock(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def        string
+		createUser string
+
+		wantUsers []string
+	}{
+		"Update last used of system and users": {def: "m_with_userdata.yaml", wantUsers: []string{"root", "user1"}},
+		"Create user data":                     {def: "m_with_userdata.yaml", createUser: "userfoo", wantUsers: []string{"userfoo"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			if tc.createUser != "" {
+				err = ms.CreateUserData(context.Background(), tc.createUser, "/home/"+tc.createUser)
+			} else {
+				err = ms.UpdateLastUsed(context.Background())
+			}
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			want := testutils.FixedTime{}.Now()
+			s, _, err := ms.GetStateByID("rpool/ROOT/ubuntu_1234")
+			if err != nil {
+				t.Fatalf("expected current state to exist but got: %v", err)
+			}
+			if tc.createUser == "" {
+				assert.True(t, want.Equal(s.LastUsed), "system state last used is stamped from the clock")
+			}
+			for _, user := range tc.wantUsers {
+				us, ok := s.Users[user]
+				if !ok {
+					t.Fatalf("expected user %q on current state", user)
+				}
+				assert.True(t, want.Equal(us.LastUsed), "last used of user %q is stamped from the clock", user)
+			}
+
+			machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestRefreshDataset(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def             string
+		snapshot        string
+		setLastUsed     string
+		setBootfsOnUser string
+		refresh         string
+
+		wantLayoutChange bool
+	}{
+		"Refresh new system snapshot":          {def: "m_clone_with_userdata.yaml", snapshot: "rpool/ROOT/ubuntu_1234", refresh: "rpool/ROOT/ubuntu_1234", wantLayoutChange: true},
+		"Refresh new snapshot on parent":       {def: "m_clone_with_userdata.yaml", snapshot: "rpool/ROOT/ubuntu_1234", refresh: "rpool/ROOT", wantLayoutChange: true},
+		"Refresh updated last used":            {def: "m_clone_with_userdata.yaml", setLastUsed: "rpool/ROOT/ubuntu_1234", refresh: "rpool/ROOT/ubuntu_1234"},
+		"Refresh updated last used on user":    {def: "m_clone_with_userdata.yaml", setLastUsed: "rpool/USERDATA/user1_abcd", refresh: "rpool/USERDATA/user1_abcd"},
+		"Refresh user association to a system": {def: "m_clone_with_userdata.yaml", setBootfsOnUser: "rpool/USERDATA/root_bcde", refresh: "rpool/USERDATA", wantLayoutChange: true},
+		"Refresh unchanged dataset":            {def: "m_clone_with_userdata.yaml", refresh: "rpool/ROOT/ubuntu_1234"},
+
+		"Unknown dataset falls back to full refresh": {def: "m_clone_with_userdata.yaml", snapshot: "rpool/ROOT/ubuntu_1234", refresh: "rpool/doesntexist", wantLayoutChange: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			// Change datasets behind our back
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatalf("couldn't create original zfs datasets state: %v", err)
+			}
+			trans, _ := z.NewTransaction(context.Background())
+			if tc.snapshot != "" {
+				if err := trans.Snapshot("newsnap", tc.snapshot, true); err != nil {
+					t.Fatalf("couldn't snapshot %q: %v", tc.snapshot, err)
+				}
+			}
+			if tc.setLastUsed != "" {
+				if err := trans.SetProperty(libzfsadapter.LastUsedProp, "2000000042", tc.setLastUsed, false); err != nil {
+					t.Fatalf("couldn't set last used on %q: %v", tc.setLastUsed, err)
+				}
+			}
+			if tc.setBootfsOnUser != "" {
+				if err := trans.SetProperty(libzfsadapter.BootfsDatasetsProp, "rpool/ROOT/ubuntu_5678", tc.setBootfsOnUser, false); err != nil {
+					t.Fatalf("couldn't set bootfs datasets on %q: %v", tc.setBootfsOnUser, err)
+				}
+			}
+			trans.Done()
+
+			if err := ms.RefreshDataset(context.Background(), tc.refresh); err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+			if tc.wantLayoutChange {
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+		})
+	}
+}
+
+func TestReloadProperties(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def      string
+		dataset  string
+		property string
+		value    string
+
+		wantLayoutChange bool
+		wantErr          bool
+	}{
+		"Reload protection of a snapshot":     {def: "m_bootlist.yaml", dataset: "rpool/ROOT/ubuntu_1234@snap1", property: libzfsadapter.ProtectedProp, value: "yes"},
+		"Reload last used of a clone":         {def: "m_bootlist.yaml", dataset: "rpool/ROOT/ubuntu_5678", property: libzfsadapter.LastUsedProp, value: "2000000042"},
+		"Reload bootfs datasets of user":      {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/user1_efgh", property: libzfsadapter.BootfsDatasetsProp, value: "rpool/ROOT/ubuntu_1234", wantLayoutChange: true},
+		"Reload canmount rebuilds the layout": {def: "m_bootlist.yaml", dataset: "rpool/ROOT/ubuntu_5678", property: libzfsadapter.CanmountProp, value: "off", wantLayoutChange: true},
+		"Reload unchanged dataset":            {def: "m_bootlist.yaml", dataset: "rpool/ROOT/ubuntu_1234"},
+
+		"Error on unknown dataset": {def: "m_bootlist.yaml", dataset: "rpool/doesntexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			// Change datasets behind our back
+			if tc.property != "" {
+				z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+				if err != nil {
+					t.Fatalf("couldn't create original zfs datasets state: %v", err)
+				}
+				trans, _ := z.NewTransaction(context.Background())
+				if err := trans.SetProperty(tc.property, tc.value, tc.dataset, true); err != nil {
+					t.Fatalf("couldn't set %s on %q: %v", tc.property, tc.dataset, err)
+				}
+				trans.Done()
+			}
+
+			err = ms.ReloadProperties(context.Background(), tc.dataset)
+			if tc.wantErr {
+				assert.Error(t, err, "ReloadProperties should return an error but didn't")
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			assert.NoError(t, err, "ReloadProperties should return no error")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+			if tc.wantLayoutChange {
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+		})
+	}
+}
+
+// TestConcurrentRefresh is mostly useful with -race, to detect accessors not protected against a concurrent refresh.
+func TestConcurrentRefresh(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				m, ok := ms.CurrentMachine()
+				assert.True(t, ok, "Current machine should always be found")
+				assert.Equal(t, "rpool/ROOT/ubuntu_1234", m.ID, "Unexpected current machine")
+				s, ok := ms.CurrentState()
+				assert.True(t, ok, "Current state should always be found")
+				assert.Equal(t, "rpool/ROOT/ubuntu_1234", s.ID, "Unexpected current state")
+				_, err := ms.GetMachine("rpool/ROOT/ubuntu_1234")
+				assert.NoError(t, err, "GetMachine should always find the machine")
+				_, _, err = ms.GetStateByID("rpool/ROOT/ubuntu_1234")
+				assert.NoError(t, err, "GetStateByID should always find the state")
+				assert.Equal(t, []string{"rpool/ROOT/ubuntu_1234"}, ms.SortedMachineIDs(), "Unexpected machine IDs")
+				ms.NextState()
+				ms.Machines()
+				ms.OrphanDatasets()
+				m.IsCurrent(&ms)
+				ms.PersistentDatasetsSize()
+				ms.BootState()
+				ms.UnknownBootStateReason()
+				_, err = ms.IDToState(context.Background(), "rpool/ROOT/ubuntu_1234", "")
+				assert.NoError(t, err, "IDToState should always find the state")
+				ms.EstimateSpaceForClone("rpool/ROOT/ubuntu_1234")
+				ms.SharedDatasets("rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234")
+				ms.CloneGraph()
+				ms.Validate()
+				ms.DanglingUserLinks()
+				ms.MountpointConflicts()
+				assert.NoError(t, ms.Describe(&strings.Builder{}), "Describe should return no error")
+				_, err = ms.List()
+				assert.NoError(t, err, "List should return no error")
+				_, err = json.Marshal(&ms)
+				assert.NoError(t, err, "Machines should always be exported to json")
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, ms.Refresh(context.Background()), "Refresh should return no error")
+		assert.NoError(t, ms.RefreshDataset(context.Background(), "rpool/ROOT/ubuntu_1234"), "RefreshDataset should return no error")
+		assert.NoError(t, ms.ReloadProperties(context.Background(), "rpool/ROOT/ubuntu_1234"), "ReloadProperties should return no error")
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRefreshCancelled(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
+	initMachines := ms.CopyForTests(t)
+
+	// Scanning all datasets takes way more than a second
+	libzfs.(*mock.LibZFS).SlowScan(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = ms.Refresh(ctx)
+	assert.ErrorIs(t, err, context.Canceled, "Refresh should return the context cancellation")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "Refresh should return promptly once cancelled")
+
+	assertMachinesEquals(t, initMachines, ms)
+}
+
 func TestCreateUserData(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
@@ -844,30 +1221,25 @@ func TestCurrentIsZsys(t *testing.T) {
 	}
 }
 
-func TestChangeHomeOnUserData(t *testing.T) {
+func TestBootState(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
-		def     string
-		home    string
-		newHome string
-
-		setPropertyErr bool
-		scanErr        bool
+		cmdline string
 
-		wantErr bool
-		isNoOp  bool
+		want        machines.BootStateKind
+		wantMachine string
 	}{
-		"Rename home": {def: "m_with_userdata.yaml"},
-
-		// Argument or matching issue
-		"Home doesn't match": {def: "m_with_userdata.yaml", home: "/home/userabcd", wantErr: true, isNoOp: true},
-		"System not zsys":    {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
-		"Old home empty":     {def: "m_with_userdata.yaml", home: "[empty]", wantErr: true, isNoOp: true},
-		"New home empty":     {def: "m_with_userdata.yaml", newHome: "[empty]", wantErr: true, isNoOp: true},
-
-		// Errors
-		"Set property fails":            {def: "m_with_userdata.yaml", setPropertyErr: true, wantErr: true, isNoOp: true},
-		"Scan fails does trigger error": {def: "m_with_userdata.yaml", scanErr: true, wantErr: true, isNoOp: true},
+		"Zsys machine is current":               {cmdline: generateCmdLine("rpool"), want: machines.BootedZsys, wantMachine: "rpool"},
+		"Zfs non zsys machine is current":       {cmdline: generateCmdLine("rpool2"), want: machines.BootedNonZsys, wantMachine: "rpool2"},
+		"Zfs root dataset matching no machine":  {cmdline: generateCmdLine("rpool/ROOT/nomachine"), want: machines.BootedRescue},
+		"Live system":                           {cmdline: "BOOT_IMAGE=/casper/vmlinuz boot=casper quiet splash", want: machines.BootedRescue},
+		"Rescue target":                         {cmdline: "BOOT_IMAGE=/vmlinuz root=/dev/sda1 systemd.unit=rescue.target", want: machines.BootedRescue},
+		"Single user mode":                      {cmdline: "BOOT_IMAGE=/vmlinuz root=/dev/sda1 single", want: machines.BootedRescue},
+		"Non zfs system":                        {cmdline: "BOOT_IMAGE=/vmlinuz root=/dev/sda1 quiet splash", want: machines.BootedNonZsys},
+		"Parameters containing rescue keywords": {cmdline: "BOOT_IMAGE=/vmlinuz root=/dev/sda1 foo=single", want: machines.BootedNonZsys},
+		"No command line":                       {want: machines.BootStateUnknown},
+		"Blank command line":                    {cmdline: "  \n", want: machines.BootStateUnknown},
+		"Unterminated quote":                    {cmdline: `BOOT_IMAGE=/vmlinuz root=/dev/sda1 foo="bar`, want: machines.BootStateUnknown},
 	}
 
 	for name, tc := range tests {
@@ -876,90 +1248,84 @@ func TestChangeHomeOnUserData(t *testing.T) {
 			t.Parallel()
 			dir, cleanup := testutils.TempDir(t)
 			defer cleanup()
+
 			libzfs := testutils.GetMockZFS(t)
-			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "d_two_machines_one_zsys_one_non_zsys.yaml"), testutils.WithLibZFS(libzfs))
 			defer fPools.Create(dir)()
 
-			lzfs := libzfs.(*mock.LibZFS)
-			lzfs.ForceLastUsedTime(true)
-
-			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
 			if err != nil {
 				t.Error("expected success but got an error scanning for machines", err)
 			}
 
-			initMachines := ms.CopyForTests(t)
-
-			lzfs.ErrOnScan(tc.scanErr)
-			lzfs.ErrOnSetProperty(tc.setPropertyErr)
-
-			err = ms.ChangeHomeOnUserData(context.Background(), getDefaultValue(tc.home, "/home/user1"), getDefaultValue(tc.newHome, "/home/foo"))
-			if err != nil {
-				if !tc.wantErr {
-					t.Fatalf("expected no error but got: %v", err)
-				}
-				return
-			}
-			if err == nil && tc.wantErr {
-				t.Fatal("expected an error but got none")
-			}
-
-			if tc.isNoOp {
-				assertMachinesEquals(t, initMachines, ms)
+			got, m := ms.BootState()
+			assert.Equal(t, tc.want, got, "Unexpected boot state, got %s", got)
+			if tc.want == machines.BootStateUnknown {
+				assert.NotEmpty(t, ms.UnknownBootStateReason(), "A reason should be given for an unknown boot state")
 			} else {
-				assertMachinesToGolden(t, ms)
-				assertMachinesNotEquals(t, initMachines, ms)
+				assert.Empty(t, ms.UnknownBootStateReason(), "No reason should be given for a known boot state")
 			}
-
-			// finale rescan uneeded if last one failed
-			machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
-			if err != nil {
-				t.Error("expected success but got an error scanning for machines", err)
+			if tc.wantMachine == "" {
+				assert.Nil(t, m, "No machine should be returned")
+				return
+			}
+			if assert.NotNil(t, m, "A machine should be returned") {
+				assert.Equal(t, tc.wantMachine, m.ID, "Unexpected current machine")
 			}
-			assertMachinesEquals(t, machinesAfterRescan, ms)
 		})
 	}
 }
 
-func TestCreateSystemSnapshot(t *testing.T) {
+func TestEmptyCmdline(t *testing.T) {
 	t.Parallel()
-	tests := map[string]struct {
-		def          string
-		cmdline      string
-		snapshotName string
-
-		setCapOnPool string
-		capValue     string
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
 
-		wantErr bool
-		isNoOp  bool
-	}{
-		"Take one snapshot":       {def: "m_with_userdata.yaml"},
-		"Give a name to snapshot": {def: "m_with_userdata.yaml", snapshotName: "my_snapshot"},
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "d_two_machines_one_zsys_one_non_zsys.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
 
-		"Children on system datasets": {def: "m_with_userdata_children_on_system.yaml"},
-		"Children on user datasets":   {def: "m_with_userdata_children_on_user.yaml"},
-		"Children on user datasets with one child non associated with current machine": {def: "m_with_userdata_child_associated_one_state.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_9999")},
+	ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
 
-		"No associated userdata": {def: "d_one_machine_with_children.yaml", cmdline: generateCmdLine("rpool")},
+	var ids []string
+	for _, m := range ms.Machines() {
+		ids = append(ids, m.ID)
+	}
+	assert.ElementsMatch(t, []string{"rpool", "rpool2"}, ids, "All machines should be built without a command line")
 
-		// Free space handling
-		"Not enough free space on system pool":                {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "99", wantErr: true},
-		"Not enough free space on user pool":                  {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "99", wantErr: true},
-		"Capacity is invalid":                                 {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "NaN", wantErr: true},
-		"Take snapshot, not enough free space on other pools": {def: "m_without_userdata_prefer_system_pool.yaml", setCapOnPool: "rpool2", capValue: "99"},
+	_, ok := ms.CurrentMachine()
+	assert.False(t, ok, "No machine should be current")
+	got, m := ms.BootState()
+	assert.Equal(t, machines.BootStateUnknown, got, "Unexpected boot state, got %s", got)
+	assert.Nil(t, m, "No machine should be returned")
+	assert.Equal(t, "no kernel command line", ms.UnknownBootStateReason(), "Unexpected reason for unknown boot state")
 
-		// error cases with snapshot exists on root. on userdataset. on system child. on user child
-		"Error on existing snapshot on system root":  {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_root_snapshot", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on system child": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_child_snapshot", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on user root":    {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_root_snapshot", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on user child":   {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_child_snapshot", wantErr: true, isNoOp: true},
+	assert.NoError(t, ms.Refresh(context.Background()), "Refresh should succeed without a command line")
+	assert.Len(t, ms.Machines(), 2, "All machines should be kept after a refresh")
+}
 
-		"Error when name starts with dash":            {def: "m_with_userdata.yaml", snapshotName: "-my_snapshot", wantErr: true, isNoOp: true},
-		"Error when name contains invalid characters": {def: "m_with_userdata.yaml", snapshotName: "my, snäpshôt, is beautiful,", wantErr: true, isNoOp: true},
+func TestOriginChain(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		dataset string
 
-		"Non zsys":   {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
-		"No machine": {def: "m_with_userdata_no_zsys.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), wantErr: true, isNoOp: true},
+		want    []string
+		wantErr bool
+	}{
+		"Main dataset has no origin": {dataset: "rpool/main", want: []string{"rpool/main"}},
+		"Clone":                      {dataset: "rpool/clone", want: []string{"rpool/clone", "rpool/main@snap1", "rpool/main"}},
+		"Clone of a clone":           {dataset: "rpool/clone2", want: []string{"rpool/clone2", "rpool/clone@snap2", "rpool/clone", "rpool/main@snap1", "rpool/main"}},
+		"Snapshot":                   {dataset: "rpool/main@snap1", want: []string{"rpool/main@snap1", "rpool/main"}},
+		"Snapshot of a clone":        {dataset: "rpool/clone@snap2", want: []string{"rpool/clone@snap2", "rpool/clone", "rpool/main@snap1", "rpool/main"}},
+
+		"Error on unknown dataset":         {dataset: "rpool/doesntexist", wantErr: true},
+		"Error on unknown snapshot":        {dataset: "rpool/main@doesntexist", wantErr: true},
+		"Error on missing origin in chain": {dataset: "rpool/orphan", wantErr: true},
+		"Error on origins looping":         {dataset: "rpool/loop1", wantErr: true},
+		"Error on empty dataset name":      {wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -968,102 +1334,47 @@ func TestCreateSystemSnapshot(t *testing.T) {
 			t.Parallel()
 			dir, cleanup := testutils.TempDir(t)
 			defer cleanup()
+
 			libzfs := testutils.GetMockZFS(t)
-			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "d_origin_chains.yaml"), testutils.WithLibZFS(libzfs))
 			defer fPools.Create(dir)()
 
-			if tc.cmdline == "" {
-				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
-			}
-
-			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/main"), machines.WithLibZFS(libzfs))
 			if err != nil {
 				t.Error("expected success but got an error scanning for machines", err)
 			}
-			lzfs := libzfs.(*mock.LibZFS)
-
-			lzfs.ForceLastUsedTime(true)
-			if tc.setCapOnPool != "" {
-				lzfs.SetPoolCapacity(tc.setCapOnPool, tc.capValue)
-			}
-
-			initMachines := ms.CopyForTests(t)
 
-			snapshotName, err := ms.CreateSystemSnapshot(context.Background(), tc.snapshotName)
-			if err != nil {
-				if !tc.wantErr {
-					t.Fatalf("expected no error but got: %v", err)
-				}
+			got, err := ms.OriginChain(tc.dataset)
+			if tc.wantErr {
+				assert.Error(t, err, "OriginChain should fail")
 				return
 			}
-			if err == nil && tc.wantErr {
-				t.Fatal("expected an error but got none")
-			}
-
-			if tc.snapshotName != "" {
-				if snapshotName != tc.snapshotName {
-					t.Errorf("provided snapshotname isn't the one used. Want: %s, got: %s", tc.snapshotName, snapshotName)
-				}
-			} else {
-				if !strings.HasPrefix(snapshotName, machines.AutomatedSnapshotPrefix) {
-					t.Errorf("generated snapshotname should start with %s, but got: %s", machines.AutomatedSnapshotPrefix, snapshotName)
-				}
-			}
-
-			if tc.isNoOp {
-				assertMachinesEquals(t, initMachines, ms)
-			} else {
-				assertMachinesToGolden(t, ms)
-				assertMachinesNotEquals(t, initMachines, ms)
-			}
-
-			// finale rescan uneeded if last one failed
-			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
-			if err != nil {
-				t.Error("expected success but got an error scanning for machines", err)
-			}
-			assertMachinesEquals(t, machinesAfterRescan, ms)
+			assert.NoError(t, err, "OriginChain should succeed")
+			assert.Equal(t, tc.want, got, "Unexpected origin chain")
 		})
 	}
 }
 
-func TestCreateUserSnapshot(t *testing.T) {
+func TestCurrentMachineAndState(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
-		def          string
-		cmdline      string
-		snapshotName string
-		userName     string
-
-		setCapOnPool string
-		capValue     string
+		cmdline        string
+		mountedDataset string
 
-		wantErr bool
-		isNoOp  bool
+		wantMachine string
+		wantState   string
 	}{
-		"Take one snapshot":                                   {def: "m_with_userdata.yaml"},
-		"Give a name to snapshot":                             {def: "m_with_userdata.yaml", snapshotName: "my_snapshot"},
-		"Take one snapshot on a machine with other snapshots": {def: "m_snapshot_with_userdata.yaml"},
-
-		"Children on user datasets": {def: "m_with_userdata_children_on_user.yaml"},
-		"Children on user datasets with one child non associated with current machine": {def: "m_with_userdata_child_associated_one_state.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_9999")},
-
-		// Space handling
-		"Not enough free space on user pool":                       {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "99", wantErr: true},
-		"Take user snapshot, not enough free space on other pools": {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "99"},
-		"Capacity is invalid":                                      {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "NaN", wantErr: true},
+		"Current is main state":                         {cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234"), wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
+		"Current is a clone":                            {cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678"), wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_5678"},
+		"Booted on snapshot uses mounted":               {cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234@snap1"), mountedDataset: "rpool/ROOT/ubuntu_1234", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
+		"Current on systemd-boot":                       {cmdline: `initrd=\EFI\ubuntu\initrd.img-5.4.0-21-generic root=ZFS=rpool/ROOT/ubuntu_5678 rw`, wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_5678"},
+		"Current on systemd-boot with dracut root form": {cmdline: `initrd=\EFI\ubuntu\initrd.img-5.4.0-21-generic root=zfs:rpool/ROOT/ubuntu_5678 rw`, wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_5678"},
 
-		// Error cases with non-existent user, snapshot exists on root, on userdataset, on system child, on user child
-		"Error on empty user":                       {def: "m_with_userdata.yaml", userName: "-", wantErr: true, isNoOp: true},
-		"Error on non existent user":                {def: "m_with_userdata.yaml", userName: "nonexistent", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on system root": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_root_snapshot", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on user root":   {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_root_snapshot", wantErr: true, isNoOp: true},
-		"Error on existing snapshot on user child":  {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_child_snapshot", wantErr: true, isNoOp: true},
-		// We don’t handle that case: the snapshot is only on a child, so it’s not part of history of this machine, and can’t be automatically reverted to it
-		//"Error on existing snapshot on system child": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_child_snapshot", wantErr: true, isNoOp: true},
+		"Root selected by initramfs uses mounted": {cmdline: "ro root=zfs:AUTO", mountedDataset: "rpool/ROOT/ubuntu_1234", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
 
-		"Non zsys":   {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
-		"No machine": {def: "m_with_userdata_no_zsys.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), wantErr: true, isNoOp: true},
+		"No current machine":               {cmdline: generateCmdLine("rpool/ROOT/foo")},
+		"Booted on snapshot without mount": {cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234@snap1")},
+		"Not a zfs system":                 {cmdline: "aaaaa bbbbb"},
 	}
 
 	for name, tc := range tests {
@@ -1072,125 +1383,109 @@ func TestCreateUserSnapshot(t *testing.T) {
 			t.Parallel()
 			dir, cleanup := testutils.TempDir(t)
 			defer cleanup()
+
 			libzfs := testutils.GetMockZFS(t)
-			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_persistent.yaml"), testutils.WithLibZFS(libzfs))
 			defer fPools.Create(dir)()
 
-			if tc.userName == "" {
-				tc.userName = "user1"
-			} else if tc.userName == "-" {
-				tc.userName = ""
-			}
-			if tc.cmdline == "" {
-				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			if tc.mountedDataset != "" {
+				lzfs := libzfs.(*mock.LibZFS)
+				lzfs.SetDatasetAsMounted(tc.mountedDataset, true)
 			}
 
 			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
 			if err != nil {
 				t.Error("expected success but got an error scanning for machines", err)
 			}
-			lzfs := libzfs.(*mock.LibZFS)
-
-			lzfs.ForceLastUsedTime(true)
-			if tc.setCapOnPool != "" {
-				lzfs.SetPoolCapacity(tc.setCapOnPool, tc.capValue)
-			}
-
-			initMachines := ms.CopyForTests(t)
-
-			snapshotName, err := ms.CreateUserSnapshot(context.Background(), tc.userName, tc.snapshotName)
-			if err != nil {
-				if !tc.wantErr {
-					t.Fatalf("expected no error but got: %v", err)
-				}
-				return
-			}
-			if err == nil && tc.wantErr {
-				t.Fatal("expected an error but got none")
-			}
 
-			if tc.snapshotName != "" {
-				if snapshotName != tc.snapshotName {
-					t.Errorf("provided snapshotname isn't the one used. Want: %s, got: %s", tc.snapshotName, snapshotName)
-				}
+			m, ok := ms.CurrentMachine()
+			assert.Equal(t, tc.wantMachine != "", ok, "Expected current machine ok flag")
+			if ok {
+				assert.Equal(t, tc.wantMachine, m.ID, "Expected current machine")
 			} else {
-				if !strings.HasPrefix(snapshotName, machines.AutomatedSnapshotPrefix) {
-					t.Errorf("generated snapshotname should start with %s, but got: %s", machines.AutomatedSnapshotPrefix, snapshotName)
-				}
+				assert.Nil(t, m, "Expected no current machine")
 			}
 
-			if tc.isNoOp {
-				assertMachinesEquals(t, initMachines, ms)
+			s, ok := ms.CurrentState()
+			assert.Equal(t, tc.wantState != "", ok, "Expected current state ok flag")
+			if ok {
+				assert.Equal(t, tc.wantState, s.ID, "Expected current state")
 			} else {
-				assertMachinesToGolden(t, ms)
-				assertMachinesNotEquals(t, initMachines, ms)
+				assert.Nil(t, s, "Expected no current state")
 			}
-
-			// finale rescan uneeded if last one failed
-			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
-			if err != nil {
-				t.Error("expected success but got an error scanning for machines", err)
-			}
-			assertMachinesEquals(t, machinesAfterRescan, ms)
 		})
 	}
 }
 
-func TestRemoveState(t *testing.T) {
+func TestIsCurrentAndIsHistory(t *testing.T) {
 	t.Parallel()
 	tests := map[string]struct {
-		def            string
-		currentStateID string
-		state          string
-		user           string
-		force          bool
-
-		destroyErrDS []string
+		def     string
+		cmdline string
+		machine string
 
-		isNoOp              bool
-		wantErr             bool
-		wantConfirmationErr bool
+		wantCurrent bool
 	}{
-		"Remove system state, one dataset": {def: "m_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234"},
-
-		// FIXME: miss bpool and bpool/BOOT from golden file
-		"Remove system state, complex with boot, children and user datasets": {def: "m_layout1_one_machine.yaml", state: "rpool/ROOT/ubuntu_1234"},
-		"Remove one system snapshot only":                                    {def: "state_remove_internal.yaml", state: "rpool/ROOT/ubuntu_1234@snap3"},
-		"Removing system state try to delete its snapshots":                  {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_6789", wantErr: true, wantConfirmationErr: true},
-		"Removing system state deletes its snapshots":                        {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_6789", force: true},
+		"Current machine":    {def: "m_bootlist.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234"), machine: "rpool/ROOT/ubuntu_1234", wantCurrent: true},
+		"Booted on a clone":  {def: "m_bootlist.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678"), machine: "rpool/ROOT/ubuntu_1234", wantCurrent: true},
+		"Other machine":      {def: "m_with_swap_volumes.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234"), machine: "rpool/ROOT/ubuntu_5678"},
+		"No current machine": {def: "m_bootlist.yaml", cmdline: generateCmdLine("rpool/ROOT/foo"), machine: "rpool/ROOT/ubuntu_1234"},
+	}
 
-		"Remove system state, with system and users snapshots and clones":         {def: "m_layout1_machines_with_snapshots_clones.yaml", state: "rpool/ROOT/ubuntu_1234", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove system state, with system and users snapshots and clones, forced": {def: "m_layout1_machines_with_snapshots_clones.yaml", state: "rpool/ROOT/ubuntu_1234", force: true},
-		"Remove system state when user datasets are linked to 2 states":           {def: "state_remove_internal.yaml", state: "rpool/ROOT/ubuntu_5678"},
-		"Remove system state, with datasets":                                      {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_1234", wantConfirmationErr: true, wantErr: true, isNoOp: true},
-		"Remove system state, with datasets, forced":                              {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_1234", force: true},
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
 
-		"Remove user state, one dataset":                       {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", user: "user4"},
-		"Remove user state, one dataset, no user":              {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", wantErr: true, isNoOp: true},
-		"Remove user state, one dataset, wrong user":           {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", user: "root", wantErr: true, isNoOp: true},
-		"Remove user state, with snapshots and clones":         {def: "state_remove.yaml", user: "user6", state: "rpool/USERDATA/user6_clone1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove user state, with snapshots and clones, forced": {def: "state_remove.yaml", user: "user6", state: "rpool/USERDATA/user6_clone1", force: true},
-		"Remove user state, with datasets":                     {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone@snapuser5", user: "user5", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove user state, with datasets, forced":             {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone@snapuser5", user: "user5", force: true},
-		"Remove user snapshot state":                           {def: "state_remove.yaml", state: "rpool/USERDATA/user1_efgh@snapuser2", user: "user1"},
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
 
-		"Can’t remove user leaf snapshot linked to system state":                                 {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd@snap1", user: "user1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove user leaf snapshot linked to system state, forced":                               {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd@snap1", user: "user1", force: true},
-		"Can’t remove user leaf filesystem state linked to system state":                         {def: "state_remove.yaml", state: "rpool/USERDATA/user3_3333", user: "user3", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove user leaf filesystem state linked to system state, forced":                       {def: "state_remove.yaml", state: "rpool/USERDATA/user3_3333", user: "user3", force: true},
-		"Can’t remove user filesystem linked to system state with deps linked to system state":   {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd", user: "user1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
-		"Remove user filesystem linked to system state with deps linked to system state, forced": {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd", user: "user1", force: true},
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
 
-		// Shared user state handling
-		"Remove shared user state linked to a history state. Deps are not removed":                         {def: "state_remove.yaml", state: "rpool/USERDATA/root_bcde-rpool.ROOT.ubuntu-5678", user: "root", force: true},
-		"Remove shared user state linked to current machine state. Deps are not removed":                   {def: "state_remove.yaml", state: "rpool/USERDATA/root_bcde-rpool.ROOT.ubuntu-1234", user: "root", force: true},
-		"Remove shared user state as a dependency of other state. Deps are removed":                        {def: "m_shared_userstate_on_clones.yaml", state: "rpool/USERDATA/user_abcd", user: "user", force: true},
-		"Remove shared user state on different matchines as a dependency of other state. Deps are removed": {def: "m_shared_userstate_on_two_machines.yaml", state: "rpool/USERDATA/user_abcd", user: "user", force: true},
+			m, err := ms.GetMachine(tc.machine)
+			if err != nil {
+				t.Fatalf("couldn't get machine %s: %v", tc.machine, err)
+			}
+			assert.Equal(t, tc.wantCurrent, m.IsCurrent(&ms), "Unexpected current machine")
+
+			// Machines are compared by identity
+			copied := *m
+			assert.False(t, copied.IsCurrent(&ms), "A copy of a machine is never current")
+			var noMachine *machines.Machine
+			assert.False(t, noMachine.IsCurrent(&ms), "No machine is never current")
+
+			assert.False(t, m.State.IsHistory(m), "Main state isn't part of history")
+			for id, h := range m.History {
+				assert.True(t, h.IsHistory(m), "%s should be part of history", id)
+				copiedState := *h
+				assert.False(t, copiedState.IsHistory(m), "A copy of %s isn't part of history", id)
+				assert.False(t, h.IsHistory(nil), "%s isn't part of any history without machine", id)
+			}
+			var noState *machines.State
+			assert.False(t, noState.IsHistory(m), "No state is never part of history")
+		})
+	}
+}
+func TestSetCmdline(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
 
-		"No state given": {def: "m_with_userdata.yaml", wantErr: true, isNoOp: true},
-		"Error on trying to remove current state":    {def: "m_with_userdata.yaml", currentStateID: "rpool/ROOT/ubuntu_1234", state: "rpool/ROOT/ubuntu_1234", wantErr: true, isNoOp: true},
-		"Error on destroy state, one dataset":        {def: "m_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234", destroyErrDS: []string{}, wantErr: true, isNoOp: true},
-		"Error on destroy user state, with datasets": {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone", user: "user5", force: true, destroyErrDS: []string{}, wantErr: true},
+		wantCurrent string
+		wantErr     bool
+	}{
+		"Current machine":                  {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234"), wantCurrent: "rpool/ROOT/ubuntu_1234"},
+		"History state of a machine":       {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678"), wantCurrent: "rpool/ROOT/ubuntu_1234"},
+		"Not a zfs system":                 {def: "m_clone_with_userdata.yaml", cmdline: "BOOT_IMAGE=/vmlinuz-5.4.0-21-generic root=UUID=e8ae3b4a ro"},
+		"Error on unknown root":            {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), wantErr: true},
+		"Error on unknown dataset as root": {def: "d_one_machine_one_dataset.yaml", cmdline: generateCmdLine("rpool/doesntexist"), wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -1204,106 +1499,4582 @@ func TestRemoveState(t *testing.T) {
 			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
 			defer fPools.Create(dir)()
 
-			ms, err := machines.New(context.Background(), generateCmdLine(tc.currentStateID), machines.WithLibZFS(libzfs))
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
 			if err != nil {
 				t.Error("expected success but got an error scanning for machines", err)
 			}
-
 			initMachines := ms.CopyForTests(t)
-			lzfs := libzfs.(*mock.LibZFS)
-			lzfs.ErrOnDestroyDS(tc.destroyErrDS)
 
-			err = ms.RemoveState(context.Background(), tc.state, tc.user, tc.force, false)
+			err = ms.SetCmdline(context.Background(), tc.cmdline)
 			if err != nil {
 				if !tc.wantErr {
 					t.Fatalf("expected no error but got: %v", err)
 				}
-				var e *machines.ErrStateRemovalNeedsConfirmation
-
-				if tc.wantConfirmationErr {
-					assert.True(t, errors.As(err, &e), "expected ErrStateRemovalNeedsConfirmation error type")
-				} else {
-					assert.False(t, errors.As(err, &e), "don't expect ErrStateRemovalNeedsConfirmation error type")
-				}
+				assertMachinesEquals(t, initMachines, ms)
 				return
 			}
-			if err == nil && tc.wantErr {
+			if tc.wantErr {
 				t.Fatal("expected an error but got none")
 			}
 
-			if tc.isNoOp {
-				assertMachinesEquals(t, initMachines, ms)
-			} else {
-				assertMachinesToGolden(t, ms)
-				assertMachinesNotEquals(t, initMachines, ms)
-			}
+			m, ok := ms.CurrentMachine()
+			if tc.wantCurrent == "" {
+				assert.False(t, ok, "Expected no current machine")
+			} else {
+				assert.True(t, ok, "Expected a current machine")
+				assert.Equal(t, tc.wantCurrent, m.ID, "Unexpected current machine")
+			}
+
+			// Same than scanning with this command line, either positional or as an option.
+			msWithCmdline, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, msWithCmdline, ms)
+			msWithOption, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs), machines.WithCmdline(tc.cmdline))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, msWithOption, ms)
+		})
+	}
+}
+
+func TestStateUsers(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
+
+	want := map[string]map[string]string{
+		"rpool/ROOT/ubuntu_1234":       {"root": "rpool/USERDATA/root_bcde", "user1": "rpool/USERDATA/user1_abcd"},
+		"rpool/ROOT/ubuntu_1234@snap1": {"user1": "rpool/USERDATA/user1_abcd@snap1"},
+		"rpool/ROOT/ubuntu_5678":       {"user1": "rpool/USERDATA/user1_efgh"},
+	}
+
+	got := make(map[string]map[string]string)
+	for _, m := range ms.Machines() {
+		states := []*machines.State{&m.State}
+		for _, h := range m.History {
+			states = append(states, h)
+		}
+		for _, s := range states {
+			got[s.ID] = make(map[string]string)
+			for user, us := range s.Users {
+				got[s.ID][user] = us.ID
+			}
+		}
+	}
+
+	assert.Equal(t, want, got, "Expected user states attached to current and history states")
+}
+
+func TestRenamedUsers(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		renames map[string]string
+
+		wantUsers        map[string]map[string]string
+		wantMachineUsers []string
+		wantErr          bool
+	}{
+		"Renamed user is split without renames": {
+			wantUsers: map[string]map[string]string{
+				"rpool/ROOT/ubuntu_1234":       {"bob": "rpool/USERDATA/bob_efgh"},
+				"rpool/ROOT/ubuntu_1234@snap1": {"bob": "rpool/USERDATA/bob_efgh@snap1"},
+				"rpool/ROOT/ubuntu_5678":       {"alice": "rpool/USERDATA/alice_abcd"},
+			},
+			wantMachineUsers: []string{"alice", "bob"}},
+		"Renamed user is merged": {renames: map[string]string{"alice": "bob"},
+			wantUsers: map[string]map[string]string{
+				"rpool/ROOT/ubuntu_1234":       {"bob": "rpool/USERDATA/bob_efgh"},
+				"rpool/ROOT/ubuntu_1234@snap1": {"bob": "rpool/USERDATA/bob_efgh@snap1"},
+				"rpool/ROOT/ubuntu_5678":       {"bob": "rpool/USERDATA/alice_abcd"},
+			},
+			wantMachineUsers: []string{"bob"}},
+		"User renamed multiple times is merged under last name": {renames: map[string]string{"alice": "carol", "carol": "bob"},
+			wantUsers: map[string]map[string]string{
+				"rpool/ROOT/ubuntu_1234":       {"bob": "rpool/USERDATA/bob_efgh"},
+				"rpool/ROOT/ubuntu_1234@snap1": {"bob": "rpool/USERDATA/bob_efgh@snap1"},
+				"rpool/ROOT/ubuntu_5678":       {"bob": "rpool/USERDATA/alice_abcd"},
+			},
+			wantMachineUsers: []string{"bob"}},
+		"Unknown renamed user is ignored": {renames: map[string]string{"dave": "bob"},
+			wantUsers: map[string]map[string]string{
+				"rpool/ROOT/ubuntu_1234":       {"bob": "rpool/USERDATA/bob_efgh"},
+				"rpool/ROOT/ubuntu_1234@snap1": {"bob": "rpool/USERDATA/bob_efgh@snap1"},
+				"rpool/ROOT/ubuntu_5678":       {"alice": "rpool/USERDATA/alice_abcd"},
+			},
+			wantMachineUsers: []string{"alice", "bob"}},
+
+		"Error on empty user":          {renames: map[string]string{"alice": ""}, wantErr: true},
+		"Error on user renamed itself": {renames: map[string]string{"alice": "alice"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_renamed_user.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithRenamedUsers(tc.renames))
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			m, ok := ms.CurrentMachine()
+			if !ok {
+				t.Fatal("expected a current machine")
+			}
+			var gotMachineUsers []string
+			for user := range m.AllUsersStates {
+				gotMachineUsers = append(gotMachineUsers, user)
+			}
+			sort.Strings(gotMachineUsers)
+			assert.Equal(t, tc.wantMachineUsers, gotMachineUsers, "Unexpected users of the machine")
+
+			got := make(map[string]map[string]string)
+			states := []*machines.State{&m.State}
+			for _, h := range m.History {
+				states = append(states, h)
+			}
+			for _, s := range states {
+				got[s.ID] = make(map[string]string)
+				for user, us := range s.Users {
+					got[s.ID][user] = us.ID
+				}
+			}
+			assert.Equal(t, tc.wantUsers, got, "Unexpected user states attached to current and history states")
+
+			// Renames are applied again on refresh
+			if err := ms.Refresh(context.Background()); err != nil {
+				t.Fatalf("expected no error refreshing but got: %v", err)
+			}
+			m, _ = ms.CurrentMachine()
+			var gotUsersAfterRefresh []string
+			for user := range m.AllUsersStates {
+				gotUsersAfterRefresh = append(gotUsersAfterRefresh, user)
+			}
+			sort.Strings(gotUsersAfterRefresh)
+			assert.Equal(t, tc.wantMachineUsers, gotUsersAfterRefresh, "Unexpected users of the machine after refresh")
+		})
+	}
+}
+
+func TestMachines(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantIDs []string
+	}{
+		"One machine":                        {def: "d_one_machine_one_dataset.yaml", wantIDs: []string{"rpool"}},
+		"Two machines are sorted":            {def: "d_two_machines_one_dataset.yaml", wantIDs: []string{"rpool", "rpool2"}},
+		"History states are not machines":    {def: "m_clone_with_userdata.yaml", wantIDs: []string{"rpool/ROOT/ubuntu_1234"}},
+		"No machine":                         {def: "d_no_machine.yaml"},
+		"Non zsys machines are still listed": {def: "d_two_machines_one_zsys_one_non_zsys.yaml", wantIDs: []string{"rpool", "rpool2"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var gotIDs []string
+			for _, m := range ms.Machines() {
+				gotIDs = append(gotIDs, m.ID)
+			}
+			assert.Equal(t, tc.wantIDs, gotIDs, "Expected machines returned in order")
+		})
+	}
+}
+
+func TestBootDatasetsAssociation(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantDatasets map[string][]string
+	}{
+		"Machines with prefixed IDs don't share boot datasets": {def: "m_two_machines_prefixed_ids_separate_boot.yaml",
+			wantDatasets: map[string][]string{
+				"rpool/ROOT/ubuntu_1234": {"bpool/BOOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234"},
+				"rpool/ROOT/ubuntu_12345": {"bpool/BOOT/ubuntu_12345", "bpool/BOOT/ubuntu_12345/grub", "bpool/BOOT/ubuntu_12345/ubuntu_1234",
+					"rpool/ROOT/ubuntu_12345"},
+				// Boot dataset explicitly associated to another system state
+				"rpool/ROOT/ubuntu_5678": {"rpool/ROOT/ubuntu_5678"},
+			}},
+		"Snapshots with the same name on machines with prefixed IDs": {def: "m_two_machines_prefixed_ids_snapshots_separate_boot.yaml",
+			wantDatasets: map[string][]string{
+				"rpool/ROOT/ubuntu_1234":        {"bpool/BOOT/ubuntu_1234", "bpool/BOOT/ubuntu_1234/grub", "rpool/ROOT/ubuntu_1234"},
+				"rpool/ROOT/ubuntu_1234@snap1":  {"bpool/BOOT/ubuntu_1234/grub@snap1", "bpool/BOOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_1234@snap1"},
+				"rpool/ROOT/ubuntu_12345":       {"bpool/BOOT/ubuntu_12345", "rpool/ROOT/ubuntu_12345"},
+				"rpool/ROOT/ubuntu_12345@snap1": {"bpool/BOOT/ubuntu_12345@snap1", "rpool/ROOT/ubuntu_12345@snap1"},
+				"rpool/ROOT/ubuntu_5678":        {"bpool/BOOT/ubuntu_5678", "rpool/ROOT/ubuntu_5678"},
+				// Boot dataset not promoted with its system one: its snapshot is on a boot dataset of another state
+				"rpool/ROOT/ubuntu_5678@snap2": {"bpool/BOOT/ubuntu_9999@snap2", "rpool/ROOT/ubuntu_5678@snap2"},
+				"rpool/ROOT/ubuntu_9999":       {"bpool/BOOT/ubuntu_9999", "rpool/ROOT/ubuntu_9999"},
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			got := make(map[string][]string)
+			for _, m := range ms.Machines() {
+				got[m.ID] = stateDatasetNames(m.State)
+				for id, h := range m.History {
+					got[id] = stateDatasetNames(*h)
+				}
+			}
+			assert.Equal(t, tc.wantDatasets, got, "Unexpected datasets attached to states")
+		})
+	}
+}
+
+func TestSortedIDs(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantMachines []string
+		wantHistory  map[string][]string
+	}{
+		"One machine with history": {def: "m_clone_with_userdata.yaml",
+			wantMachines: []string{"rpool/ROOT/ubuntu_1234"},
+			wantHistory:  map[string][]string{"rpool/ROOT/ubuntu_1234": {"rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678"}}},
+		"Multiple machines": {def: "m_two_machines_prefixed_ids_snapshots_separate_boot.yaml",
+			wantMachines: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_12345", "rpool/ROOT/ubuntu_5678"},
+			wantHistory: map[string][]string{
+				"rpool/ROOT/ubuntu_1234":  {"rpool/ROOT/ubuntu_1234@snap1"},
+				"rpool/ROOT/ubuntu_12345": {"rpool/ROOT/ubuntu_12345@snap1"},
+				"rpool/ROOT/ubuntu_5678":  {"rpool/ROOT/ubuntu_5678@snap2", "rpool/ROOT/ubuntu_9999"},
+			}},
+		"No machine": {def: "d_no_machine.yaml", wantMachines: []string{}, wantHistory: map[string][]string{}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			assert.Equal(t, tc.wantMachines, ms.SortedMachineIDs(), "Unexpected machine IDs order")
+			gotHistory := make(map[string][]string)
+			for i, m := range ms.Machines() {
+				assert.Equal(t, tc.wantMachines[i], m.ID, "Machines() should be in the same order than SortedMachineIDs()")
+				gotHistory[m.ID] = m.SortedHistoryIDs()
+			}
+			assert.Equal(t, tc.wantHistory, gotHistory, "Unexpected history IDs order")
+		})
+	}
+}
+
+func TestUserStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def  string
+		user string
+
+		wantUsers  []string
+		wantStates []string
+		wantErr    bool
+	}{
+		"Current first, then most recent": {def: "m_clone_with_userdata.yaml", user: "user1",
+			wantUsers:  []string{"root", "user1"},
+			wantStates: []string{"rpool/USERDATA/user1_abcd", "rpool/USERDATA/user1_abcd@snap1", "rpool/USERDATA/user1_efgh"}},
+		"Only current state": {def: "m_clone_with_userdata.yaml", user: "root",
+			wantUsers:  []string{"root", "user1"},
+			wantStates: []string{"rpool/USERDATA/root_bcde"}},
+
+		"Error on unknown user":          {def: "m_clone_with_userdata.yaml", user: "doesntexist", wantUsers: []string{"root", "user1"}, wantErr: true},
+		"Error on machine without users": {def: "d_one_machine_one_dataset.yaml", user: "user1", wantUsers: []string{}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			m := ms.Machines()[0]
+
+			assert.Equal(t, tc.wantUsers, m.UserNames(), "Unexpected users")
+
+			states, err := m.UserStates(tc.user)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			var got []string
+			for _, s := range states {
+				got = append(got, s.ID)
+			}
+			assert.Equal(t, tc.wantStates, got, "Unexpected user states order")
+		})
+	}
+}
+
+func TestStatesOlderThan(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		d   time.Duration
+
+		wantStates []string
+	}{
+		"All history states, oldest first": {def: "m_clone_with_userdata.yaml",
+			wantStates: []string{"rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678"}},
+		"Only states older than duration": {def: "m_clone_with_userdata.yaml", d: time.Since(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)),
+			wantStates: []string{"rpool/ROOT/ubuntu_1234@snap1"}},
+		"No state older than duration": {def: "m_clone_with_userdata.yaml", d: time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))},
+
+		"No history": {def: "d_one_machine_one_dataset.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			m := ms.Machines()[0]
+
+			var got []string
+			for _, s := range m.StatesOlderThan(tc.d) {
+				got = append(got, s.ID)
+			}
+			assert.Equal(t, tc.wantStates, got, "Unexpected states")
+		})
+	}
+}
+
+func TestMachineForUserDataset(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		dataset string
+
+		wantMachine string
+		wantState   string
+		wantErr     bool
+	}{
+		"User dataset of main state":       {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/user1_abcd", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
+		"Other user dataset of main state": {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/root_bcde", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
+		"User dataset of clone state":      {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/user1_efgh", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_5678"},
+		"User snapshot of snapshot state":  {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/user1_abcd@snap1", wantMachine: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234@snap1"},
+
+		"Error on persistent dataset":   {def: "m_clone_with_persistent.yaml", dataset: "rpool/opt", wantErr: true},
+		"Error on unassociated dataset": {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA", wantErr: true},
+		"Error on unknown dataset":      {def: "m_clone_with_userdata.yaml", dataset: "rpool/USERDATA/doesntexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			m, s, err := ms.MachineForUserDataset(tc.dataset)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantMachine, m.ID, "Unexpected owning machine")
+			if tc.wantState == "" {
+				assert.Nil(t, s, "Expected no owning system state")
+				return
+			}
+			assert.Equal(t, tc.wantState, s.ID, "Unexpected owning system state")
+		})
+	}
+}
+
+func TestOrphanDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantOrphans []string
+		wantReasons map[string]string
+	}{
+		"System and user orphan clones": {def: "m_orphan_clones.yaml",
+			wantOrphans: []string{"rpool/ROOT/ubuntu_9999", "rpool/USERDATA/user2_bbbb"},
+			wantReasons: map[string]string{
+				"rpool/ROOT/ubuntu_9999":    "clone of rpool/ROOT/ubuntu_doesntexist@snap1 isn't a boot, user or system dataset of any machine",
+				"rpool/USERDATA/user2_bbbb": "user clone of rpool/USERDATA/user2_aaaa@usersnap1 isn't associated to any machine",
+			}},
+		"User clone with missing origin": {def: "m_clone_origin_doesnt_exist.yaml",
+			wantOrphans: []string{"rpool/USERDATA/user1_abcd"},
+			wantReasons: map[string]string{
+				"rpool/USERDATA/user1_abcd": "origin nopool/USERDATA/ubuntu_1234@snap1 of user clone doesn't exist",
+			}},
+		"Attached clones aren't orphans": {def: "m_clone_with_userdata.yaml"},
+		"No machine":                     {def: "d_no_machine.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, d := range ms.OrphanDatasets() {
+				got = append(got, d.Name)
+				reason, ok := ms.OrphanReason(d.Name)
+				assert.True(t, ok, "Orphan %s should have a reason", d.Name)
+				assert.Equal(t, tc.wantReasons[d.Name], reason, "Unexpected reason for orphan %s", d.Name)
+			}
+			assert.Equal(t, tc.wantOrphans, got, "Unexpected orphan datasets")
+
+			_, ok := ms.OrphanReason("rpool/ROOT/ubuntu_1234")
+			assert.False(t, ok, "Main dataset isn't an orphan")
+		})
+	}
+}
+
+func TestSwapDatasets(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_swap_volumes.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
+
+	swapNames := func(id string) (names []string) {
+		m, err := ms.GetMachine(id)
+		if err != nil {
+			t.Fatalf("couldn't get machine %s: %v", id, err)
+		}
+		for _, d := range m.SwapDatasets {
+			assert.True(t, d.IsVolume, "Swap dataset %s should be a volume", d.Name)
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	// Volumes under a machine belong to it only, others are shared by all machines of the pool
+	assert.Equal(t, []string{"rpool/ROOT/ubuntu_1234/swap", "rpool/swap"}, swapNames("rpool/ROOT/ubuntu_1234"), "Unexpected swap datasets")
+	assert.Equal(t, []string{"rpool/swap"}, swapNames("rpool/ROOT/ubuntu_5678"), "Unexpected swap datasets")
+
+	m, _ := ms.GetMachine("rpool/ROOT/ubuntu_1234")
+	assert.Equal(t, uint64(1638400), m.SwapDatasets[0].VolSize, "Unexpected swap volume size")
+
+	machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
+	assertMachinesEquals(t, machinesAfterRescan, ms)
+}
+
+func TestWithPools(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		pools []string
+
+		wantMachines []string
+	}{
+		"All pools by default":         {def: "d_two_machines_one_dataset.yaml", wantMachines: []string{"rpool", "rpool2"}},
+		"Only machines of given pool":  {def: "d_two_machines_one_dataset.yaml", pools: []string{"rpool2"}, wantMachines: []string{"rpool2"}},
+		"Machines of all given pools":  {def: "d_two_machines_one_dataset.yaml", pools: []string{"rpool", "rpool2"}, wantMachines: []string{"rpool", "rpool2"}},
+		"No machine on unknown pool":   {def: "d_two_machines_one_dataset.yaml", pools: []string{"doesntexist"}},
+		"Boot pool excluded from scan": {def: "m_with_separate_boot.yaml", pools: []string{"rpool"}, wantMachines: []string{"rpool/ROOT/ubuntu_1234"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool"), machines.WithLibZFS(libzfs), machines.WithPools(tc.pools))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, m := range ms.Machines() {
+				got = append(got, m.ID)
+				if tc.pools == nil {
+					continue
+				}
+				for route := range m.Datasets {
+					pool := strings.SplitN(route, "/", 2)[0]
+					assert.Contains(t, tc.pools, pool, "%s is attached to %s but its pool isn't selected", route, m.ID)
+				}
+			}
+			assert.Equal(t, tc.wantMachines, got, "Unexpected machines")
+		})
+	}
+}
+
+func TestIgnoreDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def      string
+		patterns []string
+
+		wantOrphans []string
+		wantIgnored []string
+		wantErr     bool
+	}{
+		"No pattern": {def: "m_orphan_clones.yaml",
+			wantOrphans: []string{"rpool/ROOT/ubuntu_9999", "rpool/USERDATA/user2_bbbb"}},
+		"Ignore system orphan clone": {def: "m_orphan_clones.yaml", patterns: []string{"rpool/ROOT/ubuntu_9*"},
+			wantOrphans: []string{"rpool/USERDATA/user2_bbbb"},
+			wantIgnored: []string{"rpool/ROOT/ubuntu_9999"}},
+		"Ignore datasets with their snapshots and descendants": {def: "m_orphan_clones.yaml", patterns: []string{"rpool/USERDATA/user2_*"},
+			wantOrphans: []string{"rpool/ROOT/ubuntu_9999"},
+			wantIgnored: []string{"rpool/USERDATA/user2_aaaa", "rpool/USERDATA/user2_aaaa@usersnap1", "rpool/USERDATA/user2_bbbb"}},
+		"Multiple patterns": {def: "m_orphan_clones.yaml", patterns: []string{"rpool/ROOT/ubuntu_9999", "rpool/USERDATA/user2_bbbb"},
+			wantIgnored: []string{"rpool/ROOT/ubuntu_9999", "rpool/USERDATA/user2_bbbb"}},
+		"Pattern matching nothing": {def: "m_orphan_clones.yaml", patterns: []string{"nopool/*"},
+			wantOrphans: []string{"rpool/ROOT/ubuntu_9999", "rpool/USERDATA/user2_bbbb"}},
+
+		"Error on invalid pattern": {def: "m_orphan_clones.yaml", patterns: []string{"rpool/[ROOT"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs),
+				machines.WithTriageReport(), machines.WithIgnoreDatasets(tc.patterns))
+			if tc.wantErr {
+				assert.Error(t, err, "New should return an error but didn't")
+				return
+			}
+			assert.NoError(t, err, "New should return no error")
+
+			assertIgnored := func() {
+				t.Helper()
+				var got []string
+				for _, d := range ms.OrphanDatasets() {
+					got = append(got, d.Name)
+				}
+				assert.Equal(t, tc.wantOrphans, got, "Unexpected orphan datasets")
+
+				triaged := make(map[string]bool)
+				for _, d := range ms.TriageReport() {
+					triaged[d.Dataset] = true
+				}
+				assert.True(t, triaged["rpool/ROOT/ubuntu_1234"], "Main dataset should be triaged")
+				for _, n := range tc.wantIgnored {
+					assert.False(t, triaged[n], "%s should be ignored but was triaged", n)
+					_, ok := ms.OrphanReason(n)
+					assert.False(t, ok, "%s should be ignored but is an orphan", n)
+				}
+			}
+			assertIgnored()
+
+			// Refreshing an ignored dataset, or everything, keeps it ignored.
+			for _, n := range tc.wantIgnored {
+				if strings.Contains(n, "@") {
+					continue
+				}
+				err := ms.RefreshDataset(context.Background(), n)
+				assert.NoError(t, err, "RefreshDataset should return no error")
+			}
+			assertIgnored()
+			err = ms.Refresh(context.Background())
+			assert.NoError(t, err, "Refresh should return no error")
+			assertIgnored()
+		})
+	}
+}
+
+func TestSnapshotsMatching(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		pattern string
+
+		want []string
+	}{
+		"Prefix matches on all machines and clones": {def: "m_snapshots_matching.yaml", pattern: "autozsys_*",
+			want: []string{"rpool/ROOT/ubuntu_1234@autozsys_aaaa", "rpool/ROOT/ubuntu_1234@autozsys_bbbb", "rpool/ROOT/ubuntu_5678@autozsys_cccc", "rpool/ROOT/ubuntu_9999@autozsys_dddd"}},
+		"Exact snapshot name":                {def: "m_snapshots_matching.yaml", pattern: "manual", want: []string{"rpool/ROOT/ubuntu_1234@manual"}},
+		"Every snapshot, never clones":       {def: "m_snapshots_matching.yaml", pattern: "*", want: []string{"rpool/ROOT/ubuntu_1234@autozsys_aaaa", "rpool/ROOT/ubuntu_1234@autozsys_bbbb", "rpool/ROOT/ubuntu_1234@manual", "rpool/ROOT/ubuntu_5678@autozsys_cccc", "rpool/ROOT/ubuntu_9999@autozsys_dddd"}},
+		"Pattern on full ID matches nothing": {def: "m_snapshots_matching.yaml", pattern: "rpool/ROOT/ubuntu_1234@*"},
+		"No match":                           {def: "m_snapshots_matching.yaml", pattern: "doesntexist*"},
+		"Invalid pattern":                    {def: "m_snapshots_matching.yaml", pattern: "autozsys_[a"},
+		"No machine":                         {def: "d_no_machine.yaml", pattern: "*"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, s := range ms.SnapshotsMatching(tc.pattern) {
+				got = append(got, s.ID)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected matching snapshots")
+		})
+	}
+}
+
+func TestHistoryStatesWithBootOnOtherPool(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		id  string
+
+		wantRoutes []string
+	}{
+		"Main state":                  {def: "m_history_clones_chain_separate_boot.yaml", id: "rpool/ROOT/ubuntu_1234", wantRoutes: []string{"bpool/BOOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234"}},
+		"Clone":                       {def: "m_history_clones_chain_separate_boot.yaml", id: "rpool/ROOT/ubuntu_5678", wantRoutes: []string{"bpool/BOOT/ubuntu_5678", "rpool/ROOT/ubuntu_5678"}},
+		"Clone of a clone":            {def: "m_history_clones_chain_separate_boot.yaml", id: "rpool/ROOT/ubuntu_9999", wantRoutes: []string{"bpool/BOOT/ubuntu_9999", "rpool/ROOT/ubuntu_9999"}},
+		"Snapshot of main state":      {def: "m_history_clones_chain_separate_boot.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", wantRoutes: []string{"bpool/BOOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_1234@snap1"}},
+		"Snapshot of a history clone": {def: "m_history_clones_chain_separate_boot.yaml", id: "rpool/ROOT/ubuntu_5678@snap2", wantRoutes: []string{"bpool/BOOT/ubuntu_5678@snap2", "rpool/ROOT/ubuntu_5678@snap2"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			s, m, err := ms.GetStateByID(tc.id)
+			if err != nil {
+				t.Fatalf("Couldn't find state %s: %v", tc.id, err)
+			}
+			assert.Equal(t, "rpool/ROOT/ubuntu_1234", m.ID, "All states should be on the same machine")
+
+			var got []string
+			for route := range s.Datasets {
+				got = append(got, route)
+			}
+			sort.Strings(got)
+			assert.Equal(t, tc.wantRoutes, got, "System and boot datasets should be attached to the same state")
+			assert.Empty(t, ms.UnattachedSystemDatasets(), "No system or boot dataset should be left unattached")
+		})
+	}
+}
+
+func TestUnattachedSystemDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantUnattached []string
+		wantReasons    map[string]string
+	}{
+		"Unattached system and boot datasets": {def: "m_unattached_system_datasets.yaml",
+			wantUnattached: []string{"bpool/BOOT/ubuntu_5555", "rpool/ROOT/manual", "rpool/ROOT/ubuntu_1234/var@manual", "rpool/ROOT/ubuntu_9999"},
+			wantReasons: map[string]string{
+				"bpool/BOOT/ubuntu_5555":            "no parent match: boot dataset doesn't match any machine state",
+				"rpool/ROOT/manual":                 "no parent match: not a child, clone or snapshot of any machine state",
+				"rpool/ROOT/ubuntu_1234/var@manual": "no parent match: not a child, clone or snapshot of any machine state",
+				"rpool/ROOT/ubuntu_9999":            "no origin: clone chain of rpool/ROOT/ubuntu_9999 doesn't lead to any existing dataset",
+			}},
+		"Attached clones and separate boot": {def: "m_clone_with_separate_boot.yaml"},
+		"Attached clones and user datasets": {def: "m_clone_with_userdata.yaml"},
+		"User datasets are never reported":  {def: "m_orphan_clones.yaml", wantUnattached: []string{"rpool/ROOT/ubuntu_9999"}},
+		"No machine":                        {def: "d_no_machine.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, d := range ms.UnattachedSystemDatasets() {
+				got = append(got, d.Name)
+				reason, ok := ms.UnattachedReason(d.Name)
+				assert.True(t, ok, "Unattached dataset %s should have a reason", d.Name)
+				if want, ok := tc.wantReasons[d.Name]; ok {
+					assert.Equal(t, want, reason, "Unexpected reason for unattached dataset %s", d.Name)
+				}
+			}
+			assert.Equal(t, tc.wantUnattached, got, "Unexpected unattached system datasets")
+
+			_, ok := ms.UnattachedReason("rpool/ROOT/ubuntu_1234")
+			assert.False(t, ok, "Main dataset is attached")
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantErrs []machines.ValidationError
+	}{
+		"Valid machine with clone and user datasets": {def: "m_clone_with_userdata.yaml"},
+		"Valid non zsys machines":                    {def: "d_two_machines_one_zsys_one_non_zsys.yaml"},
+		"No machine":                                 {def: "d_no_machine.yaml"},
+
+		"Inconsistent bootfs and dangling user references": {def: "m_invalid_states.yaml",
+			wantErrs: []machines.ValidationError{
+				{Code: machines.ValidationInconsistentBootfs, Machine: "rpool/ROOT/ubuntu_1234", Dataset: "rpool/ROOT/ubuntu_5678",
+					Msg: "bootfs is false while machine bootfs is true"},
+				{Code: machines.ValidationDanglingUserReference, Dataset: "rpool/USERDATA/user1_abcd",
+					Msg: `associated to system state "rpool/ROOT/ubuntu_gone" which doesn't exist`},
+				{Code: machines.ValidationDanglingUserReference, Dataset: "rpool/USERDATA/user2_abcd",
+					Msg: `associated to system state "rpool/ROOT/ubuntu_gone" which doesn't exist`},
+			}},
+		"Mountpoint conflicts": {def: "m_mountpoint_conflicts.yaml",
+			wantErrs: []machines.ValidationError{
+				{Code: machines.ValidationMountpointConflict, Machine: "rpool/ROOT/ubuntu_1234", Dataset: "rpool/ROOT/ubuntu_1234/srv",
+					Msg: `mountpoint "/srv" is shared by rpool/ROOT/ubuntu_1234/srv, rpool/srv`},
+				{Code: machines.ValidationMountpointConflict, Dataset: "rpool/data1",
+					Msg: `mountpoint "/data" is shared by rpool/data1, rpool/data2`},
+			}},
+		"Multiple main root datasets on the same pool": {def: "m_duplicate_main_roots.yaml",
+			wantErrs: []machines.ValidationError{
+				{Code: machines.ValidationDuplicateMainRoot, Machine: "rpool/ROOT/ubuntu_1234", Dataset: "rpool/ROOT/ubuntu_1234",
+					Msg: `pool "rpool" has multiple main root datasets: rpool/ROOT/ubuntu_1234, rpool/ROOT/ubuntu_5678`},
+				{Code: machines.ValidationDuplicateMainRoot, Machine: "rpool/ROOT/ubuntu_5678", Dataset: "rpool/ROOT/ubuntu_5678",
+					Msg: `pool "rpool" has multiple main root datasets: rpool/ROOT/ubuntu_1234, rpool/ROOT/ubuntu_5678`},
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			errs := ms.Validate()
+
+			assert.Equal(t, tc.wantErrs, errs, "Unexpected validation errors")
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestDanglingUserLinks(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want []machines.DanglingLink
+	}{
+		"No dangling link": {def: "m_clone_with_userdata.yaml"},
+		"No user dataset":  {def: "d_one_machine_with_clone_dataset.yaml"},
+		"No machine":       {def: "d_no_machine.yaml"},
+		"Dangling user links": {def: "m_invalid_states.yaml",
+			want: []machines.DanglingLink{
+				{Dataset: "rpool/USERDATA/user1_abcd", SystemDataset: "rpool/ROOT/ubuntu_gone"},
+				{Dataset: "rpool/USERDATA/user2_abcd", SystemDataset: "rpool/ROOT/ubuntu_gone"},
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			links := ms.DanglingUserLinks()
+
+			assert.Equal(t, tc.want, links, "Unexpected dangling user links")
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestRelinkUserDataset(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def         string
+		userDataset string
+		stateID     string
+
+		wantUser           string
+		wantBootfsDatasets string
+		wantErr            bool
+	}{
+		"Relink dangling user dataset": {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user2_abcd", stateID: "rpool/ROOT/ubuntu_5678",
+			wantUser: "user2", wantBootfsDatasets: "rpool/ROOT/ubuntu_5678"},
+		"Relink drops dangling links and keeps valid ones": {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user1_abcd", stateID: "rpool/ROOT/ubuntu_5678",
+			wantUser: "user1", wantBootfsDatasets: "rpool/ROOT/ubuntu_1234,rpool/ROOT/ubuntu_5678"},
+		"Relink to an existing valid state only drops dangling links": {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user1_abcd", stateID: "rpool/ROOT/ubuntu_1234",
+			wantUser: "user1", wantBootfsDatasets: "rpool/ROOT/ubuntu_1234"},
+		"Relink to another state": {def: "m_clone_with_userdata.yaml", userDataset: "rpool/USERDATA/root_bcde", stateID: "rpool/ROOT/ubuntu_5678",
+			wantUser: "root", wantBootfsDatasets: "rpool/ROOT/ubuntu_1234,rpool/ROOT/ubuntu_5678"},
+		"Already associated user dataset": {def: "m_clone_with_userdata.yaml", userDataset: "rpool/USERDATA/user1_efgh", stateID: "rpool/ROOT/ubuntu_5678",
+			wantUser: "user1", wantBootfsDatasets: "rpool/ROOT/ubuntu_5678"},
+
+		"Error on unknown state":        {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user2_abcd", stateID: "rpool/ROOT/ubuntu_doesntexist", wantErr: true},
+		"Error on snapshot state":       {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user2_abcd", stateID: "rpool/ROOT/ubuntu_1234@snap1", wantErr: true},
+		"Error on unknown user dataset": {def: "m_invalid_states.yaml", userDataset: "rpool/USERDATA/user3_abcd", stateID: "rpool/ROOT/ubuntu_5678", wantErr: true},
+		"Error on system dataset":       {def: "m_invalid_states.yaml", userDataset: "rpool/ROOT/ubuntu_1234", stateID: "rpool/ROOT/ubuntu_5678", wantErr: true},
+		"Error on user snapshot":        {def: "m_clone_with_userdata.yaml", userDataset: "rpool/USERDATA/user1_abcd@snap1", stateID: "rpool/ROOT/ubuntu_5678", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			err = ms.RelinkUserDataset(context.Background(), tc.userDataset, tc.stateID)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			s, _, err := ms.GetStateByID(tc.stateID)
+			if err != nil {
+				t.Fatalf("expected state %q but got: %v", tc.stateID, err)
+			}
+			us, ok := s.Users[tc.wantUser]
+			if !ok {
+				t.Fatalf("expected user %q to be attached to %s", tc.wantUser, tc.stateID)
+			}
+			assert.Equal(t, tc.userDataset, us.ID, "Unexpected user state attached")
+			assert.Equal(t, tc.wantBootfsDatasets, us.Datasets[us.ID][0].BootfsDatasets, "Unexpected bootfs datasets")
+			for _, l := range ms.DanglingUserLinks() {
+				assert.NotEqual(t, tc.userDataset, l.Dataset, "Relinked user dataset shouldn't have any dangling link")
+			}
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestPools(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want []string
+	}{
+		"One pool":                           {def: "m_with_userdata.yaml", want: []string{"rpool"}},
+		"Separate boot pool":                 {def: "m_clone_with_separate_boot.yaml", want: []string{"bpool", "rpool"}},
+		"Persistent dataset on another pool": {def: "m_with_persistent_on_another_pool.yaml", want: []string{"cpool", "rpool"}},
+		"User datasets on another pool":      {def: "m_with_userdata_on_other_pool.yaml", want: []string{"rpool", "rpool2"}},
+		"Zsys and non zsys machines":         {def: "d_two_machines_one_zsys_one_non_zsys.yaml", want: []string{"rpool", "rpool2"}},
+		"Only persistent dataset":            {def: "d_no_machine.yaml", want: []string{"rpool"}},
+		"No dataset":                         {def: "d_no_dataset.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			assert.Equal(t, tc.want, ms.Pools(), "Unexpected pools")
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
+
+		want string
+	}{
+		"One machine without history": {def: "d_one_machine_one_dataset.yaml", cmdline: generateCmdLine("rpool"),
+			want: `Machine rpool (zsys, current)
+  Main state:
+    - rpool (last used: 2020-09-13 12:26:39, datasets: 1, size: 0 B)
+`},
+		"Machine with history and users": {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234"),
+			want: `Machine rpool/ROOT/ubuntu_1234 (zsys, current)
+  Main state:
+    - rpool/ROOT/ubuntu_1234 (last used: 2019-04-18 02:45:55, datasets: 1, size: 0 B)
+      - root: rpool/USERDATA/root_bcde (last used: 2018-08-03 21:55:33, datasets: 1, size: 0 B)
+      - user1: rpool/USERDATA/user1_abcd (last used: 2018-12-10 12:20:44, datasets: 1, size: 0 B)
+  History:
+    - rpool/ROOT/ubuntu_5678 (last used: 2019-12-31 07:36:17, datasets: 1, size: 0 B)
+      - user1: rpool/USERDATA/user1_efgh (last used: 2017-11-19 17:05:11, datasets: 1, size: 0 B)
+    - rpool/ROOT/ubuntu_1234@snap1 (last used: 2018-12-10 12:20:44, datasets: 1, size: 0 B)
+      - user1: rpool/USERDATA/user1_abcd@snap1 (last used: 2018-03-28 07:30:22, datasets: 1, size: 0 B)
+`},
+		"No current machine": {def: "d_one_machine_one_dataset.yaml",
+			want: `Machine rpool (zsys)
+  Main state:
+    - rpool (last used: 2020-09-13 12:26:39, datasets: 1, size: 0 B)
+`},
+		"No machine": {def: "d_no_machine.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var out strings.Builder
+			if err := ms.Describe(&out); err != nil {
+				t.Fatalf("Got an error when expecting none: %v", err)
+			}
+			assert.Equal(t, tc.want, out.String(), "Unexpected description")
+
+			// Output is stable
+			var again strings.Builder
+			if err := ms.Describe(&again); err != nil {
+				t.Fatalf("Got an error when expecting none: %v", err)
+			}
+			assert.Equal(t, out.String(), again.String(), "Description should be deterministic")
+		})
+	}
+}
+
+func TestEncryptedStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def          string
+		operation    string
+		state        string
+		user         string
+		keepUserData bool
+
+		wantEncrypted    map[string]bool
+		wantKeyNotLoaded string
+	}{
+		"Snapshot system with locked user dataset": {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "snapshot",
+			wantKeyNotLoaded: "rpool/USERDATA/user1_abcd"},
+		"Snapshot locked user":        {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "snapshot", user: "user1", wantKeyNotLoaded: "rpool/USERDATA/user1_abcd"},
+		"Snapshot non encrypted user": {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "snapshot", user: "root"},
+		"Revert to state with locked user dataset": {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "revert", state: "rpool/ROOT/ubuntu_1234@snap1",
+			wantKeyNotLoaded: "rpool/USERDATA/user1_abcd@snap1"},
+		"Revert to clone with locked user dataset": {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "revert", state: "rpool/ROOT/ubuntu_5678",
+			wantKeyNotLoaded: "rpool/USERDATA/user1_efgh"},
+		"Revert keeping locked user data": {def: "m_clone_with_userdata_encrypted_locked.yaml", operation: "revert", state: "rpool/ROOT/ubuntu_1234@snap1", keepUserData: true},
+
+		"Encrypted states": {def: "m_clone_with_userdata_encrypted_locked.yaml",
+			wantEncrypted: map[string]bool{
+				"rpool/ROOT/ubuntu_1234":       true,
+				"rpool/ROOT/ubuntu_1234@snap1": true,
+				"rpool/ROOT/ubuntu_5678":       true,
+			}},
+		"No encrypted state": {def: "m_clone_with_userdata.yaml",
+			wantEncrypted: map[string]bool{
+				"rpool/ROOT/ubuntu_1234":       false,
+				"rpool/ROOT/ubuntu_1234@snap1": false,
+				"rpool/ROOT/ubuntu_5678":       false,
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			if tc.wantEncrypted != nil {
+				m, _ := ms.CurrentMachine()
+				got := map[string]bool{m.ID: m.State.Encrypted()}
+				for id, h := range m.History {
+					got[id] = h.Encrypted()
+				}
+				assert.Equal(t, tc.wantEncrypted, got, "Unexpected encrypted states")
+				return
+			}
+
+			initMachines := ms.CopyForTests(t)
+
+			switch tc.operation {
+			case "snapshot":
+				if tc.user != "" {
+					_, err = ms.CreateUserSnapshot(context.Background(), tc.user, "snap2")
+				} else {
+					_, err = ms.CreateSystemSnapshot(context.Background(), "snap2")
+				}
+			case "revert":
+				_, err = ms.RevertToState(context.Background(), tc.state, machines.RevertOptions{KeepUserData: tc.keepUserData})
+			}
+
+			if tc.wantKeyNotLoaded == "" {
+				if err != nil {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+
+			var errKey zfs.ErrKeyNotLoaded
+			if !errors.As(err, &errKey) {
+				t.Fatalf("expected a key not loaded error but got: %v", err)
+			}
+			assert.Equal(t, tc.wantKeyNotLoaded, errKey.Dataset, "Unexpected dataset with key not loaded")
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestStrictLayout(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantErr bool
+	}{
+		"Valid layout":                  {def: "m_clone_with_userdata.yaml"},
+		"Machines on different pools":   {def: "d_two_machines_one_zsys_one_non_zsys.yaml"},
+		"Error on duplicate main roots": {def: "m_duplicate_main_roots.yaml", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			// Default mode never fails on layout
+			if _, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs)); err != nil {
+				t.Fatalf("expected no error without strict layout but got: %v", err)
+			}
+
+			_, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs), machines.WithStrictLayout())
+			if tc.wantErr {
+				assert.Error(t, err, "Expected an error on strict layout")
+				return
+			}
+			assert.NoError(t, err, "Expected no error on strict layout")
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
+	}{
+		"One machine":                             {def: "d_one_machine_one_dataset.yaml", cmdline: generateCmdLine("rpool")},
+		"Machine with clone and user datasets":    {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678")},
+		"Real machines with snapshots and clones": {def: "m_layout1_machines_with_snapshots_clones.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_1234")},
+		"No current machine":                      {def: "m_clone_with_userdata.yaml"},
+		"No machine":                              {def: "d_no_machine.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			b, err := json.Marshal(&ms)
+			if err != nil {
+				t.Fatalf("couldn't export machines to json: %v", err)
+			}
+			var got machines.Machines
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("couldn't import machines from json: %v", err)
+			}
+
+			assertMachinesEquals(t, ms, got)
+
+			// Current machine and user states are references to the machines map elements
+			wantM, wantOk := ms.CurrentMachine()
+			m, ok := got.CurrentMachine()
+			assert.Equal(t, wantOk, ok, "Current machine should be restored")
+			if !ok {
+				return
+			}
+			assert.Equal(t, wantM.ID, m.ID, "Current machine should be restored")
+			assert.Same(t, got.AllMachines()[m.ID], m, "Current machine should reference the machine in machines map")
+			states := []*machines.State{&m.State}
+			for _, h := range m.History {
+				states = append(states, h)
+			}
+			for _, s := range states {
+				for user, us := range s.Users {
+					var found bool
+					for _, aus := range m.AllUsersStates[user] {
+						if aus == us {
+							found = true
+						}
+					}
+					assert.True(t, found, "User state %s of %s should reference one of all user states", us.ID, s.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeHomeOnUserData(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		home    string
+		newHome string
+
+		setPropertyErr bool
+		scanErr        bool
+
+		wantErr bool
+		isNoOp  bool
+	}{
+		"Rename home": {def: "m_with_userdata.yaml"},
+
+		// Argument or matching issue
+		"Home doesn't match": {def: "m_with_userdata.yaml", home: "/home/userabcd", wantErr: true, isNoOp: true},
+		"System not zsys":    {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
+		"Old home empty":     {def: "m_with_userdata.yaml", home: "[empty]", wantErr: true, isNoOp: true},
+		"New home empty":     {def: "m_with_userdata.yaml", newHome: "[empty]", wantErr: true, isNoOp: true},
+
+		// Errors
+		"Set property fails":            {def: "m_with_userdata.yaml", setPropertyErr: true, wantErr: true, isNoOp: true},
+		"Scan fails does trigger error": {def: "m_with_userdata.yaml", scanErr: true, wantErr: true, isNoOp: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			lzfs := libzfs.(*mock.LibZFS)
+			lzfs.ForceLastUsedTime(true)
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			initMachines := ms.CopyForTests(t)
+
+			lzfs.ErrOnScan(tc.scanErr)
+			lzfs.ErrOnSetProperty(tc.setPropertyErr)
+
+			err = ms.ChangeHomeOnUserData(context.Background(), getDefaultValue(tc.home, "/home/user1"), getDefaultValue(tc.newHome, "/home/foo"))
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if tc.isNoOp {
+				assertMachinesEquals(t, initMachines, ms)
+			} else {
+				assertMachinesToGolden(t, ms)
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+
+			// finale rescan uneeded if last one failed
+			machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestCreateSystemSnapshot(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def          string
+		cmdline      string
+		snapshotName string
+
+		setCapOnPool string
+		capValue     string
+
+		wantErr bool
+		isNoOp  bool
+	}{
+		"Take one snapshot":       {def: "m_with_userdata.yaml"},
+		"Give a name to snapshot": {def: "m_with_userdata.yaml", snapshotName: "my_snapshot"},
+
+		"Children on system datasets": {def: "m_with_userdata_children_on_system.yaml"},
+		"Children on user datasets":   {def: "m_with_userdata_children_on_user.yaml"},
+		"Children on user datasets with one child non associated with current machine": {def: "m_with_userdata_child_associated_one_state.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_9999")},
+
+		"No associated userdata": {def: "d_one_machine_with_children.yaml", cmdline: generateCmdLine("rpool")},
+
+		// Free space handling
+		"Not enough free space on system pool":                {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "99", wantErr: true},
+		"Not enough free space on user pool":                  {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "99", wantErr: true},
+		"Capacity is invalid":                                 {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "NaN", wantErr: true},
+		"Take snapshot, not enough free space on other pools": {def: "m_without_userdata_prefer_system_pool.yaml", setCapOnPool: "rpool2", capValue: "99"},
+
+		// error cases with snapshot exists on root. on userdataset. on system child. on user child
+		"Error on existing snapshot on system root":  {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_root_snapshot", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on system child": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_child_snapshot", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on user root":    {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_root_snapshot", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on user child":   {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_child_snapshot", wantErr: true, isNoOp: true},
+
+		"Error when name starts with dash":            {def: "m_with_userdata.yaml", snapshotName: "-my_snapshot", wantErr: true, isNoOp: true},
+		"Error when name contains invalid characters": {def: "m_with_userdata.yaml", snapshotName: "my, snäpshôt, is beautiful,", wantErr: true, isNoOp: true},
+
+		"Non zsys":   {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
+		"No machine": {def: "m_with_userdata_no_zsys.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), wantErr: true, isNoOp: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			if tc.cmdline == "" {
+				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			}
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			lzfs := libzfs.(*mock.LibZFS)
+
+			lzfs.ForceLastUsedTime(true)
+			if tc.setCapOnPool != "" {
+				lzfs.SetPoolCapacity(tc.setCapOnPool, tc.capValue)
+			}
+
+			initMachines := ms.CopyForTests(t)
+
+			snapshotName, err := ms.CreateSystemSnapshot(context.Background(), tc.snapshotName)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if tc.snapshotName != "" {
+				if snapshotName != tc.snapshotName {
+					t.Errorf("provided snapshotname isn't the one used. Want: %s, got: %s", tc.snapshotName, snapshotName)
+				}
+			} else {
+				if !strings.HasPrefix(snapshotName, machines.AutomatedSnapshotPrefix) {
+					t.Errorf("generated snapshotname should start with %s, but got: %s", machines.AutomatedSnapshotPrefix, snapshotName)
+				}
+			}
+
+			if tc.isNoOp {
+				assertMachinesEquals(t, initMachines, ms)
+			} else {
+				assertMachinesToGolden(t, ms)
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+
+			// finale rescan uneeded if last one failed
+			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def  string
+		name string
+
+		wantState string
+		wantUsers map[string]string
+		wantErr   bool
+	}{
+		"Save system and users": {def: "m_with_userdata.yaml", name: "save",
+			wantState: "rpool/ROOT/ubuntu_1234@save",
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_abcd@save", "root": "rpool/USERDATA/root_bcde@save"}},
+		"Save with a generated name": {def: "m_with_userdata.yaml"},
+
+		"Roll back on existing user snapshot": {def: "m_with_userdata_and_multiple_snapshots.yaml", name: "user_root_snapshot", wantErr: true},
+		"Error on invalid name":               {def: "m_with_userdata.yaml", name: "bad/name", wantErr: true},
+		"Error on non zsys machine":           {def: "m_with_userdata_no_zsys.yaml", name: "save", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			id, err := ms.Snapshot(context.Background(), tc.name)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+				if err != nil {
+					t.Fatal("expected success but got an error scanning for machines", err)
+				}
+				assertMachinesEquals(t, initMachines, machinesAfterRescan)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if tc.wantState != "" {
+				assert.Equal(t, tc.wantState, id, "Unexpected new state ID")
+			}
+			s, _, err := ms.GetStateByID(id)
+			if err != nil {
+				t.Fatalf("expected new state %q but got: %v", id, err)
+			}
+			if tc.wantUsers != nil {
+				gotUsers := make(map[string]string)
+				for user, us := range s.Users {
+					gotUsers[user] = us.ID
+				}
+				assert.Equal(t, tc.wantUsers, gotUsers, "User snapshots should be linked to the new state")
+			}
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestCreateUserSnapshot(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def          string
+		cmdline      string
+		snapshotName string
+		userName     string
+
+		setCapOnPool string
+		capValue     string
+
+		wantErr bool
+		isNoOp  bool
+	}{
+		"Take one snapshot":                                   {def: "m_with_userdata.yaml"},
+		"Give a name to snapshot":                             {def: "m_with_userdata.yaml", snapshotName: "my_snapshot"},
+		"Take one snapshot on a machine with other snapshots": {def: "m_snapshot_with_userdata.yaml"},
+
+		"Children on user datasets": {def: "m_with_userdata_children_on_user.yaml"},
+		"Children on user datasets with one child non associated with current machine": {def: "m_with_userdata_child_associated_one_state.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_9999")},
+
+		// Space handling
+		"Not enough free space on user pool":                       {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "99", wantErr: true},
+		"Take user snapshot, not enough free space on other pools": {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool", capValue: "99"},
+		"Capacity is invalid":                                      {def: "m_with_userdata_on_other_pool.yaml", setCapOnPool: "rpool2", capValue: "NaN", wantErr: true},
+
+		// Error cases with non-existent user, snapshot exists on root, on userdataset, on system child, on user child
+		"Error on empty user":                       {def: "m_with_userdata.yaml", userName: "-", wantErr: true, isNoOp: true},
+		"Error on non existent user":                {def: "m_with_userdata.yaml", userName: "nonexistent", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on system root": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_root_snapshot", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on user root":   {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_root_snapshot", wantErr: true, isNoOp: true},
+		"Error on existing snapshot on user child":  {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "user_child_snapshot", wantErr: true, isNoOp: true},
+		// We don’t handle that case: the snapshot is only on a child, so it’s not part of history of this machine, and can’t be automatically reverted to it
+		//"Error on existing snapshot on system child": {def: "m_with_userdata_and_multiple_snapshots.yaml", snapshotName: "system_child_snapshot", wantErr: true, isNoOp: true},
+
+		"Non zsys":   {def: "m_with_userdata_no_zsys.yaml", wantErr: true, isNoOp: true},
+		"No machine": {def: "m_with_userdata_no_zsys.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), wantErr: true, isNoOp: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			if tc.userName == "" {
+				tc.userName = "user1"
+			} else if tc.userName == "-" {
+				tc.userName = ""
+			}
+			if tc.cmdline == "" {
+				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			}
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			lzfs := libzfs.(*mock.LibZFS)
+
+			lzfs.ForceLastUsedTime(true)
+			if tc.setCapOnPool != "" {
+				lzfs.SetPoolCapacity(tc.setCapOnPool, tc.capValue)
+			}
+
+			initMachines := ms.CopyForTests(t)
+
+			snapshotName, err := ms.CreateUserSnapshot(context.Background(), tc.userName, tc.snapshotName)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if tc.snapshotName != "" {
+				if snapshotName != tc.snapshotName {
+					t.Errorf("provided snapshotname isn't the one used. Want: %s, got: %s", tc.snapshotName, snapshotName)
+				}
+			} else {
+				if !strings.HasPrefix(snapshotName, machines.AutomatedSnapshotPrefix) {
+					t.Errorf("generated snapshotname should start with %s, but got: %s", machines.AutomatedSnapshotPrefix, snapshotName)
+				}
+			}
+
+			if tc.isNoOp {
+				assertMachinesEquals(t, initMachines, ms)
+			} else {
+				assertMachinesToGolden(t, ms)
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+
+			// finale rescan uneeded if last one failed
+			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestAutoSnapshot(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		naming *machines.SnapshotNaming
+		reason string
+
+		wantName          string
+		wantErr           bool
+		wantInvalidNaming bool
+	}{
+		"Default naming":                  {wantName: "autozsys_xxxxxx"},
+		"Default naming with reason":      {reason: "apt upgrade", wantName: "autozsys_xxxxxx"},
+		"Custom prefix":                   {naming: &machines.SnapshotNaming{Prefix: "mysnap"}, wantName: "mysnap_xxxxxx"},
+		"Custom prefix and timestamp":     {naming: &machines.SnapshotNaming{Prefix: "mysnap", TimestampFormat: "20060102-150405"}, reason: "daily", wantName: "mysnap_20200101-120000"},
+		"Timestamp with default prefix":   {naming: &machines.SnapshotNaming{Prefix: "autozsys", TimestampFormat: "2006-01-02"}, wantName: "autozsys_2020-01-01"},
+		"Error on empty prefix":           {naming: &machines.SnapshotNaming{}, wantInvalidNaming: true},
+		"Error on invalid prefix":         {naming: &machines.SnapshotNaming{Prefix: "my snap,"}, wantInvalidNaming: true},
+		"Error on invalid timestamp":      {naming: &machines.SnapshotNaming{Prefix: "mysnap", TimestampFormat: "2006/01/02"}, wantInvalidNaming: true},
+		"Error on snapshot already taken": {naming: &machines.SnapshotNaming{Prefix: "mysnap", TimestampFormat: "2006"}, wantName: "mysnap_2020", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			var ms machines.Machines
+			var err error
+			if tc.naming != nil {
+				ms, err = machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}),
+					machines.WithSnapshotNaming(*tc.naming))
+			} else {
+				ms, err = machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}))
+			}
+			if tc.wantInvalidNaming {
+				assert.Error(t, err, "New should fail with an invalid naming scheme")
+				return
+			}
+			assert.NoError(t, err, "New should succeed")
+
+			if tc.wantErr {
+				_, err := ms.CreateSystemSnapshot(context.Background(), tc.wantName)
+				assert.NoError(t, err, "Setup: CreateSystemSnapshot should succeed")
+			}
+
+			snapshotName, err := ms.AutoSnapshot(context.Background(), tc.reason)
+			if tc.wantErr {
+				assert.Error(t, err, "AutoSnapshot should fail")
+				return
+			}
+			assert.NoError(t, err, "AutoSnapshot should succeed")
+			assert.Equal(t, tc.wantName, snapshotName, "Unexpected generated snapshot name")
+
+			s, _, err := ms.GetStateByID("rpool/ROOT/ubuntu_1234@" + snapshotName)
+			assert.NoError(t, err, "snapshot state should be attached to the machine")
+			for route, ds := range s.Datasets {
+				for _, d := range ds {
+					assert.Equalf(t, tc.reason, d.SnapshotReason, "Unexpected snapshot reason on %s (route %s)", d.Name, route)
+				}
+			}
+			assert.Equal(t, machines.SnapshotSourceAutomatic, s.Source(), "Automatic snapshots should be tagged as such")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "rescanning machines should succeed")
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestSnapshotSource(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		snapshotName string
+		userName     string
+		existingID   string
+
+		want string
+	}{
+		"Named system snapshot is manual":               {snapshotName: "my_snapshot", want: machines.SnapshotSourceManual},
+		"Named system snapshot with zsys prefix":        {snapshotName: "autozsys_mine", want: machines.SnapshotSourceManual},
+		"Generated system snapshot name is automatic":   {want: machines.SnapshotSourceAutomatic},
+		"Named user snapshot is manual":                 {snapshotName: "my_snapshot", userName: "user1", want: machines.SnapshotSourceManual},
+		"Generated user snapshot name is automatic":     {userName: "user1", want: machines.SnapshotSourceAutomatic},
+		"Snapshot without recorded source has no value": {existingID: "rpool/ROOT/ubuntu_1234@system_root_snapshot"},
+		"Filesystem state has no source":                {existingID: "rpool/ROOT/ubuntu_1234"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_userdata_and_multiple_snapshots.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "New should succeed")
+
+			var s *machines.State
+			switch {
+			case tc.existingID != "":
+				s, _, err = ms.GetStateByID(tc.existingID)
+				assert.NoError(t, err, "Setup: state should exist")
+			case tc.userName != "":
+				snapshotName, err := ms.CreateUserSnapshot(context.Background(), tc.userName, tc.snapshotName)
+				assert.NoError(t, err, "CreateUserSnapshot should succeed")
+				m, _ := ms.CurrentMachine()
+				for _, us := range m.AllUsersStates[tc.userName] {
+					if strings.HasSuffix(us.ID, "@"+snapshotName) {
+						s = us
+					}
+				}
+			default:
+				snapshotName, err := ms.CreateSystemSnapshot(context.Background(), tc.snapshotName)
+				assert.NoError(t, err, "CreateSystemSnapshot should succeed")
+				s, _, err = ms.GetStateByID("rpool/ROOT/ubuntu_1234@" + snapshotName)
+				assert.NoError(t, err, "snapshot state should be attached to the machine")
+			}
+			if s == nil {
+				t.Fatal("state to check not found")
+			}
+
+			assert.Equal(t, tc.want, s.Source(), "Unexpected snapshot source")
+
+			// The source survives a rescan
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "rescanning machines should succeed")
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestRemoveState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def            string
+		currentStateID string
+		state          string
+		user           string
+		force          bool
+
+		destroyErrDS []string
+
+		wantRemoved         []string
+		isNoOp              bool
+		wantErr             bool
+		wantConfirmationErr bool
+	}{
+		"Remove system state, one dataset": {def: "m_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234", wantRemoved: []string{"rpool/ROOT/ubuntu_1234"}},
+
+		// FIXME: miss bpool and bpool/BOOT from golden file
+		"Remove system state, complex with boot, children and user datasets": {def: "m_layout1_one_machine.yaml", state: "rpool/ROOT/ubuntu_1234"},
+		"Remove one system snapshot only":                                    {def: "state_remove_internal.yaml", state: "rpool/ROOT/ubuntu_1234@snap3"},
+		"Removing system state try to delete its snapshots":                  {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_6789", wantErr: true, wantConfirmationErr: true},
+		"Removing system state deletes its snapshots":                        {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_6789", force: true},
+
+		"Remove system state, with system and users snapshots and clones":         {def: "m_layout1_machines_with_snapshots_clones.yaml", state: "rpool/ROOT/ubuntu_1234", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove system state, with system and users snapshots and clones, forced": {def: "m_layout1_machines_with_snapshots_clones.yaml", state: "rpool/ROOT/ubuntu_1234", force: true},
+		"Remove system state when user datasets are linked to 2 states":           {def: "state_remove_internal.yaml", state: "rpool/ROOT/ubuntu_5678"},
+		"Remove system state, with datasets":                                      {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_1234", wantConfirmationErr: true, wantErr: true, isNoOp: true},
+		"Remove system state, with datasets, forced":                              {def: "state_remove.yaml", state: "rpool/ROOT/ubuntu_1234", force: true},
+
+		"Remove user state, one dataset":                       {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", user: "user4"},
+		"Remove user state, one dataset, no user":              {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", wantErr: true, isNoOp: true},
+		"Remove user state, one dataset, wrong user":           {def: "state_remove.yaml", state: "rpool/USERDATA/user4_clone", user: "root", wantErr: true, isNoOp: true},
+		"Remove user state, with snapshots and clones":         {def: "state_remove.yaml", user: "user6", state: "rpool/USERDATA/user6_clone1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove user state, with snapshots and clones, forced": {def: "state_remove.yaml", user: "user6", state: "rpool/USERDATA/user6_clone1", force: true},
+		"Remove user state, with datasets":                     {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone@snapuser5", user: "user5", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove user state, with datasets, forced":             {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone@snapuser5", user: "user5", force: true},
+		"Remove user snapshot state":                           {def: "state_remove.yaml", state: "rpool/USERDATA/user1_efgh@snapuser2", user: "user1", wantRemoved: []string{"rpool/USERDATA/user1_efgh@snapuser2"}},
+
+		"Can’t remove user leaf snapshot linked to system state":                                 {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd@snap1", user: "user1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove user leaf snapshot linked to system state, forced":                               {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd@snap1", user: "user1", force: true},
+		"Can’t remove user leaf filesystem state linked to system state":                         {def: "state_remove.yaml", state: "rpool/USERDATA/user3_3333", user: "user3", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove user leaf filesystem state linked to system state, forced":                       {def: "state_remove.yaml", state: "rpool/USERDATA/user3_3333", user: "user3", force: true},
+		"Can’t remove user filesystem linked to system state with deps linked to system state":   {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd", user: "user1", wantErr: true, wantConfirmationErr: true, isNoOp: true},
+		"Remove user filesystem linked to system state with deps linked to system state, forced": {def: "state_remove.yaml", state: "rpool/USERDATA/user1_abcd", user: "user1", force: true},
+
+		// Shared user state handling
+		"Remove shared user state linked to a history state. Deps are not removed":                         {def: "state_remove.yaml", state: "rpool/USERDATA/root_bcde-rpool.ROOT.ubuntu-5678", user: "root", force: true},
+		"Remove shared user state linked to current machine state. Deps are not removed":                   {def: "state_remove.yaml", state: "rpool/USERDATA/root_bcde-rpool.ROOT.ubuntu-1234", user: "root", force: true},
+		"Remove shared user state as a dependency of other state. Deps are removed":                        {def: "m_shared_userstate_on_clones.yaml", state: "rpool/USERDATA/user_abcd", user: "user", force: true},
+		"Remove shared user state on different matchines as a dependency of other state. Deps are removed": {def: "m_shared_userstate_on_two_machines.yaml", state: "rpool/USERDATA/user_abcd", user: "user", force: true},
+
+		"No state given": {def: "m_with_userdata.yaml", wantErr: true, isNoOp: true},
+		"Error on trying to remove current state":       {def: "m_with_userdata.yaml", currentStateID: "rpool/ROOT/ubuntu_1234", state: "rpool/ROOT/ubuntu_1234", wantErr: true, isNoOp: true},
+		"Error on trying to remove current clone state": {def: "m_clone_with_userdata.yaml", currentStateID: "rpool/ROOT/ubuntu_5678", state: "rpool/ROOT/ubuntu_5678", wantErr: true, isNoOp: true},
+		"Error on destroy state, one dataset":           {def: "m_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234", destroyErrDS: []string{}, wantErr: true, isNoOp: true},
+		"Error on destroy user state, with datasets":    {def: "state_remove.yaml", state: "rpool/USERDATA/user5_for-manual-clone", user: "user5", force: true, destroyErrDS: []string{}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine(tc.currentStateID), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			initMachines := ms.CopyForTests(t)
+			lzfs := libzfs.(*mock.LibZFS)
+			lzfs.ErrOnDestroyDS(tc.destroyErrDS)
+
+			var wantRemoved []string
+			if !tc.wantErr {
+				wantRemoved, err = ms.RemoveState(context.Background(), tc.state, tc.user, tc.force, true)
+				assert.NoError(t, err, "Dry run should return no error")
+				assertMachinesEquals(t, initMachines, ms)
+			}
+
+			removed, err := ms.RemoveState(context.Background(), tc.state, tc.user, tc.force, false)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				var e *machines.ErrStateRemovalNeedsConfirmation
+
+				if tc.wantConfirmationErr {
+					assert.True(t, errors.As(err, &e), "expected ErrStateRemovalNeedsConfirmation error type")
+				} else {
+					assert.False(t, errors.As(err, &e), "don't expect ErrStateRemovalNeedsConfirmation error type")
+				}
+				return
+			}
+			if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			assert.ElementsMatch(t, wantRemoved, removed, "Removed datasets should be the ones listed on dry run")
+			if tc.wantRemoved != nil {
+				assert.Equal(t, tc.wantRemoved, removed, "Unexpected removed datasets")
+			}
+
+			if tc.isNoOp {
+				assertMachinesEquals(t, initMachines, ms)
+			} else {
+				assertMachinesToGolden(t, ms)
+				assertMachinesNotEquals(t, initMachines, ms)
+			}
+
+			machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine(tc.currentStateID), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestIDToState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		name string
+		user string
+
+		wantState string
+		wantErr   bool
+	}{
+		"Match full system path ID": {name: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
+		"Match full user path ID":   {name: "rpool/USERDATA/user1_abcd", user: "user1", wantState: "rpool/USERDATA/user1_abcd"},
+
+		"Match suffix system ID":       {name: "5678", wantState: "rpool/ROOT/ubuntu_5678"},
+		"Match dataset path system ID": {name: "ubuntu_5678", wantState: "rpool/ROOT/ubuntu_5678"},
+		"Match unique system snapshot": {name: "snap1", wantState: "rpool/ROOT/ubuntu_1234@snap1"},
+
+		"Limit search on duplicated snapshot name to a single user": {name: "snap1", user: "user1", wantState: "rpool/USERDATA/user1_abcd@snap1"},
+
+		// User datasets shared between machines
+		"Match on user generated ID":                                                         {name: "jklm-rpool.ROOT.ubuntu-1234", user: "user2", wantState: "rpool/USERDATA/user2_jklm"},
+		"Doesn’t match on user dataset regular name":                                         {name: "rpool/USERDATA/user2_jklm", user: "user2", wantErr: true},
+		"User data attached to 2 machines but only linked to one system state isn’t renamed": {name: "rpool/USERDATA/user3_mnop", user: "user3", wantState: "rpool/USERDATA/user3_mnop"},
+
+		// Multiple matches
+		"Multiple states match system suffix ID": {name: "1234", wantErr: true},
+		"Multiple states match user suffix ID":   {name: "abcd", user: "user1", wantErr: true},
+
+		// No match
+		"Empty name":         {name: "", wantErr: true},
+		"No match at all":    {name: "/doesntexists", wantErr: true},
+		"User doesn’t exist": {name: "foo", user: "userfoo", wantErr: true},
+		"No match on full path ID search without user provided":    {name: "rpool/USERDATA/user1_abcd", wantErr: true},
+		"No match on full path ID search with wrong user provided": {name: "rpool/USERDATA/user1_abcd", user: "userfoo", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "state_idtostate.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			_, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatalf("couldn’t create original zfs datasets state")
+			}
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			got, err := ms.IDToState(context.Background(), tc.name, tc.user)
+
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantState, got.ID, "didn't get expected state")
+		})
+	}
+}
+
+func TestGetStateByID(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		id string
+
+		wantState    string
+		wantMachine  string
+		wantErr      bool
+		wantNotFound bool
+	}{
+		"Match main state full path":     {id: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234", wantMachine: "rpool/ROOT/ubuntu_1234"},
+		"Match clone state full path":    {id: "rpool/ROOT/ubuntu_5678", wantState: "rpool/ROOT/ubuntu_5678", wantMachine: "rpool/ROOT/ubuntu_1234"},
+		"Match snapshot state full path": {id: "rpool/ROOT/ubuntu_1234@snap2", wantState: "rpool/ROOT/ubuntu_1234@snap2", wantMachine: "rpool/ROOT/ubuntu_1234"},
+		"Match snapshot name":            {id: "snap1", wantState: "rpool/ROOT/ubuntu_1234@snap1", wantMachine: "rpool/ROOT/ubuntu_1234"},
+		"Match suffix ID":                {id: "5678", wantState: "rpool/ROOT/ubuntu_5678", wantMachine: "rpool/ROOT/ubuntu_1234"},
+		"Match other machine":            {id: "rpool2/ROOT/ubuntu_1234", wantState: "rpool2/ROOT/ubuntu_1234", wantMachine: "rpool2/ROOT/ubuntu_1234"},
+
+		"Ambiguous suffix ID":       {id: "1234", wantErr: true},
+		"Ambiguous dataset path ID": {id: "ubuntu_1234", wantErr: true},
+		"User states don’t match":   {id: "rpool/USERDATA/user1_abcd", wantErr: true, wantNotFound: true},
+		"Empty ID":                  {id: "", wantErr: true},
+		"No match at all":           {id: "/doesntexists", wantErr: true, wantNotFound: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "state_idtostate.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			s, m, err := ms.GetStateByID(tc.id)
+
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				assert.Equal(t, tc.wantNotFound, errors.Is(err, machines.ErrStateNotFound), "Unexpected state not found error kind")
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantState, s.ID, "didn't get expected state")
+			assert.Equal(t, tc.wantMachine, m.ID, "didn't get expected machine")
+		})
+	}
+}
+
+func TestRevertToState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def          string
+		cmdline      string
+		state        string
+		keepUserData bool
+
+		wantMainState string
+		wantHistory   []string
+		wantUsers     map[string]string
+		wantNotZsys   bool
+		wantErr       bool
+	}{
+		"Revert to a snapshot clones it": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1",
+			wantMainState: "rpool/ROOT/ubuntu_xxxxxx", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_xxxxxx"}},
+		"Revert to a clone promotes it": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678",
+			wantMainState: "rpool/ROOT/ubuntu_5678", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_efgh"}},
+		"Revert to a snapshot keeping user data": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", keepUserData: true,
+			wantMainState: "rpool/ROOT/ubuntu_xxxxxx", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_abcd", "root": "rpool/USERDATA/root_bcde"}},
+		"Revert to a clone keeping user data": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678", keepUserData: true,
+			wantMainState: "rpool/ROOT/ubuntu_5678", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_abcd", "root": "rpool/USERDATA/root_bcde"}},
+
+		"Error on current state":              {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234", wantErr: true},
+		"Error on current state being clone":  {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/ubuntu_5678"), state: "rpool/ROOT/ubuntu_5678", wantErr: true},
+		"Error on state of another machine":   {def: "d_two_machines_one_dataset.yaml", cmdline: generateCmdLine("rpool"), state: "rpool2", wantErr: true},
+		"Error on unknown state":              {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/doesntexist", wantErr: true},
+		"Error on non zsys machine":           {def: "m_with_userdata_no_zsys.yaml", state: "rpool/ROOT/ubuntu_1234", wantNotZsys: true, wantErr: true},
+		"Error on non zsys state":             {def: "m_invalid_states.yaml", state: "rpool/ROOT/ubuntu_5678", wantNotZsys: true, wantErr: true},
+		"Error when no current machine found": {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), state: "rpool/ROOT/ubuntu_5678", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			if tc.cmdline == "" {
+				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			}
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			// A dry run computes the same plan than the real revert, without changing anything
+			dryRunPlan, dryRunErr := ms.RevertToState(context.Background(), tc.state, machines.RevertOptions{KeepUserData: tc.keepUserData, DryRun: true})
+			assertMachinesEquals(t, initMachines, ms)
+
+			plan, err := ms.RevertToState(context.Background(), tc.state, machines.RevertOptions{KeepUserData: tc.keepUserData})
+			assert.Equal(t, dryRunErr != nil, err != nil, "Dry run and revert should both fail or succeed")
+			assert.Equal(t, dryRunPlan, plan, "Dry run plan should be the applied one")
+			assert.Equal(t, tc.wantNotZsys, errors.Is(err, machines.ErrNotZsys), "Unexpected not zsys error kind")
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			m, ok := ms.CurrentMachine()
+			if !ok {
+				t.Fatal("expected to still have a current machine after revert")
+			}
+			assert.Equal(t, tc.wantMainState, m.ID, "Reverted state should be the main machine state")
+			assert.Equal(t, tc.state, plan.State, "Plan should revert to requested state")
+			assert.Equal(t, tc.wantMainState, plan.NewState, "Plan should announce the new main machine state")
+			for _, h := range tc.wantHistory {
+				assert.Contains(t, m.History, h, "Expected state to be in machine history")
+			}
+			gotUsers := make(map[string]string)
+			for user, us := range m.Users {
+				gotUsers[user] = us.ID
+			}
+			assert.Equal(t, tc.wantUsers, gotUsers, "Expected user states attached to reverted state")
+
+			ns, ok := ms.NextState()
+			if !ok {
+				t.Fatal("expected reverted state to be the next state")
+			}
+			assert.Same(t, &m.State, ns, "Reverted state should be the next state")
+			// Next state is only known in memory
+			ms.SetNextState(nil)
+
+			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestSetDefaultBootState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		state string
+
+		wantNotZsys bool
+		wantErr     bool
+	}{
+		"Set clone state":   {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678"},
+		"Set current state": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234"},
+
+		"Error on snapshot state":   {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", wantErr: true},
+		"Error on unknown state":    {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/doesntexist", wantErr: true},
+		"Error on non zsys machine": {def: "m_with_userdata_no_zsys.yaml", state: "rpool/ROOT/ubuntu_1234", wantNotZsys: true, wantErr: true},
+		"Error on non zsys state":   {def: "m_invalid_states.yaml", state: "rpool/ROOT/ubuntu_5678", wantNotZsys: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+			lzfs := libzfs.(*mock.LibZFS)
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+			lzfs.RecordOperations(true)
+
+			err = ms.SetDefaultBootState(context.Background(), tc.state)
+			assert.Equal(t, tc.wantNotZsys, errors.Is(err, machines.ErrNotZsys), "Unexpected not zsys error kind")
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assert.Empty(t, lzfs.Operations(), "No zfs operation should run on error")
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			assert.Equal(t, []string{"zpool set bootfs=" + tc.state + " rpool"}, lzfs.Operations(), "Pool bootfs should be set to the state")
+			ns, ok := ms.NextState()
+			if !ok {
+				t.Fatal("expected default boot state to be the next state")
+			}
+			assert.Equal(t, tc.state, ns.ID, "Default boot state should be the next state")
+			// Next state is only known in memory
+			ms.SetNextState(nil)
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestSetNextBootState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
+		state   string
+
+		wantNotZsys bool
+		wantErr     bool
+	}{
+		"Boot once on clone state": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678"},
+		"Boot once on main state":  {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234"},
+
+		"Error on snapshot state":           {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", wantErr: true},
+		"Error on unknown state":            {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/doesntexist", wantErr: true},
+		"Error on state of another machine": {def: "d_two_machines_one_dataset.yaml", cmdline: generateCmdLine("rpool"), state: "rpool2", wantErr: true},
+		"Error on non zsys machine":         {def: "m_with_userdata_no_zsys.yaml", state: "rpool/ROOT/ubuntu_1234", wantNotZsys: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+			lzfs := libzfs.(*mock.LibZFS)
+
+			if tc.cmdline == "" {
+				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			}
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+			lzfs.RecordOperations(true)
+
+			err = ms.SetNextBootState(context.Background(), tc.state)
+			assert.Empty(t, lzfs.Operations(), "Booting once shouldn't change anything on the system")
+			assert.Equal(t, tc.wantNotZsys, errors.Is(err, machines.ErrNotZsys), "Unexpected not zsys error kind")
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				_, ok := ms.NextState()
+				assert.False(t, ok, "No next state should be set on error")
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			ns, ok := ms.NextState()
+			if !ok {
+				t.Fatal("expected state to be the next state")
+			}
+			assert.Equal(t, tc.state, ns.ID, "State to boot once should be the next state")
+			for _, e := range ms.GenerateBootList() {
+				assert.Equal(t, e.Root == tc.state, e.Default, "Only the state to boot once should be the default entry")
+			}
+			// Next state is only known in memory
+			ms.SetNextState(nil)
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestCloneState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		cmdline string
+		newName string
+
+		wantState string
+		wantUsers map[string]string
+		wantErr   bool
+	}{
+		"Clone current state with users": {def: "m_clone_with_userdata.yaml", newName: "experiment",
+			wantState: "rpool/ROOT/ubuntu_experiment",
+			wantUsers: map[string]string{"user1": "rpool/USERDATA/user1_xxxxxx", "root": "rpool/USERDATA/root_xxxxxx"}},
+		"Clone current state with separate boot": {def: "m_clone_with_separate_boot.yaml", newName: "experiment",
+			wantState: "rpool/ROOT/ubuntu_experiment", wantUsers: map[string]string{}},
+
+		"Error on existing state":             {def: "m_clone_with_userdata.yaml", newName: "5678", wantErr: true},
+		"Error on invalid name":               {def: "m_clone_with_userdata.yaml", newName: "bad/name", wantErr: true},
+		"Error on non zsys machine":           {def: "m_with_userdata_no_zsys.yaml", newName: "experiment", wantErr: true},
+		"Error when no current machine found": {def: "m_clone_with_userdata.yaml", cmdline: generateCmdLine("rpool/ROOT/nomachine"), newName: "experiment", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			if tc.cmdline == "" {
+				tc.cmdline = generateCmdLine("rpool/ROOT/ubuntu_1234")
+			}
+
+			ms, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			id, err := ms.CloneState(context.Background(), tc.newName)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			assert.Equal(t, tc.wantState, id, "Unexpected new state ID")
+
+			m, ok := ms.CurrentMachine()
+			if !ok {
+				t.Fatal("expected to still have a current machine after clone")
+			}
+			assert.Equal(t, "rpool/ROOT/ubuntu_1234", m.ID, "Current state shouldn't change")
+			if !assert.Contains(t, m.History, id, "New state should be in machine history") {
+				return
+			}
+			s := m.History[id]
+			assert.Equal(t, len(m.State.Datasets), len(s.Datasets), "New state should have the same routes than the cloned one")
+			gotUsers := make(map[string]string)
+			for user, us := range s.Users {
+				gotUsers[user] = us.ID
+			}
+			assert.Equal(t, tc.wantUsers, gotUsers, "Unexpected user states attached to new state")
+
+			machinesAfterRescan, err := machines.New(context.Background(), tc.cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestIncompleteOperations(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def         string
+		interrupted bool
+		clone       bool
+		cloneErr    bool
+
+		want []string
+	}{
+		"No operation in progress": {def: "m_clone_with_userdata.yaml"},
+		"Interrupted clone":        {def: "m_clone_with_userdata.yaml", interrupted: true, want: []string{"rpool/ROOT/ubuntu_1234"}},
+		"Completed clone":          {def: "m_clone_with_userdata.yaml", clone: true},
+		"Failed clone":             {def: "m_clone_with_userdata.yaml", clone: true, cloneErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+			lzfs := libzfs.(*mock.LibZFS)
+
+			// Simulate a clone interrupted after marking the current state and snapshotting it
+			if tc.interrupted {
+				z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+				if err != nil {
+					t.Fatalf("couldn't create original zfs datasets state: %v", err)
+				}
+				tr, _ := z.NewTransaction(context.Background())
+				if err := tr.SetProperty(libzfsadapter.OperationInProgressProp, "clone", "rpool/ROOT/ubuntu_1234", true); err != nil {
+					t.Fatalf("couldn't mark operation in progress: %v", err)
+				}
+				if err := tr.Snapshot("experiment", "rpool/ROOT/ubuntu_1234", false); err != nil {
+					t.Fatalf("couldn't snapshot state: %v", err)
+				}
+				tr.Done()
+			}
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			if tc.clone {
+				lzfs.ErrOnClone(tc.cloneErr)
+				_, err := ms.CloneState(context.Background(), "experiment")
+				if err != nil && !tc.cloneErr {
+					t.Fatalf("expected no error cloning but got: %v", err)
+				} else if err == nil && tc.cloneErr {
+					t.Fatal("expected an error cloning but got none")
+				}
+			}
+
+			assert.Equal(t, tc.want, ms.IncompleteOperations(), "Unexpected datasets with an operation in progress")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			assert.Equal(t, tc.want, machinesAfterRescan.IncompleteOperations(), "Unexpected datasets with an operation in progress after rescan")
+		})
+	}
+}
+
+func TestCloneGraph(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want map[string][]string
+	}{
+		"No clone": {def: "m_with_userdata.yaml", want: map[string][]string{}},
+		"System and user clones": {def: "m_clone_with_userdata.yaml", want: map[string][]string{
+			"rpool/ROOT/ubuntu_1234@snap1":    {"rpool/ROOT/ubuntu_5678"},
+			"rpool/USERDATA/user1_abcd@snap1": {"rpool/USERDATA/user1_efgh"},
+		}},
+		"Clones with children": {def: "m_clone_with_children.yaml", want: map[string][]string{
+			"rpool/ROOT/ubuntu_1234@snap1":     {"rpool/ROOT/ubuntu_5678"},
+			"rpool/ROOT/ubuntu_1234/opt@snap1": {"rpool/ROOT/ubuntu_5678/opt"},
+		}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			got := ms.CloneGraph()
+			assert.Equal(t, tc.want, got, "Unexpected clone graph")
+			assert.Equal(t, got, ms.CloneGraph(), "Clone graph should be deterministic")
+		})
+	}
+}
+
+func TestRenameState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		id      string
+		newName string
+
+		wantState    string
+		wantDatasets []string
+		wantUsers    map[string]string
+		wantErr      bool
+	}{
+		"Rename history state with users": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678", newName: "before-upgrade",
+			wantState:    "rpool/ROOT/ubuntu_before-upgrade",
+			wantDatasets: []string{"rpool/ROOT/ubuntu_before-upgrade"},
+			wantUsers:    map[string]string{"user1": "rpool/USERDATA/user1_efgh"}},
+		"Rename history state with separate boot": {def: "m_clone_with_separate_boot.yaml", id: "rpool/ROOT/ubuntu_5678", newName: "before-upgrade",
+			wantState:    "rpool/ROOT/ubuntu_before-upgrade",
+			wantDatasets: []string{"bpool/BOOT/ubuntu_before-upgrade", "rpool/ROOT/ubuntu_before-upgrade"},
+			wantUsers:    map[string]string{}},
+
+		"Error on current state":  {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234", newName: "before-upgrade", wantErr: true},
+		"Error on snapshot state": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", newName: "before-upgrade", wantErr: true},
+		"Error on existing state": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678", newName: "1234", wantErr: true},
+		"Error on same name":      {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678", newName: "5678", wantErr: true},
+		"Error on invalid name":   {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678", newName: "bad/name", wantErr: true},
+		"Error on unknown state":  {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_doesntexist", newName: "before-upgrade", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			err = ms.RenameState(context.Background(), tc.id, tc.newName)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			_, _, err = ms.GetStateByID(tc.id)
+			assert.Error(t, err, "Old state should be gone")
+			s, _, err := ms.GetStateByID(tc.wantState)
+			if err != nil {
+				t.Fatalf("expected renamed state %q but got: %v", tc.wantState, err)
+			}
+			assert.ElementsMatch(t, tc.wantDatasets, stateDatasetNames(*s), "Unexpected renamed datasets")
+			gotUsers := make(map[string]string)
+			for user, us := range s.Users {
+				gotUsers[user] = us.ID
+			}
+			assert.Equal(t, tc.wantUsers, gotUsers, "Unexpected user states attached to renamed state")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestEventHooks(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		operation string
+		preErr    bool
+		postErr   bool
+
+		wantCalls []string
+		wantErr   bool
+	}{
+		"Snapshot":                       {operation: "snapshot", wantCalls: []string{"PreSnapshot rpool/ROOT/ubuntu_1234", "PostSnapshot rpool/ROOT/ubuntu_1234@snap2"}},
+		"Revert":                         {operation: "revert", wantCalls: []string{"PreRevert rpool/ROOT/ubuntu_5678", "PostRevert rpool/ROOT/ubuntu_5678"}},
+		"Clone":                          {operation: "clone", wantCalls: []string{"PreClone rpool/ROOT/ubuntu_1234", "PostClone rpool/ROOT/ubuntu_experiment"}},
+		"GC":                             {operation: "gc", wantCalls: []string{"PreGC rpool/ROOT/ubuntu_1234", "PostGC rpool/ROOT/ubuntu_1234"}},
+		"Post hook error doesn't matter": {operation: "snapshot", postErr: true, wantCalls: []string{"PreSnapshot rpool/ROOT/ubuntu_1234", "PostSnapshot rpool/ROOT/ubuntu_1234@snap2"}},
+
+		"Pre hook error aborts snapshot": {operation: "snapshot", preErr: true, wantCalls: []string{"PreSnapshot rpool/ROOT/ubuntu_1234"}, wantErr: true},
+		"Pre hook error aborts revert":   {operation: "revert", preErr: true, wantCalls: []string{"PreRevert rpool/ROOT/ubuntu_5678"}, wantErr: true},
+		"Pre hook error aborts clone":    {operation: "clone", preErr: true, wantCalls: []string{"PreClone rpool/ROOT/ubuntu_1234"}, wantErr: true},
+		"Pre hook error aborts GC":       {operation: "gc", preErr: true, wantCalls: []string{"PreGC rpool/ROOT/ubuntu_1234"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			var calls []string
+			hook := func(name string, shouldErr bool) machines.HookFunc {
+				return func(ctx context.Context, id string) error {
+					calls = append(calls, name+" "+id)
+					if shouldErr {
+						return errors.New(name + " error requested")
+					}
+					return nil
+				}
+			}
+			hooks := machines.EventHooks{
+				PreSnapshot:  hook("PreSnapshot", tc.preErr),
+				PostSnapshot: hook("PostSnapshot", tc.postErr),
+				PreRevert:    hook("PreRevert", tc.preErr),
+				PostRevert:   hook("PostRevert", tc.postErr),
+				PreClone:     hook("PreClone", tc.preErr),
+				PostClone:    hook("PostClone", tc.postErr),
+				PreGC:        hook("PreGC", tc.preErr),
+				PostGC:       hook("PostGC", tc.postErr),
+			}
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"),
+				machines.WithLibZFS(libzfs), machines.WithEventHooks(hooks))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			switch tc.operation {
+			case "snapshot":
+				_, err = ms.CreateSystemSnapshot(context.Background(), "snap2")
+			case "revert":
+				_, err = ms.RevertToState(context.Background(), "rpool/ROOT/ubuntu_5678", machines.RevertOptions{})
+			case "clone":
+				_, err = ms.CloneState(context.Background(), "experiment")
+			case "gc":
+				err = ms.GC(context.Background(), false)
+			}
+
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			assert.Equal(t, tc.wantCalls, calls, "Unexpected hooks calls")
+
+			if tc.wantErr {
+				assertMachinesEquals(t, initMachines, ms)
+			}
+		})
+	}
+}
+
+func TestContainers(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		containers map[string]machines.ContainerRole
+
+		wantDecisions []machines.TriageDecision
+		wantUsers     []string
+		wantErr       bool
+	}{
+		"Default containers": {wantUsers: []string{"user1"}, wantDecisions: []machines.TriageDecision{
+			{Dataset: "rpool/USERDATA/user1_abcd", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+			{Dataset: "rpool/SRV/user2_cdef", Class: machines.TriagePersistent, Rule: machines.TriageRulePersistent},
+			{Dataset: "rpool/DATA/shared", Class: machines.TriageUnmanaged, Rule: machines.TriageRuleIgnoredOrphan},
+		}},
+		"Custom user container": {containers: map[string]machines.ContainerRole{"SRV": machines.ContainerUser},
+			wantUsers: []string{"user1", "user2"}, wantDecisions: []machines.TriageDecision{
+				{Dataset: "rpool/USERDATA/user1_abcd", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+				{Dataset: "rpool/SRV/user2_cdef", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+				{Dataset: "rpool/DATA/shared", Class: machines.TriageUnmanaged, Rule: machines.TriageRuleIgnoredOrphan},
+			}},
+		"Custom persistent container": {containers: map[string]machines.ContainerRole{"data": machines.ContainerPersistent},
+			wantUsers: []string{"user1"}, wantDecisions: []machines.TriageDecision{
+				{Dataset: "rpool/DATA", Class: machines.TriageUnmanaged, Rule: machines.TriageRuleIgnoredOrphan},
+				{Dataset: "rpool/DATA/shared", Class: machines.TriagePersistent, Rule: machines.TriageRulePersistentContainer},
+			}},
+		"Override default container": {containers: map[string]machines.ContainerRole{"USERDATA": machines.ContainerPersistent},
+			wantUsers: []string{}, wantDecisions: []machines.TriageDecision{
+				{Dataset: "rpool/USERDATA/user1_abcd", Class: machines.TriagePersistent, Rule: machines.TriageRulePersistentContainer},
+			}},
+
+		"Error on unknown role":        {containers: map[string]machines.ContainerRole{"SRV": "other"}, wantErr: true},
+		"Error on empty container":     {containers: map[string]machines.ContainerRole{"": machines.ContainerUser}, wantErr: true},
+		"Error on container with path": {containers: map[string]machines.ContainerRole{"rpool/SRV": machines.ContainerUser}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_custom_containers.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTriageReport())
+			if tc.containers != nil {
+				ms, err = machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTriageReport(), machines.WithContainers(tc.containers))
+			}
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			got := ms.TriageReport()
+			for _, want := range tc.wantDecisions {
+				assert.Contains(t, got, want, "Missing triage decision")
+			}
+
+			s, ok := ms.CurrentState()
+			if !ok {
+				t.Fatal("expected a current state")
+			}
+			users := []string{}
+			for user := range s.Users {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+			assert.Equal(t, tc.wantUsers, users, "Unexpected users attached to current state")
+		})
+	}
+}
+
+func TestTriageReport(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def         string
+		noReportOpt bool
+
+		wantDecisions []machines.TriageDecision
+	}{
+		"System and persistent datasets": {def: "m_clone_with_persistent.yaml", wantDecisions: []machines.TriageDecision{
+			{Dataset: "rpool/ROOT", Class: machines.TriageUnmanaged, Rule: machines.TriageRuleIgnoredOrphan},
+			{Dataset: "rpool/ROOT/ubuntu_1234", Class: machines.TriageSystem, Rule: machines.TriageRuleMainRoot, Machine: "rpool/ROOT/ubuntu_1234"},
+			{Dataset: "rpool/ROOT/ubuntu_5678", Class: machines.TriageSystem, Rule: machines.TriageRuleCloneOrigin, Machine: "rpool/ROOT/ubuntu_1234"},
+			{Dataset: "rpool/opt", Class: machines.TriagePersistent, Rule: machines.TriageRulePersistent},
+		}},
+		"Boot datasets": {def: "m_clone_with_separate_boot.yaml", wantDecisions: []machines.TriageDecision{
+			{Dataset: "bpool/BOOT", Class: machines.TriageUnmanaged, Rule: machines.TriageRuleIgnoredOrphan},
+			{Dataset: "bpool/BOOT/ubuntu_1234", Class: machines.TriageBoot, Rule: machines.TriageRuleBootPrefix},
+			{Dataset: "bpool/BOOT/ubuntu_5678", Class: machines.TriageBoot, Rule: machines.TriageRuleBootPrefix},
+		}},
+		"User datasets": {def: "m_clone_with_userdata.yaml", wantDecisions: []machines.TriageDecision{
+			{Dataset: "rpool/USERDATA/root_bcde", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+			{Dataset: "rpool/USERDATA/user1_abcd", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+			{Dataset: "rpool/USERDATA/user1_efgh", Class: machines.TriageUserData, Rule: machines.TriageRuleUserDataContainer},
+		}},
+
+		"Nothing recorded without option": {def: "m_clone_with_persistent.yaml", noReportOpt: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTriageReport())
+			if tc.noReportOpt {
+				ms, err = machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			}
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			got := ms.TriageReport()
+			if tc.noReportOpt {
+				assert.Empty(t, got, "No triage decision should be recorded without the option")
+				return
+			}
+			for _, want := range tc.wantDecisions {
+				assert.Contains(t, got, want, "Missing triage decision")
+			}
+			var names []string
+			for _, d := range got {
+				names = append(names, d.Dataset)
+			}
+			assert.True(t, sort.StringsAreSorted(names), "Triage decisions should be sorted by dataset name")
+		})
+	}
+}
+
+func TestMountpointConflicts(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want []machines.MountConflict
+	}{
+		"No conflict": {def: "m_clone_with_persistent.yaml"},
+		"Conflicts within a state and between persistent datasets": {def: "m_mountpoint_conflicts.yaml",
+			want: []machines.MountConflict{
+				{Mountpoint: "/data", Datasets: []string{"rpool/data1", "rpool/data2"}},
+				{Mountpoint: "/srv", Datasets: []string{"rpool/ROOT/ubuntu_1234/srv", "rpool/srv"},
+					Machine: "rpool/ROOT/ubuntu_1234", State: "rpool/ROOT/ubuntu_1234"},
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			assert.Equal(t, tc.want, ms.MountpointConflicts(), "Unexpected mountpoint conflicts")
+		})
+	}
+}
+
+func TestCreateBookmark(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def  string
+		id   string
+		name string
+
+		wantBookmarks     []string
+		wantUserBookmarks map[string][]string
+		wantErr           bool
+	}{
+		"Bookmark system and user datasets of a snapshot": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", name: "baseline",
+			wantBookmarks:     []string{"rpool/ROOT/ubuntu_1234#baseline"},
+			wantUserBookmarks: map[string][]string{"user1": {"rpool/USERDATA/user1_abcd#baseline"}, "root": nil}},
+
+		"Error on filesystem state": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234", name: "baseline", wantErr: true},
+		"Error on invalid name":     {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", name: "bad/name", wantErr: true},
+		"Error on unknown state":    {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234@doesntexist", name: "baseline", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			err = ms.CreateBookmark(context.Background(), tc.id, tc.name)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			bookmarkNames := func(s *machines.State) (names []string) {
+				for _, b := range s.Bookmarks {
+					names = append(names, b.Name)
+				}
+				return names
+			}
+			m, _ := ms.CurrentMachine()
+			assert.Equal(t, tc.wantBookmarks, bookmarkNames(&m.State), "Unexpected bookmarks on system state")
+			for user, want := range tc.wantUserBookmarks {
+				assert.Equal(t, want, bookmarkNames(m.State.Users[user]), "Unexpected bookmarks for user %s", user)
+			}
+
+			// Bookmarks are never considered as snapshots
+			for id := range m.History {
+				assert.NotContains(t, id, "#", "Bookmarks shouldn't create history states")
+			}
+
+			// Same bookmark can't be created twice
+			assert.Error(t, ms.CreateBookmark(context.Background(), tc.id, tc.name), "Creating the same bookmark again should fail")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestHoldSnapshot(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		id  string
+		tag string
+
+		wantErr bool
+	}{
+		"Hold system and user datasets of a snapshot": {def: "m_with_held_snapshot.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", tag: "backup"},
+		"Hold system snapshot without user snapshot":  {def: "m_with_held_snapshot.yaml", id: "rpool/ROOT/ubuntu_1234@snap2", tag: "backup"},
+
+		"Error on filesystem state": {def: "m_with_held_snapshot.yaml", id: "rpool/ROOT/ubuntu_1234", tag: "backup", wantErr: true},
+		"Error on empty tag":        {def: "m_with_held_snapshot.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", tag: "", wantErr: true},
+		"Error on unknown state":    {def: "m_with_held_snapshot.yaml", id: "rpool/ROOT/ubuntu_1234@doesntexist", tag: "backup", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			err = ms.HoldSnapshot(context.Background(), tc.id, tc.tag)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			s, _, err := ms.GetStateByID(tc.id)
+			if err != nil {
+				t.Fatalf("held state %s should still exist: %v", tc.id, err)
+			}
+			assert.Equal(t, []string{tc.tag}, s.Holds, "Unexpected holds on system state")
+			for user, us := range s.Users {
+				assert.Equal(t, []string{tc.tag}, us.Holds, "Unexpected holds for user %s", user)
+			}
+
+			// Holds are read back on rescan
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+
+			// Same tag can't be held twice
+			assert.Error(t, ms.HoldSnapshot(context.Background(), tc.id, tc.tag), "Holding the same tag again should fail")
+
+			// Held states are never removed
+			_, err = ms.RemoveState(context.Background(), tc.id, "", true, false)
+			assert.Error(t, err, "Removing a held state should fail")
+			_, _, err = ms.GetStateByID(tc.id)
+			assert.NoError(t, err, "Held state should still exist after a removal attempt")
+
+			// Once released, the state can be removed
+			assert.Error(t, ms.ReleaseSnapshot(context.Background(), tc.id, "other"), "Releasing a tag not held should fail")
+			assert.NoError(t, ms.ReleaseSnapshot(context.Background(), tc.id, tc.tag), "Releasing the tag should succeed")
+			s, _, err = ms.GetStateByID(tc.id)
+			if err != nil {
+				t.Fatalf("released state %s should still exist: %v", tc.id, err)
+			}
+			assert.Empty(t, s.Holds, "Released state should have no hold left")
+			_, err = ms.RemoveState(context.Background(), tc.id, "", true, false)
+			assert.NoError(t, err, "Removing a released state should succeed")
+		})
+	}
+}
+func TestSendState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		id              string
+		incrementalFrom string
+		withUsers       bool
+
+		wantStream []string
+		wantErr    bool
+	}{
+		"Send system datasets of a snapshot": {id: "rpool/ROOT/ubuntu_1234@snap2",
+			wantStream: []string{
+				`zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from ""`,
+				`zfs send stream of rpool/ROOT/ubuntu_1234/var@snap2 from ""`,
+			}},
+		"Send with user datasets": {id: "rpool/ROOT/ubuntu_1234@snap2", withUsers: true,
+			wantStream: []string{
+				`zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from ""`,
+				`zfs send stream of rpool/ROOT/ubuntu_1234/var@snap2 from ""`,
+				`zfs send stream of rpool/USERDATA/user1_abcd@snap2 from ""`,
+			}},
+		"Send incrementally": {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234@snap1",
+			wantStream: []string{
+				`zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from "rpool/ROOT/ubuntu_1234@snap1"`,
+				`zfs send stream of rpool/ROOT/ubuntu_1234/var@snap2 from "rpool/ROOT/ubuntu_1234/var@snap1"`,
+			}},
+		"Send incrementally with user datasets": {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234@snap1", withUsers: true,
+			wantStream: []string{
+				`zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from "rpool/ROOT/ubuntu_1234@snap1"`,
+				`zfs send stream of rpool/ROOT/ubuntu_1234/var@snap2 from "rpool/ROOT/ubuntu_1234/var@snap1"`,
+				`zfs send stream of rpool/USERDATA/user1_abcd@snap2 from "rpool/USERDATA/user1_abcd@snap1"`,
+			}},
+
+		"Error on filesystem state":                       {id: "rpool/ROOT/ubuntu_1234", wantErr: true},
+		"Error on clone":                                  {id: "rpool/ROOT/ubuntu_5678", wantErr: true},
+		"Error on unknown state":                          {id: "rpool/ROOT/ubuntu_1234@doesntexist", wantErr: true},
+		"Error on incremental from itself":                {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234@snap2", wantErr: true},
+		"Error on incremental from a filesystem state":    {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234", wantErr: true},
+		"Error on incremental from a more recent state":   {id: "rpool/ROOT/ubuntu_1234@snap1", incrementalFrom: "rpool/ROOT/ubuntu_1234@snap2", wantErr: true},
+		"Error on incremental from an unknown state":      {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234@doesntexist", wantErr: true},
+		"Error on incremental from another machine state": {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_5678", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_send.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			var out strings.Builder
+			if tc.withUsers {
+				err = ms.SendState(context.Background(), tc.id, &out, tc.incrementalFrom, machines.SendWithUserDatasets())
+			} else {
+				err = ms.SendState(context.Background(), tc.id, &out, tc.incrementalFrom)
+			}
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+			} else if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if !tc.wantErr {
+				assert.Equal(t, strings.Join(tc.wantStream, "\n")+"\n", out.String(), "Unexpected send stream")
+			}
+			// Sending never modifies machines
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestSendStateProgress(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_send.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	var lastDone int
+	var currents []string
+	progress := func(done, total int, current string) {
+		assert.GreaterOrEqual(t, done, lastDone, "Progress should never go backward")
+		if total != 0 {
+			assert.LessOrEqual(t, done, total, "Progress shouldn't exceed total")
+		}
+		lastDone = done
+		if len(currents) == 0 || currents[len(currents)-1] != current {
+			currents = append(currents, current)
+		}
+	}
+
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs),
+		machines.WithProgress(progress))
+	if err != nil {
+		t.Error("expected success but got an error scanning for machines", err)
+	}
+
+	var out strings.Builder
+	err = ms.SendState(context.Background(), "rpool/ROOT/ubuntu_1234@snap2", &out, "", machines.SendWithUserDatasets())
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+
+	assert.Equal(t, out.Len(), lastDone, "All written bytes should be reported")
+	assert.Equal(t, []string{"rpool/ROOT/ubuntu_1234@snap2", "rpool/ROOT/ubuntu_1234/var@snap2", "rpool/USERDATA/user1_abcd@snap2"},
+		currents, "Progress should be reported for each dataset, in order")
+}
+
+func TestReceiveState(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		id              string
+		incrementalFrom string
+		withUsers       bool
+		stream          string
+		targetPool      string
+
+		wantID      string
+		wantHistory []string
+		wantUsers   []string
+		wantErr     bool
+	}{
+		// User snapshots are associated by name to system snapshots, even on another pool
+		"Receive a state": {id: "rpool/ROOT/ubuntu_1234@snap2",
+			wantID: "tpool/ROOT/ubuntu_1234", wantHistory: []string{"tpool/ROOT/ubuntu_1234@snap2"}, wantUsers: []string{"user1"}},
+		"Receive a state with user datasets": {id: "rpool/ROOT/ubuntu_1234@snap2", withUsers: true,
+			wantID: "tpool/ROOT/ubuntu_1234", wantHistory: []string{"tpool/ROOT/ubuntu_1234@snap2"}, wantUsers: []string{"user1"}},
+		"Receive a state incrementally": {id: "rpool/ROOT/ubuntu_1234@snap2", incrementalFrom: "rpool/ROOT/ubuntu_1234@snap1", withUsers: true,
+			wantID: "tpool/ROOT/ubuntu_1234", wantHistory: []string{"tpool/ROOT/ubuntu_1234@snap1", "tpool/ROOT/ubuntu_1234@snap2"}, wantUsers: []string{"user1"}},
+
+		"Error on existing state":           {id: "rpool/ROOT/ubuntu_1234@snap2", targetPool: "rpool", wantErr: true},
+		"Error on unknown pool":             {id: "rpool/ROOT/ubuntu_1234@snap2", targetPool: "doesntexist", wantErr: true},
+		"Error on empty stream":             {wantErr: true},
+		"Error on invalid stream":           {stream: "invalid stream\n", wantErr: true},
+		"Error on stream failing partway":   {id: "rpool/ROOT/ubuntu_1234@snap2", withUsers: true, stream: "invalid stream\n", wantErr: true},
+		"Error on user datasets only":       {stream: `zfs send stream of rpool/USERDATA/user1_abcd@snap2 from ""` + "\n", wantErr: true},
+		"Error on system children only":     {stream: `zfs send stream of rpool/ROOT/ubuntu_1234/var@snap2 from ""` + "\n", wantErr: true},
+		"Error on dataset out of container": {stream: `zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from ""` + "\n" + `zfs send stream of rpool/other@snap2 from ""` + "\n", wantErr: true},
+		"Error on multiple system states":   {stream: `zfs send stream of rpool/ROOT/ubuntu_1234@snap2 from ""` + "\n" + `zfs send stream of rpool/ROOT/ubuntu_5678@snap2 from ""` + "\n", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_receive.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			if tc.targetPool == "" {
+				tc.targetPool = "tpool"
+			}
+
+			send := func(id, from string, w *strings.Builder) error {
+				if tc.withUsers {
+					return ms.SendState(context.Background(), id, w, from, machines.SendWithUserDatasets())
+				}
+				return ms.SendState(context.Background(), id, w, from)
+			}
+
+			if tc.incrementalFrom != "" {
+				var initial strings.Builder
+				if err := send(tc.incrementalFrom, "", &initial); err != nil {
+					t.Fatalf("couldn't setup testbed when sending: %v", err)
+				}
+				if _, err := ms.ReceiveState(context.Background(), strings.NewReader(initial.String()), tc.targetPool); err != nil {
+					t.Fatalf("couldn't setup testbed when receiving: %v", err)
+				}
+			}
+
+			var stream strings.Builder
+			if tc.id != "" {
+				if err := send(tc.id, tc.incrementalFrom, &stream); err != nil {
+					t.Fatalf("couldn't setup testbed when sending: %v", err)
+				}
+			}
+			stream.WriteString(tc.stream)
+			initMachines := ms.CopyForTests(t)
+
+			id, err := ms.ReceiveState(context.Background(), strings.NewReader(stream.String()), tc.targetPool)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				// Nothing was left behind
+				machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+				if err != nil {
+					t.Error("expected success but got an error scanning for machines", err)
+				}
+				assertMachinesEquals(t, machinesAfterRescan, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantID, id, "Unexpected received state ID")
+			m, err := ms.GetMachine(id)
+			if err != nil {
+				t.Fatalf("expected received state to be a machine: %v", err)
+			}
+			assert.Equal(t, tc.wantHistory, m.SortedHistoryIDs(), "Unexpected received history")
+			assert.Equal(t, tc.wantUsers, m.UserNames(), "Unexpected users associated to received state")
+			assert.Equal(t, "noauto", m.State.Datasets[id][0].CanMount, "Received state shouldn't be mounted automatically")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestPromote(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		state string
+
+		wantMainState string
+		wantHistory   []string
+		wantRoutes    []string
+		wantErr       bool
+	}{
+		"Promote clone": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678",
+			wantMainState: "rpool/ROOT/ubuntu_5678", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantRoutes: []string{"rpool/ROOT/ubuntu_5678"}},
+		"Promote clone with separate boot": {def: "m_clone_with_separate_boot.yaml", state: "rpool/ROOT/ubuntu_5678",
+			wantMainState: "rpool/ROOT/ubuntu_5678", wantHistory: []string{"rpool/ROOT/ubuntu_1234"},
+			wantRoutes: []string{"bpool/BOOT/ubuntu_5678", "rpool/ROOT/ubuntu_5678"}},
+		"Promote main state is a no-op": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234",
+			wantMainState: "rpool/ROOT/ubuntu_1234", wantHistory: []string{"rpool/ROOT/ubuntu_5678"},
+			wantRoutes: []string{"rpool/ROOT/ubuntu_1234"}},
+
+		"Error on snapshot":      {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", wantErr: true},
+		"Error on unknown state": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/doesntexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			err = ms.Promote(context.Background(), tc.state)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			m, err := ms.GetMachine(tc.wantMainState)
+			if err != nil {
+				t.Fatalf("expected promoted state to be a machine: %v", err)
+			}
+			assert.Equal(t, tc.wantMainState, m.ID, "Promoted state should be the main machine state")
+			for _, h := range tc.wantHistory {
+				assert.Contains(t, m.History, h, "Expected state to be in machine history")
+			}
+			var routes []string
+			for route, ds := range m.Datasets {
+				routes = append(routes, route)
+				for _, d := range ds {
+					assert.Empty(t, d.Origin, "Promoted dataset %s shouldn't have any origin", d.Name)
+				}
+			}
+			sort.Strings(routes)
+			assert.Equal(t, tc.wantRoutes, routes, "Expected all routes of the state to be promoted")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		op  func(ms *machines.Machines) error
+	}{
+		"Snapshot": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.CreateSystemSnapshot(context.Background(), "dryrun")
+			return err
+		}},
+		"Clone": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.CloneState(context.Background(), "experiment")
+			return err
+		}},
+		"Revert to a snapshot": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RevertToState(context.Background(), "rpool/ROOT/ubuntu_1234@snap1", machines.RevertOptions{})
+			return err
+		}},
+		"Remove state": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RemoveState(context.Background(), "rpool/ROOT/ubuntu_5678", "", true, false)
+			return err
+		}},
+		"Promote": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.Promote(context.Background(), "rpool/ROOT/ubuntu_5678")
+		}},
+		"GC": {def: "gc_system_only.yaml", op: func(ms *machines.Machines) error {
+			return ms.GC(context.Background(), false)
+		}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			conf := machines.WithConfig(filepath.Join("testdata", "confs", "default.conf"))
+
+			// Run the operation for real first, to get the expected operations
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+			lzfs := libzfs.(*mock.LibZFS)
+			lzfs.ForceLastUsedTime(true)
+
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}), conf)
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			lzfs.RecordOperations(true)
+			if err := tc.op(&ms); err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			want := lzfs.Operations()
+			if len(want) == 0 {
+				t.Fatal("expected the operation to run some zfs operations")
+			}
+			assert.Empty(t, ms.DryRunPlan(), "Machines not in dry run mode shouldn't have any plan")
+
+			// Then in dry run, on the same layout
+			dryDir, dryCleanup := testutils.TempDir(t)
+			defer dryCleanup()
+			dryLibzfs := testutils.GetMockZFS(t)
+			dryFPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(dryLibzfs))
+			defer dryFPools.Create(dryDir)()
+			dryLzfs := dryLibzfs.(*mock.LibZFS)
+			dryLzfs.ForceLastUsedTime(true)
+
+			dryMs, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(dryLibzfs), machines.WithTime(testutils.FixedTime{}), conf, machines.WithDryRun())
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			initMachines := dryMs.CopyForTests(t)
+			dryLzfs.RecordOperations(true)
+			if err := tc.op(&dryMs); err != nil {
+				t.Fatalf("expected no error in dry run but got: %v", err)
+			}
+
+			assert.Empty(t, dryLzfs.Operations(), "No zfs operation should run in dry run")
+			assert.Equal(t, want, dryMs.DryRunPlan(), "Dry run should plan the operations run for real, in order")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(dryLibzfs), machines.WithTime(testutils.FixedTime{}), conf)
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			assertMachinesEquals(t, initMachines, machinesAfterRescan)
+
+			if err := dryMs.ResetDryRun(context.Background()); err != nil {
+				t.Fatalf("expected no error resetting dry run but got: %v", err)
+			}
+			assert.Empty(t, dryMs.DryRunPlan(), "Plan should be empty after a reset")
+			assertMachinesEquals(t, initMachines, dryMs)
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		op  func(ms *machines.Machines) error
+
+		wantErr bool
+	}{
+		"Snapshot": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.CreateSystemSnapshot(context.Background(), "readonly")
+			return err
+		}, wantErr: true},
+		"User snapshot": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.CreateUserSnapshot(context.Background(), "user1", "readonly")
+			return err
+		}, wantErr: true},
+		"Clone": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.CloneState(context.Background(), "experiment")
+			return err
+		}, wantErr: true},
+		"Revert": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RevertToState(context.Background(), "rpool/ROOT/ubuntu_1234@snap1", machines.RevertOptions{})
+			return err
+		}, wantErr: true},
+		"Remove state": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RemoveState(context.Background(), "rpool/ROOT/ubuntu_5678", "", true, false)
+			return err
+		}, wantErr: true},
+		"Rename state": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.RenameState(context.Background(), "rpool/ROOT/ubuntu_5678", "before-upgrade")
+		}, wantErr: true},
+		"Promote": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.Promote(context.Background(), "rpool/ROOT/ubuntu_5678")
+		}, wantErr: true},
+		"GC": {def: "gc_system_only.yaml", op: func(ms *machines.Machines) error {
+			return ms.GC(context.Background(), false)
+		}, wantErr: true},
+		"Bookmark": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.CreateBookmark(context.Background(), "rpool/ROOT/ubuntu_1234@snap1", "keep")
+		}, wantErr: true},
+		"Hold": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.HoldSnapshot(context.Background(), "rpool/ROOT/ubuntu_1234@snap1", "keep")
+		}, wantErr: true},
+		"Protect state": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.SetStateProtected(context.Background(), "rpool/ROOT/ubuntu_5678", true)
+		}, wantErr: true},
+		"Relink user dataset": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.RelinkUserDataset(context.Background(), "rpool/USERDATA/root_bcde", "rpool/ROOT/ubuntu_5678")
+		}, wantErr: true},
+		"Create user data": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.CreateUserData(context.Background(), "user2", "/home/user2")
+		}, wantErr: true},
+		"Dissociate user": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.DissociateUser(context.Background(), "user1", false)
+		}, wantErr: true},
+		"Ensure boot": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.EnsureBoot(context.Background())
+			return err
+		}, wantErr: true},
+		"Commit": {def: "m_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.Commit(context.Background())
+			return err
+		}, wantErr: true},
+		"Set default boot state": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.SetDefaultBootState(context.Background(), "rpool/ROOT/ubuntu_5678")
+		}, wantErr: true},
+
+		"Refresh is allowed": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			return ms.Refresh(context.Background())
+		}},
+		"Revert dry run is allowed": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RevertToState(context.Background(), "rpool/ROOT/ubuntu_1234@snap1", machines.RevertOptions{DryRun: true})
+			return err
+		}},
+		"Remove state dry run is allowed": {def: "m_clone_with_userdata.yaml", op: func(ms *machines.Machines) error {
+			_, err := ms.RemoveState(context.Background(), "rpool/ROOT/ubuntu_5678", "", true, true)
+			return err
+		}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+			lzfs := libzfs.(*mock.LibZFS)
+			lzfs.RecordOperations(true)
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs), machines.WithReadOnly())
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			assert.Empty(t, lzfs.Operations(), "Scanning in read only mode shouldn't write anything")
+			initMachines := ms.CopyForTests(t)
+
+			err = tc.op(&ms)
+			assert.Empty(t, lzfs.Operations(), "No zfs operation should run in read only mode")
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assert.True(t, errors.Is(err, machines.ErrReadOnly), "Error should be a read only one, got: %v", err)
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestStateSize(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		state string
+
+		wantErr bool
+	}{
+		"One dataset": {def: "m_with_space_one_dataset.yaml", state: "rpool/ROOT/ubuntu_1234"},
+		"Filesystem exclusive space includes its snapshots": {def: "m_with_space_with_snapshots.yaml", state: "rpool/ROOT/ubuntu_1234"},
+		"Children and boot routes are summed":               {def: "m_with_space_with_children_and_boot.yaml", state: "rpool/ROOT/ubuntu_1234"},
+		"Snapshot only counts its own space":                {def: "m_with_space_with_snapshots.yaml", state: "rpool/ROOT/ubuntu_1234@snap1"},
+
+		"Error on state without datasets": {state: "rpool/ROOT/ubuntu_1234", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &machines.State{ID: tc.state}
+			if tc.def != "" {
+				dir, cleanup := testutils.TempDir(t)
+				defer cleanup()
+
+				libzfs := testutils.GetMockZFS(t)
+				fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+				defer fPools.Create(dir)()
+
+				ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+				if err != nil {
+					t.Fatal("expected success but got an error scanning for machines", err)
+				}
+				if s, err = ms.IDToState(context.Background(), tc.state, ""); err != nil {
+					t.Fatalf("couldn't find state %q: %v", tc.state, err)
+				}
+			}
+
+			type stateSize struct {
+				Used      uint64
+				Exclusive uint64
+			}
+			var got stateSize
+			var err error
+			got.Used, got.Exclusive, err = s.Size()
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			var want stateSize
+			testutils.LoadFromGoldenFile(t, got, &want)
+			assert.Equal(t, want, got, "Unexpected state size")
+		})
+	}
+}
+
+func TestStateBootLabel(t *testing.T) {
+	t.Parallel()
+	lastUsed := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		id       string
+		lastUsed time.Time
+
+		want string
+	}{
+		"Filesystem state":          {id: "rpool/ROOT/ubuntu_a1b2c3", lastUsed: lastUsed, want: "Ubuntu (on ubuntu_a1b2c3, 2024-03-01)"},
+		"Snapshot state":            {id: "rpool/ROOT/ubuntu_a1b2c3@autozsys_xyz", lastUsed: lastUsed, want: "Ubuntu (on ubuntu_a1b2c3, snapshot autozsys_xyz, 2024-03-01)"},
+		"Date is in UTC":            {id: "rpool/ROOT/ubuntu_a1b2c3", lastUsed: lastUsed.In(time.FixedZone("UTC+2", 2*60*60)), want: "Ubuntu (on ubuntu_a1b2c3, 2024-03-01)"},
+		"No last used time":         {id: "rpool/ROOT/ubuntu_a1b2c3", want: "Ubuntu (on ubuntu_a1b2c3)"},
+		"Name without suffix":       {id: "rpool/ROOT/debian", lastUsed: lastUsed, want: "Debian (on debian, 2024-03-01)"},
+		"Name with multiple suffix": {id: "rpool/ROOT/ubuntu_server_a1b2c3", lastUsed: lastUsed, want: "Ubuntu_server (on ubuntu_server_a1b2c3, 2024-03-01)"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := machines.State{ID: tc.id, LastUsed: tc.lastUsed}
+			assert.Equal(t, tc.want, s.BootLabel(), "Unexpected boot label")
+			assert.Equal(t, s.BootLabel(), s.BootLabel(), "Boot label should be stable")
+		})
+	}
+}
+
+func TestStateWrittenSinceBase(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		state string
+
+		wantErr bool
+	}{
+		"Main dataset reports zero": {def: "m_clone_with_written.yaml", state: "rpool/ROOT/ubuntu_1234"},
+		"Clone":                     {def: "m_clone_with_written.yaml", state: "rpool/ROOT/ubuntu_5678"},
+		"Snapshot reports zero":     {def: "m_clone_with_written.yaml", state: "rpool/ROOT/ubuntu_1234@snap1"},
+		"Clone children and boot routes are summed, children created after clone report zero": {def: "m_clone_with_written_children_and_boot.yaml", state: "rpool/ROOT/ubuntu_5678"},
+
+		"Error on state without datasets": {state: "rpool/ROOT/ubuntu_5678", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &machines.State{ID: tc.state}
+			if tc.def != "" {
+				dir, cleanup := testutils.TempDir(t)
+				defer cleanup()
+
+				libzfs := testutils.GetMockZFS(t)
+				fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+				defer fPools.Create(dir)()
+
+				ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+				if err != nil {
+					t.Fatal("expected success but got an error scanning for machines", err)
+				}
+				if s, err = ms.IDToState(context.Background(), tc.state, ""); err != nil {
+					t.Fatalf("couldn't find state %q: %v", tc.state, err)
+				}
+			}
+
+			got, err := s.WrittenSinceBase()
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("Got an error when expecting none: %v", err)
+				}
+				return
+			} else if tc.wantErr {
+				t.Fatalf("Expected an error but got none")
+			}
+
+			var want uint64
+			testutils.LoadFromGoldenFile(t, got, &want)
+			assert.Equal(t, want, got, "Unexpected written size since base")
+		})
+	}
+}
+
+func TestEstimateSpaceForClone(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def        string
+		id         string
+		referenced map[string]uint64
+		available  map[string]uint64
+		without    string
+
+		wantRequired  uint64
+		wantAvailable uint64
+		wantErr       bool
+	}{
+		"Snapshot state with its user states": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_1234@snap1",
+			referenced:   map[string]uint64{"rpool/ROOT/ubuntu_1234@snap1": 300, "rpool/USERDATA/user1_abcd@snap1": 100, "rpool/ROOT/ubuntu_1234": 999},
+			available:    map[string]uint64{"rpool": 1000},
+			wantRequired: 400, wantAvailable: 1000},
+		"Filesystem state with its user states": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678",
+			referenced:   map[string]uint64{"rpool/ROOT/ubuntu_5678": 50, "rpool/USERDATA/user1_efgh": 20, "rpool/ROOT/ubuntu_1234": 999},
+			available:    map[string]uint64{"rpool": 1000},
+			wantRequired: 70, wantAvailable: 1000},
+		"Pool with the least space left on separate boot": {def: "m_snapshot_with_separate_boot_with_children.yaml", id: "rpool/ROOT/ubuntu_1234@snap1",
+			referenced:   map[string]uint64{"rpool/ROOT/ubuntu_1234@snap1": 500, "bpool/BOOT/ubuntu_1234@snap1": 30, "bpool/BOOT/ubuntu_1234/grub@snap1": 10},
+			available:    map[string]uint64{"rpool": 10000, "bpool": 60},
+			wantRequired: 40, wantAvailable: 60},
+		"Not enough space left": {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_5678",
+			referenced:   map[string]uint64{"rpool/ROOT/ubuntu_5678": 50, "rpool/USERDATA/user1_efgh": 20},
+			available:    map[string]uint64{"rpool": 10},
+			wantRequired: 70, wantAvailable: 10},
+
+		"Error on unknown state":        {def: "m_clone_with_userdata.yaml", id: "rpool/ROOT/ubuntu_doesntexist", wantErr: true},
+		"Error on missing pool dataset": {def: "m_snapshot_with_separate_boot_with_children.yaml", id: "rpool/ROOT/ubuntu_1234@snap1", without: "bpool", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatalf("couldn't scan datasets: %v", err)
+			}
+			var datasets []zfs.Dataset
+			for _, d := range z.Datasets() {
+				if d.Name == tc.without {
+					continue
+				}
+				d := *d
+				d.Referenced = tc.referenced[d.Name]
+				d.Available = tc.available[d.Name]
+				datasets = append(datasets, d)
+			}
+
+			ms, err := machines.NewFromDatasets(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), datasets)
+			if err != nil {
+				t.Fatalf("expected success but got an error building machines: %v", err)
+			}
+
+			required, available, err := ms.EstimateSpaceForClone(tc.id)
+			if tc.wantErr {
+				assert.Error(t, err, "EstimateSpaceForClone should return an error but didn't")
+				return
+			}
+			assert.NoError(t, err, "EstimateSpaceForClone should return no error")
+			assert.Equal(t, tc.wantRequired, required, "Unexpected required space")
+			assert.Equal(t, tc.wantAvailable, available, "Unexpected available space")
+		})
+	}
+}
+func TestNoautoBootDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		stateID string
+
+		want []string
+	}{
+		"Main state with some noauto boot datasets": {def: "m_boot_datasets_noauto.yaml", stateID: "rpool/ROOT/ubuntu_1234",
+			want: []string{"bpool/BOOT/ubuntu_1234", "bpool/BOOT/ubuntu_1234/efi"}},
+		"Snapshot state with some noauto boot datasets": {def: "m_boot_datasets_noauto.yaml", stateID: "rpool/ROOT/ubuntu_1234@snap1",
+			want: []string{"bpool/BOOT/ubuntu_1234@snap1", "bpool/BOOT/ubuntu_1234/efi@snap1"}},
+		"Clone state with only canmount on boot datasets": {def: "m_boot_datasets_noauto.yaml", stateID: "rpool/ROOT/ubuntu_5678"},
+		"State without boot datasets":                     {def: "m_with_userdata.yaml", stateID: "rpool/ROOT/ubuntu_1234"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			s, _, err := ms.GetStateByID(tc.stateID)
+			if err != nil {
+				t.Fatalf("expected state %s to exist: %v", tc.stateID, err)
+			}
+
+			var got []string
+			for _, d := range s.NoautoBootDatasets() {
+				got = append(got, d.Name)
+			}
+			assert.ElementsMatch(t, tc.want, got, "Unexpected noauto boot datasets")
+		})
+	}
+}
+
+func TestStateMountpoints(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def             string
+		stateID         string
+		withPersistents bool
+
+		want map[string]string
+	}{
+		"Main state": {def: "m_mountpoints.yaml", stateID: "rpool/ROOT/ubuntu_1234",
+			want: map[string]string{
+				"rpool/ROOT/ubuntu_1234":         "/",
+				"rpool/ROOT/ubuntu_1234/var":     "/var",
+				"rpool/ROOT/ubuntu_1234/var/lib": "/var/lib",
+				"rpool/USERDATA/user1_abcd":      "/home/user1",
+			}},
+		"Main state with persistent datasets": {def: "m_mountpoints.yaml", stateID: "rpool/ROOT/ubuntu_1234", withPersistents: true,
+			want: map[string]string{
+				"rpool/ROOT/ubuntu_1234":         "/",
+				"rpool/ROOT/ubuntu_1234/var":     "/var",
+				"rpool/ROOT/ubuntu_1234/var/lib": "/var/lib",
+				"rpool/USERDATA/user1_abcd":      "/home/user1",
+				"rpool/srv":                      "/srv",
+			}},
+		"Snapshot state inherits mountpoints from its parents": {def: "m_mountpoints.yaml", stateID: "rpool/ROOT/ubuntu_1234@snap1",
+			want: map[string]string{
+				"rpool/ROOT/ubuntu_1234@snap1":         "/",
+				"rpool/ROOT/ubuntu_1234/var@snap1":     "/var",
+				"rpool/ROOT/ubuntu_1234/var/lib@snap1": "/var/lib",
+			}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			s, m, err := ms.GetStateByID(tc.stateID)
+			if err != nil {
+				t.Fatalf("expected state %s to exist: %v", tc.stateID, err)
+			}
+
+			got := s.Mountpoints()
+			if tc.withPersistents {
+				got = m.StateMountpoints(*s)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected mountpoints")
+		})
+	}
+}
+
+func TestSharedDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		idA string
+		idB string
+
+		want []string
+	}{
+		"State is the clone origin of the other": {idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/ubuntu_5678",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1"}},
+		"Snapshot state is the clone origin of the other": {idA: "rpool/ROOT/ubuntu_1234@snap1", idB: "rpool/ROOT/ubuntu_5678",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1"}},
+		"Sharing is symmetric": {idA: "rpool/ROOT/ubuntu_5678", idB: "rpool/ROOT/ubuntu_1234@snap1",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1"}},
+		"Siblings cloned from the same snapshot": {idA: "rpool/ROOT/ubuntu_5678", idB: "rpool/ROOT/ubuntu_9012",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1"}},
+		"Clones of different snapshots of the same dataset": {idA: "rpool/ROOT/ubuntu_5678", idB: "rpool/ROOT/ubuntu_3456",
+			want: []string{"rpool/ROOT/ubuntu_1234"}},
+		"Snapshots of the same dataset": {idA: "rpool/ROOT/ubuntu_1234@snap1", idB: "rpool/ROOT/ubuntu_1234@snap2",
+			want: []string{"rpool/ROOT/ubuntu_1234"}},
+
+		"Unknown state shares nothing": {idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/doesntexist"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_shared_datasets.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, d := range ms.SharedDatasets(tc.idA, tc.idB) {
+				got = append(got, d.Name)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected shared datasets")
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def      string
+		snapshot bool
+		protect  string
+
+		wantChanged bool
+	}{
+		"Same layout, same fingerprint":       {def: "m_with_userdata.yaml"},
+		"Same layout with history":            {def: "m_bootlist.yaml"},
+		"New snapshot changes fingerprint":    {def: "m_with_userdata.yaml", snapshot: true, wantChanged: true},
+		"Property change changes fingerprint": {def: "m_bootlist.yaml", protect: "rpool/ROOT/ubuntu_1234@snap1", wantChanged: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			initFingerprint := ms.Fingerprint()
+			m, _ := ms.CurrentMachine()
+			initStateFingerprint := m.State.Fingerprint()
+
+			if tc.snapshot {
+				if _, err := ms.CreateSystemSnapshot(context.Background(), "newsnap"); err != nil {
+					t.Fatalf("couldn't create snapshot: %v", err)
+				}
+			}
+			if tc.protect != "" {
+				if err := ms.SetStateProtected(context.Background(), tc.protect, true); err != nil {
+					t.Fatalf("couldn't protect state: %v", err)
+				}
+			}
+
+			msRescanned, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			assert.Equal(t, ms.Fingerprint(), msRescanned.Fingerprint(), "Rescanning the same datasets should produce the same fingerprint")
+
+			if !tc.wantChanged {
+				assert.Equal(t, initFingerprint, msRescanned.Fingerprint(), "Fingerprint shouldn't have changed")
+				m, _ := msRescanned.CurrentMachine()
+				assert.Equal(t, initStateFingerprint, m.State.Fingerprint(), "State fingerprint shouldn't have changed")
+				return
+			}
+			assert.NotEqual(t, initFingerprint, msRescanned.Fingerprint(), "Fingerprint should have changed")
+		})
+	}
+}
+
+func TestLegacyMountpoints(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		wantMachines []string
+		wantRoutes   map[string][]string
+		wantHistory  []string
+	}{
+		"Legacy boot datasets attach to their machine": {def: "m_with_legacy_boot.yaml",
+			wantMachines: []string{"rpool/ROOT/ubuntu_1234"},
+			wantRoutes: map[string][]string{
+				"rpool/ROOT/ubuntu_1234": {"rpool/ROOT/ubuntu_1234"},
+				"bpool/BOOT/ubuntu_1234": {"bpool/BOOT/ubuntu_1234", "bpool/BOOT/ubuntu_1234/grub"},
+			}},
+		"Legacy root dataset is a machine": {def: "m_with_legacy_root.yaml",
+			wantMachines: []string{"rpool/ROOT/ubuntu_1234"},
+			wantRoutes: map[string][]string{
+				"rpool/ROOT/ubuntu_1234": {"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234/var"},
+			},
+			wantHistory: []string{"rpool/ROOT/ubuntu_1234@snap1"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			assert.Equal(t, tc.wantMachines, ms.SortedMachineIDs(), "Unexpected machines")
+			m, err := ms.GetMachine(tc.wantMachines[0])
+			if err != nil {
+				t.Fatalf("expected machine %s to exist: %v", tc.wantMachines[0], err)
+			}
+			got := make(map[string][]string)
+			for route, ds := range m.Datasets {
+				for _, d := range ds {
+					got[route] = append(got[route], d.Name)
+				}
+			}
+			assert.Equal(t, tc.wantRoutes, got, "Unexpected attached datasets")
+			assert.ElementsMatch(t, tc.wantHistory, m.SortedHistoryIDs(), "Unexpected history states")
+		})
+	}
+}
+
+func TestAllDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want []string
+	}{
+		"System datasets only": {def: "d_one_machine_one_dataset.yaml", want: []string{"rpool"}},
+		"History and shared user datasets listed once": {def: "m_clone_with_userdata.yaml",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678",
+				"rpool/USERDATA/root_bcde", "rpool/USERDATA/user1_abcd", "rpool/USERDATA/user1_abcd@snap1", "rpool/USERDATA/user1_efgh"}},
+		"With persistent datasets": {def: "m_clone_with_persistent.yaml",
+			want: []string{"rpool/ROOT/ubuntu_1234", "rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678", "rpool/opt"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine(tc.want[0])
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			m, ok := ms.CurrentMachine()
+			if !ok {
+				t.Fatal("expected a current machine but got none")
+			}
+
+			var got []string
+			for _, d := range m.AllDatasets() {
+				got = append(got, d.Name)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected machine datasets")
+		})
+	}
+}
+
+func TestPersistentDatasets(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+
+		want []string
+	}{
+		"Persistent datasets":    {def: "m_clone_with_persistent.yaml", want: []string{"rpool/opt"}},
+		"No persistent datasets": {def: "m_clone_with_userdata.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, d := range ms.PersistentDatasets() {
+				got = append(got, d.Name)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected persistent datasets")
+
+			// Changing the returned list or the list of a machine doesn't change the others
+			if ds := ms.PersistentDatasets(); len(ds) > 0 {
+				ds[0] = nil
+			}
+			if m, ok := ms.CurrentMachine(); ok && len(m.PersistentDatasets) > 0 {
+				m.PersistentDatasets[0] = nil
+			}
+			got = nil
+			for _, d := range ms.PersistentDatasets() {
+				got = append(got, d.Name)
+			}
+			assert.Equal(t, tc.want, got, "Persistent datasets shouldn't be changed through a copy")
+		})
+	}
+}
+
+func TestRestoreTarget(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		state string
+
+		wantMachine string
+		wantID      string
+		wantErr     bool
+	}{
+		"Snapshot state is cloned under its machine": {state: "rpool/ROOT/ubuntu_1234@snap1", wantMachine: "rpool/ROOT/ubuntu_1234", wantID: "rpool/ROOT/ubuntu_xxxxxx"},
+		"Clone state is used as is":                  {state: "rpool/ROOT/ubuntu_5678", wantMachine: "rpool/ROOT/ubuntu_1234", wantID: "rpool/ROOT/ubuntu_5678"},
+		"Current state is used as is":                {state: "rpool/ROOT/ubuntu_1234", wantMachine: "rpool/ROOT/ubuntu_1234", wantID: "rpool/ROOT/ubuntu_1234"},
+
+		"Error on unknown state": {state: "rpool/ROOT/doesntexist", wantErr: true},
+		"Error on empty id":      {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_clone_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			initMachines := ms.CopyForTests(t)
+
+			m, id, err := ms.RestoreTarget(tc.state)
+			if tc.wantErr {
+				assert.Error(t, err, "RestoreTarget should fail")
+				return
+			}
+			assert.NoError(t, err, "RestoreTarget should succeed")
+
+			assert.Equal(t, tc.wantMachine, m.ID, "Unexpected machine to restore into")
+			assert.Equal(t, tc.wantID, id, "Unexpected restored state ID")
+			assertMachinesEquals(t, initMachines, ms)
+		})
+	}
+}
+
+func TestPersistentImpact(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def   string
+		state string
+
+		want []string
+	}{
+		"Persistent datasets are kept":      {def: "m_clone_with_persistent.yaml", state: "rpool/ROOT/ubuntu_5678", want: []string{"rpool/opt"}},
+		"Persistent datasets of a snapshot": {def: "m_clone_with_persistent.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", want: []string{"rpool/opt"}},
+		"No persistent datasets":            {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678"},
+		"Unknown state":                     {def: "m_clone_with_persistent.yaml", state: "rpool/ROOT/doesntexist"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+
+			var got []string
+			for _, d := range ms.PersistentImpact(tc.state) {
+				got = append(got, d.Name)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected persistent datasets kept on revert")
+		})
+	}
+}
+
+func TestRevertableStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		machine string
+
+		want           []string
+		wantNeedsClone []bool
+	}{
+		"Snapshots and clones, most recently used first": {def: "m_bootlist.yaml", machine: "rpool/ROOT/ubuntu_1234",
+			want:           []string{"rpool/ROOT/ubuntu_5678", "rpool/ROOT/ubuntu_1234@snap2", "rpool/ROOT/ubuntu_1234@snap1"},
+			wantNeedsClone: []bool{false, true, true}},
+		"No history":       {def: "m_with_userdata.yaml", machine: "rpool/ROOT/ubuntu_1234"},
+		"Non zsys machine": {def: "d_two_machines_one_zsys_one_non_zsys.yaml", machine: "rpool2"},
+		"Non zsys history state is excluded": {def: "m_invalid_states.yaml", machine: "rpool/ROOT/ubuntu_1234",
+			want: []string{"rpool/ROOT/ubuntu_1234@snap1"}, wantNeedsClone: []bool{true}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine(tc.machine), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			m, err := ms.GetMachine(tc.machine)
+			if err != nil {
+				t.Fatalf("expected machine %s to exist: %v", tc.machine, err)
+			}
+
+			var got []string
+			var gotNeedsClone []bool
+			for _, s := range m.RevertableStates() {
+				got = append(got, s.ID)
+				gotNeedsClone = append(gotNeedsClone, s.NeedsClone)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected revertable states")
+			assert.Equal(t, tc.wantNeedsClone, gotNeedsClone, "Unexpected states needing a clone")
+		})
+	}
+}
+
+func TestZsysHistory(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		machine string
+
+		want []string
+	}{
+		"Snapshots and clones":            {def: "m_clone_with_userdata.yaml", machine: "rpool/ROOT/ubuntu_1234", want: []string{"rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678"}},
+		"Non zsys history state excluded": {def: "m_invalid_states.yaml", machine: "rpool/ROOT/ubuntu_1234", want: []string{"rpool/ROOT/ubuntu_1234@snap1"}},
+		"No history":                      {def: "m_with_userdata.yaml", machine: "rpool/ROOT/ubuntu_1234"},
+		"Non zsys machine":                {def: "d_two_machines_one_zsys_one_non_zsys.yaml", machine: "rpool2"},
+		"Non zsys machine with history":   {def: "gc_system_only_non_zsys.yaml", machine: "rpool/ROOT/ubuntu_1234"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine(tc.machine), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			m, err := ms.GetMachine(tc.machine)
+			if err != nil {
+				t.Fatalf("expected machine %s to exist: %v", tc.machine, err)
+			}
+
+			var got []string
+			for _, s := range m.ZsysHistory() {
+				got = append(got, s.ID)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected zsys history states")
+		})
+	}
+}
+
+func TestHistoryStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def              string
+		includeSnapshots bool
+
+		want []string
+	}{
+		"Clones only":                {def: "m_clone_with_userdata.yaml", want: []string{"rpool/ROOT/ubuntu_5678"}},
+		"Snapshots and clones":       {def: "m_clone_with_userdata.yaml", includeSnapshots: true, want: []string{"rpool/ROOT/ubuntu_1234@snap1", "rpool/ROOT/ubuntu_5678"}},
+		"No history":                 {def: "m_with_userdata.yaml", includeSnapshots: true},
+		"Snapshots only are ignored": {def: "m_with_userdata_and_multiple_snapshots.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+			m, err := ms.GetMachine("rpool/ROOT/ubuntu_1234")
+			if err != nil {
+				t.Fatalf("expected machine to exist: %v", err)
+			}
+
+			var got []string
+			for _, s := range m.HistoryStates(tc.includeSnapshots) {
+				got = append(got, s.ID)
+			}
+			assert.Equal(t, tc.want, got, "Unexpected history states")
+		})
+	}
+}
+
+func TestGenerateBootList(t *testing.T) {
+	t.Parallel()
+	mainEntry := machines.BootEntry{Label: "Ubuntu (on ubuntu_1234, 2019-04-18)", Root: "rpool/ROOT/ubuntu_1234",
+		Cmdline: "root=ZFS=rpool/ROOT/ubuntu_1234", Default: true, Bootable: true}
+	history := []machines.BootEntry{
+		{Label: "Ubuntu (on ubuntu_5678, 2019-12-31)", Root: "rpool/ROOT/ubuntu_5678",
+			Cmdline: "root=ZFS=rpool/ROOT/ubuntu_5678", Bootable: true},
+		{Label: "Ubuntu (on ubuntu_9012, 2019-06-01)", Root: "rpool/ROOT/ubuntu_9012",
+			Cmdline: "root=ZFS=rpool/ROOT/ubuntu_9012", Reason: "encryption key of rpool/ROOT/ubuntu_9012 isn't loaded"},
+		{Label: "Ubuntu (on ubuntu_1234, snapshot snap2, 2019-01-01)", Root: "rpool/ROOT/ubuntu_1234@snap2",
+			Cmdline: "root=ZFS=rpool/ROOT/ubuntu_1234@snap2", Bootable: true},
+		{Label: "Ubuntu (on ubuntu_1234, snapshot snap1, 2018-12-10)", Root: "rpool/ROOT/ubuntu_1234@snap1",
+			Cmdline: "root=ZFS=rpool/ROOT/ubuntu_1234@snap1", Bootable: true},
+	}
+
+	tests := map[string]struct {
+		def     string
+		cmdline string
+
+		want []machines.BootEntry
+	}{
+		"Current machine with history": {def: "m_bootlist.yaml", cmdline: "rpool/ROOT/ubuntu_1234",
+			want: append([]machines.BootEntry{mainEntry}, history...)},
+		"Booted on a history state": {def: "m_bootlist.yaml", cmdline: "rpool/ROOT/ubuntu_5678",
+			want: append([]machines.BootEntry{mainEntry}, history...)},
+		"Current machine without history": {def: "d_one_machine_one_dataset.yaml", cmdline: "rpool",
+			want: []machines.BootEntry{{Label: "Rpool (on rpool, 2020-09-13)", Root: "rpool",
+				Cmdline: "root=ZFS=rpool", Default: true, Bootable: true}}},
+
+		"No current machine": {def: "m_bootlist.yaml", cmdline: "rpool/ROOT/ubuntu_doesntexist"},
+		"Non zsys machine":   {def: "d_one_machine_one_dataset_non_zsys.yaml", cmdline: "rpool"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), generateCmdLine(tc.cmdline), machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			assert.Equal(t, tc.want, ms.GenerateBootList(), "Unexpected boot list")
+		})
+	}
+}
+
+func TestMachineSpace(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def     string
+		machine string
+	}{
+		"Only main state": {def: "m_with_space_one_dataset.yaml", machine: "rpool/ROOT/ubuntu_1234"},
+		"History states, users and persistent datasets, snapshots and shared user datasets counted once": {def: "m_with_space_history_users_and_persistent.yaml", machine: "rpool/ROOT/ubuntu_1234"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
 
-			machinesAfterRescan, err := machines.New(context.Background(), generateCmdLine(tc.currentStateID), machines.WithLibZFS(libzfs))
+			ms, err := machines.New(context.Background(), generateCmdLine(tc.machine), machines.WithLibZFS(libzfs))
 			if err != nil {
-				t.Error("expected success but got an error scanning for machines", err)
+				t.Fatal("expected success but got an error scanning for machines", err)
 			}
-			assertMachinesEquals(t, machinesAfterRescan, ms)
+			m, err := ms.GetMachine(tc.machine)
+			if err != nil {
+				t.Fatalf("couldn't find machine %q: %v", tc.machine, err)
+			}
+
+			got := m.Space()
+			var want machines.MachineSpace
+			testutils.LoadFromGoldenFile(t, got, &want)
+			assert.Equal(t, want, got, "Unexpected machine space")
 		})
 	}
 }
 
-func TestIDToState(t *testing.T) {
+func TestMachineSpaceFromPools(t *testing.T) {
 	t.Parallel()
-	tests := map[string]struct {
-		name string
-		user string
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
 
-		wantState string
-		wantErr   bool
-	}{
-		"Match full system path ID": {name: "rpool/ROOT/ubuntu_1234", wantState: "rpool/ROOT/ubuntu_1234"},
-		"Match full user path ID":   {name: "rpool/USERDATA/user1_abcd", user: "user1", wantState: "rpool/USERDATA/user1_abcd"},
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_persistent_with_space.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
 
-		"Match suffix system ID":       {name: "5678", wantState: "rpool/ROOT/ubuntu_5678"},
-		"Match dataset path system ID": {name: "ubuntu_5678", wantState: "rpool/ROOT/ubuntu_5678"},
-		"Match unique system snapshot": {name: "snap1", wantState: "rpool/ROOT/ubuntu_1234@snap1"},
+	// Like the real bindings, space properties aren't loaded when opening datasets.
+	libzfs.(*mock.LibZFS).PartialPropertiesLoad(true)
 
-		"Limit search on duplicated snapshot name to a single user": {name: "snap1", user: "user1", wantState: "rpool/USERDATA/user1_abcd@snap1"},
+	ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatal("expected success but got an error scanning for machines", err)
+	}
 
-		// User datasets shared between machines
-		"Match on user generated ID":                                                         {name: "jklm-rpool.ROOT.ubuntu-1234", user: "user2", wantState: "rpool/USERDATA/user2_jklm"},
-		"Doesn’t match on user dataset regular name":                                         {name: "rpool/USERDATA/user2_jklm", user: "user2", wantErr: true},
-		"User data attached to 2 machines but only linked to one system state isn’t renamed": {name: "rpool/USERDATA/user3_mnop", user: "user3", wantState: "rpool/USERDATA/user3_mnop"},
+	m, ok := ms.CurrentMachine()
+	if !ok {
+		t.Fatal("expected a current machine but got none")
+	}
+	assert.Equal(t, machines.MachineSpace{States: 110, Persistent: 62}, m.Space(), "Unexpected machine space")
+	assert.Equal(t, uint64(62), ms.PersistentDatasetsSize(), "Unexpected persistent datasets size")
+}
 
-		// Multiple matches
-		"Multiple states match system suffix ID": {name: "1234", wantErr: true},
-		"Multiple states match user suffix ID":   {name: "abcd", user: "user1", wantErr: true},
+func TestDiffStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		def string
+		idA string
+		idB string
 
-		// No match
-		"Empty name":         {name: "", wantErr: true},
-		"No match at all":    {name: "/doesntexists", wantErr: true},
-		"User doesn’t exist": {name: "foo", user: "userfoo", wantErr: true},
-		"No match on full path ID search without user provided":    {name: "rpool/USERDATA/user1_abcd", wantErr: true},
-		"No match on full path ID search with wrong user provided": {name: "rpool/USERDATA/user1_abcd", user: "userfoo", wantErr: true},
+		wantDiff machines.StateDiff
+		wantErr  bool
+	}{
+		"Same state has no difference": {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/ubuntu_1234"},
+		"State and its snapshot": {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/ubuntu_1234@snap1",
+			wantDiff: machines.StateDiff{OnlyInA: []string{"rpool/USERDATA/root_bcde"}}},
+		"Snapshot and its state is symmetrical": {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/ubuntu_1234@snap1", idB: "rpool/ROOT/ubuntu_1234",
+			wantDiff: machines.StateDiff{OnlyInB: []string{"rpool/USERDATA/root_bcde"}}},
+		"State and its clone": {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/ubuntu_5678",
+			wantDiff: machines.StateDiff{
+				OnlyInA: []string{"rpool/USERDATA/root_bcde"},
+				Different: []machines.DatasetDiff{
+					{A: "rpool/ROOT/ubuntu_1234", B: "rpool/ROOT/ubuntu_5678", Properties: []string{"canmount"}},
+					{A: "rpool/USERDATA/user1_abcd", B: "rpool/USERDATA/user1_efgh", Properties: []string{"canmount"}},
+				}}},
+
+		"Error on unknown first state":  {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/doesntexist", idB: "rpool/ROOT/ubuntu_1234", wantErr: true},
+		"Error on unknown second state": {def: "m_clone_with_userdata.yaml", idA: "rpool/ROOT/ubuntu_1234", idB: "rpool/ROOT/doesntexist", wantErr: true},
 	}
 
 	for name, tc := range tests {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
+			t.Parallel()
 			dir, cleanup := testutils.TempDir(t)
 			defer cleanup()
 
 			libzfs := testutils.GetMockZFS(t)
-			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "state_idtostate.yaml"), testutils.WithLibZFS(libzfs))
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
 			defer fPools.Create(dir)()
 
-			_, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
-			if err != nil {
-				t.Fatalf("couldn’t create original zfs datasets state")
-			}
-
-			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			ms, err := machines.New(context.Background(), generateCmdLine("rpool/ROOT/ubuntu_1234"), machines.WithLibZFS(libzfs))
 			if err != nil {
 				t.Error("expected success but got an error scanning for machines", err)
 			}
 
-			got, err := ms.IDToState(context.Background(), tc.name, tc.user)
-
+			diff, err := ms.DiffStates(context.Background(), tc.idA, tc.idB)
 			if err != nil {
 				if !tc.wantErr {
 					t.Fatalf("Got an error when expecting none: %v", err)
@@ -1313,7 +6084,7 @@ func TestIDToState(t *testing.T) {
 				t.Fatalf("Expected an error but got none")
 			}
 
-			assert.Equal(t, tc.wantState, got.ID, "didn't get expected state")
+			assert.Equal(t, tc.wantDiff, diff, "Unexpected states diff")
 		})
 	}
 }
@@ -1468,6 +6239,367 @@ func TestGC(t *testing.T) {
 	}
 }
 
+func TestGCProgress(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "gc_system_only.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	type call struct {
+		done, total int
+		current     string
+	}
+	var calls []call
+	progress := func(done, total int, current string) {
+		calls = append(calls, call{done, total, current})
+	}
+
+	ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs), machines.WithTime(testutils.FixedTime{}),
+		machines.WithConfig(filepath.Join("testdata", "confs", "default.conf")), machines.WithProgress(progress))
+	if err != nil {
+		t.Error("expected success but got an error scanning for machines", err)
+	}
+
+	if err := ms.GC(context.Background(), false); err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+
+	if len(calls) == 0 {
+		t.Fatal("expected progress to be reported while removing states")
+	}
+	for _, c := range calls {
+		assert.LessOrEqual(t, c.done, c.total, "Progress shouldn't exceed total")
+		if c.done < c.total {
+			assert.NotEmpty(t, c.current, "State being removed should be reported")
+		}
+	}
+	last := calls[len(calls)-1]
+	assert.Equal(t, last.total, last.done, "Last progress should report all states as done")
+}
+
+func TestGCKeepUserStatesLinkedToSystem(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		policy *machines.GCPolicy
+
+		wantUserStates []string
+	}{
+		"Keep user snapshot linked to a kept system state by default": {
+			wantUserStates: []string{"rpool/USERDATA/user1_abcd", "rpool/USERDATA/user1_abcd@autozsys_20190601-1000"}},
+		"Keep user snapshot linked to a kept system state": {policy: &machines.GCPolicy{KeepUserStatesLinkedToSystem: true},
+			wantUserStates: []string{"rpool/USERDATA/user1_abcd", "rpool/USERDATA/user1_abcd@autozsys_20190601-1000"}},
+		"Only follow history rules for user states": {policy: &machines.GCPolicy{KeepUserStatesLinkedToSystem: false},
+			wantUserStates: []string{"rpool/USERDATA/user1_abcd"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "gc_system_with_users_linked_to_kept_system_state.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			configPath := filepath.Join("testdata", "confs", "purge_all_zsys.conf")
+			var ms machines.Machines
+			var err error
+			if tc.policy != nil {
+				ms, err = machines.New(context.Background(), "", machines.WithLibZFS(libzfs),
+					machines.WithTime(testutils.FixedTime{}), machines.WithConfig(configPath), machines.WithGCPolicy(*tc.policy))
+			} else {
+				ms, err = machines.New(context.Background(), "", machines.WithLibZFS(libzfs),
+					machines.WithTime(testutils.FixedTime{}), machines.WithConfig(configPath))
+			}
+			if err != nil {
+				t.Error("expected success but got an error scanning for machines", err)
+			}
+
+			if err := ms.GC(context.Background(), false); err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			m, err := ms.GetMachine("rpool/ROOT/ubuntu_1234")
+			if err != nil {
+				t.Fatalf("expected machine to still exist: %v", err)
+			}
+			// The system snapshot is always kept, as it's the origin of a clone
+			assert.Contains(t, m.History, "rpool/ROOT/ubuntu_1234@autozsys_20190601-1000", "System snapshot should be kept")
+
+			var got []string
+			for id := range m.AllUsersStates["user1"] {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			assert.Equal(t, tc.wantUserStates, got, "Unexpected user states after GC")
+		})
+	}
+}
+
+func TestStateCreationTime(t *testing.T) {
+	t.Parallel()
+	snapshotCreation := time.Date(2018, 12, 10, 12, 20, 44, 0, time.UTC)
+	tests := map[string]struct {
+		def      string
+		state    string
+		fromDump bool
+
+		want        *time.Time
+		wantScanned bool
+	}{
+		"Snapshot state":                        {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", want: &snapshotCreation},
+		"Filesystem state created when scanned": {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_5678", wantScanned: true},
+		"Unknown creation time":                 {def: "m_clone_with_userdata.yaml", state: "rpool/ROOT/ubuntu_1234@snap1", fromDump: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			start := time.Now().Add(-time.Second)
+			defer fPools.Create(dir)()
+			end := time.Now().Add(time.Second)
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatal("expected success but got an error scanning for machines", err)
+			}
+			if tc.fromDump {
+				b, err := json.Marshal(&ms)
+				if err != nil {
+					t.Fatalf("couldn't dump machines: %v", err)
+				}
+				ms = machines.Machines{}
+				if err := json.Unmarshal(b, &ms); err != nil {
+					t.Fatalf("couldn't restore machines: %v", err)
+				}
+			}
+
+			s, _, err := ms.GetStateByID(tc.state)
+			if err != nil {
+				t.Fatalf("expected state %q but got: %v", tc.state, err)
+			}
+			got := s.CreationTime()
+
+			if tc.wantScanned {
+				if got == nil {
+					t.Fatal("expected a creation time but got none")
+				}
+				assert.False(t, got.Before(start.Truncate(time.Second)) || got.After(end), "Creation time %v should be when the dataset was created", got)
+				return
+			}
+			if tc.want == nil {
+				assert.Nil(t, got, "Unexpected creation time")
+				return
+			}
+			if got == nil {
+				t.Fatal("expected a creation time but got none")
+			}
+			assert.True(t, tc.want.Equal(*got), "Unexpected creation time: %v", got)
+		})
+	}
+}
+
+func TestSetStateProtected(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		id        string
+		protected bool
+		unprotect bool
+
+		wantID        string
+		wantProtected bool
+		wantErr       bool
+	}{
+		"Protect current state":        {id: "rpool/ROOT/ubuntu_1234", protected: true, wantID: "rpool/ROOT/ubuntu_1234", wantProtected: true},
+		"Protect snapshot state":       {id: "rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", protected: true, wantID: "rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", wantProtected: true},
+		"Protect state from short id":  {id: "autozsys_20191227-1800", protected: true, wantID: "rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", wantProtected: true},
+		"Unprotect a protected state":  {id: "rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", protected: true, unprotect: true, wantID: "rpool/ROOT/ubuntu_1234@autozsys_20191227-1800"},
+		"Unprotect an unprotected one": {id: "rpool/ROOT/ubuntu_1234", wantID: "rpool/ROOT/ubuntu_1234"},
+
+		"Error on unknown state": {id: "rpool/ROOT/doesntexist", protected: true, wantErr: true},
+		"Error on empty id":      {protected: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "gc_system_only.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "New should succeed")
+
+			err = ms.SetStateProtected(context.Background(), tc.id, tc.protected)
+			if tc.wantErr {
+				assert.Error(t, err, "SetStateProtected should fail")
+				return
+			}
+			assert.NoError(t, err, "SetStateProtected should succeed")
+			if tc.unprotect {
+				assert.NoError(t, ms.SetStateProtected(context.Background(), tc.id, false), "unprotecting should succeed")
+			}
+
+			s, _, err := ms.GetStateByID(tc.wantID)
+			assert.NoError(t, err, "state should still exist")
+			assert.Equal(t, tc.wantProtected, s.Protected(), "Unexpected protection")
+
+			machinesAfterRescan, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "rescanning machines should succeed")
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestSetStateProperty(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		id       string
+		property string
+
+		setPropertyErr bool
+
+		wantDatasets []string
+		wantErr      bool
+	}{
+		"Set on system and user datasets": {id: "rpool/ROOT/ubuntu_1234", property: libzfsadapter.ProtectedProp,
+			wantDatasets: []string{"rpool/ROOT/ubuntu_1234", "rpool/USERDATA/root_bcde", "rpool/USERDATA/user1_abcd"}},
+		"Snapshot reason is ignored on filesystem datasets": {id: "rpool/ROOT/ubuntu_1234", property: libzfsadapter.SnapshotReasonProp},
+
+		"Error on property not allowed":        {id: "rpool/ROOT/ubuntu_1234", property: libzfsadapter.MountPointProp, wantErr: true},
+		"Error on unknown state":               {id: "rpool/ROOT/doesntexist", property: libzfsadapter.SnapshotReasonProp, wantErr: true},
+		"Error on setting property is a no op": {id: "rpool/ROOT/ubuntu_1234", property: libzfsadapter.SnapshotReasonProp, setPropertyErr: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "m_with_userdata.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			cmdline := generateCmdLine("rpool/ROOT/ubuntu_1234")
+			ms, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "New should succeed")
+
+			initMachines := ms.CopyForTests(t)
+			lzfs := libzfs.(*mock.LibZFS)
+			lzfs.ErrOnSetProperty(tc.setPropertyErr)
+
+			value := "yes"
+			err = ms.SetStateProperty(context.Background(), tc.id, tc.property, value)
+			if tc.wantErr {
+				assert.Error(t, err, "SetStateProperty should fail")
+				assertMachinesEquals(t, initMachines, ms)
+				return
+			}
+			assert.NoError(t, err, "SetStateProperty should succeed")
+
+			m, ok := ms.CurrentMachine()
+			if !ok {
+				t.Fatal("expected a current machine but got none")
+			}
+			var got []string
+			for _, d := range m.AllDatasets() {
+				if (tc.property == libzfsadapter.ProtectedProp && d.Protected) ||
+					(tc.property == libzfsadapter.SnapshotReasonProp && d.SnapshotReason == value) {
+					got = append(got, d.Name)
+				}
+			}
+			assert.Equal(t, tc.wantDatasets, got, "Unexpected datasets with the property set")
+
+			machinesAfterRescan, err := machines.New(context.Background(), cmdline, machines.WithLibZFS(libzfs))
+			assert.NoError(t, err, "rescanning machines should succeed")
+			assertMachinesEquals(t, machinesAfterRescan, ms)
+		})
+	}
+}
+
+func TestGCKeepsProtectedStates(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		protect []string
+		all     bool
+
+		wantKept    []string
+		wantRemoved []string
+	}{
+		"Unprotected states are collected": {
+			wantRemoved: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", "rpool/ROOT/ubuntu_1234@autozsys_20191230-2000"}},
+		"Protected state is kept": {protect: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800"},
+			wantKept:    []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800"},
+			wantRemoved: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191230-2000"}},
+		"Protected state is kept when collecting all snapshots": {protect: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800"}, all: true,
+			wantKept:    []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800"},
+			wantRemoved: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191230-2000"}},
+		"Multiple protected states are kept": {protect: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", "rpool/ROOT/ubuntu_1234@autozsys_20191230-2000"},
+			wantKept: []string{"rpool/ROOT/ubuntu_1234@autozsys_20191227-1800", "rpool/ROOT/ubuntu_1234@autozsys_20191230-2000"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "gc_system_only.yaml"), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			configPath := filepath.Join("testdata", "confs", "purge_all_zsys.conf")
+			ms, err := machines.New(context.Background(), "", machines.WithLibZFS(libzfs),
+				machines.WithTime(testutils.FixedTime{}), machines.WithConfig(configPath))
+			assert.NoError(t, err, "New should succeed")
+
+			for _, id := range tc.protect {
+				assert.NoErrorf(t, ms.SetStateProtected(context.Background(), id, true), "Setup: couldn't protect %s", id)
+			}
+
+			if err := ms.GC(context.Background(), tc.all); err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			m, err := ms.GetMachine("rpool/ROOT/ubuntu_1234")
+			if err != nil {
+				t.Fatalf("expected machine to still exist: %v", err)
+			}
+			for _, id := range tc.wantKept {
+				assert.Contains(t, m.History, id, "Protected state should be kept")
+			}
+			for _, id := range tc.wantRemoved {
+				assert.NotContains(t, m.History, id, "Unprotected state should be collected")
+			}
+
+			// Protected states can still be removed explicitly
+			for _, id := range tc.wantKept {
+				_, err := ms.RemoveState(context.Background(), id, "", false, false)
+				assert.NoErrorf(t, err, "RemoveState should succeed on protected state %s", id)
+			}
+		})
+	}
+}
+
 func BenchmarkNewDesktop(b *testing.B) {
 	config.SetVerboseMode(0)
 	defer func() { config.SetVerboseMode(1) }()
@@ -1506,7 +6638,7 @@ func assertMachinesToGolden(t *testing.T, got machines.Machines) {
 
 	want := machines.Machines{}
 	got.MakeComparable()
-	testutils.LoadFromGoldenFile(t, got, &want)
+	testutils.LoadFromGoldenFile(t, &got, &want)
 
 	assertMachinesEquals(t, want, got)
 }
@@ -1519,7 +6651,8 @@ func assertMachinesEquals(t *testing.T, m1, m2 machines.Machines) {
 	m2.MakeComparable()
 
 	if diff := cmp.Diff(m1, m2, cmpopts.EquateEmpty(),
-		cmp.AllowUnexported(machines.Machines{}),
+		cmp.AllowUnexported(machines.Machines{}, machines.MachinesLayout{}), cmpopts.IgnoreFields(machines.Machines{}, "machinesSettings"),
+		cmpopts.IgnoreFields(machines.MachinesLayout{}, "datasets"),
 		cmpopts.IgnoreUnexported(zfs.Dataset{}, zfs.DatasetProp{})); diff != "" {
 		t.Errorf("Machines mismatch (-want +got):\n%s", diff)
 	}
@@ -1533,7 +6666,8 @@ func assertMachinesNotEquals(t *testing.T, m1, m2 machines.Machines) {
 	m2.MakeComparable()
 
 	if diff := cmp.Diff(m1, m2, cmpopts.EquateEmpty(),
-		cmp.AllowUnexported(machines.Machines{}),
+		cmp.AllowUnexported(machines.Machines{}, machines.MachinesLayout{}), cmpopts.IgnoreFields(machines.Machines{}, "machinesSettings"),
+		cmpopts.IgnoreFields(machines.MachinesLayout{}, "datasets"),
 		cmpopts.IgnoreUnexported(zfs.Dataset{}, zfs.DatasetProp{})); diff == "" {
 		t.Errorf("Machines are equals where we expected not to:\n%+v", pp.Sprint(m1))
 	}
@@ -1545,6 +6679,18 @@ func generateCmdLine(datasetAndBoot string) string {
 }
 
 // generateCmdLineWithRevert returns a command line with fake boot and a revert user data argument
+// stateDatasetNames returns the sorted names of all system datasets of s.
+func stateDatasetNames(s machines.State) []string {
+	var names []string
+	for _, ds := range s.Datasets {
+		for _, d := range ds {
+			names = append(names, d.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func generateCmdLineWithRevert(datasetAndBoot string) string {
 	return generateCmdLine(datasetAndBoot) + " " + machines.RevertUserDataTag
 }
@@ -0,0 +1,79 @@
+package machines
+
+import (
+	"io"
+	"sync"
+)
+
+// Progress is called as a long running operation advances, with done units processed out of total, and current being
+// the dataset or state processed. Units are bytes for send and receive streams, states for garbage collection.
+// total is 0 when it can't be known beforehand, like for received streams.
+type Progress func(done, total int, current string)
+
+// WithProgress reports progress of sending and receiving states, and of garbage collection, to p.
+// Calls to p are serialized, even when multiple operations run at the same time.
+func WithProgress(p Progress) func(o *options) error {
+	return func(o *options) error {
+		o.progress = p
+		return nil
+	}
+}
+
+// progressReporter serializes calls to an optional Progress callback.
+// The mutex is a pointer so that it's shared by every copy of Machines.
+type progressReporter struct {
+	f  Progress
+	mu *sync.Mutex
+}
+
+// newProgressReporter returns a reporter calling f, if not nil.
+func newProgressReporter(f Progress) progressReporter {
+	return progressReporter{f: f, mu: &sync.Mutex{}}
+}
+
+// report calls the Progress callback, if any, with done out of total units for current.
+func (p progressReporter) report(done, total int, current string) {
+	if p.f == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.f(done, total, current)
+}
+
+// progressWriter reports the number of bytes written to the underlying writer so far.
+type progressWriter struct {
+	io.Writer
+	reporter progressReporter
+	done     int
+	total    int
+	current  string
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.done += n
+	// Stream overhead can exceed the estimate
+	if w.total != 0 && w.done > w.total {
+		w.total = w.done
+	}
+	w.reporter.report(w.done, w.total, w.current)
+	return n, err
+}
+
+// progressReader reports the number of bytes read from the underlying reader so far.
+type progressReader struct {
+	io.Reader
+	reporter progressReporter
+	done     int
+	current  string
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.done += n
+		r.reporter.report(r.done, 0, r.current)
+	}
+	return n, err
+}
@@ -0,0 +1,25 @@
+package machines
+
+import (
+	"fmt"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+)
+
+// WithReadOnly only scans the system, which can then be done by an unprivileged user. Machines can be queried and
+// refreshed, but never write to zfs: any operation changing the system, like snapshotting, reverting, removing
+// states or garbage collecting, fails immediately with ErrReadOnly. Dry runs are still allowed.
+func WithReadOnly() func(o *options) error {
+	return func(o *options) error {
+		o.readOnly = true
+		return nil
+	}
+}
+
+// checkWritable returns an ErrReadOnly error for operation op if machines can't change the system.
+func (ms *Machines) checkWritable(op string) error {
+	if !ms.readOnly {
+		return nil
+	}
+	return fmt.Errorf(i18n.G("couldn't %s: %w"), op, ErrReadOnly)
+}
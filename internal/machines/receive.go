@@ -0,0 +1,112 @@
+package machines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/config"
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// ReceiveState imports in targetPool a state sent by SendState, read from r, in the same ROOT and USERDATA
+// containers. Received system datasets aren't mounted automatically and received user datasets are associated to the
+// new state. It returns the received state ID.
+// The stream should only contain a single system state, its children and user datasets. Each received dataset is
+// checked against this layout before receiving the next one, and nothing is imported if any check or stream fails.
+func (ms *Machines) ReceiveState(ctx context.Context, r io.Reader, targetPool string) (string, error) {
+	if err := ms.checkWritable(i18n.G("receive state")); err != nil {
+		return "", err
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Receiving state in %s"), targetPool)
+	layout := receivedLayout{targetPool: targetPool}
+	if _, err := t.Receive(&progressReader{Reader: r, reporter: ms.progress, current: targetPool}, targetPool, layout.add); err != nil {
+		cancel()
+		return "", fmt.Errorf(i18n.G("couldn't receive state in %s, reverting: %v"), targetPool, err)
+	}
+	if err := layout.complete(); err != nil {
+		cancel()
+		return "", fmt.Errorf(i18n.G("received datasets don't match a zsys state, reverting: %v"), err)
+	}
+	stateID := layout.stateID
+	for _, d := range ms.z.Datasets() {
+		if d.Name == stateID && d.Mountpoint != "/" {
+			cancel()
+			return "", fmt.Errorf(i18n.G("received datasets don't match a zsys state, reverting: %s isn't mounted on /"), stateID)
+		}
+	}
+
+	// Don't mount received system datasets on top of current ones.
+	if err := t.SetProperty(libzfs.CanmountProp, "noauto", stateID, true); err != nil {
+		cancel()
+		return "", fmt.Errorf(i18n.G("couldn't set %s property of %q: ")+config.ErrorFormat, libzfs.CanmountProp, stateID, err)
+	}
+	for _, n := range layout.userRoots {
+		if err := t.SetProperty(libzfs.BootfsDatasetsProp, stateID, n, true); err != nil {
+			cancel()
+			return "", fmt.Errorf(i18n.G("couldn't set %s property of %q: ")+config.ErrorFormat, libzfs.BootfsDatasetsProp, n, err)
+		}
+	}
+
+	if err := ms.refresh(ctx); err != nil {
+		return "", err
+	}
+	return stateID, nil
+}
+
+// receivedLayout is the system state root dataset and user root datasets of snapshots received in targetPool.
+type receivedLayout struct {
+	targetPool    string
+	stateID       string
+	stateReceived bool
+	userRoots     []string
+}
+
+// add checks that the received snapshot n is in the ROOT or USERDATA containers of the target pool, without
+// introducing a second system state, and records it.
+func (l *receivedLayout) add(n string) error {
+	base, _ := splitSnapshotName(n)
+	elems := strings.Split(strings.TrimPrefix(base, l.targetPool+"/"), "/")
+	if len(elems) < 2 {
+		return fmt.Errorf(i18n.G("%s isn't in a ROOT or USERDATA container"), n)
+	}
+	root := strings.Join([]string{l.targetPool, elems[0], elems[1]}, "/")
+
+	switch elems[0] {
+	case "ROOT":
+		if l.stateID != "" && l.stateID != root {
+			return fmt.Errorf(i18n.G("multiple system states received: %s and %s"), l.stateID, root)
+		}
+		l.stateID = root
+		if base == root {
+			l.stateReceived = true
+		}
+	case zfs.UserdataPrefix:
+		if !strings.Contains(elems[1], "_") {
+			return fmt.Errorf(i18n.G("%s isn't a user dataset: it should be named <user>_<id>"), root)
+		}
+		if base == root {
+			l.userRoots = append(l.userRoots, root)
+		}
+	default:
+		return fmt.Errorf(i18n.G("%s isn't in a ROOT or USERDATA container"), n)
+	}
+	return nil
+}
+
+// complete checks that the root dataset of the system state was received.
+func (l receivedLayout) complete() error {
+	if !l.stateReceived {
+		return errors.New(i18n.G("no system state root dataset received"))
+	}
+	return nil
+}
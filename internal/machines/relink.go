@@ -0,0 +1,83 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/config"
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// RelinkUserDataset associates the user dataset userDataset to the system state stateID, rewriting its bootfs datasets
+// list. References to system datasets which aren't any machine state anymore, like the ones reported by
+// DanglingUserLinks, are dropped while other valid associations are kept. This repairs user datasets which aren't
+// mounted on a state anymore, after manual dataset changes.
+// Machines are refreshed afterwards, so that the user dataset is attached to the state.
+func (ms *Machines) RelinkUserDataset(ctx context.Context, userDataset, stateID string) error {
+	if err := ms.checkWritable(i18n.G("associate user dataset")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(stateID)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s is a snapshot: user datasets can only be associated to filesystem states"), s.ID)
+	}
+
+	d := ms.findUserDataset(userDataset)
+	if d == nil {
+		return fmt.Errorf(i18n.G("no user dataset named %s"), userDataset)
+	}
+	if d.IsSnapshot {
+		return fmt.Errorf(i18n.G("%s is a snapshot and can't be associated to another state"), d.Name)
+	}
+
+	systemStates := make(map[string]bool)
+	for s := range ms.getAllStatesOnMachines() {
+		systemStates[s.ID] = true
+	}
+	var tags []string
+	if d.BootfsDatasets != "" {
+		for _, id := range strings.Split(d.BootfsDatasets, bootfsdatasetsSeparator) {
+			if id == s.ID || !systemStates[id] {
+				continue
+			}
+			tags = append(tags, id)
+		}
+	}
+	tags = append(tags, s.ID)
+	newTag := strings.Join(tags, bootfsdatasetsSeparator)
+	if newTag == d.BootfsDatasets {
+		log.Infof(ctx, i18n.G("%s is already associated to %s"), d.Name, s.ID)
+		return nil
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Associating user dataset %s to %s"), d.Name, s.ID)
+	if err := t.SetProperty(libzfs.BootfsDatasetsProp, newTag, d.Name, false); err != nil {
+		cancel()
+		return fmt.Errorf(i18n.G("couldn't set %s property of %q: ")+config.ErrorFormat, libzfs.BootfsDatasetsProp, d.Name, err)
+	}
+
+	return ms.Refresh(ctx)
+}
+
+// findUserDataset returns the user dataset named name, being attached to a machine or not.
+func (ms *Machines) findUserDataset(name string) *zfs.Dataset {
+	defer ms.rlock()()
+
+	for _, d := range append(append([]*zfs.Dataset(nil), ms.allUsersDatasets...), ms.unmanagedDatasets...) {
+		if d.Name == name && ms.isUserDataset(d.Name) {
+			return d
+		}
+	}
+	return nil
+}
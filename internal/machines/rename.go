@@ -0,0 +1,89 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/config"
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// RenameState renames the filesystem state id, replacing its suffix with newName (for instance rpool/ROOT/ubuntu_1234
+// to rpool/ROOT/ubuntu_<newName>). All its system datasets routes and their descendants are renamed, and user datasets
+// associated to it are now associated to the new name. The pool bootfs property follows the rename.
+// The currently booted state, or any state with mounted datasets, can't be renamed.
+func (ms *Machines) RenameState(ctx context.Context, id, newName string) error {
+	if err := ms.checkWritable(i18n.G("rename state")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s is a snapshot and can't be renamed"), s.ID)
+	}
+	if cs, ok := ms.CurrentState(); ok && cs == s {
+		return fmt.Errorf(i18n.G("%s is the currently booted state and can't be renamed"), s.ID)
+	}
+	for _, d := range s.getDatasets() {
+		if d.Mounted {
+			return fmt.Errorf(i18n.G("%s can't be renamed: %s is mounted"), s.ID, d.Name)
+		}
+	}
+	if err := validateStateName(newName); err != nil {
+		return err
+	}
+
+	newID := zfs.CloneName(s.ID, newName)
+	if newID == s.ID {
+		return fmt.Errorf(i18n.G("%s is already named %s"), s.ID, newName)
+	}
+	if _, _, err := ms.GetStateByID(newID); err == nil {
+		return fmt.Errorf(i18n.G("A state %s already exists"), newID)
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	log.Infof(ctx, i18n.G("Renaming %s to %s"), s.ID, newID)
+	for _, route := range sortedRoutes(s.Datasets) {
+		if err := t.Rename(route, zfs.CloneName(route, newName)); err != nil {
+			cancel()
+			return fmt.Errorf(i18n.G("couldn't rename %s: %v"), route, err)
+		}
+	}
+
+	// Update user datasets associations, including the ones of users not attached to this state anymore.
+	for _, d := range ms.allUsersDatasets {
+		if d.IsSnapshot || !nameInBootfsDatasets(s.ID, *d) {
+			continue
+		}
+		tags := strings.Split(d.BootfsDatasets, bootfsdatasetsSeparator)
+		for i := range tags {
+			if tags[i] == s.ID {
+				tags[i] = newID
+			}
+		}
+		if err := t.SetProperty(libzfs.BootfsDatasetsProp, strings.Join(tags, bootfsdatasetsSeparator), d.Name, false); err != nil {
+			cancel()
+			return fmt.Errorf(i18n.G("couldn't set %s property of %q: ")+config.ErrorFormat, libzfs.BootfsDatasetsProp, d.Name, err)
+		}
+	}
+
+	wasNextState := ms.nextState == s
+	if err := ms.Refresh(ctx); err != nil {
+		return err
+	}
+	if wasNextState {
+		if next, _, err := ms.GetStateByID(newID); err == nil {
+			ms.setNextState(next)
+		}
+	}
+	return nil
+}
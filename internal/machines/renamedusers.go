@@ -0,0 +1,102 @@
+package machines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+)
+
+// WithRenamedUsers groups user datasets of renamed system users under their new name. renames maps each old user
+// name to the new one. User datasets are named after the user when created: after a rename, new user datasets get
+// the new name while history states still reference the old one, which would otherwise split the user history.
+// Renames can be chained: a user renamed twice is grouped under its last name.
+func WithRenamedUsers(renames map[string]string) func(o *options) error {
+	return func(o *options) error {
+		for oldUser, newUser := range renames {
+			if oldUser == "" || newUser == "" {
+				return errors.New(i18n.G("renamed users can't be empty"))
+			}
+			if oldUser == newUser {
+				return fmt.Errorf(i18n.G("user %q can't be renamed to itself"), oldUser)
+			}
+		}
+		o.renamedUsers = renames
+		return nil
+	}
+}
+
+// MergeUsers attaches all user states of oldUser to newUser, on the machine and each of its system states.
+// A system state already having a newUser state keeps both, the oldUser one staying under its old name.
+func (m *Machine) MergeUsers(oldUser, newUser string) {
+	if oldUser == newUser {
+		return
+	}
+
+	if uss, ok := m.AllUsersStates[oldUser]; ok {
+		if m.AllUsersStates[newUser] == nil {
+			m.AllUsersStates[newUser] = make(map[string]*State)
+		}
+		for id, us := range uss {
+			m.AllUsersStates[newUser][id] = us
+		}
+		delete(m.AllUsersStates, oldUser)
+	}
+
+	states := []*State{&m.State}
+	for _, id := range sortedStateKeys(m.History) {
+		states = append(states, m.History[id])
+	}
+	for _, s := range states {
+		us, ok := s.Users[oldUser]
+		if !ok {
+			continue
+		}
+		if _, exists := s.Users[newUser]; exists {
+			continue
+		}
+		s.Users[newUser] = us
+		delete(s.Users, oldUser)
+	}
+}
+
+// mergeRenamedUsers merges on all machines the users renamed by configuration.
+func (ms *Machines) mergeRenamedUsers(ctx context.Context) {
+	if len(ms.renamedUsers) == 0 {
+		return
+	}
+
+	var oldUsers []string
+	for oldUser := range ms.renamedUsers {
+		oldUsers = append(oldUsers, oldUser)
+	}
+	sort.Strings(oldUsers)
+
+	for _, oldUser := range oldUsers {
+		newUser := lastUserName(ms.renamedUsers, oldUser)
+		for _, k := range sortedMachineKeys(ms.all) {
+			m := ms.all[k]
+			if _, ok := m.AllUsersStates[oldUser]; !ok {
+				continue
+			}
+			log.Debugf(ctx, i18n.G("Merging renamed user %s into %s on %s"), oldUser, newUser, m.ID)
+			m.MergeUsers(oldUser, newUser)
+		}
+	}
+}
+
+// lastUserName follows renames from user and returns its last name. Rename cycles stop on the last user not seen yet.
+func lastUserName(renames map[string]string, user string) string {
+	seen := map[string]bool{user: true}
+	for {
+		next, ok := renames[user]
+		if !ok || seen[next] {
+			return user
+		}
+		seen[next] = true
+		user = next
+	}
+}
@@ -0,0 +1,381 @@
+package machines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/config"
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// RevertOptions alters how RevertToState handles the reverted state.
+type RevertOptions struct {
+	// KeepUserData associates the current user datasets to the reverted state instead of the historical ones.
+	// Users without any current dataset still get their historical one.
+	KeepUserData bool
+	// DryRun only computes the plan to revert, without changing anything on the system.
+	DryRun bool
+}
+
+// RevertOperationKind is the kind of zfs operation of a revert plan step.
+type RevertOperationKind string
+
+const (
+	// RevertClone clones recursively Dataset snapshot with Suffix.
+	RevertClone RevertOperationKind = "clone"
+	// RevertSetProperty sets Property to Value on Dataset.
+	RevertSetProperty RevertOperationKind = "set-property"
+	// RevertPromote promotes recursively Dataset.
+	RevertPromote RevertOperationKind = "promote"
+)
+
+// RevertOperation is one zfs operation of a revert plan.
+type RevertOperation struct {
+	Kind    RevertOperationKind
+	Dataset string
+	// Suffix is the generated suffix of the clone, for RevertClone.
+	Suffix string
+	// Property and Value are set on Dataset, for RevertSetProperty.
+	Property, Value string
+}
+
+// RevertPlan is the ordered list of zfs operations reverting to State.
+// The same plan is used for previewing and applying the revert.
+type RevertPlan struct {
+	// State is the state to revert to.
+	State string
+	// NewState is the main state of the machine once reverted, and the next one to boot on.
+	NewState   string
+	Operations []RevertOperation
+}
+
+// RevertableState is a history state a machine can be reverted to.
+type RevertableState struct {
+	*State
+	// NeedsClone is set for snapshot states, which are cloned when reverting to them. Clone states are used as is.
+	NeedsClone bool
+}
+
+// RevertableStates returns history states of the machine which can be reverted to, most recently used first.
+// States which aren't managed by zsys, without a mountable root dataset, or with an encryption key not loaded on any
+// system or user dataset, are excluded. The state the machine is booted on, if it's a history one, isn't excluded:
+// RevertToState rejects it.
+func (m *Machine) RevertableStates() []RevertableState {
+	var states []RevertableState
+	for _, s := range m.ZsysHistory() {
+		if s.notBootableReason() != "" {
+			continue
+		}
+		keysLoaded := true
+		for _, d := range s.getUsersDatasets() {
+			if !d.IsKeyLoaded() {
+				keysLoaded = false
+				break
+			}
+		}
+		if !keysLoaded {
+			continue
+		}
+		states = append(states, RevertableState{State: s, NeedsClone: s.isSnapshot()})
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].LastUsed.After(states[j].LastUsed)
+	})
+	return states
+}
+
+// PersistentImpact returns the persistent datasets, sorted by name, which are kept as is when reverting to the state
+// id: they are shared by all states of the machine and never rolled back, like /srv or /opt. It's nil if the state
+// doesn't exist.
+func (ms *Machines) PersistentImpact(id string) []*zfs.Dataset {
+	if _, _, err := ms.GetStateByID(id); err != nil {
+		return nil
+	}
+
+	var r []*zfs.Dataset
+	for _, d := range ms.PersistentDatasets() {
+		if d.IsSnapshot {
+			continue
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+// RestoreTarget returns the machine reverting to the state id changes, with the ID of its new main state. Snapshot
+// states are cloned under this machine, as RevertToState does, while other states are used as is.
+// The clone suffix is generated: the clone created by RevertToState has the same name structure, not the same suffix.
+func (ms *Machines) RestoreTarget(id string) (*Machine, string, error) {
+	s, m, err := ms.GetStateByID(id)
+	if err != nil {
+		return nil, "", fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if !s.managedByZsys() {
+		return nil, "", withKind(ErrNotZsys, fmt.Errorf(i18n.G("%s isn't managed by zsys: it can't be restored"), s.ID))
+	}
+
+	if !s.isSnapshot() {
+		return m, s.ID, nil
+	}
+	return m, zfs.CloneName(s.ID, ms.z.GenerateID(6)), nil
+}
+
+// RevertToState makes the history state id of the current machine the main state of this machine, which is then the
+// one booted by default.
+// Snapshot states are cloned (system and user datasets) and never rolled back, clone states are used as is.
+// The system datasets of the reverted state are then promoted, so that current state becomes a history entry of the
+// machine and the revert can itself be reverted.
+// User datasets are promoted on next boot, by Commit().
+// The reverted state is then the next state to boot on.
+// It returns the plan of zfs operations, which is only computed and not applied with opts.DryRun.
+func (ms *Machines) RevertToState(ctx context.Context, id string, opts RevertOptions) (RevertPlan, error) {
+	if !opts.DryRun {
+		if err := ms.checkWritable(i18n.G("revert state")); err != nil {
+			return RevertPlan{}, err
+		}
+	}
+
+	plan, err := ms.planRevert(ctx, id, opts)
+	if err != nil {
+		return RevertPlan{}, err
+	}
+	if opts.DryRun {
+		return plan, nil
+	}
+	if err := runPreHook(ctx, "PreRevert", ms.hooks.PreRevert, plan.State); err != nil {
+		return RevertPlan{}, err
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	if err := ms.current.markOperation(t, operationRevert); err != nil {
+		cancel()
+		return RevertPlan{}, err
+	}
+	if err := plan.apply(t); err != nil {
+		cancel()
+		return RevertPlan{}, err
+	}
+	if err := ms.current.clearOperation(t); err != nil {
+		cancel()
+		return RevertPlan{}, err
+	}
+
+	if err := ms.Refresh(ctx); err != nil {
+		return RevertPlan{}, err
+	}
+
+	// The reverted state is now the main state of the machine.
+	unlock := ms.rlock()
+	m, ok := ms.all[plan.NewState]
+	unlock()
+	if ok {
+		ms.setNextState(&m.State)
+	}
+	runPostHook(ctx, "PostRevert", ms.hooks.PostRevert, plan.NewState)
+	return plan, nil
+}
+
+// planRevert computes all operations reverting to state id, without changing anything.
+func (ms *Machines) planRevert(ctx context.Context, id string, opts RevertOptions) (RevertPlan, error) {
+	if ms.current == nil {
+		return RevertPlan{}, errors.New(i18n.G("No current machine found, nothing to revert"))
+	}
+	if !ms.current.isZsys() {
+		return RevertPlan{}, withKind(ErrNotZsys, errors.New(i18n.G("Current machine isn't Zsys, nothing to revert")))
+	}
+
+	s, m, err := ms.GetStateByID(id)
+	if err != nil {
+		return RevertPlan{}, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if m != ms.current {
+		return RevertPlan{}, fmt.Errorf(i18n.G("%s isn't a state of current machine %s"), s.ID, ms.current.ID)
+	}
+	if !s.managedByZsys() {
+		return RevertPlan{}, withKind(ErrNotZsys, fmt.Errorf(i18n.G("%s isn't managed by zsys: its user and boot datasets aren't known"), s.ID))
+	}
+	cs, ok := ms.CurrentState()
+	if s == &m.State || (ok && s == cs) {
+		return RevertPlan{}, fmt.Errorf(i18n.G("%s is already the current state"), s.ID)
+	}
+
+	// Current user states we want to keep, and historical ones we fallback to if there is no current one.
+	keptUsers := make(map[string]*State)
+	historicalUsers := s.Users
+	if opts.KeepUserData && ok {
+		historicalUsers = make(map[string]*State)
+		for user, us := range s.Users {
+			if _, exists := cs.Users[user]; exists {
+				continue
+			}
+			log.Warningf(ctx, i18n.G("User %s has no current dataset: reverting to its historical one"), user)
+			historicalUsers[user] = us
+		}
+		keptUsers = cs.Users
+	}
+
+	// Cloned and promoted datasets need their encryption key to be loaded.
+	toRevert := s.getDatasets()
+	for _, user := range sortedStateKeys(historicalUsers) {
+		toRevert = append(toRevert, historicalUsers[user].getDatasets()...)
+	}
+	for _, d := range toRevert {
+		if !d.IsKeyLoaded() {
+			return RevertPlan{}, zfs.ErrKeyNotLoaded{Dataset: d.Name}
+		}
+	}
+
+	plan := RevertPlan{State: s.ID, NewState: s.ID}
+	routes := sortedRoutes(s.Datasets)
+	if s.isSnapshot() {
+		// Name it as zfs Clone() will do: strip any _<suffix> from the base dataset and replace it with a new one.
+		suffix := ms.z.GenerateID(6)
+		plan.NewState = zfs.CloneName(s.ID, suffix)
+
+		for i, route := range routes {
+			plan.Operations = append(plan.Operations, RevertOperation{Kind: RevertClone, Dataset: route, Suffix: suffix})
+			routes[i] = zfs.CloneName(route, suffix)
+		}
+		userDataSuffix := ms.z.GenerateID(6)
+		for _, user := range sortedStateKeys(historicalUsers) {
+			us := historicalUsers[user]
+			plan.Operations = append(plan.Operations,
+				RevertOperation{Kind: RevertClone, Dataset: us.ID, Suffix: userDataSuffix},
+				RevertOperation{Kind: RevertSetProperty, Dataset: zfs.CloneName(us.ID, userDataSuffix),
+					Property: libzfs.BootfsDatasetsProp, Value: plan.NewState})
+		}
+	} else {
+		// Detach historical user datasets replaced by current ones
+		for _, user := range sortedStateKeys(s.Users) {
+			us := s.Users[user]
+			if _, replaced := historicalUsers[user]; replaced {
+				continue
+			}
+			// Same user datasets are shared between both states
+			if kept, ok := keptUsers[user]; ok && kept.ID == us.ID {
+				continue
+			}
+			plan.Operations = append(plan.Operations, untagUserDatasets(us.getDatasets(), plan.NewState)...)
+		}
+	}
+
+	for _, user := range sortedStateKeys(keptUsers) {
+		plan.Operations = append(plan.Operations, tagUserDatasets(keptUsers[user].getDatasets(), plan.NewState)...)
+	}
+
+	// Promote system datasets, making it the main state of the machine
+	for _, route := range routes {
+		plan.Operations = append(plan.Operations, RevertOperation{Kind: RevertPromote, Dataset: route})
+	}
+
+	return plan, nil
+}
+
+// apply runs all plan operations, in order, in transaction t.
+func (plan RevertPlan) apply(t *zfs.Transaction) error {
+	log.Infof(t.Context(), i18n.G("Reverting to %s as %s"), plan.State, plan.NewState)
+	for _, op := range plan.Operations {
+		switch op.Kind {
+		case RevertClone:
+			log.Infof(t.Context(), i18n.G("cloning %q and children"), op.Dataset)
+			if err := t.Clone(op.Dataset, op.Suffix, false, true); err != nil {
+				return fmt.Errorf(i18n.G("couldn't create new datasets from %q: %v"), op.Dataset, err)
+			}
+		case RevertSetProperty:
+			log.Infof(t.Context(), i18n.G("Set %s=%q on %q"), op.Property, op.Value, op.Dataset)
+			if err := t.SetProperty(op.Property, op.Value, op.Dataset, false); err != nil {
+				return fmt.Errorf(i18n.G("couldn't set %s property of %q: ")+config.ErrorFormat, op.Property, op.Dataset, err)
+			}
+		case RevertPromote:
+			log.Infof(t.Context(), i18n.G("Promoting %s"), op.Dataset)
+			if err := t.Promote(op.Dataset); err != nil {
+				return fmt.Errorf(i18n.G("couldn't promote %s: %v"), op.Dataset, err)
+			}
+		default:
+			return fmt.Errorf(i18n.G("unknown revert operation %q on %q"), op.Kind, op.Dataset)
+		}
+	}
+	return nil
+}
+
+// Promote promotes system datasets of the clone state id, so that it doesn't depend on its origin anymore and
+// becomes the main state of its machine. Its origin is then a history state depending on it, which can be removed
+// independently.
+// Datasets of each state route (like separate boot datasets) and their children are all promoted.
+func (ms *Machines) Promote(ctx context.Context, id string) error {
+	if err := ms.checkWritable(i18n.G("promote state")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s is a snapshot and can't be promoted"), s.ID)
+	}
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+
+	if err := s.promote(t); err != nil {
+		cancel()
+		return err
+	}
+
+	return ms.Refresh(ctx)
+}
+
+// promote promotes all system datasets routes of the state, in order. Each route is promoted recursively.
+func (s State) promote(t *zfs.Transaction) error {
+	for _, route := range sortedRoutes(s.Datasets) {
+		log.Infof(t.Context(), i18n.G("Promoting %s"), route)
+		if err := t.Promote(route); err != nil {
+			return fmt.Errorf(i18n.G("couldn't promote %s: %v"), route, err)
+		}
+	}
+	return nil
+}
+
+// tagUserDatasets returns the operations associating user datasets to the system state id, keeping any existing
+// association.
+func tagUserDatasets(ds []*zfs.Dataset, id string) (ops []RevertOperation) {
+	for _, d := range ds {
+		if d.IsSnapshot || nameInBootfsDatasets(id, *d) {
+			continue
+		}
+		newTag := id
+		if d.BootfsDatasets != "" {
+			newTag = d.BootfsDatasets + bootfsdatasetsSeparator + id
+		}
+		ops = append(ops, RevertOperation{Kind: RevertSetProperty, Dataset: d.Name, Property: libzfs.BootfsDatasetsProp, Value: newTag})
+	}
+	return ops
+}
+
+// untagUserDatasets returns the operations dissociating user datasets from the system state id.
+func untagUserDatasets(ds []*zfs.Dataset, id string) (ops []RevertOperation) {
+	for _, d := range ds {
+		if d.IsSnapshot || !nameInBootfsDatasets(id, *d) {
+			continue
+		}
+		var newTags []string
+		for _, n := range strings.Split(d.BootfsDatasets, bootfsdatasetsSeparator) {
+			if n == id {
+				continue
+			}
+			newTags = append(newTags, n)
+		}
+		ops = append(ops, RevertOperation{Kind: RevertSetProperty, Dataset: d.Name, Property: libzfs.BootfsDatasetsProp,
+			Value: strings.Join(newTags, bootfsdatasetsSeparator)})
+	}
+	return ops
+}
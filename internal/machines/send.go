@@ -0,0 +1,102 @@
+package machines
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+type sendOptions struct {
+	withUserDatasets bool
+}
+
+// SendWithUserDatasets appends the user datasets of the state to the send stream, after its system datasets.
+func SendWithUserDatasets() func(o *sendOptions) {
+	return func(o *sendOptions) {
+		o.withUserDatasets = true
+	}
+}
+
+// SendState writes to w a zfs send stream of all system datasets of the snapshot state id, in dependency order.
+// If incrementalFrom is not empty, it's an older snapshot state of the same filesystem state, and the stream only
+// contains the changes since then.
+// Only snapshots can be sent: filesystem states, including clones, are still changing and should be snapshotted first.
+func (ms *Machines) SendState(ctx context.Context, id string, w io.Writer, incrementalFrom string, opts ...func(o *sendOptions)) error {
+	var o sendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
+	}
+	if !s.isSnapshot() {
+		return fmt.Errorf(i18n.G("%s isn't a snapshot: only snapshots can be sent, save the state first to create one"), s.ID)
+	}
+
+	var fromSnapshotName string
+	if incrementalFrom != "" {
+		from, _, err := ms.GetStateByID(incrementalFrom)
+		if err != nil {
+			return fmt.Errorf(i18n.G("Couldn't find state to send incrementally from: %v"), err)
+		}
+		if !from.isSnapshot() {
+			return fmt.Errorf(i18n.G("%s isn't a snapshot: only snapshots can be used as an incremental source"), from.ID)
+		}
+		base, _ := splitSnapshotName(s.ID)
+		fromBase, fromSnapshot := splitSnapshotName(from.ID)
+		if fromBase != base {
+			return fmt.Errorf(i18n.G("%s isn't a snapshot of %s: can't send %s incrementally from it"), from.ID, base, s.ID)
+		}
+		if from == s {
+			return fmt.Errorf(i18n.G("Can't send %s incrementally from itself"), s.ID)
+		}
+		fromSnapshotName = fromSnapshot
+	}
+
+	datasets := sortedParentsFirst(s.getDatasets())
+	if o.withUserDatasets {
+		datasets = append(datasets, sortedParentsFirst(s.getUsersDatasets())...)
+	}
+
+	// Progress is reported in bytes written, out of the space referenced by the datasets for full streams. The size of
+	// incremental streams isn't known beforehand.
+	pw := &progressWriter{Writer: w, reporter: ms.progress}
+	if fromSnapshotName == "" {
+		for _, d := range datasets {
+			pw.total += int(d.Referenced)
+		}
+	}
+
+	nt := ms.z.NewNoTransaction(ctx)
+	for _, d := range datasets {
+		var from string
+		if fromSnapshotName != "" {
+			base, _ := splitSnapshotName(d.Name)
+			from = base + "@" + fromSnapshotName
+		}
+		log.Infof(ctx, i18n.G("Sending %s"), d.Name)
+		pw.current = d.Name
+		if err := nt.Send(d.Name, from, pw); err != nil {
+			return fmt.Errorf(i18n.G("couldn't send %s: %v"), s.ID, err)
+		}
+	}
+	return nil
+}
+
+// sortedParentsFirst sorts datasets by the name of their filesystem dataset, so that parents are before their children.
+// Sorting snapshots by their full name doesn't: "/" is before "@", and so, children snapshots would be first.
+func sortedParentsFirst(datasets []*zfs.Dataset) []*zfs.Dataset {
+	sort.SliceStable(datasets, func(i, j int) bool {
+		bi, _ := splitSnapshotName(datasets[i].Name)
+		bj, _ := splitSnapshotName(datasets[j].Name)
+		return bi < bj
+	})
+	return datasets
+}
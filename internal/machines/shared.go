@@ -0,0 +1,187 @@
+package machines
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// SharedDatasets returns the datasets system states idA and idB both rely on, sorted by name.
+// A state relies on its own datasets, the snapshots of its filesystem datasets, which are destroyed with them, and every
+// dataset up its clone chains. When A is the clone origin of B, the snapshot B was cloned from and the datasets of A
+// it belongs to are shared. Siblings cloned from the same snapshot share that common ancestor and the datasets up its
+// chain.
+// Associated user states aren't taken into account. It returns nil if any state doesn't exist or nothing is shared.
+func (ms *Machines) SharedDatasets(idA, idB string) []*zfs.Dataset {
+	defer ms.rlock()()
+
+	sA, _, err := ms.getStateByID(idA)
+	if err != nil {
+		return nil
+	}
+	sB, _, err := ms.getStateByID(idB)
+	if err != nil {
+		return nil
+	}
+
+	idx := newSharingIndex(ms.datasets)
+	reliedA := idx.footprint(sA)
+	for n, d := range idx.ancestry(sA) {
+		reliedA[n] = d
+	}
+	reliedB := idx.footprint(sB)
+	for n, d := range idx.ancestry(sB) {
+		reliedB[n] = d
+	}
+
+	var r []*zfs.Dataset
+	for n, d := range reliedA {
+		if _, ok := reliedB[n]; ok {
+			r = append(r, d)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// neededByKeptStates returns the first state, outside of removed IDs, which needs datasets destroyed alongside s, with
+// those datasets sorted by name. It returns nil if s can be destroyed without affecting any other state.
+// A state needs its own datasets and every dataset up its clone chains, not the snapshots of its filesystem datasets.
+// States are compared by ID, as user datasets associated to multiple system states have one state for each of them.
+func (ms *Machines) neededByKeptStates(s *State, removed map[string]bool) (*State, []*zfs.Dataset) {
+	idx := newSharingIndex(ms.z.Datasets())
+	destroyed := idx.footprint(s)
+
+	for _, k := range ms.allStates() {
+		if k.ID == s.ID || removed[k.ID] {
+			continue
+		}
+		needed := idx.ancestry(k)
+		for _, d := range k.getDatasets() {
+			needed[d.Name] = d
+		}
+
+		var shared []*zfs.Dataset
+		for n, d := range destroyed {
+			if _, ok := needed[n]; ok {
+				shared = append(shared, d)
+			}
+		}
+		if len(shared) > 0 {
+			sort.Slice(shared, func(i, j int) bool { return shared[i].Name < shared[j].Name })
+			return k, shared
+		}
+	}
+	return nil, nil
+}
+
+// joinDatasetNames returns the names of ds, comma separated.
+func joinDatasetNames(ds []*zfs.Dataset) string {
+	names := make([]string, 0, len(ds))
+	for _, d := range ds {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// allStates returns all system and user states of every machine, each of them only once.
+func (ms *Machines) allStates() []*State {
+	var r []*State
+	seen := make(map[*State]bool)
+	add := func(s *State) {
+		if seen[s] {
+			return
+		}
+		seen[s] = true
+		r = append(r, s)
+	}
+
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		add(&m.State)
+		for _, id := range sortedStateKeys(m.History) {
+			add(m.History[id])
+		}
+		for _, user := range m.UserNames() {
+			for _, id := range sortedStateKeys(m.AllUsersStates[user]) {
+				add(m.AllUsersStates[user][id])
+			}
+		}
+	}
+	return r
+}
+
+// sharingIndex indexes datasets by name, and snapshots by the filesystem dataset they belong to.
+type sharingIndex struct {
+	byName    map[string]*zfs.Dataset
+	snapshots map[string][]*zfs.Dataset
+}
+
+// newSharingIndex indexes datasets to compute what states rely on.
+func newSharingIndex(datasets []*zfs.Dataset) sharingIndex {
+	idx := sharingIndex{
+		byName:    make(map[string]*zfs.Dataset, len(datasets)),
+		snapshots: make(map[string][]*zfs.Dataset),
+	}
+	for _, d := range datasets {
+		idx.byName[d.Name] = d
+		if d.IsSnapshot {
+			base, _ := splitSnapshotName(d.Name)
+			idx.snapshots[base] = append(idx.snapshots[base], d)
+		}
+	}
+	return idx
+}
+
+// footprint returns the datasets destroyed with s: its own datasets and the snapshots of its filesystem datasets.
+func (idx sharingIndex) footprint(s *State) map[string]*zfs.Dataset {
+	r := make(map[string]*zfs.Dataset)
+	for _, d := range s.getDatasets() {
+		r[d.Name] = d
+		if d.IsSnapshot {
+			continue
+		}
+		for _, snapshot := range idx.snapshots[d.Name] {
+			r[snapshot.Name] = snapshot
+		}
+	}
+	return r
+}
+
+// ancestry returns the datasets s depends on, outside of its own datasets: the filesystem datasets its snapshots
+// belong to, and every snapshot and filesystem dataset up the clone chains.
+func (idx sharingIndex) ancestry(s *State) map[string]*zfs.Dataset {
+	own := make(map[string]bool)
+	for _, d := range s.getDatasets() {
+		own[d.Name] = true
+	}
+
+	r := make(map[string]*zfs.Dataset)
+	for _, d := range s.getDatasets() {
+		for cur := d; cur != nil; {
+			var next string
+			if cur.IsSnapshot {
+				next, _ = splitSnapshotName(cur.Name)
+			} else {
+				next = cur.Origin
+			}
+			if next == "" {
+				break
+			}
+			nd, ok := idx.byName[next]
+			if !ok {
+				break
+			}
+			// Already walked from there
+			if _, walked := r[next]; walked {
+				break
+			}
+			if !own[next] {
+				r[next] = nd
+			}
+			cur = nd
+		}
+	}
+	return r
+}
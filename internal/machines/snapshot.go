@@ -5,44 +5,127 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ubuntu/zsys/internal/i18n"
 	"github.com/ubuntu/zsys/internal/zfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
 )
 
 const automatedSnapshotPrefix = "autozsys_"
 
+const (
+	// SnapshotSourceManual is the source of snapshots taken with an explicit name.
+	SnapshotSourceManual = "manual"
+	// SnapshotSourceAutomatic is the source of snapshots named by zsys.
+	SnapshotSourceAutomatic = "automatic"
+)
+
+// SnapshotNaming is the scheme generating names of automatic snapshots: <Prefix>_<suffix>.
+// The suffix is the snapshot time formatted with TimestampFormat, as in time.Format, or a random ID if empty.
+type SnapshotNaming struct {
+	Prefix          string
+	TimestampFormat string
+}
+
+// defaultSnapshotNaming generates autozsys_<random> snapshot names.
+var defaultSnapshotNaming = SnapshotNaming{Prefix: strings.TrimSuffix(automatedSnapshotPrefix, "_")}
+
+// WithSnapshotNaming overrides the naming scheme of automatic snapshots.
+// An error is returned if the scheme can generate invalid state names.
+func WithSnapshotNaming(n SnapshotNaming) func(o *options) error {
+	return func(o *options) error {
+		if n.Prefix == "" {
+			return errors.New(i18n.G("automatic snapshot prefix can't be empty"))
+		}
+		if err := validateStateName(n.name(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), "xxxxxx")); err != nil {
+			return fmt.Errorf(i18n.G("invalid automatic snapshot naming scheme: %v"), err)
+		}
+		o.snapshotNaming = n
+		return nil
+	}
+}
+
+// name returns the snapshot name generated at now, with id as suffix if there is no timestamp format.
+func (n SnapshotNaming) name(now time.Time, id string) string {
+	suffix := id
+	if n.TimestampFormat != "" {
+		suffix = now.Format(n.TimestampFormat)
+	}
+	return n.Prefix + "_" + suffix
+}
+
+// isAutomated returns if the state is a snapshot taken automatically.
+// Its recorded source prevails, otherwise it's guessed from its name being generated by this scheme or the default one.
+func (n SnapshotNaming) isAutomated(s *State) bool {
+	switch s.Source() {
+	case SnapshotSourceAutomatic:
+		return true
+	case SnapshotSourceManual:
+		return false
+	}
+	return strings.Contains(s.ID, "@"+automatedSnapshotPrefix) || strings.Contains(s.ID, "@"+n.Prefix+"_")
+}
+
 // CreateSystemSnapshot creates a snapshot of a system and all users datasets.
 // If snapshotname is not empty, it is used as the id of the snapshot otherwise an id
-// is generated with a random string.
+// is generated from the automatic snapshot naming scheme.
 func (ms *Machines) CreateSystemSnapshot(ctx context.Context, snapshotname string) (string, error) {
-	return ms.createSnapshot(ctx, snapshotname, "")
+	return ms.createSnapshot(ctx, snapshotname, "", "")
+}
+
+// Snapshot saves the system and all current users datasets of the current machine as one state, at the same point in
+// time. Every dataset is snapshotted with the same @name, which is what links user snapshots to the new system
+// state: unlike on filesystem datasets, BootfsDatasets isn't kept on snapshots. If any snapshot can't be taken, all
+// already created ones are destroyed, so that no partial state is left.
+// If name is empty, it's generated from the automatic snapshot naming scheme.
+// It returns the ID of the new system state.
+func (ms *Machines) Snapshot(ctx context.Context, name string) (string, error) {
+	name, err := ms.createSnapshot(ctx, name, "", "")
+	if err != nil {
+		return "", err
+	}
+	return ms.current.ID + "@" + name, nil
+}
+
+// AutoSnapshot creates a snapshot of a system and all users datasets, named from the automatic snapshot naming
+// scheme. reason, if not empty, is recorded on every snapshotted dataset.
+// It returns the generated snapshot name.
+func (ms *Machines) AutoSnapshot(ctx context.Context, reason string) (string, error) {
+	return ms.createSnapshot(ctx, "", "", reason)
 }
 
 // CreateUserSnapshot creates a snapshot for the provided user.
 // If snapshotName is not empty, it is used as the id of the snapshot otherwise an id
-// is generated with a random string.
+// is generated from the automatic snapshot naming scheme.
 // userName is the name of the user to snapshot the datasets from.
 func (ms *Machines) CreateUserSnapshot(ctx context.Context, userName, snapshotName string) (string, error) {
 	if userName == "" {
 		return "", errors.New(i18n.G("Needs a valid user name, got nothing"))
 	}
-	return ms.createSnapshot(ctx, snapshotName, userName)
+	return ms.createSnapshot(ctx, snapshotName, userName, "")
 }
 
 // createSnapshot creates a snapshot of a system and all users datasets.
 // If name is not empty, it is used as the id of the snapshot otherwise an id
-// is generated with a random string.
+// is generated from the automatic snapshot naming scheme.
 // If onlyUser is empty a snapshot of all the system datasets is taken,
 // otherwise only a snapshot of the given username is done
-func (ms *Machines) createSnapshot(ctx context.Context, name string, onlyUser string) (string, error) {
+// reason, if not empty, is recorded on each snapshot.
+func (ms *Machines) createSnapshot(ctx context.Context, name string, onlyUser, reason string) (string, error) {
+	if err := ms.checkWritable(i18n.G("create snapshot")); err != nil {
+		return "", err
+	}
+
 	m := ms.current
 	if !m.isZsys() {
 		return "", errors.New(i18n.G("Current machine isn't Zsys, nothing to create"))
 	}
 
+	source := SnapshotSourceManual
 	if name == "" {
-		name = automatedSnapshotPrefix + ms.z.GenerateID(6)
+		name = ms.snapshotNaming.name(ms.time.Now(), ms.z.GenerateID(6))
+		source = SnapshotSourceAutomatic
 	}
 	if err := validateStateName(name); err != nil {
 		return "", err
@@ -51,6 +134,7 @@ func (ms *Machines) createSnapshot(ctx context.Context, name string, onlyUser st
 	t, cancel := ms.z.NewTransaction(ctx)
 	defer t.Done()
 
+	target := m.ID
 	var toSnapshot []*zfs.Dataset
 	if onlyUser != "" {
 		userState, ok := m.State.Users[onlyUser]
@@ -64,6 +148,7 @@ func (ms *Machines) createSnapshot(ctx context.Context, name string, onlyUser st
 			}
 		}
 		toSnapshot = userState.getDatasets()
+		target = userState.ID
 	} else {
 		toSnapshot = append(m.State.getDatasets(), m.State.getUsersDatasets()...)
 	}
@@ -87,14 +172,32 @@ Please remove some states manually to free up space.`), ms.conf.General.MinFreeP
 		}
 	}
 
+	if err := runPreHook(ctx, "PreSnapshot", ms.hooks.PreSnapshot, target); err != nil {
+		return "", err
+	}
+
 	for _, d := range toSnapshot {
 		if err := t.Snapshot(name, d.Name, false); err != nil {
 			cancel()
 			return "", err
 		}
+		if err := t.SetProperty(libzfs.SnapshotSourceProp, source, d.Name+"@"+name, true); err != nil {
+			cancel()
+			return "", err
+		}
+		if reason == "" {
+			continue
+		}
+		if err := t.SetProperty(libzfs.SnapshotReasonProp, reason, d.Name+"@"+name, true); err != nil {
+			cancel()
+			return "", err
+		}
 	}
 
-	ms.refresh(ctx)
+	if err := ms.refresh(ctx); err != nil {
+		return "", err
+	}
+	runPostHook(ctx, "PostSnapshot", ms.hooks.PostSnapshot, target+"@"+name)
 	return name, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -192,14 +193,26 @@ func (s *State) getDependenciesWithCache(nt *zfs.NoTransaction, ms *Machines, re
 
 // RemoveState removes a system or user state with name as Id of the state and an optional user.
 // It will prevent removing user states linked to an viable system state.
-func (ms *Machines) RemoveState(ctx context.Context, name, user string, force, dryrun bool) error {
+// It returns the names of the datasets removed, or which would be removed in dry run mode: dependent datasets first,
+// then the ones of each removed state.
+func (ms *Machines) RemoveState(ctx context.Context, name, user string, force, dryrun bool) ([]string, error) {
+	if !dryrun {
+		if err := ms.checkWritable(i18n.G("remove state")); err != nil {
+			return nil, err
+		}
+	}
+
 	s, err := ms.IDToState(ctx, name, user)
 	if err != nil {
-		return fmt.Errorf(i18n.G("Couldn't find state: %v"), err)
+		return nil, fmt.Errorf(i18n.G("Couldn't find state: %w"), err)
 	}
 
 	if ms.current != nil && s == &ms.current.State {
-		return errors.New(i18n.G("Removing current system state isn't allowed"))
+		return nil, errors.New(i18n.G("Removing current system state isn't allowed"))
+	}
+	// We can be booted on a clone, which is then part of the machine history
+	if cs, ok := ms.CurrentState(); ok && s == cs {
+		return nil, errors.New(i18n.G("Removing current system state isn't allowed"))
 	}
 
 	states, datasets := s.getDependencies(ctx, ms)
@@ -263,7 +276,59 @@ func (ms *Machines) RemoveState(ctx context.Context, name, user string, force, d
 			}
 		}
 		if errmsg != "" {
-			return &ErrStateRemovalNeedsConfirmation{s: errmsg}
+			return nil, &ErrStateRemovalNeedsConfirmation{s: errmsg}
+		}
+	}
+
+	// Never destroy what states we don't remove rely on, like snapshots they are cloned from
+	removed := make(map[string]bool)
+	for _, state := range states {
+		if state.linkedStateID == "" {
+			removed[state.ID] = true
+		}
+	}
+	for _, state := range states {
+		if !removed[state.ID] {
+			continue
+		}
+		if k, shared := ms.neededByKeptStates(state.State, removed); k != nil {
+			return nil, fmt.Errorf(i18n.G("Couldn't remove state %s: %s relies on %s"), state.ID, k.ID, joinDatasetNames(shared))
+		}
+	}
+	// Nor held snapshots, until they are released
+	held := make(map[string]*zfs.Dataset)
+	for _, state := range states {
+		if !removed[state.ID] {
+			continue
+		}
+		for _, d := range ms.heldDatasets(state.State) {
+			held[d.Name] = d
+		}
+	}
+	for _, d := range datasets {
+		if len(d.Holds) > 0 {
+			held[d.Name] = d
+		}
+	}
+	if len(held) > 0 {
+		var ds []*zfs.Dataset
+		for _, d := range held {
+			ds = append(ds, d)
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+		return nil, fmt.Errorf(i18n.G("Couldn't remove state %s: %s"), s.ID, describeHolds(ds))
+	}
+
+	var removedDatasets []string
+	for _, d := range datasets {
+		removedDatasets = append(removedDatasets, d.Name)
+	}
+	for _, state := range states {
+		if !removed[state.ID] {
+			continue
+		}
+		for _, d := range state.getDatasets() {
+			removedDatasets = append(removedDatasets, d.Name)
 		}
 	}
 
@@ -275,7 +340,7 @@ func (ms *Machines) RemoveState(ctx context.Context, name, user string, force, d
 			continue
 		}
 		if err := nt.Destroy(d.Name); err != nil {
-			return fmt.Errorf(i18n.G("Couldn't remove dataset %s: %v"), d.Name, err)
+			return nil, classifyZFSError(fmt.Errorf(i18n.G("Couldn't remove dataset %s: %w"), d.Name, err))
 		}
 	}
 
@@ -286,12 +351,14 @@ func (ms *Machines) RemoveState(ctx context.Context, name, user string, force, d
 			continue
 		}
 		if err := state.remove(ctx, ms, state.linkedStateID); err != nil {
-			return fmt.Errorf(i18n.G("Couldn't remove state %s: %v"), state.ID, err)
+			return nil, fmt.Errorf(i18n.G("Couldn't remove state %s: %v"), state.ID, err)
 		}
 	}
 
-	ms.refresh(ctx)
-	return nil
+	if err := ms.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return removedDatasets, nil
 }
 
 // Remove removes a given state by deleting all of its system datasets and unlink user states
@@ -374,24 +441,234 @@ func (s *State) remove(ctx context.Context, ms *Machines, linkedStateID string)
 	return nil
 }
 
-// getDatasets returns all Datasets from this given state.
+// getDatasets returns all Datasets from this given state, sorted by route.
 func (s State) getDatasets() []*zfs.Dataset {
 	var r []*zfs.Dataset
-	for _, ds := range s.Datasets {
-		r = append(r, ds...)
+	for _, route := range sortedRoutes(s.Datasets) {
+		r = append(r, s.Datasets[route]...)
 	}
 	return r
 }
 
-// getUsersDatasets returns all user datasets attached to this particular state.
+// bootDatasets returns all boot datasets of this state, sorted by route.
+func (s State) bootDatasets() []*zfs.Dataset {
+	var r []*zfs.Dataset
+	for _, route := range sortedRoutes(s.Datasets) {
+		base, _ := splitSnapshotName(route)
+		if route == s.ID || !strings.Contains(strings.ToLower(base), bootdatasetsContainerName) {
+			continue
+		}
+		r = append(r, s.Datasets[route]...)
+	}
+	return r
+}
+
+// NoautoBootDatasets returns the boot datasets of this state which are canmount=noauto, sorted by route.
+// Those are only mounted when booting on this state, and the others are mounted on any boot: bootloader integrations
+// switch them when reverting.
+func (s State) NoautoBootDatasets() []*zfs.Dataset {
+	var r []*zfs.Dataset
+	for _, d := range s.bootDatasets() {
+		if d.CanMount != "noauto" {
+			continue
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+// Mountpoints returns where each system and user dataset of the state is mounted, indexed by dataset name.
+// Datasets without any recorded mountpoint, like snapshots taken outside of zsys, inherit it from their closest parent
+// in the state, as zfs would. canmount=off datasets and the ones which are never mounted, like mountpoint=none ones,
+// are excluded.
+// Persistent datasets are shared between machines and aren't part of any state: see Machine.StateMountpoints.
+func (s State) Mountpoints() map[string]string {
+	return effectiveMountpoints(append(s.getDatasets(), s.getUsersDatasets()...))
+}
+
+// StateMountpoints returns the mount layout booting on s produces, as State.Mountpoints, alongside the persistent
+// datasets of the machine.
+func (m Machine) StateMountpoints(s State) map[string]string {
+	return effectiveMountpoints(append(append(s.getDatasets(), s.getUsersDatasets()...), m.PersistentDatasets...))
+}
+
+// getUsersDatasets returns all user datasets attached to this particular state, sorted by user.
 func (s State) getUsersDatasets() []*zfs.Dataset {
 	var r []*zfs.Dataset
-	for _, cs := range s.Users {
-		r = append(r, cs.getDatasets()...)
+	for _, user := range sortedStateKeys(s.Users) {
+		r = append(r, s.Users[user].getDatasets()...)
 	}
 	return r
 }
 
+// Size returns, in bytes, the space referenced by all datasets of this state and the space exclusively held by them,
+// which is what would be reclaimed by removing the state.
+// For filesystem datasets, exclusive space includes their snapshots as they are destroyed with them.
+// Associated user states are not accounted for.
+func (s State) Size() (used, exclusive uint64, err error) {
+	if len(s.Datasets) == 0 {
+		return 0, 0, fmt.Errorf(i18n.G("state %s has no dataset"), s.ID)
+	}
+
+	for _, d := range s.getDatasets() {
+		used += d.Referenced
+		exclusive += exclusiveSize(*d)
+	}
+	return used, exclusive, nil
+}
+
+// WrittenSinceBase returns, in bytes, the data written to all datasets of this state since the snapshots they were
+// cloned from. Datasets which aren't clones, like the ones of a main state, or snapshots account for 0.
+// Associated user states are not accounted for.
+func (s State) WrittenSinceBase() (uint64, error) {
+	if len(s.Datasets) == 0 {
+		return 0, fmt.Errorf(i18n.G("state %s has no dataset"), s.ID)
+	}
+
+	var written uint64
+	for _, d := range s.getDatasets() {
+		written += d.WrittenSinceOrigin()
+	}
+	return written, nil
+}
+
+// Source returns if the state snapshot was taken manually or automatically, as SnapshotSourceManual or
+// SnapshotSourceAutomatic. It is empty for filesystem states and snapshots without any recorded source.
+func (s State) Source() string {
+	if len(s.Datasets[s.ID]) == 0 {
+		return ""
+	}
+	return s.Datasets[s.ID][0].SnapshotSource
+}
+
+// CreationTime returns when the root dataset of the state was created. Unlike LastUsed, it doesn't change when the
+// state is booted. It's nil if unknown, like for states built from datasets restored from a dump.
+func (s State) CreationTime() *time.Time {
+	root := s.rootDataset()
+	// Unknown creation times are 0: don't report them as the epoch
+	if root == nil || root.CreationTime() == 0 {
+		return nil
+	}
+	t := time.Unix(int64(root.CreationTime()), 0)
+	return &t
+}
+
+// Protected returns if the state is shielded from garbage collection.
+func (s State) Protected() bool {
+	if len(s.Datasets[s.ID]) == 0 {
+		return false
+	}
+	return s.Datasets[s.ID][0].Protected
+}
+
+// SetStateProtected protects, or unprotects, the system state id against garbage collection.
+// A protected state is never collected, nor anything it depends on, but can still be removed with RemoveState.
+func (ms *Machines) SetStateProtected(ctx context.Context, id string, protected bool) error {
+	if err := ms.checkWritable(i18n.G("protect state")); err != nil {
+		return err
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return err
+	}
+
+	value := "no"
+	if protected {
+		value = "yes"
+	}
+	log.Infof(ctx, i18n.G("Setting protection of state %s to %q"), s.ID, value)
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+	if err := t.SetProperty(libzfs.ProtectedProp, value, s.ID, true); err != nil {
+		cancel()
+		return fmt.Errorf(i18n.G("couldn't change protection of %s: %v"), s.ID, err)
+	}
+	return nil
+}
+
+// statePropertiesAllowlist are the properties which can be set on all datasets of a state. Properties zsys relies on to
+// build machines, like mountpoint, canmount or bootfs, are excluded as changing them would break the state.
+var statePropertiesAllowlist = map[string]bool{
+	libzfs.ProtectedProp:      true,
+	libzfs.SnapshotReasonProp: true,
+}
+
+// SetStateProperty sets property to value on all system and user datasets of the state id. Either all datasets are
+// changed or, on any failure, none are.
+// Only properties of statePropertiesAllowlist can be set. Snapshot only properties, like the snapshot reason, are
+// ignored on filesystem datasets.
+func (ms *Machines) SetStateProperty(ctx context.Context, id, property, value string) error {
+	if err := ms.checkWritable(i18n.G("set state property")); err != nil {
+		return err
+	}
+
+	if !statePropertiesAllowlist[property] {
+		return fmt.Errorf(i18n.G("property %q can't be set on a state"), property)
+	}
+
+	s, _, err := ms.GetStateByID(id)
+	if err != nil {
+		return err
+	}
+
+	log.Infof(ctx, i18n.G("Setting %s=%q on state %s"), property, value, s.ID)
+
+	t, cancel := ms.z.NewTransaction(ctx)
+	defer t.Done()
+	for _, d := range append(s.getDatasets(), s.getUsersDatasets()...) {
+		if err := t.SetProperty(property, value, d.Name, true); err != nil {
+			cancel()
+			return fmt.Errorf(i18n.G("couldn't set %s on state %s: %v"), property, s.ID, err)
+		}
+	}
+	return nil
+}
+
+// BootLabel returns a human friendly label for this state in bootloader menus, like "Ubuntu (on ubuntu_a1b2c3,
+// 2024-03-01)", derived from its ID and last used day. Snapshot states include the snapshot name.
+// Dates are always formatted in UTC as YYYY-MM-DD, so that the label is reproducible.
+func (s State) BootLabel() string {
+	base, snapshot := splitSnapshotName(s.ID)
+	name := filepath.Base(base)
+
+	distro := name
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		distro = name[:i]
+	}
+	distro = strings.ToUpper(distro[:1]) + distro[1:]
+
+	var details []string
+	details = append(details, fmt.Sprintf(i18n.G("on %s"), name))
+	if snapshot != "" {
+		details = append(details, fmt.Sprintf(i18n.G("snapshot %s"), snapshot))
+	}
+	if !s.LastUsed.IsZero() {
+		details = append(details, s.LastUsed.UTC().Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s (%s)", distro, strings.Join(details, ", "))
+}
+
+// exclusiveSize returns the space, in bytes, freed by destroying d.
+// For filesystem datasets, this includes their snapshots.
+func exclusiveSize(d zfs.Dataset) uint64 {
+	if d.IsSnapshot {
+		return d.UsedByDataset
+	}
+	return d.UsedByDataset + d.UsedBySnapshots
+}
+
+// Encrypted returns if any system dataset of this state is encrypted.
+func (s State) Encrypted() bool {
+	for _, d := range s.getDatasets() {
+		if d.IsEncrypted() {
+			return true
+		}
+	}
+	return false
+}
+
 // isSnapshot returns if this state is a snapshot.
 func (s State) isSnapshot() bool {
 	return strings.Contains(s.ID, "@")
@@ -446,6 +723,8 @@ func (ms *Machines) IDToState(ctx context.Context, name, user string) (*State, e
 	if name == "" {
 		return nil, errors.New(i18n.G("state id is mandatory"))
 	}
+
+	defer ms.rlock()()
 	var matchingStates []*State
 	for _, m := range ms.all {
 		if user != "" {
@@ -471,7 +750,7 @@ func (ms *Machines) IDToState(ctx context.Context, name, user string) (*State, e
 	}
 
 	if len(matchingStates) == 0 {
-		return nil, fmt.Errorf(i18n.G("no matching state for %s"), name)
+		return nil, withKind(ErrStateNotFound, fmt.Errorf(i18n.G("no matching state for %s"), name))
 	}
 	if len(matchingStates) > 1 {
 		var errmsg string
@@ -484,6 +763,84 @@ func (ms *Machines) IDToState(ctx context.Context, name, user string) (*State, e
 	return matchingStates[0], nil
 }
 
+// GetStateByID returns the system state matching id, being a main machine state or a history one (clone or snapshot),
+// alongside the machine it belongs to.
+// id can be a full state path, including a snapshot suffix, or any shorter form accepted by IDToState.
+func (ms *Machines) GetStateByID(id string) (*State, *Machine, error) {
+	defer ms.rlock()()
+
+	return ms.getStateByID(id)
+}
+
+// getStateByID is GetStateByID, for callers already holding the machines structure lock.
+func (ms *Machines) getStateByID(id string) (*State, *Machine, error) {
+	if id == "" {
+		return nil, nil, errors.New(i18n.G("state id is mandatory"))
+	}
+
+	var matchingStates []*State
+	var matchingMachines []*Machine
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		// Active for machine
+		if idMatches(m.ID, id) {
+			matchingStates = append(matchingStates, &m.State)
+			matchingMachines = append(matchingMachines, m)
+		}
+
+		// History
+		for _, k := range sortedStateKeys(m.History) {
+			h := m.History[k]
+			if idMatches(h.ID, id) {
+				matchingStates = append(matchingStates, h)
+				matchingMachines = append(matchingMachines, m)
+			}
+		}
+	}
+
+	// A full path match always wins over partial matches
+	for i, s := range matchingStates {
+		if s.ID == id {
+			return s, matchingMachines[i], nil
+		}
+	}
+
+	if len(matchingStates) == 0 {
+		return nil, nil, withKind(ErrStateNotFound, fmt.Errorf(i18n.G("no matching state for %s"), id))
+	}
+	if len(matchingStates) > 1 {
+		var errmsg string
+		for _, match := range matchingStates {
+			errmsg += fmt.Sprintf(i18n.G("  - %s (%s)\n"), match.ID, match.LastUsed.Format("2006-01-02 15:04:05"))
+		}
+		return nil, nil, fmt.Errorf(i18n.G("multiple states are matching %s:\n%sPlease use full state path."), id, errmsg)
+	}
+
+	return matchingStates[0], matchingMachines[0], nil
+}
+
+// SnapshotsMatching returns the snapshot history states of all machines which snapshot name, after @, matches the
+// glob pattern, sorted by ID. Clones are never returned. An invalid pattern doesn't match any snapshot.
+func (ms *Machines) SnapshotsMatching(pattern string) []*State {
+	defer ms.rlock()()
+
+	var r []*State
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		for _, id := range sortedStateKeys(m.History) {
+			_, snapshot := splitSnapshotName(id)
+			if snapshot == "" {
+				continue
+			}
+			if ok, _ := filepath.Match(pattern, snapshot); ok {
+				r = append(r, m.History[id])
+			}
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	return r
+}
+
 // idMatches returns true if the candidate matches the conditions for a given name.
 // - the full path of a state
 // - the suffix of the state (ubuntu_xxxx)
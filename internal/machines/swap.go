@@ -0,0 +1,64 @@
+package machines
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// swapVolumePrefix is the name, or name prefix followed by "_", of volumes zsys manages as swap devices.
+const swapVolumePrefix = "swap"
+
+// isSwapVolume returns if d is a swap volume: a sized volume named swap or swap_<suffix>.
+func isSwapVolume(d zfs.Dataset) bool {
+	if !d.IsVolume || d.VolSize == 0 {
+		return false
+	}
+	base := filepath.Base(d.Name)
+	return base == swapVolumePrefix || strings.HasPrefix(base, swapVolumePrefix+"_")
+}
+
+// attachSwapDatasets attaches swap volumes to machines.
+// A swap volume under any system dataset of a machine state belongs to this machine only. Others, like <pool>/swap,
+// are shared by all machines on the same pool. They are attached to the machine and not to its states, so that they
+// are kept when reverting.
+func (ms *Machines) attachSwapDatasets(volumes []*zfs.Dataset) {
+	for _, v := range volumes {
+		if !isSwapVolume(*v) {
+			continue
+		}
+
+		if m := ms.machineOwningVolume(v.Name); m != nil {
+			m.SwapDatasets = append(m.SwapDatasets, v)
+			continue
+		}
+
+		pool := poolName(v.Name)
+		for _, k := range sortedMachineKeys(ms.all) {
+			m := ms.all[k]
+			if poolName(m.ID) == pool {
+				m.SwapDatasets = append(m.SwapDatasets, v)
+			}
+		}
+	}
+}
+
+// machineOwningVolume returns the machine with a system dataset, in any state, which the volume name is under.
+func (ms *Machines) machineOwningVolume(name string) *Machine {
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		states := []*State{&m.State}
+		for _, id := range sortedStateKeys(m.History) {
+			states = append(states, m.History[id])
+		}
+		for _, s := range states {
+			for _, d := range s.getDatasets() {
+				if !d.IsSnapshot && strings.HasPrefix(name, d.Name+"/") {
+					return m
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package machines
+
+import (
+	"sort"
+
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// TriageClass is the kind of datasets a dataset was sorted in when building machines.
+type TriageClass string
+
+const (
+	// TriageSystem is a system dataset of a machine state.
+	TriageSystem TriageClass = "system"
+	// TriageBoot is a boot dataset, attached later to the states it matches.
+	TriageBoot TriageClass = "boot"
+	// TriageUserData is a user dataset, attached later to the states it is associated to.
+	TriageUserData TriageClass = "userdata"
+	// TriagePersistent is a persistent dataset, shared between all machines.
+	TriagePersistent TriageClass = "persistent"
+	// TriageUnmanaged is a dataset ignored by zsys.
+	TriageUnmanaged TriageClass = "unmanaged"
+)
+
+// TriageRule is the rule which sorted a dataset in its TriageClass.
+type TriageRule string
+
+const (
+	// TriageRuleMainRoot is a mountable / dataset which isn't a clone, creating a new machine.
+	TriageRuleMainRoot TriageRule = "main root"
+	// TriageRuleChild is a child of a machine main or history state root dataset.
+	TriageRuleChild TriageRule = "child"
+	// TriageRuleCloneOrigin is a mountable / clone or snapshot, which origin is a machine main root dataset.
+	TriageRuleCloneOrigin TriageRule = "clone origin"
+	// TriageRuleBootPrefix is a dataset in a boot container, mounted under /boot.
+	TriageRuleBootPrefix TriageRule = "boot prefix"
+	// TriageRuleUserDataContainer is a dataset in a userdata container.
+	TriageRuleUserDataContainer TriageRule = "userdata container"
+	// TriageRulePersistentContainer is a dataset in a persistent container.
+	TriageRulePersistentContainer TriageRule = "persistent container"
+	// TriageRulePersistent is any other dataset which is mounted automatically.
+	TriageRulePersistent TriageRule = "persistent"
+	// TriageRuleIgnoredOrphan is any other dataset which isn't mounted automatically, or a snapshot.
+	TriageRuleIgnoredOrphan TriageRule = "ignored-orphan"
+)
+
+// TriageDecision is how a dataset was sorted when building machines, and why.
+type TriageDecision struct {
+	Dataset string
+	Class   TriageClass
+	Rule    TriageRule
+	// Machine is the ID of the machine a system dataset is attached to.
+	Machine string `json:",omitempty"`
+}
+
+// WithTriageReport records how each dataset is sorted when building machines, which is then returned by
+// TriageReport. Nothing is recorded without this option.
+func WithTriageReport() func(o *options) error {
+	return func(o *options) error {
+		o.triageReport = true
+		return nil
+	}
+}
+
+// TriageReport returns how each dataset was sorted on last refresh, and the rule which matched, sorted by dataset
+// name. It's empty unless machines were created WithTriageReport.
+func (ms *Machines) TriageReport() []TriageDecision {
+	defer ms.rlock()()
+
+	r := make([]TriageDecision, len(ms.triage))
+	copy(r, ms.triage)
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Dataset < r[j].Dataset })
+	return r
+}
+
+// recordTriage records how d was sorted, if triage report is enabled.
+func (ms *Machines) recordTriage(d *zfs.Dataset, class TriageClass, rule TriageRule, machine string) {
+	if !ms.triageReport {
+		return
+	}
+	ms.triage = append(ms.triage, TriageDecision{Dataset: d.Name, Class: class, Rule: rule, Machine: machine})
+}
@@ -0,0 +1,80 @@
+package machines
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// unattachedDataset is a system or boot dataset which isn't part of any machine state.
+type unattachedDataset struct {
+	d      *zfs.Dataset
+	reason string
+}
+
+// detectUnattachedSystemDatasets records every system dataset, in a ROOT container, and boot dataset which ended
+// up in no machine main or history state.
+// origins are the resolved origins of datasets mounted on /, and boots the datasets triaged as boot datasets.
+func (ms *Machines) detectUnattachedSystemDatasets(datasets []*zfs.Dataset, origins map[string]*string, boots []*zfs.Dataset) {
+	attached := make(map[string]bool)
+	for s := range ms.getAllStatesOnMachines() {
+		for _, d := range s.getDatasets() {
+			attached[d.Name] = true
+		}
+	}
+	isBoot := make(map[string]bool)
+	for _, d := range boots {
+		isBoot[d.Name] = true
+	}
+
+	for _, d := range datasets {
+		if attached[d.Name] || d.CanMount == "off" {
+			continue
+		}
+
+		var reason string
+		switch {
+		case isBoot[d.Name]:
+			reason = i18n.G("no parent match: boot dataset doesn't match any machine state")
+		case !strings.Contains(strings.ToLower(d.Name), systemdatasetsContainerName):
+			continue
+		case triageMountpoint(*d) == "/" && origins[d.Name] == nil:
+			reason = fmt.Sprintf(i18n.G("no origin: clone chain of %s doesn't lead to any existing dataset"), d.Name)
+		default:
+			reason = i18n.G("no parent match: not a child, clone or snapshot of any machine state")
+		}
+		ms.unattachedSystemDatasets = append(ms.unattachedSystemDatasets, unattachedDataset{d: d, reason: reason})
+	}
+}
+
+// UnattachedSystemDatasets returns system datasets, in a ROOT container, and boot datasets which weren't attached
+// to any machine main or history state on last refresh, sorted by name.
+// Those datasets exist on disk but are invisible in machines states. UnattachedReason explains why.
+func (ms *Machines) UnattachedSystemDatasets() []*zfs.Dataset {
+	defer ms.rlock()()
+
+	unattached := make([]unattachedDataset, len(ms.unattachedSystemDatasets))
+	copy(unattached, ms.unattachedSystemDatasets)
+	sort.Slice(unattached, func(i, j int) bool { return unattached[i].d.Name < unattached[j].d.Name })
+
+	var r []*zfs.Dataset
+	for _, u := range unattached {
+		r = append(r, u.d)
+	}
+	return r
+}
+
+// UnattachedReason returns why the system dataset name wasn't attached to any machine state, if it isn't.
+func (ms *Machines) UnattachedReason(name string) (reason string, ok bool) {
+	defer ms.rlock()()
+
+	for _, u := range ms.unattachedSystemDatasets {
+		if u.d.Name == name {
+			return u.reason, true
+		}
+	}
+	return "", false
+}
@@ -11,7 +11,6 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/ubuntu/zsys/internal/config"
 	"github.com/ubuntu/zsys/internal/i18n"
@@ -23,6 +22,10 @@ import (
 // CreateUserData creates a new dataset for homepath and attach to current system.
 // It creates intermediates user datasets if needed.
 func (ms *Machines) CreateUserData(ctx context.Context, user, homepath string) error {
+	if err := ms.checkWritable(i18n.G("create user data")); err != nil {
+		return err
+	}
+
 	if !ms.current.isZsys() {
 		return errors.New(i18n.G("Current machine isn't Zsys, nothing to create"))
 	}
@@ -103,7 +106,7 @@ selectUserDataset:
 		return fmt.Errorf(i18n.G("couldn't add %q to BootfsDatasets property of %q: ")+config.ErrorFormat, ms.current.ID, userdataset, err)
 	}
 
-	currentTime := strconv.Itoa(int(time.Now().Unix()))
+	currentTime := strconv.Itoa(int(ms.time.Now().Unix()))
 	if err := t.SetProperty(libzfs.LastUsedProp, currentTime, userdataset, false); err != nil {
 		cancel()
 		return fmt.Errorf(i18n.G("couldn't set last used time to %q: ")+config.ErrorFormat, currentTime, err)
@@ -114,6 +117,10 @@ selectUserDataset:
 
 // ChangeHomeOnUserData tries to find an existing dataset matching home as a valid mountpoint and rename it to newhome
 func (ms *Machines) ChangeHomeOnUserData(ctx context.Context, home, newHome string) error {
+	if err := ms.checkWritable(i18n.G("change user home")); err != nil {
+		return err
+	}
+
 	if !ms.current.isZsys() {
 		return errors.New(i18n.G("Current machine isn't Zsys, nothing to modify"))
 	}
@@ -144,6 +151,10 @@ func (ms *Machines) ChangeHomeOnUserData(ctx context.Context, home, newHome stri
 // DissociateUser tries to unattach current user dataset to current system state
 // removeHome empties directory content if the user state is not associated to any other system state.
 func (ms *Machines) DissociateUser(ctx context.Context, username string, removeHome bool) error {
+	if err := ms.checkWritable(i18n.G("dissociate user")); err != nil {
+		return err
+	}
+
 	if !ms.current.isZsys() {
 		return errors.New(i18n.G("Current machine isn't Zsys, nothing to modify"))
 	}
@@ -199,7 +210,11 @@ func (ms *Machines) DissociateUser(ctx context.Context, username string, removeH
 
 	// Clean content if there is no more state associated with it and it was requested before unmounting.
 	// This will let userdel then removing the parent directory
+	// Directories are left as is in a dry run.
 	for root, dirs := range rootUserPaths {
+		if ms.plan != nil {
+			break
+		}
 		if removeHome {
 			dir, err := ioutil.ReadDir(root)
 			if err != nil {
@@ -271,6 +286,10 @@ func (ms *Machines) tryReuseUserDataSet(t *zfs.Transaction, user string, oldhome
 					if err := t.SetProperty(libzfs.MountPointProp, newhome, d.Name, false); err != nil {
 						return false, fmt.Errorf(i18n.G("couldn't set new home %q to %q: ")+config.ErrorFormat, newhome, d.Name, err)
 					}
+					// Directories are left as is in a dry run.
+					if ms.plan != nil {
+						return true, nil
+					}
 					// Reset owner on newly created mountpoint
 					// FIXME: this should be in zfs itself when changing mount property and restore all properties on mountpoint itself
 					if uid != 0 {
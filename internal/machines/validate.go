@@ -0,0 +1,327 @@
+package machines
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/zfs"
+)
+
+// ValidationCode identifies the kind of inconsistency found by Validate.
+type ValidationCode string
+
+const (
+	// ValidationNoMountableRoot is a state without any root dataset which can be mounted on /.
+	ValidationNoMountableRoot ValidationCode = "no-mountable-root"
+	// ValidationInconsistentBootfs is a state root dataset bootfs property not matching its machine one.
+	ValidationInconsistentBootfs ValidationCode = "inconsistent-bootfs"
+	// ValidationDanglingUserReference is a user dataset associated to a system state which doesn't exist.
+	ValidationDanglingUserReference ValidationCode = "dangling-user-reference"
+	// ValidationDuplicateMainRoot is a machine main root dataset on the same pool than another machine one.
+	ValidationDuplicateMainRoot ValidationCode = "duplicate-main-root"
+	// ValidationMountpointConflict is a mountpoint shared by multiple datasets mounted at boot.
+	ValidationMountpointConflict ValidationCode = "mountpoint-conflict"
+)
+
+// ValidationError is an inconsistency found on a machine or one of its states.
+type ValidationError struct {
+	Code ValidationCode
+	// Machine is the ID of the machine the dataset is part of, if any.
+	Machine string
+	// Dataset is the name of the offending dataset.
+	Dataset string
+	Msg     string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Dataset, e.Msg)
+}
+
+// Validate checks that every machine and history state is bootable and consistent.
+// It reports states without a root dataset which can be mounted, root datasets with a bootfs property not matching
+// their machine, user datasets associated to a system state which doesn't exist, pools with multiple main root
+// datasets, which creates independent machines, and mountpoint conflicts.
+// This doesn't change anything on the system. Errors are sorted by dataset name.
+func (ms *Machines) Validate() []ValidationError {
+	defer ms.rlock()()
+
+	var errs []ValidationError
+
+	systemStates := make(map[string]bool)
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		states := []*State{&m.State}
+		for _, k := range sortedStateKeys(m.History) {
+			states = append(states, m.History[k])
+		}
+
+		for _, s := range states {
+			systemStates[s.ID] = true
+
+			root := s.rootDataset()
+			if root == nil || root.CanMount == "off" {
+				errs = append(errs, ValidationError{
+					Code:    ValidationNoMountableRoot,
+					Machine: m.ID,
+					Dataset: s.ID,
+					Msg:     i18n.G("state has no root dataset which can be mounted"),
+				})
+				continue
+			}
+			if root.BootFS != m.IsZsys {
+				errs = append(errs, ValidationError{
+					Code:    ValidationInconsistentBootfs,
+					Machine: m.ID,
+					Dataset: root.Name,
+					Msg:     fmt.Sprintf(i18n.G("bootfs is %t while machine bootfs is %t"), root.BootFS, m.IsZsys),
+				})
+			}
+		}
+	}
+
+	for _, l := range ms.danglingUserLinks(systemStates) {
+		errs = append(errs, ValidationError{
+			Code:    ValidationDanglingUserReference,
+			Dataset: l.Dataset,
+			Msg:     fmt.Sprintf(i18n.G("associated to system state %q which doesn't exist"), l.SystemDataset),
+		})
+	}
+
+	errs = append(errs, ms.duplicateMainRoots()...)
+
+	for _, c := range ms.mountpointConflicts() {
+		errs = append(errs, ValidationError{
+			Code:    ValidationMountpointConflict,
+			Machine: c.Machine,
+			Dataset: c.Datasets[0],
+			Msg:     fmt.Sprintf(i18n.G("mountpoint %q is shared by %s"), c.Mountpoint, strings.Join(c.Datasets, ", ")),
+		})
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Dataset < errs[j].Dataset })
+	return errs
+}
+
+// DanglingLink is a user dataset associated, by its bootfs datasets list, to a system dataset which doesn't exist.
+type DanglingLink struct {
+	// Dataset is the name of the user dataset.
+	Dataset string
+	// SystemDataset is the missing system dataset the user dataset references.
+	SystemDataset string
+}
+
+// DanglingUserLinks returns user datasets which bootfs datasets list references a system dataset which isn't any
+// machine main or history state anymore, generally after manual dataset changes. Those user datasets aren't mounted
+// when booting the referenced state. Links are sorted by user dataset name, then by system dataset.
+// This is purely diagnostic and doesn't change anything on the system.
+func (ms *Machines) DanglingUserLinks() []DanglingLink {
+	defer ms.rlock()()
+
+	systemStates := make(map[string]bool)
+	for s := range ms.getAllStatesOnMachines() {
+		systemStates[s.ID] = true
+	}
+	return ms.danglingUserLinks(systemStates)
+}
+
+// danglingUserLinks returns links of user datasets to system datasets which aren't any of systemStates.
+// Snapshots are skipped: their list is frozen when taken and only the user dataset one is used to associate them.
+func (ms *Machines) danglingUserLinks(systemStates map[string]bool) []DanglingLink {
+	var links []DanglingLink
+	for _, d := range append(append([]*zfs.Dataset(nil), ms.allUsersDatasets...), ms.unmanagedDatasets...) {
+		if d.IsSnapshot || d.BootfsDatasets == "" || !ms.isUserDataset(d.Name) {
+			continue
+		}
+		for _, id := range strings.Split(d.BootfsDatasets, bootfsdatasetsSeparator) {
+			if systemStates[id] {
+				continue
+			}
+			links = append(links, DanglingLink{Dataset: d.Name, SystemDataset: id})
+		}
+	}
+
+	sort.SliceStable(links, func(i, j int) bool {
+		if links[i].Dataset != links[j].Dataset {
+			return links[i].Dataset < links[j].Dataset
+		}
+		return links[i].SystemDataset < links[j].SystemDataset
+	})
+	return links
+}
+
+// duplicateMainRoots reports all machines which main root dataset is on the same pool than another machine one.
+// Each of them is a mountable / dataset which isn't a clone, which is almost always a misconfiguration.
+func (ms *Machines) duplicateMainRoots() []ValidationError {
+	perPool := make(map[string][]string)
+	for _, k := range sortedMachineKeys(ms.all) {
+		pool := strings.Split(k, "/")[0]
+		perPool[pool] = append(perPool[pool], k)
+	}
+
+	var errs []ValidationError
+	for pool, ids := range perPool {
+		if len(ids) < 2 {
+			continue
+		}
+		for _, id := range ids {
+			errs = append(errs, ValidationError{
+				Code:    ValidationDuplicateMainRoot,
+				Machine: id,
+				Dataset: id,
+				Msg:     fmt.Sprintf(i18n.G("pool %q has multiple main root datasets: %s"), pool, strings.Join(ids, ", ")),
+			})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Dataset < errs[j].Dataset })
+	return errs
+}
+
+// MountConflict is a mountpoint shared by multiple datasets mounted when booting a state.
+type MountConflict struct {
+	Mountpoint string
+	// Datasets are the names of the datasets with this mountpoint, sorted.
+	Datasets []string
+	// Machine and State are the IDs of the machine and state booting with those datasets. They are empty for
+	// conflicts between persistent datasets only, as those are shared by all machines.
+	Machine string `json:",omitempty"`
+	State   string `json:",omitempty"`
+}
+
+// MountpointConflicts returns all mountpoints shared by multiple datasets which would race at boot, sorted by
+// mountpoint and state.
+// For each filesystem state, its system and user datasets which can be mounted are checked against each other and
+// against persistent datasets. Conflicts between persistent datasets only are reported once.
+func (ms *Machines) MountpointConflicts() []MountConflict {
+	defer ms.rlock()()
+
+	return ms.mountpointConflicts()
+}
+
+// mountpointConflicts is MountpointConflicts, for callers already holding the machines structure lock.
+func (ms *Machines) mountpointConflicts() []MountConflict {
+	var conflicts []MountConflict
+
+	persistents := mountableByMountpoint(ms.allPersistentDatasets)
+	for _, mp := range sortedMountpoints(persistents) {
+		if len(persistents[mp]) < 2 {
+			continue
+		}
+		conflicts = append(conflicts, MountConflict{Mountpoint: mp, Datasets: persistents[mp]})
+	}
+
+	for _, k := range sortedMachineKeys(ms.all) {
+		m := ms.all[k]
+		states := []*State{&m.State}
+		for _, k := range sortedStateKeys(m.History) {
+			states = append(states, m.History[k])
+		}
+
+		for _, s := range states {
+			if s.isSnapshot() {
+				continue
+			}
+			byMountpoint := mountableByMountpoint(append(s.getDatasets(), s.getUsersDatasets()...))
+			for _, mp := range sortedMountpoints(byMountpoint) {
+				names := append(byMountpoint[mp], persistents[mp]...)
+				if len(names) < 2 {
+					continue
+				}
+				sort.Strings(names)
+				conflicts = append(conflicts, MountConflict{Mountpoint: mp, Datasets: names, Machine: m.ID, State: s.ID})
+			}
+		}
+	}
+
+	sort.SliceStable(conflicts, func(i, j int) bool { return conflicts[i].Mountpoint < conflicts[j].Mountpoint })
+	return conflicts
+}
+
+// mountableByMountpoint returns the names of filesystem datasets which can be mounted, sorted and grouped by their
+// mountpoint.
+func mountableByMountpoint(ds []*zfs.Dataset) map[string][]string {
+	r := make(map[string][]string)
+	for _, d := range ds {
+		if d.IsSnapshot || d.CanMount == "off" {
+			continue
+		}
+		if d.Mountpoint == "" || d.Mountpoint == "none" || d.Mountpoint == "legacy" || d.Mountpoint == "-" {
+			continue
+		}
+		r[d.Mountpoint] = append(r[d.Mountpoint], d.Name)
+	}
+	for mp := range r {
+		sort.Strings(r[mp])
+	}
+	return r
+}
+
+// effectiveMountpoints returns the mountpoint of each dataset which can be mounted, indexed by dataset name.
+// Datasets without any mountpoint inherit the one of their closest parent in ds, suffixed with their relative path.
+func effectiveMountpoints(ds []*zfs.Dataset) map[string]string {
+	byName := make(map[string]*zfs.Dataset, len(ds))
+	for _, d := range ds {
+		byName[d.Name] = d
+	}
+
+	r := make(map[string]string)
+	for _, d := range ds {
+		if d.CanMount == "off" {
+			continue
+		}
+		mp := inheritedMountpoint(d, byName)
+		if mp == "" || mp == "none" || mp == "legacy" || mp == "-" {
+			continue
+		}
+		r[d.Name] = mp
+	}
+	return r
+}
+
+// inheritedMountpoint returns the mountpoint of d, or the one inherited from its closest parent in byName with a
+// mountpoint. Snapshots inherit from the snapshot of the same name of their parents.
+func inheritedMountpoint(d *zfs.Dataset, byName map[string]*zfs.Dataset) string {
+	if d.Mountpoint != "" {
+		return d.Mountpoint
+	}
+
+	base, snapshot := splitSnapshotName(d.Name)
+	for parent := base; strings.Contains(parent, "/"); {
+		parent = parent[:strings.LastIndex(parent, "/")]
+		name := parent
+		if snapshot != "" {
+			name = parent + "@" + snapshot
+		}
+		p, ok := byName[name]
+		if !ok || p.Mountpoint == "" {
+			continue
+		}
+		if p.Mountpoint == "none" || p.Mountpoint == "legacy" || p.Mountpoint == "-" {
+			return p.Mountpoint
+		}
+		return filepath.Join(p.Mountpoint, strings.TrimPrefix(base, parent))
+	}
+	return ""
+}
+
+// sortedMountpoints returns the sorted mountpoints of byMountpoint.
+func sortedMountpoints(byMountpoint map[string][]string) []string {
+	var r []string
+	for mp := range byMountpoint {
+		r = append(r, mp)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// rootDataset returns the dataset of the state named after it, if any.
+func (s State) rootDataset() *zfs.Dataset {
+	for _, d := range s.Datasets[s.ID] {
+		if d.Name == s.ID {
+			return d
+		}
+	}
+	return nil
+}
@@ -36,6 +36,7 @@ type fakePool struct {
 	Datasets   []struct {
 		Name             string
 		IsVolume         bool
+		VolSize          string `yaml:"volsize"` // Volume size in bytes, only for volumes.
 		Mountpoint       string
 		CanMount         string
 		ZsysBootfs       string    `yaml:"zsys_bootfs"`
@@ -43,6 +44,13 @@ type fakePool struct {
 		LastBootedKernel string    `yaml:"last_booted_kernel"`
 		BootfsDatasets   string    `yaml:"bootfs_datasets"`
 		Origin           string    `yaml:"origin"`
+		Encryption       string    `yaml:"encryption"` // Encryption and key status only work for mock usage.
+		KeyStatus        string    `yaml:"keystatus"`
+		Referenced       string    `yaml:"referenced"` // Space properties, in bytes, only work for mock usage.
+		UsedByDataset    string    `yaml:"usedds"`
+		UsedBySnapshots  string    `yaml:"usedsnap"`
+		Written          string    `yaml:"written"`
+		Available        string    `yaml:"available"`
 		Snapshots        orderedSnapshots
 	}
 }
@@ -55,6 +63,9 @@ type orderedSnapshots []struct {
 	LastBootedKernel string     `yaml:"last_booted_kernel"`
 	BootfsDatasets   string     `yaml:"bootfs_datasets"`
 	CreationTime     *time.Time `yaml:"creation_time"` // Snapshot creation time, only work for mock usage.
+	Used             string     `yaml:"used"`          // Space properties of the snapshot, in bytes, only work for mock usage.
+	Referenced       string     `yaml:"referenced"`
+	Written          string     `yaml:"written"`
 	//TODO: one libzfs support bookmarks
 	//BookMarks        []string
 }
@@ -201,8 +212,8 @@ func (fpools FakePools) Create(path string) func() {
 			fpools.tempPools = append(fpools.tempPools, fpool.Name)
 			defer pool.Close()
 
-			dType := libzfs.DatasetTypeFilesystem
 			for _, dataset := range fpool.Datasets {
+				dType := libzfs.DatasetTypeFilesystem
 				datasetName := fpool.Name + "/" + dataset.Name
 				var d libzfs.DZFSInterface
 				if dataset.Name == "." {
@@ -216,6 +227,9 @@ func (fpools FakePools) Create(path string) func() {
 					if dataset.IsVolume {
 						dType = libzfs.DatasetTypeVolume
 						strSize := "819200"
+						if dataset.VolSize != "" {
+							strSize = dataset.VolSize
+						}
 						props[libzfs.DatasetPropVolsize] = libzfs.Property{Value: strSize}
 					}
 
@@ -225,6 +239,24 @@ func (fpools FakePools) Create(path string) func() {
 					}
 				}
 
+				if dataset.Referenced != "" || dataset.UsedByDataset != "" || dataset.UsedBySnapshots != "" ||
+					dataset.Written != "" || dataset.Available != "" {
+					if _, ok := fpools.libzfs.(*mock.LibZFS); !ok {
+						fpools.Fatalf("trying to set space properties on %q on real ZFS run. This is not possible", datasetName)
+					}
+					for p, v := range map[libzfs.Prop]string{
+						libzfs.DatasetPropReferenced: dataset.Referenced,
+						libzfs.DatasetPropUsedds:     dataset.UsedByDataset,
+						libzfs.DatasetPropUsedsnap:   dataset.UsedBySnapshots,
+						libzfs.DatasetPropWritten:    dataset.Written,
+						libzfs.DatasetPropAvailable:  dataset.Available,
+					} {
+						if v != "" {
+							d.SetProperty(p, v)
+						}
+					}
+				}
+
 				if dType != libzfs.DatasetTypeFilesystem {
 					continue
 				}
@@ -257,6 +289,17 @@ func (fpools FakePools) Create(path string) func() {
 					}
 					d.SetProperty(libzfs.DatasetPropOrigin, dataset.Origin)
 				}
+				if dataset.Encryption != "" || dataset.KeyStatus != "" {
+					if _, ok := fpools.libzfs.(*mock.LibZFS); !ok {
+						fpools.Fatalf("trying to set encryption on %q on real ZFS run. This is not possible", datasetName)
+					}
+					if dataset.Encryption != "" {
+						d.SetProperty(libzfs.DatasetPropEncryption, dataset.Encryption)
+					}
+					if dataset.KeyStatus != "" {
+						d.SetProperty(libzfs.DatasetPropKeyStatus, dataset.KeyStatus)
+					}
+				}
 				d.Close()
 
 				snapshotWG.Add(1)
@@ -276,6 +319,20 @@ func (fpools FakePools) Create(path string) func() {
 							}
 							props[libzfs.DatasetPropCreation] = libzfs.Property{Value: strconv.FormatInt(s.CreationTime.Unix(), 10)}
 						}
+						if s.Used != "" || s.Referenced != "" || s.Written != "" {
+							if _, ok := fpools.libzfs.(*mock.LibZFS); !ok {
+								fpools.Fatalf("trying to set snapshot space properties for %q on real ZFS run. This is not possible", datasetName)
+							}
+							if s.Used != "" {
+								props[libzfs.DatasetPropUsed] = libzfs.Property{Value: s.Used}
+							}
+							if s.Referenced != "" {
+								props[libzfs.DatasetPropReferenced] = libzfs.Property{Value: s.Referenced}
+							}
+							if s.Written != "" {
+								props[libzfs.DatasetPropWritten] = libzfs.Property{Value: s.Written}
+							}
+						}
 						userProps := make(map[string]string)
 						if s.Mountpoint != "" {
 							userProps[libzfs.SnapshotMountpointProp] = s.Mountpoint
@@ -0,0 +1,142 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// errDetached is returned by any zfs operation of a handler not backed by the system.
+var errDetached = errors.New(i18n.G("zfs handler isn't backed by any system zfs pool"))
+
+// NewFromDatasets returns a zfs handler listing datasets, without scanning the system.
+// Each dataset is attached to the one it's a child or a snapshot of, if it's part of datasets, to the top otherwise.
+// Volumes are listed apart, as with a system scan.
+// The handler is detached from the system: any operation on it, like a refresh or a transaction, fails.
+// Properties and holds are taken as is, without their source, and bookmarks aren't listed.
+func NewFromDatasets(ctx context.Context, datasets []Dataset) (*Zfs, error) {
+	log.Debug(ctx, i18n.G("ZFS: build from datasets"))
+
+	z := Zfs{
+		root:        &Dataset{Name: "/"},
+		allDatasets: make(map[string]*Dataset, len(datasets)),
+		libzfs:      detachedLibZFS{},
+	}
+
+	names := make([]string, 0, len(datasets))
+	for _, d := range datasets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d := d
+		if d.IsVolume {
+			d.dZFS = detachedDZFS{}
+			z.volumes = append(z.volumes, &d)
+			continue
+		}
+		if _, exists := z.allDatasets[d.Name]; exists {
+			return nil, fmt.Errorf(i18n.G("dataset %q is listed multiple times"), d.Name)
+		}
+		d.IsSnapshot = strings.Contains(d.Name, "@")
+		d.children = nil
+		d.dZFS = detachedDZFS{isSnapshot: d.IsSnapshot}
+		z.allDatasets[d.Name] = &d
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		d := z.allDatasets[n]
+		parent := z.root
+		if p, ok := z.allDatasets[parentName(n)]; ok {
+			parent = p
+		}
+		parent.children = append(parent.children, d)
+	}
+
+	return &z, nil
+}
+
+// parentName returns the name of the dataset name is a snapshot or a child of.
+func parentName(name string) string {
+	if base, snapshot := splitSnapshotName(name); snapshot != "" {
+		return base
+	}
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// detachedLibZFS fails every operation but generating IDs.
+type detachedLibZFS struct{}
+
+func (detachedLibZFS) PoolOpen(string) (libzfs.Pool, error)              { return libzfs.Pool{}, errDetached }
+func (detachedLibZFS) PoolSetProperty(string, libzfs.Prop, string) error { return errDetached }
+func (detachedLibZFS) DatasetOpenAll() ([]libzfs.DZFSInterface, error) {
+	return nil, errDetached
+}
+func (detachedLibZFS) DatasetOpen(string) (libzfs.DZFSInterface, error) { return nil, errDetached }
+func (detachedLibZFS) DatasetCreate(string, libzfs.DatasetType, map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return nil, errDetached
+}
+func (detachedLibZFS) DatasetSnapshot(string, bool, map[libzfs.Prop]libzfs.Property, map[string]string) (libzfs.DZFSInterface, error) {
+	return nil, errDetached
+}
+func (detachedLibZFS) DatasetBookmark(string, string) error         { return errDetached }
+func (detachedLibZFS) BookmarkDestroy(string) error                 { return errDetached }
+func (detachedLibZFS) BookmarksOpenAll() ([]libzfs.Bookmark, error) { return nil, errDetached }
+func (detachedLibZFS) DatasetHold(string, string) error             { return errDetached }
+func (detachedLibZFS) DatasetRelease(string, string) error          { return errDetached }
+func (detachedLibZFS) HoldsOpenAll() ([]libzfs.Hold, error)         { return nil, errDetached }
+func (detachedLibZFS) DatasetSend(string, string, io.Writer) error  { return errDetached }
+func (detachedLibZFS) DatasetReceive(io.Reader, string, func(string) error) ([]string, error) {
+	return nil, errDetached
+}
+func (detachedLibZFS) GenerateID(length int) string {
+	return (&libzfs.Adapter{}).GenerateID(length)
+}
+
+// detachedDZFS is a dataset failing every operation. Its properties are only the ones of the Dataset owning it.
+type detachedDZFS struct {
+	isSnapshot bool
+}
+
+func (detachedDZFS) DZFSChildren() *[]libzfs.Dataset  { return &[]libzfs.Dataset{} }
+func (detachedDZFS) Children() []libzfs.DZFSInterface { return nil }
+func (detachedDZFS) Clone(string, map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return nil, errDetached
+}
+func (detachedDZFS) Clones() ([]string, error) { return nil, errDetached }
+func (detachedDZFS) Close()                    {}
+func (detachedDZFS) Destroy(bool) error        { return errDetached }
+func (detachedDZFS) GetProperty(libzfs.Prop) (libzfs.Property, error) {
+	return libzfs.Property{}, errDetached
+}
+func (detachedDZFS) GetUserProperty(string) (libzfs.Property, error) {
+	return libzfs.Property{}, errDetached
+}
+func (d detachedDZFS) IsSnapshot() bool         { return d.isSnapshot }
+func (detachedDZFS) Pool() (libzfs.Pool, error) { return libzfs.Pool{}, errDetached }
+func (detachedDZFS) Promote() error             { return errDetached }
+func (detachedDZFS) Properties() *map[libzfs.Prop]libzfs.Property {
+	return &map[libzfs.Prop]libzfs.Property{}
+}
+func (detachedDZFS) ReloadProperties() error               { return errDetached }
+func (detachedDZFS) Rename(string, bool, bool) error       { return errDetached }
+func (detachedDZFS) SetUserProperty(string, string) error  { return errDetached }
+func (detachedDZFS) SetProperty(libzfs.Prop, string) error { return errDetached }
+func (d detachedDZFS) Type() libzfs.DatasetType {
+	if d.isSnapshot {
+		return libzfs.DatasetTypeSnapshot
+	}
+	return libzfs.DatasetTypeFilesystem
+}
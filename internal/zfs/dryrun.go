@@ -0,0 +1,319 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// WithDryRun only plans libzfs operations creating, changing or destroying datasets, snapshots, bookmarks and holds:
+// they are logged and appended to plan, formatted as the zfs commands doing them, but never run.
+// The handler cache reflects planned changes, so that following operations are planned on top of them, until the next
+// Refresh which rescans the system as it is. Planned datasets only have the properties they are created with.
+func WithDryRun(plan *Plan) func(*Zfs) {
+	return func(z *Zfs) {
+		z.plan = plan
+	}
+}
+
+// Plan lists, in order, zfs operations planned in a dry run.
+type Plan struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+// Operations returns all operations planned so far.
+func (p *Plan) Operations() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.ops...)
+}
+
+// Reset forgets all planned operations.
+func (p *Plan) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ops = nil
+}
+
+func (p *Plan) add(ctx context.Context, op string) {
+	log.Infof(ctx, i18n.G("Dry run: %s"), op)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ops = append(p.ops, op)
+}
+
+// dryRunLibZFS plans mutating operations of the underlying libzfs and runs the others.
+type dryRunLibZFS struct {
+	libzfs.Interface
+	ctx  context.Context
+	plan *Plan
+
+	mu sync.Mutex
+	// renames are the planned renames, to open renamed datasets under their new name.
+	renames []rename
+}
+
+type rename struct {
+	from, to string
+}
+
+func (l *dryRunLibZFS) DatasetOpenAll() ([]libzfs.DZFSInterface, error) {
+	datasets, err := l.Interface.DatasetOpenAll()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.renames = nil
+	l.mu.Unlock()
+
+	r := make([]libzfs.DZFSInterface, 0, len(datasets))
+	for _, d := range datasets {
+		r = append(r, dryRunDZFS{DZFSInterface: d, l: l})
+	}
+	return r, nil
+}
+
+// DatasetOpen opens name, which can be the new name of a planned rename. Datasets planned to be created or moved, as
+// with a promotion, only exist in the cache and are opened empty.
+func (l *dryRunLibZFS) DatasetOpen(name string) (libzfs.DZFSInterface, error) {
+	l.mu.Lock()
+	renames := append([]rename(nil), l.renames...)
+	l.mu.Unlock()
+	return l.open(name, name, renames)
+}
+
+// open opens name as the dataset named as, following renames backwards.
+func (l *dryRunLibZFS) open(name, as string, renames []rename) (libzfs.DZFSInterface, error) {
+	d, err := l.Interface.DatasetOpen(name)
+	if err == nil {
+		return dryRunDZFS{DZFSInterface: d, l: l, renamedTo: as}, nil
+	}
+
+	for i := len(renames) - 1; i >= 0; i-- {
+		r := renames[i]
+		if name != r.to && !strings.HasPrefix(name, r.to+"/") && !strings.HasPrefix(name, r.to+"@") {
+			continue
+		}
+		return l.open(r.from+strings.TrimPrefix(name, r.to), as, renames[:i])
+	}
+
+	dtype := libzfs.DatasetTypeFilesystem
+	if strings.Contains(as, "@") {
+		dtype = libzfs.DatasetTypeSnapshot
+	}
+	return l.newPlanned(as, dtype, nil, nil), nil
+}
+
+func (l *dryRunLibZFS) PoolSetProperty(name string, p libzfs.Prop, value string) error {
+	l.plan.add(l.ctx, libzfs.OpPoolSetProperty(name, libzfs.PoolPropName(p), value))
+	return nil
+}
+
+func (l *dryRunLibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	l.plan.add(l.ctx, libzfs.OpCreate(path, props))
+	return l.newPlanned(path, dtype, props, nil), nil
+}
+
+func (l *dryRunLibZFS) DatasetSnapshot(path string, recur bool, props map[libzfs.Prop]libzfs.Property, userProps map[string]string) (libzfs.DZFSInterface, error) {
+	l.plan.add(l.ctx, libzfs.OpSnapshot(path, props, userProps))
+	p := make(map[libzfs.Prop]libzfs.Property)
+	for k, v := range props {
+		p[k] = v
+	}
+	p[libzfs.DatasetPropCreation] = libzfs.Property{Value: fmt.Sprintf("%d", time.Now().Unix())}
+	return l.newPlanned(path, libzfs.DatasetTypeSnapshot, p, userProps), nil
+}
+
+func (l *dryRunLibZFS) DatasetBookmark(snapshot, bookmark string) error {
+	l.plan.add(l.ctx, libzfs.OpBookmark(snapshot, bookmark))
+	return nil
+}
+
+func (l *dryRunLibZFS) BookmarkDestroy(bookmark string) error {
+	l.plan.add(l.ctx, libzfs.OpDestroy(bookmark))
+	return nil
+}
+
+func (l *dryRunLibZFS) DatasetHold(snapshot, tag string) error {
+	l.plan.add(l.ctx, libzfs.OpHold(snapshot, tag))
+	return nil
+}
+
+func (l *dryRunLibZFS) DatasetRelease(snapshot, tag string) error {
+	l.plan.add(l.ctx, libzfs.OpRelease(snapshot, tag))
+	return nil
+}
+
+// DatasetReceive drains the stream, so that the sender isn't blocked, and receives nothing.
+func (l *dryRunLibZFS) DatasetReceive(r io.Reader, targetPool string, check func(snapshot string) error) ([]string, error) {
+	l.plan.add(l.ctx, libzfs.OpReceive(targetPool))
+	_, err := io.Copy(ioutil.Discard, r)
+	return nil, err
+}
+
+// newPlanned returns a dataset which only exists in the plan.
+func (l *dryRunLibZFS) newPlanned(name string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property, userProps map[string]string) *plannedDZFS {
+	d := plannedDZFS{
+		l:         l,
+		dtype:     dtype,
+		props:     map[libzfs.Prop]libzfs.Property{libzfs.DatasetPropName: {Value: name}},
+		userProps: make(map[string]libzfs.Property),
+	}
+	for k, v := range props {
+		d.props[k] = v
+	}
+	for k, v := range userProps {
+		d.userProps[k] = libzfs.Property{Value: v, Source: "local"}
+	}
+	return &d
+}
+
+// dryRunDZFS plans mutating operations on an existing dataset.
+type dryRunDZFS struct {
+	libzfs.DZFSInterface
+	l *dryRunLibZFS
+	// renamedTo is the name of the dataset once planned renames are applied.
+	renamedTo string
+}
+
+func (d dryRunDZFS) name() string {
+	return (*d.Properties())[libzfs.DatasetPropName].Value
+}
+
+func (d dryRunDZFS) Properties() *map[libzfs.Prop]libzfs.Property {
+	props := d.DZFSInterface.Properties()
+	if d.renamedTo == "" || d.renamedTo == (*props)[libzfs.DatasetPropName].Value {
+		return props
+	}
+	renamed := make(map[libzfs.Prop]libzfs.Property, len(*props))
+	for k, v := range *props {
+		renamed[k] = v
+	}
+	renamed[libzfs.DatasetPropName] = libzfs.Property{Value: d.renamedTo}
+	return &renamed
+}
+
+func (d dryRunDZFS) Children() []libzfs.DZFSInterface {
+	var r []libzfs.DZFSInterface
+	for _, c := range d.DZFSInterface.Children() {
+		r = append(r, dryRunDZFS{DZFSInterface: c, l: d.l})
+	}
+	return r
+}
+
+func (d dryRunDZFS) Clone(target string, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return planClone(d.l, d.name(), target, props)
+}
+
+func (d dryRunDZFS) Destroy(bool) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpDestroy(d.name()))
+	return nil
+}
+
+func (d dryRunDZFS) Promote() error {
+	d.l.plan.add(d.l.ctx, libzfs.OpPromote(d.name()))
+	return nil
+}
+
+func (d dryRunDZFS) Rename(newName string, recur, forceUnmount bool) error {
+	return planRename(d.l, d.name(), newName)
+}
+
+func (d dryRunDZFS) SetProperty(p libzfs.Prop, value string) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpSetProperty(d.name(), libzfs.PropName(p), value))
+	return nil
+}
+
+func (d dryRunDZFS) SetUserProperty(prop, value string) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpSetProperty(d.name(), prop, value))
+	return nil
+}
+
+// plannedDZFS is a dataset which only exists in the plan.
+type plannedDZFS struct {
+	l         *dryRunLibZFS
+	dtype     libzfs.DatasetType
+	props     map[libzfs.Prop]libzfs.Property
+	userProps map[string]libzfs.Property
+	children  []libzfs.Dataset
+}
+
+func (d *plannedDZFS) name() string {
+	return d.props[libzfs.DatasetPropName].Value
+}
+
+func (d *plannedDZFS) DZFSChildren() *[]libzfs.Dataset  { return &d.children }
+func (d *plannedDZFS) Children() []libzfs.DZFSInterface { return nil }
+func (d *plannedDZFS) Clone(target string, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return planClone(d.l, d.name(), target, props)
+}
+func (d *plannedDZFS) Clones() ([]string, error) { return nil, nil }
+func (d *plannedDZFS) Close()                    {}
+func (d *plannedDZFS) Destroy(bool) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpDestroy(d.name()))
+	return nil
+}
+func (d *plannedDZFS) GetProperty(p libzfs.Prop) (libzfs.Property, error) {
+	prop, ok := d.props[p]
+	if !ok {
+		return libzfs.Property{Value: "-", Source: "-"}, nil
+	}
+	return prop, nil
+}
+func (d *plannedDZFS) GetUserProperty(p string) (libzfs.Property, error) {
+	prop, ok := d.userProps[p]
+	if !ok {
+		return libzfs.Property{Value: "-", Source: "-"}, nil
+	}
+	return prop, nil
+}
+func (d *plannedDZFS) IsSnapshot() bool { return d.dtype == libzfs.DatasetTypeSnapshot }
+func (d *plannedDZFS) Pool() (libzfs.Pool, error) {
+	return d.l.PoolOpen(strings.Split(strings.Split(d.name(), "@")[0], "/")[0])
+}
+func (d *plannedDZFS) Promote() error {
+	d.l.plan.add(d.l.ctx, libzfs.OpPromote(d.name()))
+	return nil
+}
+func (d *plannedDZFS) Properties() *map[libzfs.Prop]libzfs.Property { return &d.props }
+func (d *plannedDZFS) ReloadProperties() error                      { return nil }
+func (d *plannedDZFS) Rename(newName string, recur, forceUnmount bool) error {
+	return planRename(d.l, d.name(), newName)
+}
+func (d *plannedDZFS) SetProperty(p libzfs.Prop, value string) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpSetProperty(d.name(), libzfs.PropName(p), value))
+	d.props[p] = libzfs.Property{Value: value, Source: "local"}
+	return nil
+}
+func (d *plannedDZFS) SetUserProperty(prop, value string) error {
+	d.l.plan.add(d.l.ctx, libzfs.OpSetProperty(d.name(), prop, value))
+	d.userProps[prop] = libzfs.Property{Value: value, Source: "local"}
+	return nil
+}
+func (d *plannedDZFS) Type() libzfs.DatasetType { return d.dtype }
+
+// planClone plans cloning snapshot to target and returns the planned clone.
+func planClone(l *dryRunLibZFS, snapshot, target string, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	l.plan.add(l.ctx, libzfs.OpClone(snapshot, target, props))
+	d := l.newPlanned(target, libzfs.DatasetTypeFilesystem, props, nil)
+	d.props[libzfs.DatasetPropOrigin] = libzfs.Property{Value: snapshot, Source: "-"}
+	return d, nil
+}
+
+// planRename plans renaming name to newName. The renamed datasets can then be opened under their new name.
+func planRename(l *dryRunLibZFS, name, newName string) error {
+	l.plan.add(l.ctx, libzfs.OpRename(name, newName))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.renames = append(l.renames, rename{from: name, to: newName})
+	return nil
+}
@@ -2,8 +2,10 @@ package zfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -94,6 +96,13 @@ func (d *Dataset) refreshProperties(ctx context.Context) error {
 	}
 	sources.BootFS = srcBootFS
 
+	prot, srcProtected, err := getUserPropertyFromSys(ctx, libzfs.ProtectedProp, d.dZFS)
+	if err != nil {
+		log.Warningf(ctx, i18n.G("can't read protected property, ignoring: ")+config.ErrorFormat, err)
+	}
+	protected := prot == "yes"
+	sources.Protected = srcProtected
+
 	var lu, srcLastUsed string
 	if !d.IsSnapshot {
 		lu, srcLastUsed, err = getUserPropertyFromSys(ctx, libzfs.LastUsedProp, d.dZFS)
@@ -128,7 +137,9 @@ func (d *Dataset) refreshProperties(ctx context.Context) error {
 		if strings.Contains(d.Name, "/"+UserdataPrefix+"/") && bootfsDatasets == "" {
 			oldBootfsDatasets, oldSrcBootfsDatasets, _ := getUserPropertyFromSys(ctx, "org.zsys:bootfs-datasets", d.dZFS)
 			if oldBootfsDatasets != "" {
-				if err := d.dZFS.SetUserProperty(libzfs.BootfsDatasetsProp, oldBootfsDatasets); err != nil {
+				if err := d.dZFS.SetUserProperty(libzfs.BootfsDatasetsProp, oldBootfsDatasets); errors.Is(err, ErrReadOnly) {
+					log.Debugf(ctx, i18n.G("not transitioning bootfsdataset property of %q in read only mode"), d.Name)
+				} else if err != nil {
 					log.Warningf(ctx, i18n.G("can't transition bootfsdataset property, ignoring: ")+config.ErrorFormat, err)
 				}
 			}
@@ -139,20 +150,110 @@ func (d *Dataset) refreshProperties(ctx context.Context) error {
 	}
 	sources.BootfsDatasets = srcBootfsDatasets
 
+	var snapshotReason, srcSnapshotReason, snapshotSource, srcSnapshotSource string
+	if d.IsSnapshot {
+		if snapshotReason, srcSnapshotReason, err = getUserPropertyFromSys(ctx, libzfs.SnapshotReasonProp, d.dZFS); err != nil {
+			log.Warningf(ctx, i18n.G("can't read snapshot reason property, ignoring: ")+config.ErrorFormat, err)
+		}
+		if snapshotSource, srcSnapshotSource, err = getUserPropertyFromSys(ctx, libzfs.SnapshotSourceProp, d.dZFS); err != nil {
+			log.Warningf(ctx, i18n.G("can't read snapshot source property, ignoring: ")+config.ErrorFormat, err)
+		}
+	}
+	sources.SnapshotReason = srcSnapshotReason
+	sources.SnapshotSource = srcSnapshotSource
+
+	// The marker is only set on the state root dataset: ignore it when inherited by its children.
+	var operationInProgress, srcOperationInProgress string
+	if !d.IsSnapshot {
+		if operationInProgress, srcOperationInProgress, err = getUserPropertyFromSys(ctx, libzfs.OperationInProgressProp, d.dZFS); err != nil {
+			log.Warningf(ctx, i18n.G("can't read operation in progress property, ignoring: ")+config.ErrorFormat, err)
+		}
+		if srcOperationInProgress != "local" {
+			operationInProgress, srcOperationInProgress = "", ""
+		}
+	}
+	sources.OperationInProgress = srcOperationInProgress
+
+	referenced := sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropReferenced, d.dZFS))
+	written := sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropWritten, d.dZFS))
+	available := sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropAvailable, d.dZFS))
+	var usedByDataset, usedBySnapshots uint64
+	if d.IsSnapshot {
+		// used on a snapshot is only the space exclusively held by it
+		usedByDataset = sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropUsed, d.dZFS))
+	} else {
+		usedByDataset = sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropUsedds, d.dZFS))
+		usedBySnapshots = sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropUsedsnap, d.dZFS))
+	}
+
+	// Not encrypted datasets have encryption=off and keystatus=- or none.
+	var encryption, keyStatus string
+	if e := getPropertyFromSys(ctx, libzfs.DatasetPropEncryption, d.dZFS).Value; e != "" && e != "off" && e != "-" {
+		encryption = e
+		keyStatus = getPropertyFromSys(ctx, libzfs.DatasetPropKeyStatus, d.dZFS).Value
+	}
+
+	var creation int
+	if c := dZFSprops[libzfs.DatasetPropCreation].Value; c != "" && c != "-" {
+		if creation, err = strconv.Atoi(c); err != nil {
+			log.Debugf(ctx, i18n.G("%q has an invalid creation value %q, ignoring: %v"), name, c, err)
+			creation = 0
+		}
+	}
+	d.creation = creation
+
 	d.DatasetProp = DatasetProp{
-		Mountpoint:       mountpoint,
-		CanMount:         canMount,
-		Mounted:          mounted,
-		BootFS:           bootFS,
-		LastUsed:         lastUsed,
-		LastBootedKernel: lastBootedKernel,
-		BootfsDatasets:   bootfsDatasets,
-		Origin:           origin,
-		sources:          sources,
+		Mountpoint:          mountpoint,
+		CanMount:            canMount,
+		Mounted:             mounted,
+		BootFS:              bootFS,
+		Protected:           protected,
+		LastUsed:            lastUsed,
+		LastBootedKernel:    lastBootedKernel,
+		BootfsDatasets:      bootfsDatasets,
+		SnapshotReason:      snapshotReason,
+		SnapshotSource:      snapshotSource,
+		OperationInProgress: operationInProgress,
+		Origin:              origin,
+		Referenced:          referenced,
+		UsedByDataset:       usedByDataset,
+		UsedBySnapshots:     usedBySnapshots,
+		Written:             written,
+		Available:           available,
+		Encryption:          encryption,
+		KeyStatus:           keyStatus,
+		sources:             sources,
 	}
 	return nil
 }
 
+// sizeFromProp returns the size in bytes of a space property.
+// Unset or non applicable properties are considered as 0.
+func sizeFromProp(ctx context.Context, name string, p libzfs.Property) uint64 {
+	if p.Value == "" || p.Value == "-" {
+		return 0
+	}
+	v, err := strconv.ParseUint(p.Value, 10, 64)
+	if err != nil {
+		log.Debugf(ctx, i18n.G("%q has an invalid size value %q, ignoring: %v"), name, p.Value, err)
+		return 0
+	}
+	return v
+}
+
+// getPropertyFromSys returns the native property prop from the underlying ZFS system dataset state.
+// libzfs only loads a few native properties when opening a dataset, the others have to be fetched.
+// An unreadable property is returned empty.
+func getPropertyFromSys(ctx context.Context, prop libzfs.Prop, dZFS libzfs.DZFSInterface) libzfs.Property {
+	p, err := dZFS.GetProperty(prop)
+	if err != nil {
+		name := (*dZFS.Properties())[libzfs.DatasetPropName].Value
+		log.Debugf(ctx, i18n.G("can't get %q property on %q, ignoring: %v"), libzfs.PropName(prop), name, err)
+		return libzfs.Property{}
+	}
+	return p
+}
+
 // getUserPropertyFromSys returns the value of a user property and its source from the underlying
 // ZFS system dataset state.
 // It also sanitize the sources to only return "local" or "inherited".
@@ -199,6 +300,10 @@ func getUserPropertyFromSys(ctx context.Context, prop string, dZFS libzfs.DZFSIn
 // newDatasetTree returns a Dataset and a populated tree of all its children
 // It returns a nil Dataset with a nil error for unsupported dataset type (DatasetTypeVolume or DatasetTypeBookmark)
 func newDatasetTree(ctx context.Context, dZFS libzfs.DZFSInterface, allDatasets *map[string]*Dataset) (*Dataset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Skip non file system or snapshot datasets
 	if dZFS.Type() == libzfs.DatasetTypeVolume || dZFS.Type() == libzfs.DatasetTypeBookmark {
 		return nil, nil
@@ -227,7 +332,7 @@ func newDatasetTree(ctx context.Context, dZFS libzfs.DZFSInterface, allDatasets
 		// For security, Children are removed from libzfs in caller.
 		c, err := newDatasetTree(ctx, dZFS.Children()[i], allDatasets)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't scan dataset: %v", err)
+			return nil, fmt.Errorf("couldn't scan dataset: %w", err)
 		}
 		// Not a filesystem or snapshot dataset: skipping
 		if c == nil {
@@ -244,6 +349,49 @@ func newDatasetTree(ctx context.Context, dZFS libzfs.DZFSInterface, allDatasets
 	return &node, nil
 }
 
+// newVolumes returns all volumes in the tree of dZFS, which are skipped by newDatasetTree.
+func newVolumes(ctx context.Context, dZFS libzfs.DZFSInterface) ([]*Dataset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if dZFS.Type() != libzfs.DatasetTypeVolume {
+		var r []*Dataset
+		for _, c := range dZFS.Children() {
+			volumes, err := newVolumes(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, volumes...)
+		}
+		return r, nil
+	}
+
+	props := *dZFS.Properties()
+	name := props[libzfs.DatasetPropName].Value
+	log.Debugf(ctx, i18n.G("New volume found: %q"), name)
+	return []*Dataset{{
+		Name:     name,
+		IsVolume: true,
+		DatasetProp: DatasetProp{
+			VolSize:       sizeFromProp(ctx, name, props[libzfs.DatasetPropVolsize]),
+			Referenced:    sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropReferenced, dZFS)),
+			UsedByDataset: sizeFromProp(ctx, name, getPropertyFromSys(ctx, libzfs.DatasetPropUsedds, dZFS)),
+		},
+		dZFS: dZFS,
+	}}, nil
+}
+
+// newBookmark returns a bookmark Dataset from b.
+func newBookmark(ctx context.Context, b libzfs.Bookmark) *Dataset {
+	log.Debugf(ctx, i18n.G("New bookmark found: %q"), b.Name)
+	creation, err := strconv.Atoi(b.Creation)
+	if err != nil {
+		log.Warningf(ctx, i18n.G("creation time of bookmark %q isn't an int: ")+config.ErrorFormat, b.Name, err)
+	}
+	return &Dataset{Name: b.Name, IsBookmark: true, DatasetProp: DatasetProp{LastUsed: creation}}
+}
+
 // splitSnapshotName return base and trailing names
 func splitSnapshotName(name string) (string, string) {
 	i := strings.LastIndex(name, "@")
@@ -303,6 +451,22 @@ func (d Dataset) HasSnapshotInHierarchy() bool {
 	return false
 }
 
+// WrittenSinceOrigin returns, in bytes, the referenced space written to this clone since the snapshot it was cloned
+// from. As written is relative to the previous snapshot, what was written by each of its snapshots is added.
+// Snapshots and datasets which aren't clones return 0.
+func (d Dataset) WrittenSinceOrigin() uint64 {
+	if d.IsSnapshot || d.Origin == "" {
+		return 0
+	}
+	written := d.Written
+	for _, cd := range d.children {
+		if cd.IsSnapshot {
+			written += cd.Written
+		}
+	}
+	return written
+}
+
 // IsUserDataset returns if this filesystem dataset is or has been a userdataset, even if unlinked to any filesystem dataset
 // Note that it doesn’t take into account if the dataset is a clone of a userdataset.
 // Snapshots will always return an error, check the filesystem dataset first.
@@ -404,6 +568,14 @@ func (d *Dataset) setProperty(name, value, source string) (err error) {
 	if d.IsSnapshot && name == libzfs.BootfsDatasetsProp {
 		return nil
 	}
+	// Same for snapshot provenance properties on filesystem datasets
+	if !d.IsSnapshot && (name == libzfs.SnapshotReasonProp || name == libzfs.SnapshotSourceProp) {
+		return nil
+	}
+	// And for the operation marker on snapshots
+	if d.IsSnapshot && name == libzfs.OperationInProgressProp {
+		return nil
+	}
 
 	// In case we change the mountpoint, we need to translate the whole hierarchy for children.
 	// Store initial mountpoint path.
@@ -416,6 +588,8 @@ func (d *Dataset) setProperty(name, value, source string) (err error) {
 			bootFS = true
 		}
 		d.BootFS = bootFS
+	case libzfs.ProtectedProp:
+		d.Protected = value == "yes"
 	case libzfs.LastUsedProp:
 		lastUsed, err := strconv.Atoi(value)
 		if err != nil {
@@ -434,6 +608,10 @@ func (d *Dataset) setProperty(name, value, source string) (err error) {
 	children := make(chan *Dataset)
 	var getInheritedChildren func(d *Dataset)
 	getInheritedChildren = func(d *Dataset) {
+		// The operation marker only applies to the dataset it's set on.
+		if name == libzfs.OperationInProgressProp {
+			return
+		}
 		for _, c := range d.children {
 			np, _, _, destS := c.stringToProp(name)
 			// We ignore snapshots from inheritance: we only take user properties (even for canmount or mountpoint)
@@ -476,6 +654,8 @@ func (d *Dataset) setProperty(name, value, source string) (err error) {
 				bootFS = true
 			}
 			c.BootFS = bootFS
+		case libzfs.ProtectedProp:
+			c.Protected = value == "yes"
 		case libzfs.LastUsedProp:
 			lastUsed, err := strconv.Atoi(value)
 			if err != nil {
@@ -522,7 +702,7 @@ func (d *Dataset) stringToProp(name string) (nativeProp libzfs.Prop, userProp st
 	case libzfs.SnapshotMountpointProp:
 		value = &d.Mountpoint
 		simplifiedSource = &d.sources.Mountpoint
-	// Bootfs and LastUsed are non string. Return a local string
+	// Bootfs, Protected and LastUsed are non string. Return a local string
 	case libzfs.BootfsProp:
 		bootfs := "yes"
 		if !d.BootFS {
@@ -530,6 +710,13 @@ func (d *Dataset) stringToProp(name string) (nativeProp libzfs.Prop, userProp st
 		}
 		value = &bootfs
 		simplifiedSource = &d.sources.BootFS
+	case libzfs.ProtectedProp:
+		protected := "no"
+		if d.Protected {
+			protected = "yes"
+		}
+		value = &protected
+		simplifiedSource = &d.sources.Protected
 	case libzfs.LastUsedProp:
 		lu := strconv.Itoa(d.LastUsed)
 		value = &lu
@@ -540,6 +727,15 @@ func (d *Dataset) stringToProp(name string) (nativeProp libzfs.Prop, userProp st
 	case libzfs.LastBootedKernelProp:
 		value = &d.LastBootedKernel
 		simplifiedSource = &d.sources.LastBootedKernel
+	case libzfs.SnapshotReasonProp:
+		value = &d.SnapshotReason
+		simplifiedSource = &d.sources.SnapshotReason
+	case libzfs.SnapshotSourceProp:
+		value = &d.SnapshotSource
+		simplifiedSource = &d.sources.SnapshotSource
+	case libzfs.OperationInProgressProp:
+		value = &d.OperationInProgress
+		simplifiedSource = &d.sources.OperationInProgress
 	default:
 		panic(fmt.Sprintf("unsupported property %q", name))
 	}
@@ -616,6 +812,59 @@ func (t *nestedTransaction) inverseOrigin(oldOrigDataset, newOrigDataset *Datase
 	return nil
 }
 
+// renameInCache renames in our cache d, previously named name, and all its descendants to newName, attaching it to
+// newParent. Origins pointing to renamed snapshots are updated as well.
+func (z *Zfs) renameInCache(ctx context.Context, d *Dataset, name, newName string, newParent *Dataset) error {
+	oldParent, err := z.findDatasetByName(filepath.Dir(name))
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find parent for %q: %v"), name, err)
+	}
+	if err := oldParent.removeChild(name); err != nil {
+		return err
+	}
+	newParent.children = append(newParent.children, d)
+
+	var rename func(d *Dataset) error
+	rename = func(d *Dataset) error {
+		oldName := d.Name
+		d.Name = newName + strings.TrimPrefix(oldName, name)
+
+		// this dZFS handler still references the old name. Close it and open the renamed one.
+		d.dZFS.Close()
+		dZFS, err := z.libzfs.DatasetOpen(d.Name)
+		if err != nil {
+			return fmt.Errorf(i18n.G("cannot open renamed dataset %q: %v"), d.Name, err)
+		}
+		// We keep our own children tree, see newDatasetTree().
+		*dZFS.DZFSChildren() = nil
+		d.dZFS = dZFS
+		if err := d.refreshProperties(ctx); err != nil {
+			log.Warningf(ctx, i18n.G("couldn't refresh properties of %q: %v"), d.Name, err)
+		}
+
+		delete(z.allDatasets, oldName)
+		z.allDatasets[d.Name] = d
+
+		for _, c := range d.children {
+			if err := rename(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := rename(d); err != nil {
+		return err
+	}
+
+	for _, ds := range z.allDatasets {
+		if !strings.HasPrefix(ds.Origin, name+"@") && !strings.HasPrefix(ds.Origin, name+"/") {
+			continue
+		}
+		ds.Origin = newName + strings.TrimPrefix(ds.Origin, name)
+	}
+	return nil
+}
+
 // removeChild on our Dataset object
 func (d *Dataset) removeChild(name string) error {
 	i := -1
@@ -638,3 +887,34 @@ func (d *Dataset) removeChild(name string) error {
 	d.children = d.children[:len(d.children)-1]
 	return nil
 }
+
+// hasHold returns if tag is part of holds.
+func hasHold(holds []string, tag string) bool {
+	for _, h := range holds {
+		if h == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// addHold returns holds with tag, kept sorted.
+func addHold(holds []string, tag string) []string {
+	if hasHold(holds, tag) {
+		return holds
+	}
+	r := append(append([]string(nil), holds...), tag)
+	sort.Strings(r)
+	return r
+}
+
+// removeHold returns holds without tag, or nil if none is left.
+func removeHold(holds []string, tag string) []string {
+	var r []string
+	for _, h := range holds {
+		if h != tag {
+			r = append(r, h)
+		}
+	}
+	return r
+}
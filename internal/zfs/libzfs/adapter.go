@@ -1,6 +1,8 @@
 package libzfs
 
 import (
+	"io"
+
 	golibzfs "github.com/bicomsystems/go-libzfs"
 )
 
@@ -29,6 +31,8 @@ const (
 	PoolPropAltroot = golibzfs.PoolPropAltroot
 	// PoolPropCapacity ZFS Pool property
 	PoolPropCapacity = golibzfs.PoolPropCapacity
+	// PoolPropBootfs ZFS Pool property
+	PoolPropBootfs = golibzfs.PoolPropBootfs
 	// PoolNumProps is the end pool number property
 	PoolNumProps = golibzfs.PoolNumProps
 	// VDevTypeFile is the vdevtype on file
@@ -55,6 +59,22 @@ const (
 	DatasetPropCreation = golibzfs.DatasetPropCreation
 	// DatasetPropVolsize is the volume size property for the dataset
 	DatasetPropVolsize = golibzfs.DatasetPropVolsize
+	// DatasetPropUsed is the space consumed by the dataset and all its descendents
+	DatasetPropUsed = golibzfs.DatasetPropUsed
+	// DatasetPropReferenced is the amount of data accessible by the dataset
+	DatasetPropReferenced = golibzfs.DatasetPropReferenced
+	// DatasetPropUsedds is the space used by the dataset itself, freed if the dataset was destroyed
+	DatasetPropUsedds = golibzfs.DatasetPropUsedds
+	// DatasetPropUsedsnap is the space consumed by the snapshots of the dataset
+	DatasetPropUsedsnap = golibzfs.DatasetPropUsedsnap
+	// DatasetPropAvailable is the space available to the dataset and all its children
+	DatasetPropAvailable = golibzfs.DatasetPropAvailable
+	// DatasetPropWritten is the space referenced by the dataset written since its previous snapshot
+	DatasetPropWritten = golibzfs.DatasetPropWritten
+	// DatasetPropEncryption is the encryption algorithm of the dataset, or off
+	DatasetPropEncryption = golibzfs.DatasetPropEncryption
+	// DatasetPropKeyStatus is the encryption key status of the dataset: available, unavailable or none if not encrypted
+	DatasetPropKeyStatus = golibzfs.DatasetPropKeyStatus
 )
 
 const (
@@ -67,6 +87,14 @@ const (
 	BootfsDatasetsProp = zsysPrefix + "bootfs-datasets"
 	// LastBootedKernelProp string value
 	LastBootedKernelProp = zsysPrefix + "last-booted-kernel"
+	// SnapshotReasonProp string value
+	SnapshotReasonProp = zsysPrefix + "snapshot-reason"
+	// SnapshotSourceProp string value
+	SnapshotSourceProp = zsysPrefix + "source"
+	// ProtectedProp string value
+	ProtectedProp = zsysPrefix + "protected"
+	// OperationInProgressProp string value
+	OperationInProgressProp = zsysPrefix + "operation-in-progress"
 	// CanmountProp string value
 	CanmountProp = "canmount"
 	// SnapshotCanmountProp is the equivalent to CanmountProp, but as a user property to store on zsys snapshot
@@ -75,18 +103,42 @@ const (
 	MountPointProp = "mountpoint"
 	// SnapshotMountpointProp is the equivalent to MountPointProp, but as a user property to store on zsys snapshot
 	SnapshotMountpointProp = zsysPrefix + MountPointProp
+	// BookmarkSeparator separates a dataset name from its bookmark name
+	BookmarkSeparator = "#"
 )
 
 // Interface is the interface to use real libzfs or our in memory mock.
 type Interface interface {
 	PoolOpen(name string) (pool Pool, err error)
+	PoolSetProperty(name string, p Prop, value string) (err error)
 	DatasetOpenAll() (datasets []DZFSInterface, err error)
 	DatasetOpen(name string) (d DZFSInterface, err error)
 	DatasetCreate(path string, dtype DatasetType, props map[Prop]Property) (d DZFSInterface, err error)
 	DatasetSnapshot(path string, recur bool, props map[Prop]Property, userProps map[string]string) (rd DZFSInterface, err error)
+	DatasetBookmark(snapshot, bookmark string) (err error)
+	BookmarkDestroy(bookmark string) (err error)
+	BookmarksOpenAll() (bookmarks []Bookmark, err error)
+	DatasetHold(snapshot, tag string) (err error)
+	DatasetRelease(snapshot, tag string) (err error)
+	HoldsOpenAll() (holds []Hold, err error)
+	DatasetSend(snapshot, from string, w io.Writer) (err error)
+	DatasetReceive(r io.Reader, targetPool string, check func(snapshot string) error) (received []string, err error)
 	GenerateID(length int) string
 }
 
+// Bookmark is a zfs bookmark (<dataset>#<name>), with the creation time, in seconds since epoch, of the snapshot it
+// was created from.
+type Bookmark struct {
+	Name     string
+	Creation string
+}
+
+// Hold is a zfs user hold tag on a snapshot, preventing its destruction until released.
+type Hold struct {
+	Snapshot string
+	Tag      string
+}
+
 // DZFSInterface is the interface to use real libzfs Dataset object or in memory mock.
 type DZFSInterface interface {
 	DZFSChildren() *[]Dataset
@@ -95,12 +147,14 @@ type DZFSInterface interface {
 	Clones() (clones []string, err error)
 	Close()
 	Destroy(Defer bool) (err error)
+	GetProperty(p Prop) (prop Property, err error)
 	GetUserProperty(p string) (prop Property, err error)
 	IsSnapshot() (ok bool)
 	Pool() (p Pool, err error)
 	Promote() (err error)
 	Properties() *map[Prop]Property
 	ReloadProperties() (err error)
+	Rename(newName string, recur, forceUnmount bool) (err error)
 	SetUserProperty(prop, value string) error
 	SetProperty(p Prop, value string) error
 	Type() DatasetType
@@ -1,11 +1,18 @@
 package libzfs
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
 	golibzfs "github.com/bicomsystems/go-libzfs"
+	"golang.org/x/sys/unix"
 )
 
 // Adapter is an accessor to real system zfs libraries.
@@ -16,6 +23,16 @@ func (Adapter) PoolOpen(name string) (pool Pool, err error) {
 	return golibzfs.PoolOpen(name)
 }
 
+// PoolSetProperty sets the native property p of the pool name to value
+func (Adapter) PoolSetProperty(name string, p Prop, value string) (err error) {
+	pool, err := golibzfs.PoolOpen(name)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	return pool.SetProperty(p, value)
+}
+
 // PoolCreate creates a zfs pool
 func (Adapter) PoolCreate(name string, vdev VDevTree, features map[string]string, props PoolProperties, fsprops DatasetProperties) (pool Pool, err error) {
 	return golibzfs.PoolCreate(name, vdev, features, props, fsprops)
@@ -62,6 +79,306 @@ func (*Adapter) DatasetSnapshot(path string, recur bool, props map[Prop]Property
 	return dZFSAdapter{&d}, nil
 }
 
+// DatasetBookmark creates bookmark from snapshot.
+func (*Adapter) DatasetBookmark(snapshot, bookmark string) error {
+	return zfsCommand(nil, "bookmark", snapshot, bookmark)
+}
+
+// BookmarkDestroy destroys bookmark.
+func (*Adapter) BookmarkDestroy(bookmark string) error {
+	if !strings.Contains(bookmark, BookmarkSeparator) {
+		return fmt.Errorf("%q isn't a bookmark", bookmark)
+	}
+	return zfsCommand(nil, "destroy", bookmark)
+}
+
+// BookmarksOpenAll lists all bookmarks on imported pools.
+// No bookmark is listed if the zfs command isn't available, so that scanning datasets still works.
+func (*Adapter) BookmarksOpenAll() (bookmarks []Bookmark, err error) {
+	var out strings.Builder
+	if err := zfsCommand(&out, "list", "-H", "-p", "-t", "bookmark", "-o", "name,creation"); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't list bookmarks: %v", err)
+	}
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Split(l, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		bookmarks = append(bookmarks, Bookmark{Name: fields[0], Creation: fields[1]})
+	}
+	return bookmarks, nil
+}
+
+// zfsCommand runs the zfs command with args, writing its output to stdout if not nil.
+// libzfs bindings don't handle bookmarks at all, and libzfs can't open them: this is only used for them, including
+// incremental sends from a bookmark. The returned error wraps exec.ErrNotFound if the zfs command isn't installed.
+func zfsCommand(stdout io.Writer, args ...string) error {
+	var stderr strings.Builder
+	cmd := exec.Command("zfs", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zfs %s failed: %w: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
+
+// DatasetHold places the hold tag on snapshot, preventing its destruction until released.
+func (*Adapter) DatasetHold(snapshot, tag string) error {
+	d, err := golibzfs.DatasetOpenSingle(snapshot)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Hold(tag)
+}
+
+// DatasetRelease releases the hold tag on snapshot.
+func (*Adapter) DatasetRelease(snapshot, tag string) error {
+	d, err := golibzfs.DatasetOpenSingle(snapshot)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Release(tag)
+}
+
+// HoldsOpenAll lists all holds on snapshots of imported pools.
+// Only snapshots with user references are queried for their holds.
+func (*Adapter) HoldsOpenAll() (holds []Hold, err error) {
+	ds, err := golibzfs.DatasetOpenAll()
+	if err != nil {
+		return nil, err
+	}
+	defer golibzfs.DatasetCloseAll(ds)
+
+	var collect func(d *golibzfs.Dataset) error
+	collect = func(d *golibzfs.Dataset) error {
+		if d.IsSnapshot() {
+			refs, err := d.GetProperty(golibzfs.DatasetPropUserrefs)
+			if err != nil {
+				return err
+			}
+			if refs.Value == "0" || refs.Value == "-" {
+				return nil
+			}
+			name, err := d.Path()
+			if err != nil {
+				return err
+			}
+			tags, err := d.Holds()
+			if err != nil {
+				return fmt.Errorf("couldn't list holds of %s: %v", name, err)
+			}
+			for _, t := range tags {
+				holds = append(holds, Hold{Snapshot: name, Tag: t.Name})
+			}
+			return nil
+		}
+		for i := range d.Children {
+			if err := collect(&d.Children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := range ds {
+		if err := collect(&ds[i]); err != nil {
+			return nil, err
+		}
+	}
+	return holds, nil
+}
+
+// DatasetSend writes to w a send stream of snapshot, with its properties. If from, a snapshot or bookmark of the same
+// dataset, is not empty, the stream is incremental from it.
+// libzfs bindings can't send incrementally from a bookmark: use the zfs command for them.
+func (*Adapter) DatasetSend(snapshot, from string, w io.Writer) (err error) {
+	if strings.Contains(from, BookmarkSeparator) {
+		return zfsCommand(w, "send", "-p", "-i", from, snapshot)
+	}
+
+	d, err := golibzfs.DatasetOpenSingle(snapshot)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// libzfs writes the stream to a file descriptor.
+	f, ok := w.(*os.File)
+	if !ok {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		errCopy := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(w, pr)
+			if err != nil {
+				// Keep draining the pipe so that libzfs never writes to a closed one.
+				_, _ = io.Copy(io.Discard, pr)
+			}
+			pr.Close()
+			errCopy <- err
+		}()
+		defer func() {
+			pw.Close()
+			if e := <-errCopy; e != nil && err == nil {
+				err = fmt.Errorf("couldn't write send stream: %v", e)
+			}
+		}()
+		f = pw
+	}
+
+	flags := golibzfs.SendFlags{Props: true}
+	if from == "" {
+		return d.Send(f, flags)
+	}
+	return d.SendFrom(from, f, flags)
+}
+
+// DatasetReceive receives in targetPool all send streams read from r, one after the other, without mounting them. As
+// with zfs receive -d, the source pool name is replaced by targetPool. check, if not nil, is called on the snapshots
+// received from each stream before receiving the next one, and stops the reception on error.
+// It returns the received snapshot names, including the ones received before an error.
+func (*Adapter) DatasetReceive(r io.Reader, targetPool string, check func(snapshot string) error) (received []string, err error) {
+	// libzfs reads each stream from a file descriptor, without reading past its end: keep a single one for all streams
+	// so that nothing is lost between them.
+	f, ok := r.(*os.File)
+	if !ok {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		errCopy := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(pw, r)
+			pw.Close()
+			errCopy <- err
+		}()
+		defer func() {
+			if e := <-errCopy; e != nil && err == nil {
+				err = fmt.Errorf("couldn't read send stream: %v", e)
+			}
+		}()
+		// Closing the reader first unblocks the copy if we stop early.
+		defer pr.Close()
+		f = pr
+	}
+
+	pool, err := golibzfs.DatasetOpenSingle(targetPool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	for {
+		more, err := hasInput(f)
+		if err != nil {
+			return received, fmt.Errorf("couldn't read send stream: %v", err)
+		}
+		if !more {
+			break
+		}
+
+		before, err := snapshotsOf(targetPool)
+		if err != nil {
+			return received, err
+		}
+		if err := pool.Receive(f, golibzfs.RecvFlags{IsPrefix: true, NoMount: true}); err != nil {
+			return received, fmt.Errorf("zfs receive in %s failed: %v", targetPool, err)
+		}
+		after, err := snapshotsOf(targetPool)
+		if err != nil {
+			return received, err
+		}
+
+		known := make(map[string]bool)
+		for _, n := range before {
+			known[n] = true
+		}
+		var names []string
+		for _, n := range after {
+			if !known[n] {
+				names = append(names, n)
+			}
+		}
+		received = append(received, names...)
+		if len(names) == 0 {
+			return received, fmt.Errorf("no snapshot received in %s", targetPool)
+		}
+		if check == nil {
+			continue
+		}
+		for _, n := range names {
+			if err := check(n); err != nil {
+				return received, err
+			}
+		}
+	}
+
+	if len(received) == 0 {
+		return nil, errors.New("no send stream to receive")
+	}
+	return received, nil
+}
+
+// hasInput waits until f can be read and reports if anything is left to read, without reading it.
+func hasInput(f *os.File) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		break
+	}
+
+	// The writer of a pipe may have closed it with data left to read.
+	n, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCINQ) // FIONREAD
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// snapshotsOf returns the names of all snapshots of dataset and its descendants, in scan order.
+func snapshotsOf(dataset string) (snapshots []string, err error) {
+	d, err := golibzfs.DatasetOpen(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	var collect func(d *golibzfs.Dataset) error
+	collect = func(d *golibzfs.Dataset) error {
+		if d.IsSnapshot() {
+			name, err := d.Path()
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, name)
+			return nil
+		}
+		for i := range d.Children {
+			if err := collect(&d.Children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(&d); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
 var seedOnce = sync.Once{}
 
 // GenerateID with n ascii or digits, lowercase, characters
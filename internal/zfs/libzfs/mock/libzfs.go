@@ -1,8 +1,10 @@
 package mock
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -16,9 +18,12 @@ const currentMagicTime = "2000000000"
 
 // LibZFS is the mock, in memory implementation of libzfs
 type LibZFS struct {
-	mu       sync.RWMutex
-	datasets map[string]*dZFS
-	pools    map[string]libzfs.Pool
+	mu        sync.RWMutex
+	datasets  map[string]*dZFS
+	pools     map[string]libzfs.Pool
+	bookmarks map[string]string
+	// holds are the tags held on each snapshot
+	holds map[string]map[string]bool
 
 	errOnCreate       bool
 	errOnClone        bool
@@ -27,6 +32,18 @@ type LibZFS struct {
 	errOnScan         bool
 	errOnSetProperty  bool
 	forceLastUsedTime bool
+	scanDelay         time.Duration
+	// only expose in dataset Properties() the native properties loaded by libzfs
+	partialProperties bool
+	// number of next scan and create operations failing
+	failingScans   int
+	failingCreates int
+	scans          int
+
+	// operations are the mutating operations run, when recorded.
+	opsMu            sync.Mutex
+	recordOperations bool
+	operations       []string
 }
 
 // PoolOpen opens given pool
@@ -38,6 +55,19 @@ func (l *LibZFS) PoolOpen(name string) (pool libzfs.Pool, err error) {
 	return pool, nil
 }
 
+// PoolSetProperty sets the native property p of the pool name to value
+func (l *LibZFS) PoolSetProperty(name string, p libzfs.Prop, value string) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pool, ok := l.pools[name]
+	if !ok {
+		return fmt.Errorf("No pool found %q", name)
+	}
+	pool.Properties[p] = libzfs.Property{Value: value, Source: "local"}
+	l.record(libzfs.OpPoolSetProperty(name, libzfs.PoolPropName(p), value))
+	return nil
+}
+
 // PoolCreate creates a zfs pool
 func (l *LibZFS) PoolCreate(name string, vdev libzfs.VDevTree, features map[string]string, props libzfs.PoolProperties, fsprops libzfs.DatasetProperties) (pool libzfs.Pool, err error) {
 	p := libzfs.Pool{
@@ -55,7 +85,7 @@ func (l *LibZFS) PoolCreate(name string, vdev libzfs.VDevTree, features map[stri
 	for i, prop := range fsprops {
 		datasetProps[i] = libzfs.Property{Value: prop}
 	}
-	l.DatasetCreate(name, libzfs.DatasetTypeFilesystem, datasetProps)
+	l.createDataset(name, libzfs.DatasetTypeFilesystem, datasetProps)
 
 	return p, nil
 }
@@ -65,6 +95,9 @@ func (l *LibZFS) DatasetOpenAll() (datasets []libzfs.DZFSInterface, err error) {
 	if l.errOnScan {
 		return nil, errors.New("Error on DatasetOpenAll requested")
 	}
+	if l.consumeFailure(&l.failingScans, &l.scans) {
+		return nil, errors.New("Transient error on DatasetOpenAll requested")
+	}
 
 	// This is the only place where we can clean the global datasets from datasets to remove as libzfs doesn't do that right on Promote.
 	// zfs.New() is calling DatasetOpenAll to load the whole new state from zfs kernel state.
@@ -126,9 +159,24 @@ func (l *LibZFS) openChildrenFor(dm *dZFS) {
 
 // DatasetCreate creates a dataset
 func (l *LibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	// props are completed on creation: record them as requested
+	op := libzfs.OpCreate(path, props)
+	d, err := l.createDataset(path, dtype, props)
+	if err != nil {
+		return nil, err
+	}
+	l.record(op)
+	return d, nil
+}
+
+// createDataset creates a dataset for path, without recording it, as part of other operations.
+func (l *LibZFS) createDataset(path string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
 	if l.errOnCreate {
 		return nil, errors.New("Error on Create requested")
 	}
+	if l.consumeFailure(&l.failingCreates, nil) {
+		return nil, errors.New("Transient error on Create requested")
+	}
 	l.mu.Lock()
 	if _, ok := l.datasets[path]; ok {
 		l.mu.Unlock()
@@ -142,6 +190,7 @@ func (l *LibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[
 	}
 	l.mu.RLock()
 	if _, ok := l.pools[poolName]; !ok {
+		l.mu.RUnlock()
 		return nil, fmt.Errorf("pool %q doesn't exists", poolName)
 	}
 	l.mu.RUnlock()
@@ -208,8 +257,8 @@ func (l *LibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[
 			if pp.Source == "local" {
 				pp.Source = "inherited"
 			}
-			// Transform mountpoint
-			if k == libzfs.DatasetPropMountpoint {
+			// Transform mountpoint. none and legacy are inherited as is.
+			if k == libzfs.DatasetPropMountpoint && !isSpecialMountpoint(pprops[k].Value) {
 				pp.Value = filepath.Join(pprops[k].Value, filepath.Base(path))
 			}
 			props[k] = pp
@@ -272,7 +321,14 @@ func (l *LibZFS) DatasetSnapshot(path string, recur bool, props map[libzfs.Prop]
 	if len(strings.Split(path, "@")) != 2 || strings.Split(path, "@")[1] == "" {
 		return nil, fmt.Errorf("%q is not a valid snapshot name", path)
 	}
-	return l.createSnapshot(path, recur, props, userProps)
+	// props are completed on creation: record them as requested
+	op := libzfs.OpSnapshot(path, props, userProps)
+	d, err := l.createSnapshot(path, recur, props, userProps)
+	if err != nil {
+		return nil, err
+	}
+	l.record(op)
+	return d, nil
 }
 
 func (l *LibZFS) createSnapshot(path string, recur bool, props map[libzfs.Prop]libzfs.Property, userProps map[string]string) (libzfs.DZFSInterface, error) {
@@ -280,14 +336,14 @@ func (l *LibZFS) createSnapshot(path string, recur bool, props map[libzfs.Prop]l
 		props[libzfs.DatasetPropCreation] = libzfs.Property{Value: currentMagicTime}
 	}
 
-	dinterface, err := l.DatasetCreate(path, libzfs.DatasetTypeSnapshot, props)
+	dinterface, err := l.createDataset(path, libzfs.DatasetTypeSnapshot, props)
 	if err != nil {
 		return nil, err
 	}
 
 	d := dinterface.(*dZFS)
 	for k, v := range userProps {
-		if err := d.SetUserProperty(k, v); err != nil {
+		if err := d.setUserProperty(k, v); err != nil {
 			return nil, err
 		}
 	}
@@ -310,6 +366,224 @@ func (l *LibZFS) createSnapshot(path string, recur bool, props map[libzfs.Prop]l
 	return d, nil
 }
 
+// DatasetBookmark creates bookmark from snapshot, keeping the snapshot creation time
+func (l *LibZFS) DatasetBookmark(snapshot, bookmark string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d, ok := l.datasets[snapshot]
+	if !ok || !d.IsSnapshot() {
+		return fmt.Errorf("No snapshot found with name %q", snapshot)
+	}
+	base := strings.Split(snapshot, "@")[0]
+	if !strings.HasPrefix(bookmark, base+libzfs.BookmarkSeparator) || strings.TrimPrefix(bookmark, base+libzfs.BookmarkSeparator) == "" {
+		return fmt.Errorf("%q is not a valid bookmark name for %q", bookmark, snapshot)
+	}
+	if _, exists := l.bookmarks[bookmark]; exists {
+		return fmt.Errorf("bookmark %q already exists", bookmark)
+	}
+	l.bookmarks[bookmark] = d.Dataset.Properties[libzfs.DatasetPropCreation].Value
+	l.record(libzfs.OpBookmark(snapshot, bookmark))
+	return nil
+}
+
+// BookmarkDestroy destroys bookmark
+func (l *LibZFS) BookmarkDestroy(bookmark string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, exists := l.bookmarks[bookmark]; !exists {
+		return fmt.Errorf("No bookmark found with name %q", bookmark)
+	}
+	l.record(libzfs.OpDestroy(bookmark))
+	delete(l.bookmarks, bookmark)
+	return nil
+}
+
+// BookmarksOpenAll lists all bookmarks
+func (l *LibZFS) BookmarksOpenAll() (bookmarks []libzfs.Bookmark, err error) {
+	if l.errOnScan {
+		return nil, errors.New("Error on BookmarksOpenAll requested")
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for name, creation := range l.bookmarks {
+		bookmarks = append(bookmarks, libzfs.Bookmark{Name: name, Creation: creation})
+	}
+	return bookmarks, nil
+}
+
+// DatasetHold places the hold tag on snapshot
+func (l *LibZFS) DatasetHold(snapshot, tag string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d, ok := l.datasets[snapshot]
+	if !ok || !d.IsSnapshot() {
+		return fmt.Errorf("No snapshot found with name %q", snapshot)
+	}
+	if tag == "" {
+		return errors.New("hold tag can't be empty")
+	}
+	if l.holds[snapshot][tag] {
+		return fmt.Errorf("tag %q already exists on %q", tag, snapshot)
+	}
+	if l.holds[snapshot] == nil {
+		l.holds[snapshot] = make(map[string]bool)
+	}
+	l.holds[snapshot][tag] = true
+	l.record(libzfs.OpHold(snapshot, tag))
+	return nil
+}
+
+// DatasetRelease releases the hold tag on snapshot
+func (l *LibZFS) DatasetRelease(snapshot, tag string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.holds[snapshot][tag] {
+		return fmt.Errorf("No hold %q found on %q", tag, snapshot)
+	}
+	delete(l.holds[snapshot], tag)
+	if len(l.holds[snapshot]) == 0 {
+		delete(l.holds, snapshot)
+	}
+	l.record(libzfs.OpRelease(snapshot, tag))
+	return nil
+}
+
+// HoldsOpenAll lists all holds
+func (l *LibZFS) HoldsOpenAll() (holds []libzfs.Hold, err error) {
+	if l.errOnScan {
+		return nil, errors.New("Error on HoldsOpenAll requested")
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for snapshot, tags := range l.holds {
+		for tag := range tags {
+			holds = append(holds, libzfs.Hold{Snapshot: snapshot, Tag: tag})
+		}
+	}
+	return holds, nil
+}
+
+// DatasetSend writes a fake, but predictable, send stream of snapshot to w, incremental from from if not empty
+func (l *LibZFS) DatasetSend(snapshot, from string, w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	d, ok := l.datasets[snapshot]
+	if !ok || !d.IsSnapshot() {
+		return fmt.Errorf("No snapshot found with name %q", snapshot)
+	}
+	if from != "" {
+		base := strings.Split(snapshot, "@")[0]
+		_, isBookmark := l.bookmarks[from]
+		fromD, isSnapshot := l.datasets[from]
+		if !isBookmark && !(isSnapshot && fromD.IsSnapshot()) {
+			return fmt.Errorf("No snapshot or bookmark found with name %q", from)
+		}
+		if !strings.HasPrefix(from, base+"@") && !strings.HasPrefix(from, base+libzfs.BookmarkSeparator) {
+			return fmt.Errorf("%q isn't a snapshot or bookmark of %q", from, base)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "zfs send stream of %s from %q\n", snapshot, from)
+	return err
+}
+
+// DatasetReceive receives in targetPool the fake send streams written by DatasetSend, read from r. As with zfs receive
+// -d, the source pool name is replaced by targetPool. Local properties of the source datasets, if they still exist,
+// are received as well. check, if not nil, is called on each received snapshot before receiving the next stream, and
+// stops the reception on error. It returns the received snapshot names.
+func (l *LibZFS) DatasetReceive(r io.Reader, targetPool string, check func(snapshot string) error) (received []string, err error) {
+	l.mu.RLock()
+	_, ok := l.pools[targetPool]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("pool %q doesn't exists", targetPool)
+	}
+	l.record(libzfs.OpReceive(targetPool))
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var snapshot, from string
+		if _, err := fmt.Sscanf(scanner.Text(), "zfs send stream of %s from %q", &snapshot, &from); err != nil {
+			return received, fmt.Errorf("invalid send stream %q: %v", scanner.Text(), err)
+		}
+		i := strings.IndexAny(snapshot, "/@")
+		if i < 0 || !strings.Contains(snapshot, "@") {
+			return received, fmt.Errorf("invalid snapshot name in send stream: %q", snapshot)
+		}
+		target := targetPool + snapshot[i:]
+		base, snapName := strings.Split(target, "@")[0], strings.Split(target, "@")[1]
+
+		l.mu.RLock()
+		_, baseExists := l.datasets[base]
+		_, targetExists := l.datasets[target]
+		src := l.datasets[strings.Split(snapshot, "@")[0]]
+		srcSnapshot := l.datasets[snapshot]
+		l.mu.RUnlock()
+
+		if targetExists {
+			return received, fmt.Errorf("destination %q already exists", target)
+		}
+		if from == "" {
+			if baseExists {
+				return received, fmt.Errorf("destination %q already exists", base)
+			}
+			props := make(map[libzfs.Prop]libzfs.Property)
+			userProps := make(map[string]string)
+			if src != nil {
+				props, userProps = src.localProperties()
+			}
+			d, err := l.createDataset(base, libzfs.DatasetTypeFilesystem, props)
+			if err != nil {
+				return received, err
+			}
+			for k, v := range userProps {
+				if err := d.(*dZFS).setUserProperty(k, v); err != nil {
+					return received, err
+				}
+			}
+		} else {
+			fromSnapshot := base + "@" + strings.Split(from, "@")[len(strings.Split(from, "@"))-1]
+			l.mu.RLock()
+			_, fromExists := l.datasets[fromSnapshot]
+			l.mu.RUnlock()
+			if !baseExists || !fromExists {
+				return received, fmt.Errorf("incremental source %q doesn't exist for %q", fromSnapshot, target)
+			}
+		}
+
+		props := make(map[libzfs.Prop]libzfs.Property)
+		userProps := make(map[string]string)
+		if srcSnapshot != nil {
+			props, userProps = srcSnapshot.localProperties()
+			props[libzfs.DatasetPropCreation] = srcSnapshot.Dataset.Properties[libzfs.DatasetPropCreation]
+		}
+		if _, err := l.createSnapshot(base+"@"+snapName, false, props, userProps); err != nil {
+			return received, err
+		}
+		received = append(received, target)
+		if check == nil {
+			continue
+		}
+		if err := check(target); err != nil {
+			return received, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	if len(received) == 0 {
+		return nil, errors.New("no send stream to receive")
+	}
+	return received, nil
+}
+
 // SetDatasetAsMounted is a test-only property allowing forcing one dataset to be mounted
 func (l *LibZFS) SetDatasetAsMounted(name string, mounted bool) {
 	l.mu.Lock()
@@ -339,6 +613,42 @@ func (l *LibZFS) ErrOnClone(shouldErr bool) {
 	l.errOnClone = shouldErr
 }
 
+// FailNextScans forces a failure of the mock on the n next scan operations, which then succeed.
+func (l *LibZFS) FailNextScans(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failingScans = n
+}
+
+// FailNextCreates forces a failure of the mock on the n next create operations, which then succeed.
+func (l *LibZFS) FailNextCreates(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failingCreates = n
+}
+
+// Scans returns the number of scan operations attempted on the mock.
+func (l *LibZFS) Scans() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.scans
+}
+
+// consumeFailure counts one attempt in attempts, if not nil, and returns true if a requested failure is left in
+// failures, consuming it.
+func (l *LibZFS) consumeFailure(failures, attempts *int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if attempts != nil {
+		*attempts++
+	}
+	if *failures <= 0 {
+		return false
+	}
+	*failures--
+	return true
+}
+
 // ErrOnScan forces a failure of the mock on scan operation
 func (l *LibZFS) ErrOnScan(shouldErr bool) {
 	l.errOnScan = shouldErr
@@ -359,6 +669,41 @@ func (l *LibZFS) ErrOnDestroyDS(dsErr []string) {
 	l.errOnDestroyDS = dsErr
 }
 
+// SlowScan delays listing children of each dataset by delay, to simulate scanning a huge pool
+func (l *LibZFS) SlowScan(delay time.Duration) {
+	l.scanDelay = delay
+}
+
+// PartialPropertiesLoad only exposes in dataset Properties() the native properties which are loaded by libzfs
+// when opening or reloading a dataset. Any other native property needs then to be fetched with GetProperty.
+func (l *LibZFS) PartialPropertiesLoad(partial bool) {
+	l.partialProperties = partial
+}
+
+// RecordOperations starts or stops recording successful mutating operations, formatted as zfs commands.
+func (l *LibZFS) RecordOperations(record bool) {
+	l.opsMu.Lock()
+	defer l.opsMu.Unlock()
+	l.recordOperations = record
+}
+
+// Operations returns the recorded mutating operations, in order.
+func (l *LibZFS) Operations() []string {
+	l.opsMu.Lock()
+	defer l.opsMu.Unlock()
+	return append([]string(nil), l.operations...)
+}
+
+// record appends op to operations, if recorded.
+func (l *LibZFS) record(op string) {
+	l.opsMu.Lock()
+	defer l.opsMu.Unlock()
+	if !l.recordOperations {
+		return
+	}
+	l.operations = append(l.operations, op)
+}
+
 // ForceLastUsedTime ensures that any LastUsed property is set to the magic time for reproducibility
 func (l *LibZFS) ForceLastUsedTime(force bool) {
 	l.forceLastUsedTime = force
@@ -378,6 +723,23 @@ type dZFS struct {
 	tempOrigin     string
 }
 
+// localProperties returns mountpoint and canmount properties, and user properties, set locally on d.
+func (d *dZFS) localProperties() (props map[libzfs.Prop]libzfs.Property, userProps map[string]string) {
+	props = make(map[libzfs.Prop]libzfs.Property)
+	for _, k := range []libzfs.Prop{libzfs.DatasetPropMountpoint, libzfs.DatasetPropCanmount} {
+		if p, ok := d.Dataset.Properties[k]; ok && p.Source == "local" {
+			props[k] = p
+		}
+	}
+	userProps = make(map[string]string)
+	for k, p := range d.userProperties {
+		if p.Source == "local" {
+			userProps[k] = p.Value
+		}
+	}
+	return props, userProps
+}
+
 func (d dZFS) assertDatasetOpened() {
 	if d.isClosed {
 		panic(fmt.Sprintf("operation on closed dataset %q is prohibited", d.Dataset.Properties[libzfs.DatasetPropName].Value))
@@ -385,6 +747,7 @@ func (d dZFS) assertDatasetOpened() {
 }
 func (d dZFS) Children() (children []libzfs.DZFSInterface) {
 	d.assertDatasetOpened()
+	time.Sleep(d.libZFSMock.scanDelay)
 	var r []libzfs.DZFSInterface
 	for i := range d.children {
 		r = append(r, d.children[i])
@@ -396,9 +759,23 @@ func (d dZFS) DZFSChildren() *[]libzfs.Dataset {
 	return &d.Dataset.Children
 }
 
+// loadedProps are the native properties libzfs loads when opening or reloading a dataset.
+var loadedProps = []libzfs.Prop{libzfs.DatasetPropName, libzfs.DatasetPropCanmount, libzfs.DatasetPropMountpoint,
+	libzfs.DatasetPropOrigin, libzfs.DatasetPropMounted, libzfs.DatasetPropCreation, libzfs.DatasetPropVolsize}
+
 func (d dZFS) Properties() *map[libzfs.Prop]libzfs.Property {
 	d.assertDatasetOpened()
-	return &d.Dataset.Properties
+	if !d.libZFSMock.partialProperties {
+		return &d.Dataset.Properties
+	}
+
+	props := make(map[libzfs.Prop]libzfs.Property)
+	for _, p := range loadedProps {
+		if v, ok := d.Dataset.Properties[p]; ok {
+			props[p] = v
+		}
+	}
+	return &props
 }
 
 func (d dZFS) Type() libzfs.DatasetType {
@@ -411,15 +788,18 @@ func (d dZFS) Clone(target string, props map[libzfs.Prop]libzfs.Property) (libzf
 	if d.libZFSMock.errOnClone {
 		return nil, errors.New("Error on Clone requested")
 	}
+	// props are completed on creation: record them as requested
+	op := libzfs.OpClone(d.Dataset.Properties[libzfs.DatasetPropName].Value, target, props)
 	props[libzfs.DatasetPropOrigin] = libzfs.Property{
 		Value:  d.Dataset.Properties[libzfs.DatasetPropName].Value,
 		Source: "-",
 	}
 
-	dinterface, err := d.libZFSMock.DatasetCreate(target, libzfs.DatasetTypeFilesystem, props)
+	dinterface, err := d.libZFSMock.createDataset(target, libzfs.DatasetTypeFilesystem, props)
 	if err != nil {
 		return nil, err
 	}
+	d.libZFSMock.record(op)
 
 	di := dinterface.(*dZFS)
 	return di, nil
@@ -437,6 +817,15 @@ func (d dZFS) Pool() (p libzfs.Pool, err error) {
 	return p, nil
 }
 
+func (d dZFS) GetProperty(p libzfs.Prop) (prop libzfs.Property, err error) {
+	d.assertDatasetOpened()
+	prop, ok := d.Dataset.Properties[p]
+	if !ok {
+		return libzfs.Property{Value: "-", Source: "-"}, nil
+	}
+	return prop, nil
+}
+
 func (d dZFS) GetUserProperty(p string) (prop libzfs.Property, err error) {
 	d.assertDatasetOpened()
 	prop, ok := d.userProperties[p]
@@ -447,6 +836,15 @@ func (d dZFS) GetUserProperty(p string) (prop libzfs.Property, err error) {
 }
 
 func (d *dZFS) SetUserProperty(prop, value string) error {
+	if err := d.setUserProperty(prop, value); err != nil {
+		return err
+	}
+	d.libZFSMock.record(libzfs.OpSetProperty(d.Dataset.Properties[libzfs.DatasetPropName].Value, prop, value))
+	return nil
+}
+
+// setUserProperty sets prop locally, without recording it, as part of other operations.
+func (d *dZFS) setUserProperty(prop, value string) error {
 	if d.libZFSMock.errOnSetProperty {
 		return errors.New("Error on SetProperty requested")
 	}
@@ -478,12 +876,21 @@ func (d *dZFS) SetProperty(p libzfs.Prop, value string) error {
 		return errors.New("Error on SetProperty requested")
 	}
 	d.assertDatasetOpened()
-	return d.setPropertyWithSource(p, value, "local")
+	if err := d.setPropertyWithSource(p, value, "local"); err != nil {
+		return err
+	}
+	d.libZFSMock.record(libzfs.OpSetProperty(d.Dataset.Properties[libzfs.DatasetPropName].Value, libzfs.PropName(p), value))
+	return nil
 }
 
+// spaceProps are the read only space accounting properties of a dataset.
+var spaceProps = map[libzfs.Prop]bool{libzfs.DatasetPropUsed: true, libzfs.DatasetPropUsedds: true,
+	libzfs.DatasetPropUsedsnap: true, libzfs.DatasetPropReferenced: true, libzfs.DatasetPropWritten: true,
+	libzfs.DatasetPropAvailable: true}
+
 func (d *dZFS) setPropertyWithSource(p libzfs.Prop, value, source string) error {
 	// Those properties don't propagate to children
-	if p == libzfs.DatasetPropMounted || p == libzfs.DatasetPropOrigin {
+	if p == libzfs.DatasetPropMounted || p == libzfs.DatasetPropOrigin || spaceProps[p] {
 		source = "-"
 	}
 
@@ -502,7 +909,7 @@ func (d *dZFS) setPropertyWithSource(p libzfs.Prop, value, source string) error
 		}
 
 		v := value
-		if p == libzfs.DatasetPropMountpoint {
+		if p == libzfs.DatasetPropMountpoint && !isSpecialMountpoint(value) {
 			v = filepath.Join(value, strings.TrimPrefix(strings.Split(c.Dataset.Properties[libzfs.DatasetPropName].Value, "@")[0], d.Dataset.Properties[libzfs.DatasetPropName].Value))
 		}
 
@@ -543,7 +950,11 @@ func (d *dZFS) Destroy(Defer bool) (err error) {
 			return fmt.Errorf("can't remove %s: it has at least one clone: %s", n, name)
 		}
 	}
+	if len(d.libZFSMock.holds[n]) > 0 {
+		return fmt.Errorf("can't remove %s: dataset is busy, it has user holds", n)
+	}
 	delete(d.libZFSMock.datasets, n)
+	d.libZFSMock.record(libzfs.OpDestroy(n))
 	return nil
 }
 
@@ -575,6 +986,11 @@ func (d *dZFS) Promote() (err error) {
 
 	datasetName := d.Dataset.Properties[libzfs.DatasetPropName].Value
 	origin := d.Dataset.Properties[libzfs.DatasetPropOrigin].Value
+	defer func() {
+		if err == nil {
+			d.libZFSMock.record(libzfs.OpPromote(datasetName))
+		}
+	}()
 	if origin == "" {
 		return nil
 	}
@@ -617,7 +1033,7 @@ func (d *dZFS) Promote() (err error) {
 		for k, v := range snap.Dataset.Properties {
 			newDProps[k] = v
 		}
-		newD, err := d.libZFSMock.DatasetCreate(newName, libzfs.DatasetTypeSnapshot, newDProps)
+		newD, err := d.libZFSMock.createDataset(newName, libzfs.DatasetTypeSnapshot, newDProps)
 		if err != nil {
 			return err
 		}
@@ -660,6 +1076,55 @@ func (d *dZFS) Promote() (err error) {
 	return nil
 }
 
+// Rename renames the dataset and all its descendants, updating origin of clones depending on renamed snapshots.
+func (d *dZFS) Rename(newName string, recur, forceUnmount bool) (err error) {
+	d.assertDatasetOpened()
+	name := d.Dataset.Properties[libzfs.DatasetPropName].Value
+
+	d.libZFSMock.mu.Lock()
+	defer d.libZFSMock.mu.Unlock()
+
+	if _, exists := d.libZFSMock.datasets[newName]; exists {
+		return fmt.Errorf("can't rename %s: %s already exists", name, newName)
+	}
+	if strings.Split(name, "/")[0] != strings.Split(newName, "/")[0] {
+		return fmt.Errorf("can't rename %s to %s: not on the same pool", name, newName)
+	}
+
+	var toRename []string
+	for n := range d.libZFSMock.datasets {
+		if n == name || strings.HasPrefix(n, name+"/") || strings.HasPrefix(n, name+"@") {
+			toRename = append(toRename, n)
+		}
+	}
+	for _, n := range toRename {
+		ds := d.libZFSMock.datasets[n]
+		renamed := newName + strings.TrimPrefix(n, name)
+		ds.Dataset.Properties[libzfs.DatasetPropName] = libzfs.Property{Value: renamed}
+		delete(d.libZFSMock.datasets, n)
+		d.libZFSMock.datasets[renamed] = ds
+		if tags, ok := d.libZFSMock.holds[n]; ok {
+			delete(d.libZFSMock.holds, n)
+			d.libZFSMock.holds[renamed] = tags
+		}
+	}
+
+	d.libZFSMock.record(libzfs.OpRename(name, newName))
+
+	// All clones depending on renamed snapshots should point to their new name
+	for _, ds := range d.libZFSMock.datasets {
+		origin := ds.Dataset.Properties[libzfs.DatasetPropOrigin].Value
+		if !strings.HasPrefix(origin, name+"@") && !strings.HasPrefix(origin, name+"/") {
+			continue
+		}
+		ds.Dataset.Properties[libzfs.DatasetPropOrigin] = libzfs.Property{
+			Value:  newName + strings.TrimPrefix(origin, name),
+			Source: "-",
+		}
+	}
+	return nil
+}
+
 // ReloadProperties: set orig to new thing
 // This is to mock libZFS only reloading the orig property at this time
 func (d *dZFS) ReloadProperties() (err error) {
@@ -675,7 +1140,14 @@ func (d *dZFS) ReloadProperties() (err error) {
 // New returns a initialized LibZFS mock object
 func New() LibZFS {
 	return LibZFS{
-		datasets: make(map[string]*dZFS),
-		pools:    make(map[string]libzfs.Pool),
+		datasets:  make(map[string]*dZFS),
+		pools:     make(map[string]libzfs.Pool),
+		bookmarks: make(map[string]string),
+		holds:     make(map[string]map[string]bool),
 	}
 }
+
+// isSpecialMountpoint returns if the mountpoint value isn't a path, and is inherited as is by children.
+func isSpecialMountpoint(v string) bool {
+	return v == "none" || v == "legacy"
+}
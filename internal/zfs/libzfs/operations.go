@@ -0,0 +1,116 @@
+package libzfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Those functions format mutating operations as the zfs command line doing them, so that planned and executed
+// operations can be logged and compared.
+
+// OpCreate is the operation creating the filesystem dataset name.
+func OpCreate(name string, props map[Prop]Property) string {
+	return "zfs create" + formatProps(props, nil) + " " + name
+}
+
+// OpSnapshot is the operation creating the snapshot name.
+func OpSnapshot(name string, props map[Prop]Property, userProps map[string]string) string {
+	return "zfs snapshot" + formatProps(props, userProps) + " " + name
+}
+
+// OpClone is the operation cloning snapshot to target.
+func OpClone(snapshot, target string, props map[Prop]Property) string {
+	return "zfs clone" + formatProps(props, nil) + " " + snapshot + " " + target
+}
+
+// OpDestroy is the operation destroying the dataset, snapshot or bookmark name.
+func OpDestroy(name string) string {
+	return "zfs destroy " + name
+}
+
+// OpPromote is the operation promoting the clone name.
+func OpPromote(name string) string {
+	return "zfs promote " + name
+}
+
+// OpRename is the operation renaming name to newName.
+func OpRename(name, newName string) string {
+	return "zfs rename " + name + " " + newName
+}
+
+// OpSetProperty is the operation setting the native or user property prop to value on name.
+func OpSetProperty(name, prop, value string) string {
+	return fmt.Sprintf("zfs set %s=%s %s", prop, value, name)
+}
+
+// OpPoolSetProperty is the operation setting the native property prop to value on the pool name.
+func OpPoolSetProperty(name, prop, value string) string {
+	return fmt.Sprintf("zpool set %s=%s %s", prop, value, name)
+}
+
+// OpBookmark is the operation creating bookmark from snapshot.
+func OpBookmark(snapshot, bookmark string) string {
+	return "zfs bookmark " + snapshot + " " + bookmark
+}
+
+// OpHold is the operation placing the hold tag on snapshot.
+func OpHold(snapshot, tag string) string {
+	return "zfs hold " + tag + " " + snapshot
+}
+
+// OpRelease is the operation releasing the hold tag on snapshot.
+func OpRelease(snapshot, tag string) string {
+	return "zfs release " + tag + " " + snapshot
+}
+
+// OpReceive is the operation receiving a stream in targetPool.
+func OpReceive(targetPool string) string {
+	return "zfs receive -d " + targetPool
+}
+
+// PropName returns the zfs name of the native properties zsys sets.
+func PropName(p Prop) string {
+	switch p {
+	case DatasetPropMountpoint:
+		return MountPointProp
+	case DatasetPropCanmount:
+		return CanmountProp
+	case DatasetPropOrigin:
+		return "origin"
+	case DatasetPropCreation:
+		return "creation"
+	}
+	return fmt.Sprintf("prop%d", p)
+}
+
+// PoolPropName returns the zpool name of the native pool properties zsys sets.
+func PoolPropName(p Prop) string {
+	switch p {
+	case PoolPropBootfs:
+		return "bootfs"
+	case PoolPropAltroot:
+		return "altroot"
+	}
+	return fmt.Sprintf("poolprop%d", p)
+}
+
+// formatProps returns props and userProps as sorted -o options.
+func formatProps(props map[Prop]Property, userProps map[string]string) string {
+	var opts []string
+	for p, v := range props {
+		// origin and creation are read-only: they are only passed by the mock to create clones and snapshots.
+		if p == DatasetPropOrigin || p == DatasetPropCreation {
+			continue
+		}
+		opts = append(opts, fmt.Sprintf("-o %s=%s", PropName(p), v.Value))
+	}
+	for p, v := range userProps {
+		opts = append(opts, fmt.Sprintf("-o %s=%s", p, v))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	sort.Strings(opts)
+	return " " + strings.Join(opts, " ")
+}
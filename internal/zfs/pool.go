@@ -3,8 +3,10 @@ package zfs
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/log"
 	"github.com/ubuntu/zsys/internal/zfs/libzfs"
 )
 
@@ -22,3 +24,36 @@ func (z Zfs) GetPoolFreeSpace(n string) (freespace int, err error) {
 	}
 	return 100 - freespace, nil
 }
+
+// SetPoolBootFS sets the bootfs property of the pool of the filesystem dataset name to it, so that the pool boots on
+// it by default. The previous value is restored if the transaction is cancelled.
+func (t *Transaction) SetPoolBootFS(name string) error {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to set bootfs of pool to %q"), name)
+
+	d, err := t.Zfs.findDatasetByName(name)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), name, err)
+	}
+	if d.IsSnapshot {
+		return fmt.Errorf(i18n.G("can't boot on %q: it's a snapshot"), name)
+	}
+
+	pool := strings.Split(name, "/")[0]
+	p, err := t.Zfs.libzfs.PoolOpen(pool)
+	if err != nil {
+		return fmt.Errorf(i18n.G("Couldn't open pool %s: %v"), pool, err)
+	}
+	orig := p.Properties[libzfs.PoolPropBootfs].Value
+	p.Close()
+	// Unset bootfs is reported as "-", which is restored as an empty value.
+	if orig == "-" {
+		orig = ""
+	}
+
+	if err := t.Zfs.libzfs.PoolSetProperty(pool, libzfs.PoolPropBootfs, name); err != nil {
+		return fmt.Errorf(i18n.G("couldn't set bootfs of pool %s to %q: %v"), pool, name, err)
+	}
+	t.registerRevert(func() error { return t.Zfs.libzfs.PoolSetProperty(pool, libzfs.PoolPropBootfs, orig) })
+	return nil
+}
@@ -0,0 +1,125 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ubuntu/zsys/internal/i18n"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// ErrReadOnly is returned by any operation changing the system on a read only handler.
+var ErrReadOnly = errors.New(i18n.G("read only mode: the system can't be changed"))
+
+// WithReadOnly only allows libzfs operations reading datasets, bookmarks, holds and pools. Operations creating,
+// changing or destroying any of them fail with ErrReadOnly without reaching zfs, so that the system can be scanned
+// by an unprivileged user. Properties of old installations aren't migrated when scanning either.
+func WithReadOnly() func(*Zfs) {
+	return func(z *Zfs) {
+		z.readOnly = true
+	}
+}
+
+// errReadOnly returns the error of the refused operation op.
+func errReadOnly(op string) error {
+	return fmt.Errorf(i18n.G("couldn't %s: %w"), op, ErrReadOnly)
+}
+
+// readOnlyLibZFS refuses mutating operations of the underlying libzfs and runs the others.
+type readOnlyLibZFS struct {
+	libzfs.Interface
+}
+
+func (l readOnlyLibZFS) DatasetOpenAll() ([]libzfs.DZFSInterface, error) {
+	datasets, err := l.Interface.DatasetOpenAll()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]libzfs.DZFSInterface, 0, len(datasets))
+	for _, d := range datasets {
+		r = append(r, readOnlyDZFS{d})
+	}
+	return r, nil
+}
+
+func (l readOnlyLibZFS) DatasetOpen(name string) (libzfs.DZFSInterface, error) {
+	d, err := l.Interface.DatasetOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyDZFS{d}, nil
+}
+
+func (l readOnlyLibZFS) PoolSetProperty(name string, p libzfs.Prop, value string) error {
+	return errReadOnly(libzfs.OpPoolSetProperty(name, libzfs.PoolPropName(p), value))
+}
+
+func (l readOnlyLibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return nil, errReadOnly(libzfs.OpCreate(path, props))
+}
+
+func (l readOnlyLibZFS) DatasetSnapshot(path string, recur bool, props map[libzfs.Prop]libzfs.Property, userProps map[string]string) (libzfs.DZFSInterface, error) {
+	return nil, errReadOnly(libzfs.OpSnapshot(path, props, userProps))
+}
+
+func (l readOnlyLibZFS) DatasetBookmark(snapshot, bookmark string) error {
+	return errReadOnly(libzfs.OpBookmark(snapshot, bookmark))
+}
+
+func (l readOnlyLibZFS) BookmarkDestroy(bookmark string) error {
+	return errReadOnly(libzfs.OpDestroy(bookmark))
+}
+
+func (l readOnlyLibZFS) DatasetHold(snapshot, tag string) error {
+	return errReadOnly(libzfs.OpHold(snapshot, tag))
+}
+
+func (l readOnlyLibZFS) DatasetRelease(snapshot, tag string) error {
+	return errReadOnly(libzfs.OpRelease(snapshot, tag))
+}
+
+func (l readOnlyLibZFS) DatasetReceive(r io.Reader, targetPool string, check func(snapshot string) error) ([]string, error) {
+	return nil, errReadOnly(libzfs.OpReceive(targetPool))
+}
+
+// readOnlyDZFS refuses mutating operations on an existing dataset.
+type readOnlyDZFS struct {
+	libzfs.DZFSInterface
+}
+
+func (d readOnlyDZFS) name() string {
+	return (*d.Properties())[libzfs.DatasetPropName].Value
+}
+
+func (d readOnlyDZFS) Children() []libzfs.DZFSInterface {
+	var r []libzfs.DZFSInterface
+	for _, c := range d.DZFSInterface.Children() {
+		r = append(r, readOnlyDZFS{c})
+	}
+	return r
+}
+
+func (d readOnlyDZFS) Clone(target string, props map[libzfs.Prop]libzfs.Property) (libzfs.DZFSInterface, error) {
+	return nil, errReadOnly(libzfs.OpClone(d.name(), target, props))
+}
+
+func (d readOnlyDZFS) Destroy(bool) error {
+	return errReadOnly(libzfs.OpDestroy(d.name()))
+}
+
+func (d readOnlyDZFS) Promote() error {
+	return errReadOnly(libzfs.OpPromote(d.name()))
+}
+
+func (d readOnlyDZFS) Rename(newName string, recur, forceUnmount bool) error {
+	return errReadOnly(libzfs.OpRename(d.name(), newName))
+}
+
+func (d readOnlyDZFS) SetProperty(p libzfs.Prop, value string) error {
+	return errReadOnly(libzfs.OpSetProperty(d.name(), libzfs.PropName(p), value))
+}
+
+func (d readOnlyDZFS) SetUserProperty(prop, value string) error {
+	return errReadOnly(libzfs.OpSetProperty(d.name(), prop, value))
+}
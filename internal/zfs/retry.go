@@ -0,0 +1,155 @@
+package zfs
+
+import (
+	"time"
+
+	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+)
+
+// WithRetry retries failed libzfs read operations, like listing and opening datasets or pools, up to attempts times
+// in total. Those are idempotent and can fail transiently, while pools are still settling at boot for instance.
+// backoff is the wait before the first retry, doubled after each failure.
+// Mutating operations are only retried with WithMutationsRetry.
+func WithRetry(attempts int, backoff time.Duration) func(*Zfs) {
+	return func(z *Zfs) {
+		z.retry.attempts = attempts
+		z.retry.backoff = backoff
+	}
+}
+
+// WithMutationsRetry extends WithRetry to libzfs operations creating or destroying datasets, snapshots,
+// bookmarks and holds.
+// Only use it if a failed operation doesn't leave anything behind, which a retry would conflict with.
+func WithMutationsRetry() func(*Zfs) {
+	return func(z *Zfs) {
+		z.retry.mutations = true
+	}
+}
+
+// retryPolicy is how failed libzfs operations are retried.
+type retryPolicy struct {
+	attempts  int
+	backoff   time.Duration
+	mutations bool
+}
+
+// wrap returns l retrying failed operations following the policy, or l itself if there is nothing to retry.
+func (p retryPolicy) wrap(l libzfs.Interface) libzfs.Interface {
+	if p.attempts <= 1 {
+		return l
+	}
+	return retryingLibZFS{Interface: l, policy: p}
+}
+
+// retryingLibZFS retries failed operations of the underlying libzfs. Other operations, like send and receive which
+// consume a stream, are never retried.
+type retryingLibZFS struct {
+	libzfs.Interface
+	policy retryPolicy
+}
+
+// do runs f until it succeeds or policy attempts are exhausted, returning its last error.
+// mutating operations are only retried if the policy allows it.
+func (r retryingLibZFS) do(mutating bool, f func() error) (err error) {
+	attempts := r.policy.attempts
+	if mutating && !r.policy.mutations {
+		attempts = 1
+	}
+	wait := r.policy.backoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r retryingLibZFS) PoolOpen(name string) (pool libzfs.Pool, err error) {
+	err = r.do(false, func() (err error) {
+		pool, err = r.Interface.PoolOpen(name)
+		return err
+	})
+	return pool, err
+}
+
+func (r retryingLibZFS) PoolSetProperty(name string, p libzfs.Prop, value string) error {
+	return r.do(true, func() error {
+		return r.Interface.PoolSetProperty(name, p, value)
+	})
+}
+
+func (r retryingLibZFS) DatasetOpenAll() (datasets []libzfs.DZFSInterface, err error) {
+	err = r.do(false, func() (err error) {
+		datasets, err = r.Interface.DatasetOpenAll()
+		return err
+	})
+	return datasets, err
+}
+
+func (r retryingLibZFS) DatasetOpen(name string) (d libzfs.DZFSInterface, err error) {
+	err = r.do(false, func() (err error) {
+		d, err = r.Interface.DatasetOpen(name)
+		return err
+	})
+	return d, err
+}
+
+func (r retryingLibZFS) BookmarksOpenAll() (bookmarks []libzfs.Bookmark, err error) {
+	err = r.do(false, func() (err error) {
+		bookmarks, err = r.Interface.BookmarksOpenAll()
+		return err
+	})
+	return bookmarks, err
+}
+
+func (r retryingLibZFS) HoldsOpenAll() (holds []libzfs.Hold, err error) {
+	err = r.do(false, func() (err error) {
+		holds, err = r.Interface.HoldsOpenAll()
+		return err
+	})
+	return holds, err
+}
+
+func (r retryingLibZFS) DatasetCreate(path string, dtype libzfs.DatasetType, props map[libzfs.Prop]libzfs.Property) (d libzfs.DZFSInterface, err error) {
+	err = r.do(true, func() (err error) {
+		d, err = r.Interface.DatasetCreate(path, dtype, props)
+		return err
+	})
+	return d, err
+}
+
+func (r retryingLibZFS) DatasetSnapshot(path string, recur bool, props map[libzfs.Prop]libzfs.Property, userProps map[string]string) (rd libzfs.DZFSInterface, err error) {
+	err = r.do(true, func() (err error) {
+		rd, err = r.Interface.DatasetSnapshot(path, recur, props, userProps)
+		return err
+	})
+	return rd, err
+}
+
+func (r retryingLibZFS) DatasetBookmark(snapshot, bookmark string) error {
+	return r.do(true, func() error {
+		return r.Interface.DatasetBookmark(snapshot, bookmark)
+	})
+}
+
+func (r retryingLibZFS) BookmarkDestroy(bookmark string) error {
+	return r.do(true, func() error {
+		return r.Interface.BookmarkDestroy(bookmark)
+	})
+}
+
+func (r retryingLibZFS) DatasetHold(snapshot, tag string) error {
+	return r.do(true, func() error {
+		return r.Interface.DatasetHold(snapshot, tag)
+	})
+}
+
+func (r retryingLibZFS) DatasetRelease(snapshot, tag string) error {
+	return r.do(true, func() error {
+		return r.Interface.DatasetRelease(snapshot, tag)
+	})
+}
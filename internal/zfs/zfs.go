@@ -3,7 +3,9 @@ package zfs
 import (
 	"context"
 	"fmt"
+	"io"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/ubuntu/zsys/internal/config"
@@ -22,12 +24,26 @@ type Dataset struct {
 	// Name of the dataset.
 	Name       string
 	IsSnapshot bool `json:",omitempty"`
+	// IsBookmark is true for bookmarks (<dataset>#<name>). Only LastUsed, the creation time of their snapshot, is set.
+	IsBookmark bool `json:",omitempty"`
+	// IsVolume is true for volumes (zvols). Only VolSize and space properties are set.
+	IsVolume bool `json:",omitempty"`
+	// Holds are the user hold tags of a snapshot, sorted. A held snapshot can't be destroyed until they are released.
+	Holds []string `json:",omitempty"`
 	DatasetProp
 
+	// creation is when the dataset was created, in seconds since epoch, or 0 if unknown.
+	creation int
 	children []*Dataset
 	dZFS     libzfs.DZFSInterface
 }
 
+// CreationTime returns when the dataset was created, in seconds since epoch. It's 0 if unknown, like for datasets
+// restored from a dump, as it isn't serialized.
+func (d Dataset) CreationTime() int {
+	return d.creation
+}
+
 // DatasetProp abstracts some properties for a given dataset
 type DatasetProp struct {
 	// Mountpoint where the dataset will be mounted (without alt-root).
@@ -44,8 +60,37 @@ type DatasetProp struct {
 	LastBootedKernel string `json:",omitempty"`
 	// BootfsDatasets is a user property for user datasets, linking them to relevant system bootfs datasets.
 	BootfsDatasets string `json:",omitempty"`
+	// SnapshotReason is a user property for snapshots, recording why they were taken.
+	SnapshotReason string `json:",omitempty"`
+	// Protected is a user property shielding the dataset state from garbage collection.
+	Protected bool `json:",omitempty"`
+	// SnapshotSource is a user property for snapshots, recording if they were taken manually or automatically.
+	SnapshotSource string `json:",omitempty"`
+	// OperationInProgress is a user property set on the root dataset of a state while zsys changes it, like when
+	// cloning or reverting. It's left set if the operation was interrupted.
+	OperationInProgress string `json:",omitempty"`
 	// Origin points to the dataset snapshot this one was clone from.
 	Origin string `json:",omitempty"`
+	// Referenced is the amount of data, in bytes, accessible by this dataset.
+	Referenced uint64 `json:",omitempty"`
+	// UsedByDataset is the space, in bytes, exclusively used by this dataset and freed if it was destroyed.
+	// For snapshots, this is the space uniquely held by the snapshot.
+	UsedByDataset uint64 `json:",omitempty"`
+	// UsedBySnapshots is the space, in bytes, consumed by the snapshots of this dataset.
+	UsedBySnapshots uint64 `json:",omitempty"`
+	// Written is the referenced space, in bytes, written since the previous snapshot. For snapshots, this is the
+	// space written between the previous snapshot and this one. The origin is the previous snapshot of a clone.
+	Written uint64 `json:",omitempty"`
+	// VolSize is the logical size, in bytes, of a volume.
+	VolSize uint64 `json:",omitempty"`
+	// Available is the space, in bytes, available to this dataset and its children. On the root dataset of a pool,
+	// this is the free space of the pool.
+	Available uint64 `json:",omitempty"`
+	// Encryption is the encryption algorithm of this dataset. It's empty if the dataset isn't encrypted.
+	Encryption string `json:",omitempty"`
+	// KeyStatus is the status of the encryption key of this dataset: available or unavailable.
+	// It's empty if the dataset isn't encrypted.
+	KeyStatus string `json:",omitempty"`
 
 	// Here are the sources (not exposed to the public API) for each property
 	// Used mostly for tests
@@ -54,12 +99,55 @@ type DatasetProp struct {
 
 // datasetSources list sources some properties for a given dataset
 type datasetSources struct {
-	Mountpoint       string `json:",omitempty"`
-	CanMount         string `json:",omitempty"`
-	BootFS           string `json:",omitempty"`
-	LastUsed         string `json:",omitempty"`
-	LastBootedKernel string `json:",omitempty"`
-	BootfsDatasets   string `json:",omitempty"`
+	Mountpoint          string `json:",omitempty"`
+	CanMount            string `json:",omitempty"`
+	BootFS              string `json:",omitempty"`
+	LastUsed            string `json:",omitempty"`
+	LastBootedKernel    string `json:",omitempty"`
+	BootfsDatasets      string `json:",omitempty"`
+	SnapshotReason      string `json:",omitempty"`
+	SnapshotSource      string `json:",omitempty"`
+	Protected           string `json:",omitempty"`
+	OperationInProgress string `json:",omitempty"`
+}
+
+// ErrKeyNotLoaded is returned when an operation requires the encryption key of a dataset which isn't loaded.
+type ErrKeyNotLoaded struct {
+	Dataset string
+}
+
+func (e ErrKeyNotLoaded) Error() string {
+	return fmt.Sprintf(i18n.G("encryption key of %q isn't loaded"), e.Dataset)
+}
+
+// IsEncrypted returns if the dataset is encrypted.
+func (d Dataset) IsEncrypted() bool {
+	return d.Encryption != ""
+}
+
+// IsKeyLoaded returns if the dataset content is accessible: it's either not encrypted or its key is loaded.
+func (d Dataset) IsKeyLoaded() bool {
+	return !d.IsEncrypted() || d.KeyStatus != "unavailable"
+}
+
+// checkKeyLoaded returns an ErrKeyNotLoaded for the first dataset, d or its filesystem children if recursive, which
+// key isn't loaded.
+func checkKeyLoaded(d *Dataset, recursive bool) error {
+	if !d.IsKeyLoaded() {
+		return ErrKeyNotLoaded{Dataset: d.Name}
+	}
+	if !recursive {
+		return nil
+	}
+	for _, c := range d.children {
+		if c.IsSnapshot {
+			continue
+		}
+		if err := checkKeyLoaded(c, true); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Zfs is a system handler talking to zfs linux module.
@@ -68,8 +156,19 @@ type Zfs struct {
 	// root is a virtual dataset to which all top dataset of all pools are attached
 	root        *Dataset
 	allDatasets map[string]*Dataset
+	// bookmarks aren't part of the dataset tree, as they can't have any children or be mounted
+	bookmarks []*Dataset
+	// volumes aren't part of the dataset tree either, as they can't be mounted or have any filesystem children
+	volumes []*Dataset
 
 	libzfs libzfs.Interface
+	retry  retryPolicy
+	// pools are the only pools scanned, if any. All imported pools are scanned otherwise.
+	pools []string
+	// plan lists operations planned in a dry run, if any.
+	plan *Plan
+	// readOnly refuses any operation changing the system.
+	readOnly bool
 }
 
 // WithLibZFS allows overriding default libzfs implementations with a mock
@@ -79,6 +178,17 @@ func WithLibZFS(libzfs libzfs.Interface) func(*Zfs) {
 	}
 }
 
+// WithPools limits scans to datasets and bookmarks of the named pools. Other imported pools, like external or backup
+// ones, are ignored, as if they weren't imported.
+// zfs clones always belong to the same pool than their origin, so clone chains are never cut by the selection. However,
+// datasets related to another pool only by name, like boot datasets on a separate boot pool, are only found if that
+// pool is selected too.
+func WithPools(pools []string) func(*Zfs) {
+	return func(z *Zfs) {
+		z.pools = pools
+	}
+}
+
 // New returns a new zfs system handler.
 func New(ctx context.Context, options ...func(*Zfs)) (*Zfs, error) {
 	log.Debug(ctx, i18n.G("ZFS: new scan"))
@@ -89,6 +199,13 @@ func New(ctx context.Context, options ...func(*Zfs)) (*Zfs, error) {
 	for _, options := range options {
 		options(&z)
 	}
+	z.libzfs = z.retry.wrap(z.libzfs)
+	if z.readOnly {
+		z.libzfs = readOnlyLibZFS{Interface: z.libzfs}
+	}
+	if z.plan != nil {
+		z.libzfs = &dryRunLibZFS{Interface: z.libzfs, ctx: ctx, plan: z.plan}
+	}
 
 	if err := z.Refresh(ctx); err != nil {
 		return nil, err
@@ -105,6 +222,10 @@ func (z *Zfs) Refresh(ctx context.Context) error {
 		root:        &Dataset{Name: "/"},
 		allDatasets: make(map[string]*Dataset),
 		libzfs:      z.libzfs,
+		retry:       z.retry,
+		pools:       z.pools,
+		plan:        z.plan,
+		readOnly:    z.readOnly,
 	}
 
 	// scan all datasets that are currently imported on the system
@@ -115,18 +236,250 @@ func (z *Zfs) Refresh(ctx context.Context) error {
 
 	var children []*Dataset
 	for _, dZFS := range dsZFS {
+		if name := (*dZFS.Properties())[libzfs.DatasetPropName].Value; !newZ.inSelectedPools(name) {
+			log.Debugf(ctx, i18n.G("Skipping %q: its pool isn't selected"), name)
+			continue
+		}
+		// Volumes are collected first, as children are released once the dataset tree is built
+		volumes, err := newVolumes(ctx, dZFS)
+		if err != nil {
+			return fmt.Errorf("couldn't scan all volumes: %w", err)
+		}
+		newZ.volumes = append(newZ.volumes, volumes...)
 		c, err := newDatasetTree(ctx, dZFS, &newZ.allDatasets)
 		if err != nil {
-			return fmt.Errorf("couldn't scan all datasets: %v", err)
+			return fmt.Errorf("couldn't scan all datasets: %w", err)
 		}
 		children = append(children, c)
 	}
 	newZ.root.children = children
 
+	bookmarks, err := newZ.libzfs.BookmarksOpenAll()
+	if err != nil {
+		log.Warningf(ctx, i18n.G("couldn't list bookmarks, ignoring: %v"), err)
+	}
+	for _, b := range bookmarks {
+		if !newZ.inSelectedPools(b.Name) {
+			continue
+		}
+		newZ.bookmarks = append(newZ.bookmarks, newBookmark(ctx, b))
+	}
+
+	holds, err := newZ.libzfs.HoldsOpenAll()
+	if err != nil {
+		log.Warningf(ctx, i18n.G("couldn't list holds, ignoring: %v"), err)
+	}
+	for _, h := range holds {
+		d, ok := newZ.allDatasets[h.Snapshot]
+		if !ok {
+			continue
+		}
+		d.Holds = addHold(d.Holds, h.Tag)
+	}
+
 	*z = newZ
 	return nil
 }
 
+// inSelectedPools returns if the dataset name belongs to one of the pools to scan.
+func (z *Zfs) inSelectedPools(name string) bool {
+	if len(z.pools) == 0 {
+		return true
+	}
+	pool := name
+	if i := strings.IndexAny(name, "/@#"); i >= 0 {
+		pool = name[:i]
+	}
+	for _, p := range z.pools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshDataset rescans only the dataset name and its descendants for the zfs instance.
+// Datasets already known are updated in place, so that any reference to them stays valid.
+// Volumes, bookmarks and holds of name and its descendants are rescanned too.
+// sameDatasets is false if any dataset was added or removed under name.
+func (z *Zfs) RefreshDataset(ctx context.Context, name string) (sameDatasets bool, err error) {
+	log.Debugf(ctx, i18n.G("ZFS: refresh dataset %q"), name)
+
+	parentName, _ := splitSnapshotName(name)
+	if parentName == name {
+		parentName = "."
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			parentName = name[:i]
+		}
+	}
+	parent, err := z.findDatasetByName(parentName)
+	if err != nil {
+		return false, fmt.Errorf(i18n.G("can't find parent of %q: %v"), name, err)
+	}
+
+	dZFS, err := z.libzfs.DatasetOpen(name)
+	if err != nil {
+		return false, fmt.Errorf(i18n.G("can't open %q: %v"), name, err)
+	}
+	// Volumes are collected first, as children are released once the dataset tree is built
+	volumes, err := newVolumes(ctx, dZFS)
+	if err != nil {
+		dZFS.Close()
+		return false, fmt.Errorf(i18n.G("couldn't scan volumes of %q: %v"), name, err)
+	}
+	freshDatasets := make(map[string]*Dataset)
+	fresh, err := newDatasetTree(ctx, dZFS, &freshDatasets)
+	if err != nil {
+		dZFS.Close()
+		return false, fmt.Errorf(i18n.G("couldn't scan %q: %v"), name, err)
+	}
+	if fresh == nil {
+		dZFS.Close()
+		return false, fmt.Errorf(i18n.G("%q isn't a filesystem or snapshot dataset"), name)
+	}
+
+	// Forget previous datasets which disappeared
+	sameDatasets = true
+	old, exists := z.allDatasets[name]
+	if exists {
+		var forget func(d *Dataset)
+		forget = func(d *Dataset) {
+			if _, ok := freshDatasets[d.Name]; !ok {
+				delete(z.allDatasets, d.Name)
+				d.dZFS.Close()
+				sameDatasets = false
+			}
+			for _, c := range d.children {
+				forget(c)
+			}
+		}
+		forget(old)
+	}
+
+	// Replace fresh datasets with known ones, updated with new properties
+	var merge func(fresh *Dataset) *Dataset
+	merge = func(fresh *Dataset) *Dataset {
+		d, ok := z.allDatasets[fresh.Name]
+		if !ok {
+			d = fresh
+			z.allDatasets[d.Name] = d
+			sameDatasets = false
+		} else {
+			d.IsSnapshot = fresh.IsSnapshot
+			d.DatasetProp = fresh.DatasetProp
+			d.dZFS.Close()
+			d.dZFS = fresh.dZFS
+		}
+		var children []*Dataset
+		for _, c := range fresh.children {
+			children = append(children, merge(c))
+		}
+		d.children = children
+		return d
+	}
+	d := merge(fresh)
+
+	if !exists {
+		parent.children = append(parent.children, d)
+	}
+
+	z.refreshVolumes(name, volumes)
+	z.refreshBookmarks(ctx, name)
+	z.refreshHolds(ctx, name)
+
+	return sameDatasets, nil
+}
+
+// refreshVolumes replaces known volumes under name with volumes.
+func (z *Zfs) refreshVolumes(name string, volumes []*Dataset) {
+	var kept []*Dataset
+	for _, v := range z.volumes {
+		if isDatasetOrDescendant(name, v.Name) {
+			v.dZFS.Close()
+			continue
+		}
+		kept = append(kept, v)
+	}
+	z.volumes = append(kept, volumes...)
+}
+
+// refreshBookmarks rescans bookmarks of name and its descendants.
+// Known ones are kept if bookmarks can't be listed.
+func (z *Zfs) refreshBookmarks(ctx context.Context, name string) {
+	bookmarks, err := z.libzfs.BookmarksOpenAll()
+	if err != nil {
+		log.Warningf(ctx, i18n.G("couldn't list bookmarks, ignoring: %v"), err)
+		return
+	}
+
+	var kept []*Dataset
+	for _, b := range z.bookmarks {
+		if !isDatasetOrDescendant(name, b.Name) {
+			kept = append(kept, b)
+		}
+	}
+	for _, b := range bookmarks {
+		if !isDatasetOrDescendant(name, b.Name) || !z.inSelectedPools(b.Name) {
+			continue
+		}
+		kept = append(kept, newBookmark(ctx, b))
+	}
+	z.bookmarks = kept
+}
+
+// refreshHolds rescans holds of snapshots of name and its descendants.
+// Known ones are kept if holds can't be listed.
+func (z *Zfs) refreshHolds(ctx context.Context, name string) {
+	holds, err := z.libzfs.HoldsOpenAll()
+	if err != nil {
+		log.Warningf(ctx, i18n.G("couldn't list holds, ignoring: %v"), err)
+		return
+	}
+
+	for n, d := range z.allDatasets {
+		if isDatasetOrDescendant(name, n) {
+			d.Holds = nil
+		}
+	}
+	for _, h := range holds {
+		if !isDatasetOrDescendant(name, h.Snapshot) {
+			continue
+		}
+		d, ok := z.allDatasets[h.Snapshot]
+		if !ok {
+			continue
+		}
+		d.Holds = addHold(d.Holds, h.Tag)
+	}
+}
+
+// isDatasetOrDescendant returns if n is the dataset name or any of its children, snapshots or bookmarks.
+func isDatasetOrDescendant(name, n string) bool {
+	return n == name || strings.HasPrefix(n, name+"/") || strings.HasPrefix(n, name+"@") || strings.HasPrefix(n, name+libzfs.BookmarkSeparator)
+}
+
+// ReloadProperties rereads the properties of the dataset name only and updates it in place, so that any reference to it
+// sees the new values. Its children and snapshots aren't reloaded, and no dataset is added or removed.
+func (z *Zfs) ReloadProperties(ctx context.Context, name string) error {
+	log.Debugf(ctx, i18n.G("ZFS: reload properties of %q"), name)
+
+	d, err := z.findDatasetByName(name)
+	if err != nil {
+		return err
+	}
+	if d == z.root {
+		return fmt.Errorf(i18n.G("%q isn't a dataset"), name)
+	}
+
+	if err := d.dZFS.ReloadProperties(); err != nil {
+		return fmt.Errorf(i18n.G("couldn't reload properties of %q: %v"), name, err)
+	}
+	if err := d.refreshProperties(ctx); err != nil {
+		return fmt.Errorf(i18n.G("couldn't refresh properties of %q: %v"), name, err)
+	}
+	return nil
+}
+
 // Datasets returns all datasets on the system, where parent will always be before children.
 func (z Zfs) Datasets() []*Dataset {
 	ds := make(chan *Dataset)
@@ -152,6 +505,22 @@ func (z Zfs) Datasets() []*Dataset {
 	return r
 }
 
+// Bookmarks returns all bookmarks on the system, sorted by name.
+func (z Zfs) Bookmarks() []*Dataset {
+	r := make([]*Dataset, len(z.bookmarks))
+	copy(r, z.bookmarks)
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// Volumes returns all volumes (zvols) on the system, sorted by name.
+func (z Zfs) Volumes() []*Dataset {
+	r := make([]*Dataset, len(z.volumes))
+	copy(r, z.volumes)
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
 // GenerateID returns from a given length a random string (known in advanced if libzfs mock is used)
 func (z Zfs) GenerateID(length int) string {
 	return z.libzfs.GenerateID(length)
@@ -368,6 +737,9 @@ func (t *Transaction) Snapshot(snapName, datasetName string, recursive bool) (er
 	if err != nil {
 		return fmt.Errorf(i18n.G("cannot find %q: %v"), datasetName, err)
 	}
+	if err := checkKeyLoaded(d, recursive); err != nil {
+		return err
+	}
 
 	nestedT := t.newNestedTransaction()
 	defer nestedT.Done(&errSnapshot)
@@ -466,30 +838,15 @@ func (t *Transaction) Clone(name, suffix string, ignoreErrorOnExists, recursive
 	defer nestedT.Done(&errClone)
 
 	rootName, snapshotName := splitSnapshotName(name)
-
-	// Reformat the name with the new uuid and clone now the dataset.
-	// pool/ROOT/ubuntu -> pool/ROOT/ubuntu_5678
-	// pool/ROOT/ubuntu_ -> pool/ROOT/ubuntu_5678
-	// pool/ROOT/ubuntu_1234 -> pool/ROOT/ubuntu_5678
-	// pool/ROOT/ubuntu_1234/var -> pool/ROOT/ubuntu_5678/var
-	// pool/ROOT/ubuntu_1234/var_lib -> pool/ROOT/ubuntu_5678/var_lib
-	newRootName := rootName
-	suffixIndex := strings.Index(newRootName, "_")
-	if suffixIndex > -1 {
-		subdatasets := ""
-		subDatasetsIndex := strings.Index(newRootName[suffixIndex:], "/")
-		if subDatasetsIndex > -1 {
-			subdatasets = newRootName[suffixIndex:][subDatasetsIndex:]
-		}
-		newRootName = fmt.Sprintf("%s_%s%s", newRootName[:suffixIndex], suffix, subdatasets)
-	} else {
-		newRootName += "_" + suffix
-	}
+	newRootName := CloneName(name, suffix)
 
 	parent, err := t.Zfs.findDatasetByName(rootName)
 	if err != nil {
 		return fmt.Errorf(i18n.G("cannot find parent for %q: %v"), name, err)
 	}
+	if err := checkKeyLoaded(parent, recursive); err != nil {
+		return err
+	}
 
 	if recursive {
 		if err := parent.checkSnapshotHierarchyIntegrity(snapshotName, true); err != nil {
@@ -499,6 +856,27 @@ func (t *Transaction) Clone(name, suffix string, ignoreErrorOnExists, recursive
 	return nestedT.cloneRecursive(*d, snapshotName, rootName, newRootName, ignoreErrorOnExists, recursive)
 }
 
+// CloneName returns the name of the dataset created by cloning the snapshot name with suffix.
+// Any older _<suffix> is replaced:
+// pool/ROOT/ubuntu@snap -> pool/ROOT/ubuntu_5678
+// pool/ROOT/ubuntu_@snap -> pool/ROOT/ubuntu_5678
+// pool/ROOT/ubuntu_1234@snap -> pool/ROOT/ubuntu_5678
+// pool/ROOT/ubuntu_1234/var@snap -> pool/ROOT/ubuntu_5678/var
+// pool/ROOT/ubuntu_1234/var_lib@snap -> pool/ROOT/ubuntu_5678/var_lib
+func CloneName(name, suffix string) string {
+	newRootName, _ := splitSnapshotName(name)
+	suffixIndex := strings.Index(newRootName, "_")
+	if suffixIndex < 0 {
+		return newRootName + "_" + suffix
+	}
+	subdatasets := ""
+	subDatasetsIndex := strings.Index(newRootName[suffixIndex:], "/")
+	if subDatasetsIndex > -1 {
+		subdatasets = newRootName[suffixIndex:][subDatasetsIndex:]
+	}
+	return fmt.Sprintf("%s_%s%s", newRootName[:suffixIndex], suffix, subdatasets)
+}
+
 // cloneRecursive recursively clones all children and store "revert" operations by cleaning newly
 // created datasets.
 func (t *nestedTransaction) cloneRecursive(d Dataset, snapshotName, rootName, newRootName string, ignoreErrorOnExists, recursive bool) error {
@@ -707,6 +1085,221 @@ func (t *nestedTransaction) promoteRecursive(d *Dataset) error {
 	return nil
 }
 
+// Bookmark creates the bookmark name of snapshot snapshotName, as <dataset>#<name>. Bookmarks are cheap markers of a
+// snapshot which survive its destruction, and can be used as a base for incremental sends.
+func (t *Transaction) Bookmark(snapshotName, name string) error {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to bookmark %q as %q"), snapshotName, name)
+
+	d, err := t.Zfs.findDatasetByName(snapshotName)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), snapshotName, err)
+	}
+	if !d.IsSnapshot {
+		return fmt.Errorf(i18n.G("%q isn't a snapshot"), snapshotName)
+	}
+
+	base, _ := splitSnapshotName(snapshotName)
+	bookmarkName := base + libzfs.BookmarkSeparator + name
+	for _, b := range t.Zfs.bookmarks {
+		if b.Name == bookmarkName {
+			return fmt.Errorf(i18n.G("bookmark %q already exists"), bookmarkName)
+		}
+	}
+
+	if err := t.Zfs.libzfs.DatasetBookmark(snapshotName, bookmarkName); err != nil {
+		return fmt.Errorf(i18n.G("couldn't bookmark %q: ")+config.ErrorFormat, snapshotName, err)
+	}
+	t.Zfs.bookmarks = append(t.Zfs.bookmarks, &Dataset{Name: bookmarkName, IsBookmark: true, DatasetProp: DatasetProp{LastUsed: d.LastUsed}})
+
+	t.registerRevert(func() error {
+		if err := t.Zfs.libzfs.BookmarkDestroy(bookmarkName); err != nil {
+			return fmt.Errorf(i18n.G("couldn't destroy bookmark %q for cleanup: %v"), bookmarkName, err)
+		}
+		for i, b := range t.Zfs.bookmarks {
+			if b.Name == bookmarkName {
+				t.Zfs.bookmarks = append(t.Zfs.bookmarks[:i], t.Zfs.bookmarks[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// Hold places the user hold tag on snapshot snapshotName, which can't be destroyed until the tag is released.
+func (t *Transaction) Hold(snapshotName, tag string) error {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to hold %q with %q"), snapshotName, tag)
+
+	d, err := t.Zfs.findDatasetByName(snapshotName)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), snapshotName, err)
+	}
+	if !d.IsSnapshot {
+		return fmt.Errorf(i18n.G("%q isn't a snapshot: only snapshots can be held"), snapshotName)
+	}
+	if hasHold(d.Holds, tag) {
+		return fmt.Errorf(i18n.G("%q is already held with %q"), snapshotName, tag)
+	}
+
+	if err := t.Zfs.libzfs.DatasetHold(snapshotName, tag); err != nil {
+		return fmt.Errorf(i18n.G("couldn't hold %q: ")+config.ErrorFormat, snapshotName, err)
+	}
+	d.Holds = addHold(d.Holds, tag)
+
+	t.registerRevert(func() error {
+		if err := t.Zfs.libzfs.DatasetRelease(snapshotName, tag); err != nil {
+			return fmt.Errorf(i18n.G("couldn't release %q on %q for cleanup: %v"), tag, snapshotName, err)
+		}
+		d.Holds = removeHold(d.Holds, tag)
+		return nil
+	})
+	return nil
+}
+
+// Release releases the user hold tag on snapshot snapshotName.
+func (t *Transaction) Release(snapshotName, tag string) error {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to release %q on %q"), tag, snapshotName)
+
+	d, err := t.Zfs.findDatasetByName(snapshotName)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), snapshotName, err)
+	}
+	if !hasHold(d.Holds, tag) {
+		return fmt.Errorf(i18n.G("%q isn't held with %q"), snapshotName, tag)
+	}
+
+	if err := t.Zfs.libzfs.DatasetRelease(snapshotName, tag); err != nil {
+		return fmt.Errorf(i18n.G("couldn't release %q on %q: ")+config.ErrorFormat, tag, snapshotName, err)
+	}
+	d.Holds = removeHold(d.Holds, tag)
+
+	t.registerRevert(func() error {
+		if err := t.Zfs.libzfs.DatasetHold(snapshotName, tag); err != nil {
+			return fmt.Errorf(i18n.G("couldn't hold %q with %q again for cleanup: %v"), snapshotName, tag, err)
+		}
+		d.Holds = addHold(d.Holds, tag)
+		return nil
+	})
+	return nil
+}
+
+// Receive receives in targetPool all send streams read from r, replacing the source pool name by targetPool. Received
+// datasets aren't mounted. check, if not nil, is called on the snapshots received from each stream before receiving the
+// next one: the first error it returns stops the reception. It returns the received snapshot names, in reception order.
+// Any dataset created by the reception is destroyed on revert.
+func (t *Transaction) Receive(r io.Reader, targetPool string, check func(snapshot string) error) (received []string, err error) {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to receive send streams in %q"), targetPool)
+
+	if strings.Contains(targetPool, "/") || !t.Zfs.datasetExists(targetPool) {
+		return nil, fmt.Errorf(i18n.G("%q isn't an imported pool"), targetPool)
+	}
+
+	received, errReceive := t.Zfs.libzfs.DatasetReceive(r, targetPool, check)
+
+	// Even on partial reception, track everything which was received so that it's reverted.
+	var newDatasets []*Dataset
+	t.registerRevert(func() error {
+		nt := t.Zfs.NewNoTransaction(t.ctx)
+		for i := len(newDatasets) - 1; i >= 0; i-- {
+			if err := nt.destroyOne(newDatasets[i]); err != nil {
+				return fmt.Errorf(i18n.G("couldn't destroy %q for cleanup: %v"), newDatasets[i].Name, err)
+			}
+		}
+		return nil
+	})
+
+	for _, name := range received {
+		base, _ := splitSnapshotName(name)
+		// Intermediate filesystem datasets are created if needed.
+		var names []string
+		for n := base; n != targetPool && !t.Zfs.datasetExists(n); n = filepath.Dir(n) {
+			names = append([]string{n}, names...)
+		}
+		names = append(names, name)
+
+		for _, n := range names {
+			dZFS, err := t.Zfs.libzfs.DatasetOpen(n)
+			if err != nil {
+				return received, fmt.Errorf(i18n.G("cannot open received dataset %q: %v"), n, err)
+			}
+			// We keep our own children tree, see newDatasetTree().
+			*dZFS.DZFSChildren() = nil
+			d := Dataset{
+				Name:       n,
+				IsSnapshot: dZFS.IsSnapshot(),
+				dZFS:       dZFS,
+			}
+			if err := d.refreshProperties(t.ctx); err != nil {
+				log.Warningf(t.ctx, i18n.G("couldn't fetch property of newly received dataset: %v"), err)
+			}
+
+			parentName := filepath.Dir(n)
+			if d.IsSnapshot {
+				parentName, _ = splitSnapshotName(n)
+			}
+			parent, err := t.Zfs.findDatasetByName(parentName)
+			if err != nil {
+				return received, fmt.Errorf(i18n.G("cannot find parent for %q: %v"), n, err)
+			}
+			parent.children = append(parent.children, &d)
+			t.Zfs.allDatasets[n] = &d
+			newDatasets = append(newDatasets, &d)
+		}
+	}
+
+	if errReceive != nil {
+		return received, fmt.Errorf(i18n.G("couldn't receive in %q: ")+config.ErrorFormat, targetPool, errReceive)
+	}
+	return received, nil
+}
+
+// Rename renames the filesystem dataset name to newName, with all its descendants and their snapshots.
+// Clones depending on renamed snapshots are updated accordingly. newName should be on the same pool and not exist.
+func (t *Transaction) Rename(name, newName string) error {
+	t.checkValid()
+	log.Debugf(t.ctx, i18n.G("ZFS: trying to rename %q to %q"), name, newName)
+
+	d, err := t.Zfs.findDatasetByName(name)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), name, err)
+	}
+	if d.IsSnapshot {
+		return fmt.Errorf(i18n.G("can't rename %q: it's a snapshot"), name)
+	}
+	if strings.Split(name, "/")[0] != strings.Split(newName, "/")[0] {
+		return fmt.Errorf(i18n.G("can't rename %q to %q: they are on different pools"), name, newName)
+	}
+	if t.Zfs.datasetExists(newName) {
+		return fmt.Errorf(i18n.G("can't rename %q to %q: it already exists"), name, newName)
+	}
+	newParent, err := t.Zfs.findDatasetByName(filepath.Dir(newName))
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find parent for %q: %v"), newName, err)
+	}
+
+	if err := d.dZFS.Rename(newName, false, false); err != nil {
+		return fmt.Errorf(i18n.G("couldn't rename %q to %q: ")+config.ErrorFormat, name, newName, err)
+	}
+	t.registerRevert(func() error {
+		// Create our own "temporary" transaction to not attach to main one
+		tempT, _ := t.Zfs.NewTransaction(context.Background())
+		defer tempT.Done()
+		if err := tempT.Rename(newName, name); err != nil {
+			return fmt.Errorf(i18n.G("couldn't rename %q back to %q for cleanup: %v"), newName, name, err)
+		}
+		return nil
+	})
+
+	if err := t.Zfs.renameInCache(t.ctx, d, name, newName, newParent); err != nil {
+		return fmt.Errorf(i18n.G("couldn't refresh our internal layout cache: %v"), err)
+	}
+	return nil
+}
+
 // Destroy recursively all children, including dataset named "name".
 // If the dataset is a filesystem dataset, only remove it and children if there is no snapshots in the descendants.
 // If the dataset is a snapshot, navigate through the hierarchy to delete all dataset with the same snapshot name.
@@ -892,3 +1485,46 @@ func (nt *NoTransaction) Dependencies(d Dataset) []*Dataset {
 	}
 	return uniqDeps
 }
+
+// Send writes to w a send stream of snapshot snapshotName. If from is not empty, the stream is incremental from this
+// older snapshot or bookmark of the same dataset.
+// Sending doesn't modify any dataset, so there is nothing to revert.
+func (nt *NoTransaction) Send(snapshotName, from string, w io.Writer) error {
+	log.Debugf(nt.ctx, i18n.G("ZFS: trying to send %q, incremental from %q"), snapshotName, from)
+
+	d, err := nt.Zfs.findDatasetByName(snapshotName)
+	if err != nil {
+		return fmt.Errorf(i18n.G("cannot find %q: %v"), snapshotName, err)
+	}
+	if !d.IsSnapshot {
+		return fmt.Errorf(i18n.G("%q isn't a snapshot: only snapshots can be sent"), snapshotName)
+	}
+
+	if from != "" {
+		base, _ := splitSnapshotName(snapshotName)
+		var fromDataset *Dataset
+		if strings.HasPrefix(from, base+"@") {
+			fromDataset, _ = nt.Zfs.findDatasetByName(from)
+		} else if strings.HasPrefix(from, base+libzfs.BookmarkSeparator) {
+			for _, b := range nt.Zfs.bookmarks {
+				if b.Name == from {
+					fromDataset = b
+					break
+				}
+			}
+		} else {
+			return fmt.Errorf(i18n.G("%q isn't a snapshot or bookmark of %q"), from, base)
+		}
+		if fromDataset == nil {
+			return fmt.Errorf(i18n.G("cannot find %q to send incrementally from"), from)
+		}
+		if fromDataset.LastUsed > d.LastUsed {
+			return fmt.Errorf(i18n.G("%q is more recent than %q"), from, snapshotName)
+		}
+	}
+
+	if err := nt.Zfs.libzfs.DatasetSend(snapshotName, from, w); err != nil {
+		return fmt.Errorf(i18n.G("couldn't send %q: ")+config.ErrorFormat, snapshotName, err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package zfs_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"github.com/ubuntu/zsys/internal/testutils"
 	"github.com/ubuntu/zsys/internal/zfs"
 	"github.com/ubuntu/zsys/internal/zfs/libzfs"
+	"github.com/ubuntu/zsys/internal/zfs/libzfs/mock"
 )
 
 func init() {
@@ -132,6 +134,96 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewPartialPropertiesLoad(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		def string
+	}{
+		"Space properties":      {def: "one_pool_n_datasets_one_snapshot_with_space_properties.yaml"},
+		"Encryption properties": {def: "one_pool_n_datasets_n_children_encrypted_locked.yaml"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			ta := timeAsserter(time.Now())
+			libzfs := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(libzfs))
+			defer fPools.Create(dir)()
+
+			// Like the real bindings, only some native properties are loaded when opening datasets.
+			libzfs.(*mock.LibZFS).PartialPropertiesLoad(true)
+
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			assertDatasetsToGolden(t, ta, z.Datasets())
+		})
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	adapter := testutils.GetLibZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "one_pool_n_datasets_with_volume.yaml"), testutils.WithLibZFS(adapter))
+	defer fPools.Create(dir)()
+
+	z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+
+	volumes := z.Volumes()
+	if len(volumes) != 1 {
+		t.Fatalf("expected one volume but got %d: %v", len(volumes), volumes)
+	}
+	assert.Equal(t, "rpool/vol1", volumes[0].Name, "Unexpected volume name")
+	assert.True(t, volumes[0].IsVolume, "Volume should be marked as such")
+	assert.Equal(t, uint64(819200), volumes[0].VolSize, "Unexpected volume size")
+
+	// Volumes aren't part of the datasets tree
+	for _, d := range z.Datasets() {
+		assert.False(t, d.IsVolume, "%q shouldn't be a volume", d.Name)
+	}
+}
+
+func TestVolumesPartialPropertiesLoad(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	libzfs := testutils.GetMockZFS(t)
+	fPools := testutils.NewFakePools(t, filepath.Join("testdata", "one_pool_n_datasets_with_volume_with_space_properties.yaml"), testutils.WithLibZFS(libzfs))
+	defer fPools.Create(dir)()
+
+	// Like the real bindings, space properties aren't loaded when opening datasets.
+	libzfs.(*mock.LibZFS).PartialPropertiesLoad(true)
+
+	z, err := zfs.New(context.Background(), zfs.WithLibZFS(libzfs))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+
+	volumes := z.Volumes()
+	if len(volumes) != 1 {
+		t.Fatalf("expected one volume but got %d: %v", len(volumes), volumes)
+	}
+	assert.Equal(t, uint64(819200), volumes[0].VolSize, "Unexpected volume size")
+	assert.Equal(t, uint64(409600), volumes[0].Referenced, "Unexpected volume referenced space")
+	assert.Equal(t, uint64(851968), volumes[0].UsedByDataset, "Unexpected volume used space")
+}
+
 func TestRefresh(t *testing.T) {
 	failOnZFSPermissionDenied(t)
 	dir, cleanup := testutils.TempDir(t)
@@ -155,6 +247,211 @@ func TestRefresh(t *testing.T) {
 	assertDatasetsEquals(t, ta, oldZ.Datasets(), z.Datasets())
 }
 
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		attempts        int
+		retryMutations  bool
+		failingScans    int
+		failingCreates  int
+		createAfterScan bool
+
+		wantScans     int
+		wantErr       bool
+		wantCreateErr bool
+	}{
+		"No retry by default":                 {failingScans: 1, wantScans: 1, wantErr: true},
+		"Retry scan until it succeeds":        {attempts: 3, failingScans: 2, wantScans: 3},
+		"Retry scan up to attempts":           {attempts: 3, failingScans: 3, wantScans: 3, wantErr: true},
+		"Successful scan isn't retried":       {attempts: 3, wantScans: 1},
+		"One attempt is no retry":             {attempts: 1, failingScans: 1, wantScans: 1, wantErr: true},
+		"Mutations aren't retried by default": {attempts: 3, failingCreates: 1, createAfterScan: true, wantScans: 1, wantCreateErr: true},
+		"Mutations are retried on demand":     {attempts: 3, retryMutations: true, failingCreates: 2, createAfterScan: true, wantScans: 1},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			adapter := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "one_pool_one_dataset.yaml"), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			lzfs := adapter.(*mock.LibZFS)
+			lzfs.FailNextScans(tc.failingScans)
+			scansBefore := lzfs.Scans()
+
+			opts := []func(*zfs.Zfs){zfs.WithLibZFS(adapter)}
+			if tc.attempts > 0 {
+				opts = append(opts, zfs.WithRetry(tc.attempts, time.Millisecond))
+			}
+			if tc.retryMutations {
+				opts = append(opts, zfs.WithMutationsRetry())
+			}
+			z, err := zfs.New(context.Background(), opts...)
+			assert.Equal(t, tc.wantScans, lzfs.Scans()-scansBefore, "Unexpected number of scans")
+			if tc.wantErr {
+				assert.Error(t, err, "New should fail")
+				return
+			}
+			assert.NoError(t, err, "New should succeed")
+
+			if !tc.createAfterScan {
+				return
+			}
+			lzfs.FailNextCreates(tc.failingCreates)
+			trans, _ := z.NewTransaction(context.Background())
+			defer trans.Done()
+			err = trans.Create("rpool/new", "/new", "on")
+			if tc.wantCreateErr {
+				assert.Error(t, err, "Create should fail")
+				return
+			}
+			assert.NoError(t, err, "Create should succeed")
+		})
+	}
+}
+
+func TestWithPools(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		pools []string
+
+		wantPools []string
+	}{
+		"All pools by default":     {wantPools: []string{"bpool", "rpool"}},
+		"Only selected pool":       {pools: []string{"rpool"}, wantPools: []string{"rpool"}},
+		"Multiple selected pools":  {pools: []string{"bpool", "rpool"}, wantPools: []string{"bpool", "rpool"}},
+		"Unknown pool is no match": {pools: []string{"doesntexist"}},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			adapter := testutils.GetMockZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "two_pools_n_datasets_n_snapshots.yaml"), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+
+			opts := []func(*zfs.Zfs){zfs.WithLibZFS(adapter)}
+			if tc.pools != nil {
+				opts = append(opts, zfs.WithPools(tc.pools))
+			}
+			z, err := zfs.New(context.Background(), opts...)
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			// Refreshing keeps the selection
+			if err := z.Refresh(context.Background()); err != nil {
+				t.Fatalf("expected no error on refresh but got: %v", err)
+			}
+
+			seen := make(map[string]bool)
+			var got []string
+			for _, d := range z.Datasets() {
+				pool := strings.SplitN(strings.SplitN(d.Name, "@", 2)[0], "/", 2)[0]
+				if seen[pool] {
+					continue
+				}
+				seen[pool] = true
+				got = append(got, pool)
+			}
+			assert.ElementsMatch(t, tc.wantPools, got, "Unexpected scanned pools")
+		})
+	}
+}
+
+func TestRefreshDataset(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		def             string
+		snapshotOn      string
+		holdAndBookmark bool
+		datasetName     string
+
+		wantSameDatasets bool
+		wantErr          bool
+	}{
+		"Refresh dataset with new snapshot":                     {def: "layout1__one_pool_n_datasets.yaml", snapshotOn: "rpool/ROOT/ubuntu_1234", datasetName: "rpool/ROOT/ubuntu_1234"},
+		"Refresh dataset with new held and bookmarked snapshot": {def: "layout1__one_pool_n_datasets.yaml", snapshotOn: "rpool/ROOT/ubuntu_1234", holdAndBookmark: true, datasetName: "rpool/ROOT/ubuntu_1234"},
+		"Refresh parent of dataset with new snapshot":           {def: "layout1__one_pool_n_datasets.yaml", snapshotOn: "rpool/ROOT/ubuntu_1234", datasetName: "rpool"},
+		"Refresh unchanged dataset":                             {def: "layout1__one_pool_n_datasets.yaml", datasetName: "rpool/ROOT/ubuntu_1234", wantSameDatasets: true},
+
+		"Error on dataset doesn't exist":  {def: "layout1__one_pool_n_datasets.yaml", datasetName: "rpool/doesntexist", wantErr: true},
+		"Error on parent doesn't exist":   {def: "layout1__one_pool_n_datasets.yaml", datasetName: "rpool/doesntexist/child", wantErr: true},
+		"Error on snapshot doesn't exist": {def: "layout1__one_pool_n_datasets.yaml", datasetName: "rpool/ROOT/ubuntu_1234@doesntexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			ta := timeAsserter(time.Now())
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			initState := copyState(z)
+
+			// Snapshot from another zfs instance
+			if tc.snapshotOn != "" {
+				otherZ, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+				if err != nil {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				trans, _ := otherZ.NewTransaction(context.Background())
+				if err := trans.Snapshot("snap1", tc.snapshotOn, true); err != nil {
+					t.Fatalf("couldn't snapshot %q: %v", tc.snapshotOn, err)
+				}
+				if tc.holdAndBookmark {
+					if err := trans.Hold(tc.snapshotOn+"@snap1", "keep"); err != nil {
+						t.Fatalf("couldn't hold %q: %v", tc.snapshotOn+"@snap1", err)
+					}
+					if err := trans.Bookmark(tc.snapshotOn+"@snap1", "snap1"); err != nil {
+						t.Fatalf("couldn't bookmark %q: %v", tc.snapshotOn+"@snap1", err)
+					}
+				}
+				trans.Done()
+			}
+
+			sameDatasets, err := z.RefreshDataset(context.Background(), tc.datasetName)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				assertDatasetsEquals(t, ta, initState, z.Datasets())
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			assert.Equal(t, tc.wantSameDatasets, sameDatasets, "sameDatasets should match")
+			zfs.AssertNoZFSChildren(t, z)
+			assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+			newZ, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			assert.Equal(t, newZ.Bookmarks(), z.Bookmarks(), "Bookmarks should be the same after a rescan")
+			assert.Equal(t, newZ.Volumes(), z.Volumes(), "Volumes should be the same after a rescan")
+		})
+	}
+}
+
 func TestCreate(t *testing.T) {
 	failOnZFSPermissionDenied(t)
 
@@ -534,6 +831,447 @@ func TestPromoteCloneTree(t *testing.T) {
 	assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
 }
 
+func TestBookmark(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		def          string
+		snapshotName string
+		name         string
+		cancel       bool
+
+		wantBookmarks []string
+		wantErr       bool
+	}{
+		"Bookmark a snapshot":          {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r1", name: "baseline", wantBookmarks: []string{"rpool/ROOT/ubuntu_1234#baseline"}},
+		"Bookmark a children snapshot": {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234/var@snap_r1", name: "baseline", wantBookmarks: []string{"rpool/ROOT/ubuntu_1234/var#baseline"}},
+		"Revert bookmark on cancel":    {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r1", name: "baseline", cancel: true},
+
+		"Error on filesystem dataset": {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234", name: "baseline", wantErr: true},
+		"Error on missing snapshot":   {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@doesntexist", name: "baseline", wantErr: true},
+		"Error on existing bookmark":  {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", name: "existing", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			// Create an existing bookmark
+			setupTrans, _ := z.NewTransaction(context.Background())
+			if err := setupTrans.Bookmark("rpool/ROOT/ubuntu_1234@snap_r2", "existing"); err != nil {
+				t.Fatalf("couldn't setup testbed when bookmarking: %v", err)
+			}
+			setupTrans.Done()
+
+			trans, cancel := z.NewTransaction(context.Background())
+			defer trans.Done()
+
+			err = trans.Bookmark(tc.snapshotName, tc.name)
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			if tc.cancel {
+				cancel()
+				trans.Done()
+			}
+
+			want := append([]string{"rpool/ROOT/ubuntu_1234#existing"}, tc.wantBookmarks...)
+			sort.Strings(want)
+			var got []string
+			for _, b := range z.Bookmarks() {
+				assert.True(t, b.IsBookmark, "Bookmark should be marked as such")
+				assert.NotZero(t, b.LastUsed, "Bookmark should have the creation time of its snapshot")
+				got = append(got, b.Name)
+			}
+			assert.Equal(t, want, got, "Unexpected bookmarks")
+
+			// Bookmarks aren't part of the datasets tree
+			for _, d := range z.Datasets() {
+				assert.False(t, d.IsBookmark, "%q shouldn't be a bookmark", d.Name)
+			}
+
+			newZ, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			assert.Equal(t, z.Bookmarks(), newZ.Bookmarks(), "Bookmarks should be the same after a rescan")
+		})
+	}
+}
+
+func TestHold(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		def          string
+		snapshotName string
+		tag          string
+		release      bool
+		cancel       bool
+
+		wantHolds []string
+		wantErr   bool
+	}{
+		"Hold a snapshot":                 {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r1", tag: "backup", wantHolds: []string{"backup"}},
+		"Hold a held snapshot":            {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", tag: "backup", wantHolds: []string{"backup", "existing"}},
+		"Revert hold on cancel":           {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r1", tag: "backup", cancel: true},
+		"Release a hold":                  {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", tag: "existing", release: true},
+		"Revert release on cancel":        {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", tag: "existing", release: true, cancel: true, wantHolds: []string{"existing"}},
+		"Error on filesystem dataset":     {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234", tag: "backup", wantErr: true},
+		"Error on missing snapshot":       {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@doesntexist", tag: "backup", wantErr: true},
+		"Error on existing hold":          {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", tag: "existing", wantErr: true, wantHolds: []string{"existing"}},
+		"Error on releasing missing hold": {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r1", tag: "backup", release: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			// Create an existing hold
+			setupTrans, _ := z.NewTransaction(context.Background())
+			if err := setupTrans.Hold("rpool/ROOT/ubuntu_1234@snap_r2", "existing"); err != nil {
+				t.Fatalf("couldn't setup testbed when holding: %v", err)
+			}
+			setupTrans.Done()
+
+			trans, cancel := z.NewTransaction(context.Background())
+			defer trans.Done()
+
+			if tc.release {
+				err = trans.Release(tc.snapshotName, tc.tag)
+			} else {
+				err = trans.Hold(tc.snapshotName, tc.tag)
+			}
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			if tc.cancel {
+				cancel()
+				trans.Done()
+			}
+
+			holds := func(z *zfs.Zfs) []string {
+				for _, d := range z.Datasets() {
+					if d.Name == tc.snapshotName {
+						return d.Holds
+					}
+				}
+				return nil
+			}
+			assert.Equal(t, tc.wantHolds, holds(z), "Unexpected holds")
+
+			newZ, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			assert.Equal(t, holds(z), holds(newZ), "Holds should be the same after a rescan")
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		def          string
+		snapshotName string
+		from         string
+
+		wantErr bool
+	}{
+		"Send a snapshot":                     {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2"},
+		"Send a children snapshot":            {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234/var@snap_r2"},
+		"Send incrementally from a snapshot":  {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", from: "rpool/ROOT/ubuntu_1234@snap_r1"},
+		"Send incrementally from a bookmark":  {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", from: "rpool/ROOT/ubuntu_1234#baseline"},
+		"Error on filesystem dataset":         {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234", wantErr: true},
+		"Error on missing snapshot":           {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@doesntexist", wantErr: true},
+		"Error on missing incremental source": {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", from: "rpool/ROOT/ubuntu_1234@doesntexist", wantErr: true},
+		"Error on source of another dataset":  {def: "layout1_with_bootfs_already_cloned.yaml", snapshotName: "rpool/ROOT/ubuntu_1234@snap_r2", from: "rpool/ROOT/ubuntu_1234/var@snap_r1", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			ta := timeAsserter(time.Now())
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			// Create a bookmark to send incrementally from
+			setupTrans, _ := z.NewTransaction(context.Background())
+			if err := setupTrans.Bookmark("rpool/ROOT/ubuntu_1234@snap_r1", "baseline"); err != nil {
+				t.Fatalf("couldn't setup testbed when bookmarking: %v", err)
+			}
+			setupTrans.Done()
+			initState := copyState(z)
+
+			var out strings.Builder
+			nt := z.NewNoTransaction(context.Background())
+			err = nt.Send(tc.snapshotName, tc.from, &out)
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if !tc.wantErr {
+				assert.NotEmpty(t, out.String(), "A send stream should have been written")
+			} else {
+				assert.Empty(t, out.String(), "No send stream should have been written")
+			}
+
+			// Sending never modifies datasets
+			assertDatasetsEquals(t, ta, initState, z.Datasets())
+		})
+	}
+}
+
+func TestReceive(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		send          []string
+		from          string
+		alreadySent   bool
+		invalidStream bool
+		rejected      string
+		targetPool    string
+		cancel        bool
+
+		wantReceived []string
+		wantErr      bool
+	}{
+		"Receive a snapshot": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1"},
+			wantReceived: []string{"tpool/ROOT/ubuntu_1234@snap_r1"}},
+		"Receive multiple streams": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1", "rpool/ROOT/ubuntu_1234/var@snap_r1"},
+			wantReceived: []string{"tpool/ROOT/ubuntu_1234@snap_r1", "tpool/ROOT/ubuntu_1234/var@snap_r1"}},
+		"Receive incrementally": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r2"}, from: "snap_r1", alreadySent: true,
+			wantReceived: []string{"tpool/ROOT/ubuntu_1234@snap_r2"}},
+		"Revert reception on cancel": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1", "rpool/ROOT/ubuntu_1234/var@snap_r1"}, cancel: true,
+			wantReceived: []string{"tpool/ROOT/ubuntu_1234@snap_r1", "tpool/ROOT/ubuntu_1234/var@snap_r1"}},
+
+		"Error on missing pool":           {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1"}, targetPool: "doesntexist", wantErr: true},
+		"Error on dataset as pool":        {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1"}, targetPool: "tpool/ROOT", wantErr: true},
+		"Error on existing destination":   {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1"}, targetPool: "rpool", wantErr: true},
+		"Error on invalid stream":         {invalidStream: true, wantErr: true},
+		"Error on stream failing partway": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1", "rpool/ROOT/ubuntu_1234/var@snap_r1"}, invalidStream: true, wantErr: true},
+		"Error on rejected snapshot stops reception": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r1", "rpool/ROOT/ubuntu_1234/var@snap_r1"},
+			rejected: "tpool/ROOT/ubuntu_1234@snap_r1", wantErr: true},
+		"Error on missing incremental source": {send: []string{"rpool/ROOT/ubuntu_1234@snap_r2"}, from: "snap_r1", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			// Received snapshots keep the creation time of the sent ones, which predates the test.
+			ta := timeAsserter(time.Unix(0, 0))
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "layout1_with_backup_pool.yaml"), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			if tc.targetPool == "" {
+				tc.targetPool = "tpool"
+			}
+
+			nt := z.NewNoTransaction(context.Background())
+			if tc.alreadySent {
+				var initialStream bytes.Buffer
+				if err := nt.Send("rpool/ROOT/ubuntu_1234@"+tc.from, "", &initialStream); err != nil {
+					t.Fatalf("couldn't setup testbed when sending: %v", err)
+				}
+				setupTrans, _ := z.NewTransaction(context.Background())
+				if _, err := setupTrans.Receive(&initialStream, tc.targetPool, nil); err != nil {
+					t.Fatalf("couldn't setup testbed when receiving: %v", err)
+				}
+				setupTrans.Done()
+			}
+
+			var stream bytes.Buffer
+			for _, n := range tc.send {
+				var from string
+				if tc.from != "" {
+					from = strings.Split(n, "@")[0] + "@" + tc.from
+				}
+				if err := nt.Send(n, from, &stream); err != nil {
+					t.Fatalf("couldn't setup testbed when sending: %v", err)
+				}
+			}
+			if tc.invalidStream {
+				stream.WriteString("invalid stream\n")
+			}
+			initState := copyState(z)
+
+			trans, cancel := z.NewTransaction(context.Background())
+			defer trans.Done()
+
+			var checked []string
+			check := func(snapshot string) error {
+				checked = append(checked, snapshot)
+				if snapshot == tc.rejected {
+					return errors.New("rejected snapshot")
+				}
+				return nil
+			}
+
+			received, err := trans.Receive(&stream, tc.targetPool, check)
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+			if err != nil {
+				if tc.rejected != "" {
+					assert.Equal(t, []string{tc.rejected}, checked, "Reception should stop on the rejected snapshot")
+				}
+				cancel()
+				trans.Done()
+				assertDatasetsEquals(t, ta, initState, z.Datasets())
+				assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+				return
+			}
+			assert.Equal(t, tc.wantReceived, received, "Unexpected received snapshots")
+			assert.Equal(t, tc.wantReceived, checked, "Each received snapshot should be checked")
+
+			if tc.cancel {
+				cancel()
+				trans.Done()
+				assertDatasetsEquals(t, ta, initState, z.Datasets())
+				assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+				return
+			}
+
+			datasets := make(map[string]*zfs.Dataset)
+			for _, d := range z.Datasets() {
+				datasets[d.Name] = d
+			}
+			for _, n := range received {
+				base, _ := zfs.SplitSnapshotName(n)
+				assert.Contains(t, datasets, n, "Received snapshot should be in cache")
+				assert.Contains(t, datasets, base, "Received dataset should be in cache")
+			}
+			assert.Equal(t, "/", datasets["tpool/ROOT/ubuntu_1234"].Mountpoint, "Properties should be received")
+
+			zfs.AssertNoZFSChildren(t, z)
+			assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		def     string
+		dataset string
+		newName string
+		cancel  bool
+
+		wantErr bool
+	}{
+		"Rename dataset with children and snapshots": {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234", newName: "rpool/ROOT/ubuntu_renamed"},
+		"Rename clone":                {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_9012", newName: "rpool/ROOT/ubuntu_renamed"},
+		"Rename under another parent": {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234/opt", newName: "rpool/ROOT/opt"},
+		"Revert rename on cancel":     {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234", newName: "rpool/ROOT/ubuntu_renamed", cancel: true},
+
+		"Error on snapshot":               {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234@snap_r1", newName: "rpool/ROOT/ubuntu_1234@renamed", wantErr: true},
+		"Error on existing target":        {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234", newName: "rpool/ROOT/ubuntu_5678", wantErr: true},
+		"Error on target on another pool": {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234", newName: "bpool/ubuntu_1234", wantErr: true},
+		"Error on missing target parent":  {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/ubuntu_1234", newName: "rpool/NOPARENT/ubuntu_1234", wantErr: true},
+		"Error on missing dataset":        {def: "layout1_with_bootfs_already_cloned.yaml", dataset: "rpool/ROOT/doesntexist", newName: "rpool/ROOT/ubuntu_renamed", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			ta := timeAsserter(time.Now())
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", tc.def), testutils.WithWaitBetweenSnapshots(), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+
+			// Create a clone depending on our dataset snapshots
+			setupTrans, _ := z.NewTransaction(context.Background())
+			if err := setupTrans.Clone("rpool/ROOT/ubuntu_1234@snap_r2", "9012", false, true); err != nil {
+				t.Fatalf("couldn't setup testbed when cloning: %v", err)
+			}
+			setupTrans.Done()
+			initState := copyState(z)
+
+			trans, cancel := z.NewTransaction(context.Background())
+			defer trans.Done()
+
+			err = trans.Rename(tc.dataset, tc.newName)
+
+			if err != nil && !tc.wantErr {
+				t.Fatalf("expected no error but got: %v", err)
+			} else if err == nil && tc.wantErr {
+				t.Fatal("expected an error but got none")
+			}
+
+			if tc.wantErr {
+				assertDatasetsEquals(t, ta, initState, z.Datasets())
+				return
+			}
+
+			if tc.cancel {
+				cancel()
+				trans.Done()
+				assertDatasetsEquals(t, ta, initState, z.Datasets())
+				assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+				return
+			}
+
+			for _, d := range z.Datasets() {
+				assert.False(t, d.Name == tc.dataset || strings.HasPrefix(d.Name, tc.dataset+"/") || strings.HasPrefix(d.Name, tc.dataset+"@"),
+					"%q should have been renamed", d.Name)
+				assert.False(t, strings.HasPrefix(d.Origin, tc.dataset+"@") || strings.HasPrefix(d.Origin, tc.dataset+"/"),
+					"Origin of %q should have been renamed: %q", d.Name, d.Origin)
+			}
+
+			zfs.AssertNoZFSChildren(t, z)
+			assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+		})
+	}
+}
+
 func TestDestroy(t *testing.T) {
 	failOnZFSPermissionDenied(t)
 
@@ -710,6 +1448,56 @@ func TestSetProperty(t *testing.T) {
 	}
 }
 
+func TestSnapshotProvenanceProperties(t *testing.T) {
+	failOnZFSPermissionDenied(t)
+
+	tests := map[string]struct {
+		propertyName  string
+		propertyValue string
+		dataset       string
+
+		wantReason string
+		wantSource string
+	}{
+		"Set snapshot reason":                       {propertyName: libzfs.SnapshotReasonProp, propertyValue: "apt upgrade", dataset: "rpool@snap1", wantReason: "apt upgrade"},
+		"Set snapshot reason containing separators": {propertyName: libzfs.SnapshotReasonProp, propertyValue: "before: kernel update", dataset: "rpool@snap1", wantReason: "before: kernel update"},
+		"Set snapshot source":                       {propertyName: libzfs.SnapshotSourceProp, propertyValue: "manual", dataset: "rpool@snap1", wantSource: "manual"},
+
+		"Provenance isn't loaded on filesystem datasets": {propertyName: libzfs.SnapshotSourceProp, propertyValue: "manual", dataset: "rpool"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			ta := timeAsserter(time.Now())
+			adapter := testutils.GetLibZFS(t)
+			fPools := testutils.NewFakePools(t, filepath.Join("testdata", "one_pool_one_dataset_one_snapshot_without_user_properties.yaml"), testutils.WithLibZFS(adapter))
+			defer fPools.Create(dir)()
+			z, err := zfs.New(context.Background(), zfs.WithLibZFS(adapter))
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			trans, _ := z.NewTransaction(context.Background())
+
+			err = trans.SetProperty(tc.propertyName, tc.propertyValue, tc.dataset, true)
+			trans.Done()
+			assert.NoError(t, err, "SetProperty should succeed")
+
+			for _, d := range z.Datasets() {
+				if d.Name != tc.dataset {
+					continue
+				}
+				assert.Equal(t, tc.wantReason, d.SnapshotReason, "Unexpected snapshot reason")
+				assert.Equal(t, tc.wantSource, d.SnapshotSource, "Unexpected snapshot source")
+			}
+
+			assertIdempotentWithNew(t, ta, z.Datasets(), adapter)
+		})
+	}
+}
+
 func TestDependencies(t *testing.T) {
 	failOnZFSPermissionDenied(t)
 